@@ -0,0 +1,319 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the implementation of the control queues that experimenters can use
+// to send commands, such as cancelling an experiment, to the runners processing their work.
+// The control queue for a work queue uses the name of the work queue with a '_control' suffix.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/leaf-ai/go-service/pkg/network"
+	"github.com/leaf-ai/go-service/pkg/server"
+
+	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	controlPollOpt = flag.Duration("control-poll-interval", time.Duration(30*time.Second), "the interval between checks of control queues for commands applying to running experiments, 0 disables control queues")
+	controlTTLOpt  = flag.Duration("control-command-ttl", time.Duration(15*time.Minute), "the period of time after being issued that control commands are discarded without being applied")
+)
+
+const (
+	// controlCancel stops an experiment giving it the grace period to terminate
+	controlCancel = "cancel"
+	// controlKill stops an experiment without a grace period
+	controlKill = "kill"
+
+	// userCancelReason is the reason recorded for experiments stopped using a control command
+	userCancelReason = "cancelled by user"
+
+	// controlBatch is the maximum number of commands examined on each check of a control queue
+	controlBatch = 10
+)
+
+// controlMsg is the message sent over control queues.  The payload is the JSON encoded
+// controlCommand and is signed in the same manner as experiment requests.
+//
+type controlMsg struct {
+	Payload     string `json:"payload"`
+	Signature   string `json:"signature"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// controlCommand is a command for the experiment identified using either its experiment key, or
+// the accession ID assigned by the runner and included in reports
+//
+type controlCommand struct {
+	Command     string    `json:"command"`
+	Experiment  string    `json:"experiment_key,omitempty"`
+	AccessionID string    `json:"accession_id,omitempty"`
+	Issued      time.Time `json:"issued"`
+}
+
+// controlled is the information needed to stop an experiment that is running
+//
+type controlled struct {
+	proc        *processor
+	cancel      context.CancelFunc
+	termination *runner.Termination
+}
+
+var (
+	// running contains the experiments that can be stopped using control commands, keyed on their accession IDs
+	running     = map[string]*controlled{}
+	runningSync sync.Mutex
+)
+
+// registerControl makes a running experiment available to control commands, the returned function
+// should be called once the experiment has stopped
+//
+func (p *processor) registerControl(cancel context.CancelFunc, termination *runner.Termination) (deregister func()) {
+	runningSync.Lock()
+	defer runningSync.Unlock()
+
+	running[p.AccessionID] = &controlled{
+		proc:        p,
+		cancel:      cancel,
+		termination: termination,
+	}
+
+	return func() {
+		runningSync.Lock()
+		defer runningSync.Unlock()
+		delete(running, p.AccessionID)
+	}
+}
+
+// isUserCancelled returns true if the experiment was stopped as a result of a control command
+//
+func (p *processor) isUserCancelled() (cancelled bool) {
+	runningSync.Lock()
+	defer runningSync.Unlock()
+
+	return p.userCancelled
+}
+
+// hasControlled returns true if experiments from the named subscription are running
+//
+func hasControlled(subscription string) (found bool) {
+	runningSync.Lock()
+	defer runningSync.Unlock()
+
+	for _, ctl := range running {
+		if ctl.proc.Group == subscription {
+			return true
+		}
+	}
+	return false
+}
+
+// applyControl stops any experiments from the subscription that the command applies to
+//
+func applyControl(subscription string, cmd *controlCommand) (found bool) {
+	runningSync.Lock()
+	defer runningSync.Unlock()
+
+	for id, ctl := range running {
+		if ctl.proc.Group != subscription {
+			continue
+		}
+		if len(cmd.AccessionID) != 0 && cmd.AccessionID != id {
+			continue
+		}
+		if len(cmd.Experiment) != 0 && cmd.Experiment != ctl.proc.Request.Experiment.Key {
+			continue
+		}
+
+		found = true
+		if ctl.proc.userCancelled {
+			continue
+		}
+		ctl.proc.userCancelled = true
+
+		logger.Info("experiment "+cmd.Command+" requested", "project_id", ctl.proc.Request.Config.Database.ProjectId,
+			"experiment_id", ctl.proc.Request.Experiment.Key, "accession_id", id)
+
+		if cmd.Command == controlKill {
+			ctl.termination.Kill(userCancelReason)
+		} else {
+			ctl.termination.Set(userCancelReason)
+		}
+		ctl.proc.stoppingReport(userCancelReason)
+		ctl.cancel()
+	}
+	return found
+}
+
+// stoppingReport sends a progress report indicating that the experiment is being stopped
+//
+func (p *processor) stoppingReport(reason string) {
+	if p.ResponseQ == nil {
+		return
+	}
+	select {
+	case p.ResponseQ <- &runnerReports.Report{
+		Time: timestamppb.Now(),
+		ExecutorId: &wrappers.StringValue{
+			Value: network.GetHostName(),
+		},
+		UniqueId: &wrappers.StringValue{
+			Value: p.AccessionID,
+		},
+		ExperimentId: &wrappers.StringValue{
+			Value: p.Request.Experiment.Key,
+		},
+		Payload: &runnerReports.Report_Progress{
+			Progress: &runnerReports.Progress{
+				Time:  timestamppb.Now(),
+				State: runnerReports.TaskState_Stopping,
+				Error: &runnerReports.Progress_Error{
+					Msg: &wrappers.StringValue{
+						Value: reason,
+					},
+				},
+			},
+		},
+	}:
+	default:
+		// Dont respond to back preassure
+	}
+}
+
+// unpackControl extracts a command from a control queue message, checking its signature using
+// the key for the work queue the control queue is associated with
+//
+func unpackControl(shortQName string, msg []byte) (cmd *controlCommand, err kv.Error) {
+	ctlMsg := &controlMsg{}
+	if errGo := json.Unmarshal(msg, ctlMsg); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if len(ctlMsg.Signature) == 0 {
+		if !*acceptClearTextOpt {
+			return nil, kv.NewError("control command has no signature").With("stack", stack.Trace().TrimRuntime())
+		}
+	} else {
+		if err = verifySignature(strings.TrimSuffix(shortQName, runner.ControlSuffix), ctlMsg.Payload, ctlMsg.Signature, ctlMsg.Fingerprint); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd = &controlCommand{}
+	if errGo := json.Unmarshal([]byte(ctlMsg.Payload), cmd); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	switch cmd.Command {
+	case controlCancel, controlKill:
+	default:
+		return nil, kv.NewError("control command unrecognized").With("command", cmd.Command).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(cmd.Experiment) == 0 && len(cmd.AccessionID) == 0 {
+		return nil, kv.NewError("control command has no experiment").With("stack", stack.Trace().TrimRuntime())
+	}
+	return cmd, nil
+}
+
+// handleControl is the message handler for control queues.  Expired commands are discarded,
+// and commands for experiments that are not running on this runner are returned to the
+// queue for other runners.
+//
+func handleControl(subscription string) (handler task.MsgHandler) {
+	return func(ctx context.Context, qt *task.QueueTask) (rsc *server.Resource, consume bool, err kv.Error) {
+		cmd, err := unpackControl(qt.ShortQName, qt.Msg)
+		if err != nil {
+			// Commands that can never be applied are discarded
+			logger.Warn("control command discarded", "subscription", qt.Subscription, "error", err.Error())
+			return nil, true, nil
+		}
+
+		// Expired commands are discarded before being applied so that stale, or replayed,
+		// commands cannot stop experiments that have been started since
+		if time.Since(cmd.Issued) > *controlTTLOpt {
+			logger.Info("control command expired", "subscription", qt.Subscription,
+				"experiment_id", cmd.Experiment, "accession_id", cmd.AccessionID, "issued", cmd.Issued)
+			return nil, true, nil
+		}
+
+		return nil, applyControl(subscription, cmd), nil
+	}
+}
+
+// watchControl periodically checks the control queue for a work queue for commands while
+// experiments from the work queue are running on this runner
+//
+func (qr *Queuer) watchControl(ctx context.Context, request *SubRequest) {
+	if *controlPollOpt == 0 {
+		return
+	}
+
+	check := time.NewTicker(*controlPollOpt)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-check.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if !hasControlled(request.subscription) {
+			continue
+		}
+
+		// Commands returned to the queue can be presented again within the same check, once a
+		// command is seen for a second time every command on the queue has been examined
+		seen := map[[sha256.Size]byte]struct{}{}
+		repeated := false
+		handler := handleControl(request.subscription)
+
+		qt := &task.QueueTask{
+			FQProject:    qr.project,
+			Project:      request.project,
+			Subscription: request.subscription + runner.ControlSuffix,
+			Handler: func(ctx context.Context, qt *task.QueueTask) (rsc *server.Resource, consume bool, err kv.Error) {
+				digest := sha256.Sum256(qt.Msg)
+				if _, repeated = seen[digest]; repeated {
+					return nil, false, nil
+				}
+				seen[digest] = struct{}{}
+				return handler(ctx, qt)
+			},
+		}
+
+		eCtx, eCancel := context.WithTimeout(ctx, qr.timeout)
+		exists, err := qr.tasker.Exists(eCtx, qt.Subscription)
+		eCancel()
+		if err != nil || !exists {
+			continue
+		}
+
+		// Commands for experiments running elsewhere are returned to the queue and can be
+		// presented again so the number examined on each check is limited
+		for i := 0; i < controlBatch; i++ {
+			processed, _, err := qr.tasker.Work(ctx, qt)
+			if err != nil {
+				logger.Debug("control queue unavailable", "project_id", request.project, "subscription", qt.Subscription, "error", err.Error())
+			}
+			if !processed || err != nil || repeated {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/go-service/pkg/server"
+
+	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// This file contains tests for the control queue commands used to stop running experiments
+
+func controlMessage(t *testing.T, cmd *controlCommand) (msg []byte) {
+	payload, errGo := json.Marshal(cmd)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	msg, errGo = json.Marshal(&controlMsg{Payload: string(payload)})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	return msg
+}
+
+func TestControlCancel(t *testing.T) {
+	clearText := *acceptClearTextOpt
+	defer func() {
+		*acceptClearTextOpt = clearText
+	}()
+
+	subscription := "StudioML.topic?test_queue"
+
+	responseQ := make(chan *runnerReports.Report, 10)
+	p := &processor{
+		Group:       subscription,
+		AccessionID: "accession-1",
+		ResponseQ:   responseQ,
+		Request: &request.Request{
+			Experiment: request.Experiment{
+				Key: "experiment-1",
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx, termination := runner.WithTermination(ctx)
+
+	deregister := p.registerControl(cancel, termination)
+	defer deregister()
+
+	if !hasControlled(subscription) {
+		t.Fatal("running experiment was not registered")
+	}
+
+	handler := handleControl(subscription)
+	qt := &task.QueueTask{
+		Subscription: subscription + runner.ControlSuffix,
+		ShortQName:   "test_queue" + runner.ControlSuffix,
+	}
+
+	// Unsigned commands are discarded unless clear text messages are accepted
+	*acceptClearTextOpt = false
+	qt.Msg = controlMessage(t, &controlCommand{Command: controlCancel, Experiment: "experiment-1", Issued: time.Now()})
+	if _, consume, _ := handler(context.Background(), qt); !consume {
+		t.Fatal("unsigned command was not discarded")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("unsigned command cancelled the experiment")
+	}
+	*acceptClearTextOpt = true
+
+	// Commands for other experiments are returned to the queue, unless expired
+	qt.Msg = controlMessage(t, &controlCommand{Command: controlCancel, Experiment: "experiment-2", Issued: time.Now()})
+	if _, consume, _ := handler(context.Background(), qt); consume {
+		t.Fatal("command for another experiment was consumed")
+	}
+	qt.Msg = controlMessage(t, &controlCommand{Command: controlCancel, Experiment: "experiment-2", Issued: time.Now().Add(-2 * *controlTTLOpt)})
+	if _, consume, _ := handler(context.Background(), qt); !consume {
+		t.Fatal("expired command was not discarded")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("command for another experiment cancelled the experiment")
+	}
+
+	// Expired commands for the experiment are discarded without stopping it
+	qt.Msg = controlMessage(t, &controlCommand{Command: controlKill, AccessionID: "accession-1", Issued: time.Now().Add(-2 * *controlTTLOpt)})
+	if _, consume, _ := handler(context.Background(), qt); !consume {
+		t.Fatal("expired command was not discarded")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("expired command cancelled the experiment")
+	}
+
+	// Commands for the experiment stop it with the reason recorded
+	qt.Msg = controlMessage(t, &controlCommand{Command: controlKill, AccessionID: "accession-1", Issued: time.Now()})
+	if _, consume, _ := handler(context.Background(), qt); !consume {
+		t.Fatal("command for the experiment was not consumed")
+	}
+	if ctx.Err() == nil {
+		t.Fatal("experiment was not cancelled")
+	}
+	if reason := runner.TerminationReason(ctx); reason != userCancelReason {
+		t.Fatalf("unexpected termination reason '%s'", reason)
+	}
+	if !termination.Immediate() {
+		t.Fatal("kill command did not request an immediate termination")
+	}
+	if !p.isUserCancelled() {
+		t.Fatal("experiment was not marked as cancelled by the user")
+	}
+
+	select {
+	case report := <-responseQ:
+		if state := report.GetProgress().GetState(); state != runnerReports.TaskState_Stopping {
+			t.Fatalf("unexpected report state %v", state)
+		}
+	default:
+		t.Fatal("stopping report was not sent")
+	}
+}
+
+// headOfLineQueue is a control queue that, like a RabbitMQ queue returning a message to its
+// head, presents the same command every time work is requested
+//
+type headOfLineQueue struct {
+	task.TaskQueue
+	msg   []byte
+	works int
+	stop  context.CancelFunc
+}
+
+func (q *headOfLineQueue) Exists(ctx context.Context, subscription string) (exists bool, err kv.Error) {
+	return true, nil
+}
+
+func (q *headOfLineQueue) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool, resource *server.Resource, err kv.Error) {
+	q.works++
+	qt.Msg = q.msg
+	if _, ack, _ := qt.Handler(ctx, qt); ack {
+		q.msg = nil
+	}
+	// Stopping after the command is seen a second time ends the watch once the current
+	// check is complete
+	if q.works == 2 {
+		q.stop()
+	}
+	return q.msg != nil, nil, nil
+}
+
+func TestControlRepeated(t *testing.T) {
+	clearText, poll := *acceptClearTextOpt, *controlPollOpt
+	defer func() {
+		*acceptClearTextOpt, *controlPollOpt = clearText, poll
+	}()
+	*acceptClearTextOpt = true
+	*controlPollOpt = 10 * time.Millisecond
+
+	subscription := "StudioML.topic?repeated_queue"
+	p := &processor{
+		Group:       subscription,
+		AccessionID: "accession-1",
+		Request: &request.Request{
+			Experiment: request.Experiment{
+				Key: "experiment-1",
+			},
+		},
+	}
+	expCtx, expCancel := context.WithCancel(context.Background())
+	defer expCancel()
+	_, termination := runner.WithTermination(expCtx)
+	deregister := p.registerControl(expCancel, termination)
+	defer deregister()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// A command for an experiment running elsewhere must not be examined repeatedly while
+	// commands behind it wait
+	q := &headOfLineQueue{
+		msg:  controlMessage(t, &controlCommand{Command: controlCancel, Experiment: "experiment-2", Issued: time.Now()}),
+		stop: cancel,
+	}
+	qr := &Queuer{project: "repeated", tasker: q, timeout: time.Minute}
+	qr.watchControl(ctx, &SubRequest{project: "repeated", subscription: subscription})
+
+	if q.works != 2 {
+		t.Fatalf("command examined %d times in a single check", q.works)
+	}
+	if expCtx.Err() != nil {
+		t.Fatal("command for another experiment cancelled the experiment")
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the implementation of a watcher that tracks the disk space consumed by
+// a running experiment and terminates the experiment should it exceed the disk space
+// allocated to it
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/leaf-ai/go-service/pkg/network"
+
+	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	diskQuotaIntervalOpt = flag.Duration("disk-quota-interval", time.Duration(30*time.Second), "the interval between checks of the disk space used by running experiments, 0 disables disk quota enforcement")
+
+	diskUsed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runner_experiment_disk_used_bytes",
+			Help: "Disk space in bytes consumed by the working directory of running experiments.",
+		},
+		[]string{"host", "project", "experiment"},
+	)
+
+	// diskQuotaWarnings are the fractions of the disk allocation at which the experiment
+	// will be sent a warning as it nears its quota
+	diskQuotaWarnings = []float64{0.8, 0.9}
+)
+
+func init() {
+	prometheus.MustRegister(diskUsed)
+}
+
+// dirSize returns the total size of the files within a directory tree, files using any of
+// the skipped inodes are not counted
+//
+func dirSize(dir string, skip map[runner.Inode]struct{}) (size uint64, err kv.Error) {
+	errGo := filepath.Walk(dir, func(path string, info os.FileInfo, errGo error) error {
+		if errGo != nil {
+			// Experiments are free to remove their files while they are being counted
+			if os.IsNotExist(errGo) {
+				return nil
+			}
+			return errGo
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if inode, ok := runner.FileInode(info); ok {
+			if _, isPresent := skip[inode]; isPresent {
+				return nil
+			}
+		}
+		size += uint64(info.Size())
+		return nil
+	})
+	if errGo != nil {
+		return size, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dir", dir)
+	}
+	return size, nil
+}
+
+// diskQuotaStart will start a watcher that periodically measures the disk space consumed
+// by the experiment working directory.  Reports are sent as the usage nears the quota, and
+// should the quota be exceeded the reason is recorded in the termination and the cancel
+// function is used to stop the experiment.
+//
+func (p *processor) diskQuotaStart(ctx context.Context, cancel context.CancelFunc, termination *runner.Termination, quota uint64) {
+	if quota == 0 || *diskQuotaIntervalOpt == 0 {
+		return
+	}
+
+	labels := prometheus.Labels{
+		"host":       host,
+		"project":    p.Request.Config.Database.ProjectId,
+		"experiment": p.Request.Experiment.Key,
+	}
+
+	// Read only artifacts are shared with other experiments and are not counted
+	mounted := artifactCache.MountedInodes(p.ExprDir)
+
+	go func() {
+		defer diskUsed.Delete(labels)
+
+		check := time.NewTicker(*diskQuotaIntervalOpt)
+		defer check.Stop()
+
+		warned := 0
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-check.C:
+			}
+
+			used, err := dirSize(p.ExprDir, mounted)
+			if err != nil {
+				logger.Debug("disk usage unavailable", "project_id", p.Request.Config.Database.ProjectId,
+					"experiment_id", p.Request.Experiment.Key, "error", err.Error())
+				continue
+			}
+			diskUsed.With(labels).Set(float64(used))
+
+			if used > quota {
+				reason := "disk quota exceeded, " + humanize.Bytes(used) + " used of the " + humanize.Bytes(quota) + " allocated"
+				logger.Warn(reason, "project_id", p.Request.Config.Database.ProjectId, "experiment_id", p.Request.Experiment.Key)
+				p.diskQuotaReport(runnerReports.LogSeverity_Error, reason, used, quota)
+
+				termination.Set(reason)
+				cancel()
+				return
+			}
+
+			// Only warn once for each threshold crossed
+			for ; warned < len(diskQuotaWarnings) && float64(used) >= float64(quota)*diskQuotaWarnings[warned]; warned++ {
+				msg := "disk usage nearing quota, " + humanize.Bytes(used) + " used of the " + humanize.Bytes(quota) + " allocated"
+				p.diskQuotaReport(runnerReports.LogSeverity_Warning, msg, used, quota)
+			}
+		}
+	}()
+}
+
+// diskQuotaReport sends a disk usage message to any response queue for the experiment
+//
+func (p *processor) diskQuotaReport(severity runnerReports.LogSeverity, msg string, used uint64, quota uint64) {
+	if p.ResponseQ == nil {
+		return
+	}
+	select {
+	case p.ResponseQ <- &runnerReports.Report{
+		Time: timestamppb.Now(),
+		ExecutorId: &wrappers.StringValue{
+			Value: network.GetHostName(),
+		},
+		UniqueId: &wrappers.StringValue{
+			Value: p.AccessionID,
+		},
+		ExperimentId: &wrappers.StringValue{
+			Value: p.Request.Experiment.Key,
+		},
+		Payload: &runnerReports.Report_Logging{
+			Logging: &runnerReports.LogEntry{
+				Time:     timestamppb.Now(),
+				Severity: severity,
+				Message: &wrappers.StringValue{
+					Value: msg,
+				},
+				Fields: map[string]string{
+					"disk_used":  humanize.Bytes(used),
+					"disk_quota": humanize.Bytes(quota),
+				},
+			},
+		},
+	}:
+	default:
+		// Dont respond to back preassure
+	}
+}
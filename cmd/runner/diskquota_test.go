@@ -0,0 +1,83 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// This file contains tests for the disk quota watcher used to stop experiments
+// that consume more disk space than they were allocated
+
+func TestDiskQuota(t *testing.T) {
+	dir, errGo := os.MkdirTemp("", "disk-quota-test")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	if errGo = os.WriteFile(filepath.Join(dir, "output"), make([]byte, 4096), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	size, err := dirSize(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 4096 {
+		t.Fatalf("unexpected directory size %d", size)
+	}
+
+	// Files shared with the read only artifact cache are not counted
+	info, errGo := os.Stat(filepath.Join(dir, "output"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	inode, _ := runner.FileInode(info)
+	if size, err = dirSize(dir, map[runner.Inode]struct{}{inode: {}}); err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 {
+		t.Fatalf("unexpected directory size %d with the file skipped", size)
+	}
+
+	interval := *diskQuotaIntervalOpt
+	*diskQuotaIntervalOpt = 10 * time.Millisecond
+	defer func() {
+		*diskQuotaIntervalOpt = interval
+	}()
+
+	p := &processor{
+		ExprDir: dir,
+		Request: &request.Request{},
+	}
+
+	// An experiment within its quota is left running
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	ctx, termination := runner.WithTermination(ctx)
+	p.diskQuotaStart(ctx, cancel, termination, 8192)
+	<-ctx.Done()
+	if reason := termination.Reason(); len(reason) != 0 {
+		t.Fatalf("experiment within quota terminated, %s", reason)
+	}
+
+	// An experiment over its quota is cancelled with the reason recorded
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx, termination = runner.WithTermination(ctx)
+	p.diskQuotaStart(ctx, cancel, termination, 1024)
+	<-ctx.Done()
+	if ctx.Err() == context.DeadlineExceeded {
+		t.Fatal("experiment over quota was not terminated")
+	}
+	if reason := runner.TerminationReason(ctx); !strings.HasPrefix(reason, "disk quota exceeded") {
+		t.Fatalf("unexpected termination reason '%s'", reason)
+	}
+}
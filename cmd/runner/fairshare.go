@@ -0,0 +1,342 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the implementation of a node level scheduler that grants the capacity
+// of the node to queues using their weighted fair share of the recent usage of the node.
+//
+// Each queue accrues usage, in GPU and CPU seconds, as its experiments run.  The usage decays
+// over time so that only recent usage counts.  When a queue with work asks to be granted
+// capacity its usage, divided by its weight, is compared with that of other queues that have
+// recently asked for capacity and still have work.  The queue is deferred to its next poll if
+// another queue has a smaller share.  Experiments that are running are charged an estimate of
+// their usage until they complete so that long running experiments are accounted for while
+// they run.
+//
+// Weights are configured using a JSON document, for example
+//
+//    {"default": 1, "projects": {"amqp://rabbitmq:5672/": 2}, "queues": {"rmq_sweeps": 0.25}}
+//
+// where the weight of a queue is its entry in queues, or the entry of its project, the queue
+// server or SQS project the runner is using, or the default.  The document is supplied using
+// the fair-share-weights option and the FAIR_SHARE_WEIGHTS entry of the runners Kubernetes
+// ConfigMap, the ConfigMap taking precedence.
+//
+// Queues are compared with the waiting queues in the same priority level, queues waiting in
+// a higher priority level always being granted capacity first, see priority.go.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"math"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/leaf-ai/go-service/pkg/server"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	fairShareOpt         = flag.Bool("fair-share", true, "grant the capacity of the runner to queues using their weighted fair share of recent GPU and CPU usage")
+	fairShareWeightsOpt  = flag.String("fair-share-weights", "", "a JSON document of fair share weights, for example {\"default\": 1, \"projects\": {...}, \"queues\": {\"rmq_sweeps\": 0.5}}, the FAIR_SHARE_WEIGHTS entry of the Kubernetes ConfigMap takes precedence")
+	fairShareHalfLifeOpt = flag.Duration("fair-share-half-life", time.Hour, "the half life of the usage used for fair share scheduling")
+	fairShareGPUCostOpt  = flag.Float64("fair-share-gpu-cost", 10.0, "the number of CPU seconds that one GPU second is equivalent to when comparing usage for fair share scheduling")
+
+	// scheduler contains the usage of the queues serviced by this runner
+	scheduler = newFairShare()
+)
+
+const (
+	// fairShareConfigKey is the entry within the Kubernetes ConfigMap containing the weights
+	fairShareConfigKey = "FAIR_SHARE_WEIGHTS"
+
+	// fairShareMinEstimate is the smallest run time charged to an experiment when it is started
+	fairShareMinEstimate = time.Duration(time.Minute)
+)
+
+// shareWeights contains the configured weights of projects and queues, queues without a weight
+// use the weight of their project and projects without a weight use the default
+//
+type shareWeights struct {
+	Default  float64            `json:"default"`
+	Projects map[string]float64 `json:"projects"`
+	Queues   map[string]float64 `json:"queues"`
+}
+
+// parseShareWeights decodes a JSON document of weights, an empty document giving every queue
+// the same weight
+//
+func parseShareWeights(doc string) (weights *shareWeights, err kv.Error) {
+	weights = &shareWeights{Default: 1.0}
+	if len(doc) == 0 {
+		return weights, nil
+	}
+	if errGo := json.Unmarshal([]byte(doc), weights); errGo != nil {
+		return nil, kv.Wrap(errGo, "fair share weights invalid").With("stack", stack.Trace().TrimRuntime())
+	}
+	return weights, nil
+}
+
+func (weights *shareWeights) weight(project string, queue string) (weight float64) {
+	if weight, isPresent := weights.Queues[queue]; isPresent {
+		return weight
+	}
+	if weight, isPresent := weights.Projects[project]; isPresent {
+		return weight
+	}
+	return weights.Default
+}
+
+// shareUsage contains the recent usage of a single queue
+//
+type shareUsage struct {
+	project string
+	queue   string
+	lane    int // The priority level assigned to the queue using its name
+
+	gpuSeconds float64 // Decayed usage of completed experiments
+	cpuSeconds float64
+	pendingGPU float64 // Estimated usage of running experiments
+	pendingCPU float64
+	updated    time.Time
+	waiting    time.Time // When the queue last asked for capacity, cleared when it has no work
+	since      time.Time // When the queue started waiting for capacity, cleared when it is granted
+}
+
+// shareGrant is the charge made against a queue for an experiment that was granted capacity
+//
+type shareGrant struct {
+	key        string
+	gpuSeconds float64
+	cpuSeconds float64
+}
+
+// fairShare tracks the usage of queues and grants capacity to them
+//
+type fairShare struct {
+	weights *shareWeights
+	lanes   *regexp.Regexp // Assigns queues to priority levels, nil when priority levels are not used
+	queues  map[string]*shareUsage
+	sync.Mutex
+}
+
+func newFairShare() (fs *fairShare) {
+	return &fairShare{
+		weights: &shareWeights{Default: 1.0},
+		queues:  map[string]*shareUsage{},
+	}
+}
+
+// setWeights replaces the weights, returning true when they were changed
+//
+func (fs *fairShare) setWeights(weights *shareWeights) (changed bool) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	changed = !reflect.DeepEqual(fs.weights, weights)
+	fs.weights = weights
+	return changed
+}
+
+// decay ages the usage of a queue to the current time
+//
+func (usage *shareUsage) decay(now time.Time) {
+	if *fairShareHalfLifeOpt > 0 {
+		factor := math.Pow(0.5, float64(now.Sub(usage.updated))/float64(*fairShareHalfLifeOpt))
+		usage.gpuSeconds *= factor
+		usage.cpuSeconds *= factor
+	}
+	usage.updated = now
+}
+
+// share returns the usage of the queue relative to its weight, queues with no weight only
+// receive capacity that no other queue is waiting for
+//
+func (fs *fairShare) share(usage *shareUsage) (share float64) {
+	weight := fs.weights.weight(usage.project, usage.queue)
+	if weight <= 0 {
+		return math.Inf(1)
+	}
+	gpu := usage.gpuSeconds + usage.pendingGPU
+	cpu := usage.cpuSeconds + usage.pendingCPU
+	return (cpu + gpu*(*fairShareGPUCostOpt)) / weight
+}
+
+// usage returns the decayed usage of a queue, removing queues whose usage has become insignificant
+//
+func (fs *fairShare) usage(project string, queue string, now time.Time) (usage *shareUsage) {
+	for key, other := range fs.queues {
+		other.decay(now)
+		if other.pendingGPU == 0 && other.pendingCPU == 0 && other.gpuSeconds+other.cpuSeconds < 1.0 &&
+			now.Sub(other.waiting) > 2*queuePollInterval {
+			delete(fs.queues, key)
+			fairShareUsage.DeleteLabelValues(host, other.project, other.queue, "gpu")
+			fairShareUsage.DeleteLabelValues(host, other.project, other.queue, "cpu")
+		}
+	}
+
+	key := project + ":" + queue
+	if usage = fs.queues[key]; usage == nil {
+		usage = &shareUsage{
+			project: project,
+			queue:   queue,
+			lane:    laneLevel(fs.lanes, queue),
+			updated: now,
+		}
+		fs.queues[key] = usage
+	}
+	return usage
+}
+
+// grant is used by a queue with work to ask for the capacity needed to run an experiment using the
+// resources for the estimated duration.  A nil grant is returned when a queue in a higher priority
+// level, or in the same level with a smaller share of recent usage, is waiting for capacity,
+// otherwise the queue is charged the estimated usage until the grant is completed.
+//
+func (fs *fairShare) grant(project string, queue string, rsc *server.Resource, estimate time.Duration) (grant *shareGrant) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if !*fairShareOpt && fs.lanes == nil {
+		return &shareGrant{}
+	}
+
+	now := time.Now()
+	usage := fs.usage(project, queue, now)
+	if usage.since.IsZero() || now.Sub(usage.waiting) > 2*queuePollInterval {
+		usage.since = now
+	}
+	usage.waiting = now
+
+	// Queues asking for capacity within the last couple of polls are deemed to be waiting for it
+	level := usage.level(now)
+	share := fs.share(usage)
+	for _, other := range fs.queues {
+		if other == usage || now.Sub(other.waiting) > 2*queuePollInterval {
+			continue
+		}
+		otherLevel := other.level(now)
+		if otherLevel < level || (otherLevel == level && *fairShareOpt && fs.share(other) < share) {
+			fairShareDeferred.WithLabelValues(host, project, queue).Inc()
+			return nil
+		}
+	}
+	usage.since = time.Time{}
+
+	grant = &shareGrant{key: project + ":" + queue}
+	if rsc != nil {
+		grant.gpuSeconds = float64(rsc.Gpus) * estimate.Seconds()
+		grant.cpuSeconds = float64(rsc.Cpus) * estimate.Seconds()
+	} else {
+		grant.cpuSeconds = estimate.Seconds()
+	}
+	usage.pendingGPU += grant.gpuSeconds
+	usage.pendingCPU += grant.cpuSeconds
+
+	return grant
+}
+
+// idle is used by a queue that has no work to stop it being treated as waiting for capacity
+//
+func (fs *fairShare) idle(project string, queue string) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if usage, isPresent := fs.queues[project+":"+queue]; isPresent {
+		usage.waiting = time.Time{}
+		usage.since = time.Time{}
+	}
+}
+
+// complete replaces the estimated charge of a grant with the usage of the experiment that
+// ran, a nil resource indicating that no experiment was run
+//
+func (fs *fairShare) complete(grant *shareGrant, rsc *server.Resource, ran time.Duration) {
+	if grant == nil || len(grant.key) == 0 {
+		return
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+
+	usage, isPresent := fs.queues[grant.key]
+	if !isPresent {
+		return
+	}
+	usage.decay(time.Now())
+
+	usage.pendingGPU = math.Max(0, usage.pendingGPU-grant.gpuSeconds)
+	usage.pendingCPU = math.Max(0, usage.pendingCPU-grant.cpuSeconds)
+	if rsc != nil {
+		usage.gpuSeconds += float64(rsc.Gpus) * ran.Seconds()
+		usage.cpuSeconds += float64(rsc.Cpus) * ran.Seconds()
+	}
+
+	fairShareUsage.WithLabelValues(host, usage.project, usage.queue, "gpu").Set(usage.gpuSeconds)
+	fairShareUsage.WithLabelValues(host, usage.project, usage.queue, "cpu").Set(usage.cpuSeconds)
+}
+
+// fairShare asks the scheduler for the capacity to run an experiment from the named queue
+// using the resources and execution times of previous experiments from the queue
+//
+func (qr *Queuer) fairShare(name string) (grant *shareGrant) {
+	estimate := fairShareMinEstimate
+	if avg, err := qr.subs.getExecAvg(name); err == nil && avg > estimate {
+		estimate = avg
+	}
+	return scheduler.grant(qr.project, name, qr.resources(name), estimate)
+}
+
+// serviceFairShare loads the fair share weights from the command line options and then
+// periodically from the Kubernetes ConfigMap of the runner
+//
+func serviceFairShare(ctx context.Context, interval time.Duration) {
+
+	lanes, err := parseLanes(*priorityLanesOpt)
+	if err != nil {
+		logger.Warn("queue priority expression ignored", "error", err.Error())
+	}
+	scheduler.setLanes(lanes)
+
+	defaults, err := parseShareWeights(*fairShareWeightsOpt)
+	if err != nil {
+		logger.Warn("fair share weights ignored", "error", err.Error())
+		defaults, _ = parseShareWeights("")
+	}
+	scheduler.setWeights(defaults)
+
+	check := time.NewTicker(interval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-check.C:
+			if server.IsAliveK8s() != nil {
+				continue
+			}
+			values, err := server.ConfigK8s(ctx, *cfgNamespace, *cfgConfigMap)
+			if err != nil {
+				logger.Debug("fair share weights unavailable", "error", err.Error())
+				continue
+			}
+
+			weights := defaults
+			if doc, isPresent := values[fairShareConfigKey]; isPresent {
+				if weights, err = parseShareWeights(doc); err != nil {
+					logger.Warn("fair share weights ignored", "configmap", *cfgConfigMap, "error", err.Error())
+					continue
+				}
+			}
+			if scheduler.setWeights(weights) {
+				logger.Info("fair share weights updated", "weights", Spew.Sdump(weights))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/go-service/pkg/server"
+)
+
+// TestFairShare checks that capacity is granted to the waiting queue with the smallest weighted
+// share of recent usage, and that estimated charges are replaced by the usage of experiments
+func TestFairShare(t *testing.T) {
+	saved := *fairShareOpt
+	*fairShareOpt = true
+	defer func() {
+		*fairShareOpt = saved
+	}()
+
+	weights, err := parseShareWeights(`{"default": 1, "queues": {"rmq_heavy": 4}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newFairShare()
+	fs.setWeights(weights)
+
+	rsc := &server.Resource{Cpus: 2, Gpus: 1}
+
+	// A queue that has run experiments is deferred while a queue with less usage is waiting
+	busy := fs.grant("project", "rmq_busy", rsc, time.Hour)
+	if busy == nil {
+		t.Fatal("idle runner deferred a queue")
+	}
+	fs.complete(busy, rsc, time.Hour)
+
+	if fs.grant("project", "rmq_light", rsc, time.Minute) == nil {
+		t.Fatal("queue without usage deferred")
+	}
+	if fs.grant("project", "rmq_busy", rsc, time.Minute) != nil {
+		t.Fatal("queue with more usage was not deferred")
+	}
+
+	// Queues without work are no longer waiting for capacity
+	fs.idle("project", "rmq_light")
+
+	// A queue with the same usage and a larger weight has a smaller share
+	heavy := fs.grant("project", "rmq_heavy", rsc, time.Hour)
+	if heavy == nil {
+		t.Fatal("queue without usage deferred")
+	}
+	fs.complete(heavy, rsc, time.Hour)
+	if fs.grant("project", "rmq_heavy", rsc, time.Minute) == nil {
+		t.Fatal("queue with a larger weight was deferred")
+	}
+
+	// Grants that did not run an experiment are refunded
+	light := fs.grant("project", "rmq_light", rsc, 10*time.Hour)
+	if light == nil {
+		t.Fatal("queue deferred")
+	}
+	fs.complete(light, nil, 0)
+	if usage := fs.queues["project:rmq_light"]; usage.pendingCPU > time.Minute.Seconds()*2+1 || usage.gpuSeconds != 0 {
+		t.Fatal("unused grant was charged", usage.pendingCPU, usage.gpuSeconds)
+	}
+
+	if _, err = parseShareWeights("{"); err == nil {
+		t.Fatal("invalid weights accepted")
+	}
+}
@@ -152,15 +152,9 @@ func HandleMsg(ctx context.Context, qt *task.QueueTask) (rsc *server.Resource, c
 	// Blocking call to run the entire task and only return on termination due to the context
 	// being canceled or its own error / success
 	ack, err := proc.Process(ctx)
-	if err != nil {
-
-		if !ack {
-			return rsc, ack, err.With("status", "retry")
-		}
-
-		return rsc, ack, err.With("status", "dump")
-	}
 
+	// The final progress report carries the reason for any failure, for example
+	// the runner terminating the experiment, back to the experimenter
 	if qt.ResponseQ != nil {
 		errDetails := &runnerReports.Progress_Error{}
 		state := runnerReports.TaskState_Success
@@ -196,5 +190,13 @@ func HandleMsg(ctx context.Context, qt *task.QueueTask) (rsc *server.Resource, c
 			// that we cannot correct
 		}
 	}
+
+	if err != nil {
+		if !ack {
+			return rsc, ack, err.With("status", "retry")
+		}
+
+		return rsc, ack, err.With("status", "dump")
+	}
 	return rsc, ack, nil
 }
@@ -25,6 +25,7 @@ import (
 	"github.com/leaf-ai/studio-go-runner/internal/defense"
 	"github.com/leaf-ai/studio-go-runner/internal/disk_resource"
 	"github.com/leaf-ai/studio-go-runner/internal/resources"
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
 
 	"github.com/davecgh/go-spew/spew"
 
@@ -60,7 +61,7 @@ var (
 
 	amqpURL       = flag.String("amqp-url", "", "The URL for an amqp message exchange through which StudioML is being sents work")
 	amqpMgtURL    = flag.String("amqp-mgt-url", "", "The URL for the management interface for an amqp message exchange which StudioML can use to query the broker for queue stats etc")
-	queueMatch    = flag.String("queue-match", "^(rmq|sqs|local)_.*$", "User supplied regular expression that needs to match a queues name to be considered for work")
+	queueMatch    = flag.String("queue-match", "^(rmq|sqs|local|nats|kafka)_.*$", "User supplied regular expression that needs to match a queues name to be considered for work")
 	queueMismatch = flag.String("queue-mismatch", "", "User supplied regular expression that must not match a queues name to be considered for work")
 
 	tempOpt    = flag.String("working-dir", setTemp(), "the local working directory being used for runner storage, defaults to env var %TMPDIR, or /tmp")
@@ -91,6 +92,11 @@ var (
 	captureOutputMD = flag.Bool("schema-logs", true, "automatically add experiment logs to metadata json")
 
 	localQueueRootOpt = flag.String("queue-root", "", "Local file path to directory serving as a root for local file queues")
+
+	natsURL      = flag.String("nats-url", "", "The URL for a NATS server with JetStream enabled through which StudioML is being sent work")
+	natsCredsOpt = flag.String("nats-creds", "", "An optional NATS credentials file used to authenticate with the nats-url server")
+
+	kafkaURL = flag.String("kafka-url", "", "The URL for a Kafka cluster, kafka://broker[,broker...], through which StudioML is being sent work")
 )
 
 // GetRqstSigs returns the signing public key struct for
@@ -293,17 +299,17 @@ func validateCredsOpts() (errs []kv.Error) {
 		logger.Warn("running in test mode, queue validation not performed")
 	} else {
 		if len(*sqsCertsDirOpt) == 0 && len(*amqpURL) == 0 &&
-		   len(*localQueueRootOpt) == 0 {
-			errs = append(errs, kv.NewError("One of the amqp-url, sqs-certs or queue-root options must be set for the runner to work"))
+		   len(*localQueueRootOpt) == 0 && len(*natsURL) == 0 && len(*kafkaURL) == 0 {
+			errs = append(errs, kv.NewError("One of the amqp-url, nats-url, kafka-url, sqs-certs or queue-root options must be set for the runner to work"))
 		} else {
 			stat, err := os.Stat(*sqsCertsDirOpt)
 			if err != nil || !stat.Mode().IsDir() {
-				if len(*amqpURL) == 0 {
+				if len(*amqpURL) == 0 && len(*natsURL) == 0 && len(*kafkaURL) == 0 {
 					*localQueueRootOpt = os.ExpandEnv(*localQueueRootOpt)
 					stat, err = os.Stat(*localQueueRootOpt)
 			        if err != nil || !stat.Mode().IsDir() {
 						msg := fmt.Sprintf(
-							"sqs-certs must be set to an existing directory, or amqp-url is specified, or queue-root must be set to an existing directory for the runner to perform any useful work (%s)",
+							"sqs-certs must be set to an existing directory, or amqp-url, nats-url, or kafka-url is specified, or queue-root must be set to an existing directory for the runner to perform any useful work (%s)",
 							*sqsCertsDirOpt)
 						errs = append(errs, kv.NewError(msg))
 					}
@@ -361,7 +367,19 @@ func validateServerOpts() (errs []kv.Error) {
 
 	errs = append(errs, validateCredsOpts()...)
 
-	if len(*amqpURL) != 0 {
+	errs = append(errs, runner.ValidateLocalQueueOpts()...)
+
+	errs = append(errs, runner.ValidateNATSOpts()...)
+
+	if _, err := parseShareWeights(*fairShareWeightsOpt); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := parseLanes(*priorityLanesOpt); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(*amqpURL) != 0 || len(*natsURL) != 0 || len(*kafkaURL) != 0 {
 		// Just looking for syntax errors that we should stop on if seen.  We wont
 		// save the results of the compilation itself
 		if _, errGo := regexp.Compile(*queueMatch); errGo != nil {
@@ -503,6 +521,10 @@ func startServices(ctx context.Context, cancel context.CancelFunc, statusC chan
 	// runner including idle times, and the maximum number of tasks to complete
 	go serviceLimiter(ctx, cancel)
 
+	// Load the weights used to share the capacity of the runner between queues, and watch
+	// the Kubernetes ConfigMap for changes to them
+	go serviceFairShare(ctx, time.Duration(2*time.Minute))
+
 	// Create a component that listens to AWS credentials directories
 	// and starts and stops run methods as needed based on the credentials
 	// it has for the AWS infrastructure
@@ -518,4 +540,13 @@ func startServices(ctx context.Context, cancel context.CancelFunc, statusC chan
 	// queues
 	//
 	go serviceFileQueue(ctx, 3*time.Second)
+
+	// Create a component that listens to NATS JetStream streams for work
+	// subjects
+	//
+	go serviceNATS(ctx, serviceIntervals)
+
+	// Create a component that listens to Kafka topics for work
+	//
+	go serviceKafka(ctx, serviceIntervals)
 }
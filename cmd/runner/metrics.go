@@ -53,6 +53,27 @@ var (
 		},
 		[]string{"host", "queue_type", "queue_name", "project", "experiment"},
 	)
+	fairShareUsage = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runner_fair_share_usage_seconds",
+			Help: "Recent decayed usage of the runner by a queue in GPU, or CPU, seconds.",
+		},
+		[]string{"host", "project", "queue_name", "resource"},
+	)
+	fairShareDeferred = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_fair_share_deferred",
+			Help: "Number of times a queue with work was deferred in favour of a queue with a smaller fair share of usage.",
+		},
+		[]string{"host", "project", "queue_name"},
+	)
+	queuePeekSkipped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_queue_peek_skipped",
+			Help: "Number of times a queue was skipped because the request at its head did not fit the runners free resources.",
+		},
+		[]string{"host", "project", "queue_name"},
+	)
 )
 
 func init() {
@@ -62,6 +83,9 @@ func init() {
 	prometheus.MustRegister(queueIgnored)
 	prometheus.MustRegister(queueRunning)
 	prometheus.MustRegister(queueRan)
+	prometheus.MustRegister(fairShareUsage)
+	prometheus.MustRegister(fairShareDeferred)
+	prometheus.MustRegister(queuePeekSkipped)
 }
 
 func GetCounterValue(metric *prometheus.CounterVec, labels prometheus.Labels) (val float64, err kv.Error) {
@@ -0,0 +1,161 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the implementation of a NATS JetStream service for
+// retrieving and handling StudioML workloads from subjects within
+// JetStream streams
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/leaf-ai/go-service/pkg/server"
+	"github.com/leaf-ai/go-service/pkg/types"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serviceNATS runs for the lifetime of the daemon and uses the ctx to perform orderly shutdowns.
+// This function will initiate checks of the NATS server for streams with subjects
+// that require processing using the projects server Cycle function.
+//
+func serviceNATS(ctx context.Context, checkInterval time.Duration) {
+
+	logger.Debug("starting serviceNATS", stack.Trace().TrimRuntime())
+	defer logger.Debug("stopping serviceNATS", stack.Trace().TrimRuntime())
+
+	if len(*natsURL) == 0 {
+		return
+	}
+
+	matcher, mismatcher := initFileQueueParams()
+
+	w, err := getWrapper()
+	if err != nil {
+		logger.Debug("encryption wrapper skipped", "error", err.Error())
+	}
+
+	natsProject, err := runner.NewNATS(*natsURL, "", *natsCredsOpt, w, logger)
+	if err != nil {
+		logger.Warn("NATS disabled", "error", err.Error())
+		return
+	}
+
+	// Tracks all known queues and their cancel functions so they can have any
+	// running jobs terminated should they disappear
+	live := &Projects{
+		queueType: "NATS",
+		projects:  map[string]context.CancelFunc{},
+	}
+
+	lifecycleC := make(chan server.K8sStateUpdate, 1)
+	id, err := server.K8sStateUpdates().Add(lifecycleC)
+	if err != nil {
+		logger.Warn(err.With("stack", stack.Trace().TrimRuntime()).Error())
+	}
+
+	defer func() {
+		// Ignore failures to cleanup resources we will never reuse
+		func() {
+			defer func() {
+				_ = recover()
+			}()
+			server.K8sStateUpdates().Delete(id)
+		}()
+		close(lifecycleC)
+	}()
+
+	// first time through make sure the server is checked immediately
+	qCheck := time.Duration(time.Second)
+	currentCheck := qCheck
+	qTicker := time.NewTicker(currentCheck)
+	defer qTicker.Stop()
+
+	// Watch for when the server should not be getting new work
+	state := server.K8sStateUpdate{
+		State: types.K8sRunning,
+	}
+
+	for {
+		// Dont wait an excessive amount of time after server checks fail before
+		// retrying
+		if qCheck > time.Duration(3*time.Minute) {
+			qCheck = time.Duration(3 * time.Minute)
+		}
+
+		// If the interval between queue checks changes reset the ticker
+		if qCheck != currentCheck {
+			currentCheck = qCheck
+			qTicker.Stop()
+			qTicker = time.NewTicker(currentCheck)
+		}
+
+		select {
+		case <-ctx.Done():
+			live.Lock()
+			defer live.Unlock()
+
+			// When shutting down stop all projects
+			for _, quiter := range live.projects {
+				if quiter != nil {
+					quiter()
+				}
+			}
+			logger.Debug("quitC done for serviceNATS", "stack", stack.Trace().TrimRuntime())
+			return
+		case state = <-lifecycleC:
+		case <-qTicker.C:
+
+			ran, _ := GetCounterAccum(queueRan)
+			running, _ := GetGaugeAccum(queueRunning)
+
+			msg := fmt.Sprintf("checking serviceNATS, with %.0f running tasks and %.0f completed tasks", math.Round(running), math.Round(ran))
+			logger.Debug(msg, "stack", stack.Trace().TrimRuntime())
+
+			qCheck = checkInterval
+
+			// If the pulling of work is currently suspending bail out of checking the queues
+			if state.State != types.K8sRunning && state.State != types.K8sUnknown {
+				queueIgnored.With(prometheus.Labels{"host": host, "queue_type": live.queueType, "queue_name": "*"}).Inc()
+				logger.Trace("k8s has NATS disabled", "stack", stack.Trace().TrimRuntime())
+				continue
+			}
+
+			// Found returns a map that contains the NATS server as a project when
+			// it has subjects matching the queue expressions
+			eCtx, eCancel := context.WithTimeout(ctx, time.Minute)
+			found, err := natsProject.GetKnown(eCtx, matcher, mismatcher)
+			eCancel()
+
+			if err != nil {
+				qCheck = qCheck * 2
+				err = err.With("backoff", qCheck.String())
+				logger.Warn("unable to refresh NATS subjects", err.Error())
+				continue
+			}
+			if len(found) == 0 {
+				items := []string{"no queues", "identity", natsProject.Identity, "matcher", matcher.String()}
+
+				if mismatcher != nil {
+					items = append(items, "mismatcher", mismatcher.String())
+				}
+				items = append(items, "stack", stack.Trace().TrimRuntime().String())
+				logger.Warn(items[0], items[1:])
+
+				qCheck = qCheck * 2
+				continue
+			}
+
+			if err := live.Cycle(ctx, found); err != nil {
+				logger.Warn(err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the implementation of peeking at the request at the head of a queue
+// to learn its resource requirements before it is claimed.  Without peeking the resources
+// needed by a queue are only known once a request from it has been run, and requests that
+// do not fit the free resources of the runner are claimed and then returned to the queue.
+
+import (
+	"context"
+	"flag"
+
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+)
+
+var (
+	queuePeekOpt = flag.Bool("queue-peek", true, "check the resources requested by the message at the head of a queue fit the free resources of the runner before claiming it")
+)
+
+// peek retrieves the resources requested by the message at the head of the named queue and
+// records them against the queue, returning false when the request does not fit the free
+// resources of the runner.  Queues that cannot be peeked at are deemed to fit, and are claimed
+// from without their resources being checked.
+//
+func (qr *Queuer) peek(ctx context.Context, name string) (fits bool) {
+	if !*queuePeekOpt {
+		return true
+	}
+
+	rsc, err := qr.tasker.Peek(ctx, name)
+	if err == task.ErrPeekUnsupported {
+		return true
+	}
+	if err != nil {
+		logger.Debug("peek failed", "project_id", qr.project, "subscription_id", name, "error", err.Error())
+		return true
+	}
+	if rsc == nil {
+		return true
+	}
+
+	if err = qr.subs.setResources(name, rsc); err != nil {
+		logger.Trace("resource update failed", "subscription", name, "error", err.Error())
+		return true
+	}
+
+	if fits, err = qr.check(ctx, name); err != nil {
+		logger.Debug("peeked resource check failed", "project_id", qr.project, "subscription_id", name, "error", err.Error())
+		return true
+	}
+	if !fits {
+		queuePeekSkipped.WithLabelValues(host, qr.project, name).Inc()
+	}
+	return fits
+}
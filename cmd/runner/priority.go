@@ -0,0 +1,100 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+// This file contains the implementation of priority lanes.  Queues are assigned a priority
+// level using their names, the level being the first sub match of a regular expression, for
+// example the expression _p([0-9]+)$ places the queue rmq_project_p0 into level 0.  Level 0
+// is the highest priority and queues whose names do not match are placed into the default level.
+//
+// Queues with work waiting for capacity in a higher priority level are granted capacity
+// before queues in lower levels, queues within the same level then being granted capacity
+// using their fair share.  To prevent queues in lower levels from being starved the level of a
+// queue is raised by one for every aging interval it has been waiting for capacity.
+
+import (
+	"flag"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	priorityLanesOpt   = flag.String("queue-priority", "_p([0-9]+)$", "a regular expression whose first sub match against a queue name is the priority level of the queue, 0 being the highest, an empty expression disables priority levels")
+	priorityDefaultOpt = flag.Uint("queue-priority-default", 1, "the priority level of queues whose names do not match the queue-priority expression")
+	priorityAgingOpt   = flag.Duration("queue-priority-aging", 30*time.Minute, "the time a queue waits for capacity before its priority level is raised by one, 0 disables aging")
+)
+
+// parseLanes compiles the regular expression used to assign queues to priority levels, an
+// empty expression giving every queue the default level
+//
+func parseLanes(expr string) (lanes *regexp.Regexp, err kv.Error) {
+	if len(expr) == 0 {
+		return nil, nil
+	}
+	lanes, errGo := regexp.Compile(expr)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo, "queue priority expression invalid").With("expr", expr).With("stack", stack.Trace().TrimRuntime())
+	}
+	if lanes.NumSubexp() < 1 {
+		return nil, kv.NewError("queue priority expression has no sub match for the level").With("expr", expr).With("stack", stack.Trace().TrimRuntime())
+	}
+	return lanes, nil
+}
+
+// laneLevel returns the priority level of the named queue
+//
+func laneLevel(lanes *regexp.Regexp, queue string) (level int) {
+	if lanes != nil {
+		if matches := lanes.FindStringSubmatch(queue); len(matches) > 1 {
+			if level, errGo := strconv.Atoi(matches[1]); errGo == nil && level >= 0 {
+				return level
+			}
+		}
+	}
+	return int(*priorityDefaultOpt)
+}
+
+// level returns the priority level of a queue raised by the time it has been waiting for capacity
+//
+func (usage *shareUsage) level(now time.Time) (level int) {
+	level = usage.lane
+	if *priorityAgingOpt > 0 && !usage.since.IsZero() {
+		level -= int(now.Sub(usage.since) / *priorityAgingOpt)
+	}
+	if level < 0 {
+		return 0
+	}
+	return level
+}
+
+// setLanes replaces the expression used to assign queues to priority levels
+//
+func (fs *fairShare) setLanes(lanes *regexp.Regexp) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fs.lanes = lanes
+	for _, usage := range fs.queues {
+		usage.lane = laneLevel(lanes, usage.queue)
+	}
+}
+
+// byPriority orders subscriptions so that queues in higher priority levels are polled first
+//
+func byPriority(subs []Subscription) {
+	scheduler.Lock()
+	lanes := scheduler.lanes
+	scheduler.Unlock()
+
+	if lanes == nil {
+		return
+	}
+	sort.SliceStable(subs, func(i, j int) bool {
+		return laneLevel(lanes, subs[i].name) < laneLevel(lanes, subs[j].name)
+	})
+}
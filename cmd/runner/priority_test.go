@@ -0,0 +1,72 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/go-service/pkg/server"
+)
+
+// TestPriorityLanes checks that queues waiting in higher priority levels are granted capacity
+// first regardless of their usage, and that queues waiting in lower levels are aged upward
+func TestPriorityLanes(t *testing.T) {
+	saved := *fairShareOpt
+	*fairShareOpt = true
+	defer func() {
+		*fairShareOpt = saved
+	}()
+
+	lanes, err := parseLanes(`_p([0-9]+)$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := newFairShare()
+	fs.setLanes(lanes)
+
+	if level := laneLevel(lanes, "rmq_project_p0"); level != 0 {
+		t.Fatal("unexpected level", level)
+	}
+	if level := laneLevel(lanes, "rmq_project"); level != int(*priorityDefaultOpt) {
+		t.Fatal("unexpected default level", level)
+	}
+
+	rsc := &server.Resource{Cpus: 2, Gpus: 1}
+
+	// The urgent queue has the larger usage but is in a higher level
+	urgent := fs.grant("project", "rmq_eval_p0", rsc, time.Hour)
+	if urgent == nil {
+		t.Fatal("idle runner deferred a queue")
+	}
+	fs.complete(urgent, rsc, time.Hour)
+
+	if fs.grant("project", "rmq_sweep_p2", rsc, time.Minute) != nil {
+		t.Fatal("queue in a lower level was not deferred")
+	}
+	if fs.grant("project", "rmq_eval_p0", rsc, time.Minute) == nil {
+		t.Fatal("queue in a higher level was deferred")
+	}
+
+	// Once the lower level queue has waited for two aging intervals it shares the top level and
+	// its smaller usage gives it the capacity
+	sweep := fs.queues["project:rmq_sweep_p2"]
+	sweep.since = time.Now().Add(-2 * *priorityAgingOpt)
+	if level := sweep.level(time.Now()); level != 0 {
+		t.Fatal("waiting queue was not aged", level)
+	}
+	if fs.grant("project", "rmq_sweep_p2", rsc, time.Minute) == nil {
+		t.Fatal("aged queue was deferred")
+	}
+
+	// Queues without work do not block lower levels
+	fs.idle("project", "rmq_eval_p0")
+	fs.idle("project", "rmq_sweep_p2")
+	if fs.grant("project", "rmq_other", rsc, time.Minute) == nil {
+		t.Fatal("queue deferred by idle queues")
+	}
+
+	if _, err = parseLanes(`_p[0-9]+$`); err == nil {
+		t.Fatal("expression without a level accepted")
+	}
+}
@@ -9,6 +9,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -36,6 +37,7 @@ import (
 	"github.com/leaf-ai/go-service/pkg/network"
 
 	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/integrity"
 	"github.com/leaf-ai/studio-go-runner/internal/request"
 	pkgResources "github.com/leaf-ai/studio-go-runner/internal/resources"
 	"github.com/leaf-ai/studio-go-runner/internal/runner"
@@ -61,6 +63,9 @@ type processor struct {
 	ready       chan bool                  // Used by the processor to indicate it has released resources or state has changed
 	AccessionID string                     // A unique identifier for this task
 	ResponseQ   chan *runnerReports.Report // A response queue the runner can employ to send progress updates on
+	ResponseKey *rsa.PublicKey             // The public key of the response queue, used to seal the secrets of encrypted artifacts
+
+	userCancelled bool // Set when the experiment was stopped using a control command, guarded by runningSync
 }
 
 type tempSafe struct {
@@ -95,6 +100,8 @@ const (
 	ExecPythonVEnv
 	// ExecSingularity inidcates we are using the Singularity container packaging and runtime
 	ExecSingularity
+	// ExecContainer indicates we are using an OCI container image and runtime
+	ExecContainer
 
 	fmtAddLog = `[{"op": "add", "path": "/studioml/log/-", "value": {"ts": "%s", "msg":"%s"}}]`
 )
@@ -188,6 +195,13 @@ func newProcessor(ctx context.Context, qt *task.QueueTask, accessionID string) (
 		ResponseQ:   qt.ResponseQ,
 	}
 
+	// Encrypted artifacts have their secrets sealed using the key of the response queue
+	if store := GetRspnsEncrypt(); store != nil {
+		if key, err := store.Select(qt.ShortQName + responseSuffix); err == nil {
+			proc.ResponseKey = key
+		}
+	}
+
 	// Extract processor information from the message received on the wire, includes decryption etc
 	if hardError, err = proc.unpackMsg(qt); hardError == true || err != nil {
 		return proc, hardError, err
@@ -220,6 +234,11 @@ func newProcessor(ctx context.Context, qt *task.QueueTask, accessionID string) (
 		}
 	}
 
+	// OCI container images take precedence over other forms of packaging
+	if len(runner.ContainerImage(proc.Request)) != 0 {
+		mode = ExecContainer
+	}
+
 	switch mode {
 	case ExecPythonVEnv:
 		if proc.Executor, err = runner.NewVirtualEnv(proc.Request, proc.ExprDir, proc.AccessionID, proc.ResponseQ); err != nil {
@@ -229,6 +248,10 @@ func newProcessor(ctx context.Context, qt *task.QueueTask, accessionID string) (
 		if proc.Executor, err = runner.NewSingularity(proc.Request, proc.ExprDir); err != nil {
 			return nil, true, err
 		}
+	case ExecContainer:
+		if proc.Executor, err = runner.NewContainer(proc.Request, proc.ExprDir, proc.AccessionID, proc.ResponseQ); err != nil {
+			return nil, true, err
+		}
 	default:
 		return nil, true, kv.NewError("unable to determine execution class from artifacts").With("stack", stack.Trace().TrimRuntime()).
 			With("mode", mode, "project", proc.Request.Config.Database.ProjectId).With("experiment", proc.Request.Experiment.Key)
@@ -266,50 +289,8 @@ func (proc *processor) unpackMsg(qt *task.QueueTask) (hardError bool, err kv.Err
 			return false, kv.NewError("payload signature has no fingerprint").With("stack", stack.Trace().TrimRuntime())
 		}
 
-		// Now check the signature by getting the queue name and then looking for the applicable
-		// public key inside the signature store
-		pubKey, fp, err := GetRqstSigs().SelectSSH(qt.ShortQName)
-		if err != nil {
-			return false, err
-		}
-		if fp != envelope.Message.Fingerprint {
-			logger.Info("payload signature has an unmatched fingerprint", "fingerprint", fp, "message.Fingerprint", envelope.Message.Fingerprint)
-		}
-
-		sigBin, errGo := base64.StdEncoding.DecodeString(envelope.Message.Signature)
-		if errGo != nil {
-			return false, kv.Wrap(errGo).With("signature", envelope.Message.Signature).With("stack", stack.Trace().TrimRuntime())
-		}
-
-		err = nil
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					err = kv.Wrap(r.(error)).With("stack", stack.Trace().TrimRuntime())
-				}
-			}()
-
-			// First try for the RFC format using the parser
-			sig, errSig := defense.ParseSSHSignature(sigBin)
-			if errSig != nil {
-				// We could have 64 byte blob so just try to use that
-				if len(sigBin) == 64 {
-					sig = &ssh.Signature{
-						Format: "ssh-ed25519",
-						Blob:   sigBin,
-					}
-				} else {
-					err = errSig
-					return
-				}
-			}
-			if err == nil {
-				if errGo := pubKey.Verify([]byte(envelope.Message.Payload), sig); errGo != nil {
-					err = kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-				}
-			}
-		}()
-		if err != nil {
+		// Now check the signature using the public key for the queue the message arrived on
+		if err = verifySignature(qt.ShortQName, envelope.Message.Payload, envelope.Message.Signature, envelope.Message.Fingerprint); err != nil {
 			return false, err
 		}
 
@@ -330,10 +311,63 @@ func (proc *processor) unpackMsg(qt *task.QueueTask) (hardError bool, err kv.Err
 	return hardError, nil
 }
 
+// verifySignature checks the signature of a payload using the public key held for the named
+// queue inside the request signature store
+//
+func verifySignature(shortQName string, payload string, signature string, fingerprint string) (err kv.Error) {
+
+	// Check the signature by getting the queue name and then looking for the applicable
+	// public key inside the signature store
+	pubKey, fp, err := GetRqstSigs().SelectSSH(shortQName)
+	if err != nil {
+		return err
+	}
+	if fp != fingerprint {
+		logger.Info("payload signature has an unmatched fingerprint", "fingerprint", fp, "message.Fingerprint", fingerprint)
+	}
+
+	sigBin, errGo := base64.StdEncoding.DecodeString(signature)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("signature", signature).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = kv.Wrap(r.(error)).With("stack", stack.Trace().TrimRuntime())
+			}
+		}()
+
+		// First try for the RFC format using the parser
+		sig, errSig := defense.ParseSSHSignature(sigBin)
+		if errSig != nil {
+			// We could have 64 byte blob so just try to use that
+			if len(sigBin) == 64 {
+				sig = &ssh.Signature{
+					Format: "ssh-ed25519",
+					Blob:   sigBin,
+				}
+			} else {
+				err = errSig
+				return
+			}
+		}
+		if errGo := pubKey.Verify([]byte(payload), sig); errGo != nil {
+			err = kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+	}()
+	return err
+}
+
 // Close will release all resources and clean up the work directory that
 // was used by the studioml work
 //
 func (p *processor) Close() (err error) {
+	// Read only artifacts are released even when the work directory is retained
+	if len(p.ExprDir) != 0 {
+		artifactCache.Release(p.ExprDir)
+	}
+
 	if *debugOpt || 0 == len(p.ExprDir) {
 		return nil
 	}
@@ -364,8 +398,8 @@ func (p *processor) fetchAll(ctx context.Context) (err kv.Error) {
 			continue
 		}
 
-		// This artifact is downloaded during the runtime pass not beforehand
-		if group == "_singularity" {
+		// These artifacts are downloaded during the runtime pass not beforehand
+		if group == "_singularity" || group == runner.ContainerArtifact {
 			continue
 		}
 
@@ -552,6 +586,18 @@ func (p *processor) updateMetaData(group string, artifact request.Artifact, acce
 		src := filepath.Join(p.ExprDir, "output", "output")
 		jsonDest := filepath.Join(metaDir, "scrape-host-"+accessionID+".json")
 		return p.copyToMetaData(src, jsonDest)
+	case "_metadata":
+		// The hashes of the artifacts used, and produced, by the experiment are recorded
+		// to establish the provenance of its results
+		prov, errGo := json.MarshalIndent(artifactCache.Provenance(p.ExprDir), "", "  ")
+		if errGo != nil {
+			return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		provDest := filepath.Join(metaDir, "provenance-host-"+accessionID+".json")
+		if errGo = ioutil.WriteFile(provDest, prov, 0600); errGo != nil {
+			return kv.Wrap(errGo).With("provDest", provDest, "stack", stack.Trace().TrimRuntime())
+		}
+		return nil
 	default:
 		return kv.NewError("group unrecognized").With("group", group, "stack", stack.Trace().TrimRuntime())
 	}
@@ -569,6 +615,11 @@ func (p *processor) returnOne(ctx context.Context, group string, artifact reques
 				logger.Warn("output artifact could not be used for metadata", "project_id", p.Request.Config.Database.ProjectId,
 					"ep.Request.Experiment.Keyxperiment_id", p.Request.Experiment.Key, "error", err.Error())
 			}
+		case "_metadata":
+			if err = p.updateMetaData(group, artifact, accessionID); err != nil {
+				logger.Warn("provenance could not be added to metadata", "project_id", p.Request.Config.Database.ProjectId,
+					"experiment_id", p.Request.Experiment.Key, "error", err.Error())
+			}
 		}
 	}
 
@@ -578,7 +629,7 @@ func (p *processor) returnOne(ctx context.Context, group string, artifact reques
 		return false, warns, nil
 	}
 
-	return artifactCache.Restore(ctx, &artifact, p.Request.Config.Database.ProjectId, group, p.ExprEnvs, p.ExprDir)
+	return artifactCache.Restore(ctx, &artifact, p.Request.Config.Database.ProjectId, group, p.ExprEnvs, p.ExprDir, p.ResponseKey)
 }
 
 // returnAll creates tar archives of the experiments artifacts and then puts them
@@ -617,6 +668,15 @@ func (p *processor) returnAll(ctx context.Context, accessionID string) {
 		}
 	}
 
+	// Artifacts returned after the metadata need to be added to the provenance within the metadata
+	if len(returned) != 0 && returned[len(returned)-1] != "_metadata" {
+		if artifact, isPresent := p.Request.Experiment.Artifacts["_metadata"]; isPresent && artifact.Mutable {
+			if _, _, err := p.returnOne(ctx, "_metadata", artifact, accessionID); err != nil {
+				logger.Debug("return error", "project_id", p.Request.Config.Database.ProjectId, "group", "_metadata", "error", err.Error())
+			}
+		}
+	}
+
 	if len(returned) != 0 {
 		logger.Info("project returned", "project_id", p.Request.Config.Database.ProjectId, "result", strings.Join(returned, ", "))
 	}
@@ -742,7 +802,9 @@ func (p *processor) Process(ctx context.Context) (ack bool, err kv.Error) {
 				logger.Warn("unresponsive response queue channel")
 			}
 		}
-		return false, err
+		// Experiments stopped by the experimenter, or using artifacts that do not match their
+		// declared hashes, are consumed rather than being retried
+		return p.isUserCancelled() || integrity.IsMismatch(err), err
 	}
 
 	if p.ResponseQ != nil {
@@ -1070,6 +1132,9 @@ func (p *processor) runScript(ctx context.Context, accessionID string, refresh m
 	// completes normally and terminates by returning
 	runCtx, runCancel := context.WithCancel(context.Background())
 
+	// Carry the reason for any cancellation from the callers context through to the executor
+	runCtx, termination := runner.WithTermination(runCtx)
+
 	// Start a checkpointer for our output files and pass it the context used
 	// to notify when it is to stop.  Save a reference to the channel used to
 	// indicate when the checkpointer has flushed files etc.
@@ -1092,6 +1157,10 @@ func (p *processor) runScript(ctx context.Context, accessionID string, refresh m
 		// Wait for any one of two contexts to cancel
 		select {
 		case <-ctx.Done():
+			termination.Set(runner.TerminationReason(ctx))
+			if runner.TerminationFromContext(ctx).Immediate() {
+				termination.Kill("")
+			}
 		case <-runCtx.Done():
 			return
 		}
@@ -1149,7 +1218,10 @@ func (p *processor) run(ctx context.Context, alloc *pkgResources.Allocated, acce
 			With("stack", stack.Trace().TrimRuntime())
 	}
 
-	// Now we have the files locally stored we can begin the work
+	// Now we have the files locally stored we can begin the work, the executor being closed
+	// to release anything shared with other experiments such as cached environments
+	defer p.Executor.Close()
+
 	if err = p.Executor.Make(alloc, p); err != nil {
 		return err
 	}
@@ -1181,6 +1253,18 @@ func (p *processor) run(ctx context.Context, alloc *pkgResources.Allocated, acce
 	runCtx, runCancel := context.WithTimeout(ctx, maxDuration)
 	defer runCancel()
 
+	// Allow the reason for the runner stopping the experiment to be recorded
+	runCtx, termination := runner.WithTermination(runCtx)
+
+	// Allow experimenters to stop the experiment using commands sent over the control queue
+	deregister := p.registerControl(runCancel, termination)
+	defer deregister()
+
+	// Watch the disk space used by the experiment, stopping it should it exceed its allocation
+	if alloc != nil && alloc.Disk != nil {
+		p.diskQuotaStart(runCtx, runCancel, termination, alloc.Disk.Size)
+	}
+
 	if logger.IsInfo() {
 
 		deadline, _ := runCtx.Deadline()
@@ -252,6 +252,11 @@ func (live *Projects) run(ctx context.Context, proj string, mgt string, cred str
 		logger.Warn("failed project initialization", "project", proj, "error", err.Error())
 		return
 	}
+	// Task queues holding long lived connections, such as the members of Kafka consumer
+	// groups, release them once the project stops
+	if closer, isCloser := qr.tasker.(interface{ Close() }); isCloser {
+		defer closer.Close()
+	}
 	if err := qr.run(ctx, qRefreshInterval, 5*time.Second); err != nil {
 		logger.Warn("failed project runner", "project", proj, "error", err.Error())
 		return
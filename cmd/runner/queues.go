@@ -160,9 +160,9 @@ func (qr *Queuer) refresh() (err kv.Error) {
 	}
 	refreshSuccesses.With(prometheus.Labels{"host": host, "project": qr.project}).Inc()
 
-	// Ignore queues used for response messages
+	// Ignore queues used for response messages, failed messages, and control commands
 	for k := range known {
-		if strings.HasSuffix(k, responseSuffix) {
+		if strings.HasSuffix(k, responseSuffix) || strings.HasSuffix(k, runner.DeadLetterSuffix) || strings.HasSuffix(k, runner.ControlSuffix) {
 			delete(known, k)
 		}
 	}
@@ -222,7 +222,11 @@ func (qr *Queuer) producer(ctx context.Context, interval time.Duration) {
 		select {
 		case <-check.C:
 
-			for _, sub := range qr.subscriptions() {
+			// Queues in higher priority levels are checked for work first
+			subs := qr.subscriptions()
+			byPriority(subs)
+
+			for _, sub := range subs {
 
 				qr.busyQs.Lock()
 				_, busy := qr.busyQs.subs[sub.name]
@@ -558,6 +562,10 @@ func (qr *Queuer) doWork(ctx context.Context, request *SubRequest) {
 	//
 	go qr.startFetch(cCtx, request)
 
+	// Commands sent to experiments running from this queue, for example cancellations,
+	// are watched for on a companion control queue
+	go qr.watchControl(cCtx, request)
+
 	// While the above func is looking for work check periodically that
 	// the queue that was used to send the message still exists, if it
 	// does not cancel everything as this is an indication that the
@@ -580,10 +588,31 @@ func (qr *Queuer) fetchWork(ctx context.Context, qt *task.QueueTask) {
 
 	workDone := false
 	startedAt := time.Now()
+	grant := &shareGrant{}
 
 	// Make sure we are not needlessly doing this by seeing if anything at all is waiting
 	hasWork, err := qr.tasker.HasWork(ctx, qt.Subscription)
 
+	// Requests that will not fit the free resources of the runner are left on the queue
+	// for other runners rather than being claimed and returned
+	if hasWork && err == nil && capacityMaybe && !qr.peek(ctx, qt.Subscription) {
+		hasWork = false
+		capacityMaybe = false
+	}
+
+	if !hasWork && err == nil {
+		scheduler.idle(qr.project, qt.Subscription)
+	}
+
+	if hasWork && err == nil && capacityMaybe {
+		// Capacity is granted to the queues waiting for it using their fair share of recent
+		// usage, queues that are deferred try again on their next poll without a backoff
+		if grant = qr.fairShare(qt.Subscription); grant == nil {
+			logger.Trace("fair share deferred", "project_id", qt.Project, "subscription_id", qt.Subscription)
+			return
+		}
+	}
+
 	if hasWork && err == nil {
 
 		if exists, _ := qr.tasker.Exists(ctx, qt.Subscription+responseSuffix); exists {
@@ -650,6 +679,15 @@ func (qr *Queuer) fetchWork(ctx context.Context, qt *task.QueueTask) {
 		// Decrement the inflight counter for the worker
 		qr.subs.decWorkers(qt.Subscription)
 
+		// Replace the estimated usage charged to the queue with that of the experiment, queues
+		// that turned out to be empty are no longer waiting for capacity
+		if processed {
+			scheduler.complete(grant, rsc, time.Since(startedAt))
+		} else {
+			scheduler.complete(grant, nil, 0)
+			scheduler.idle(qr.project, qt.Subscription)
+		}
+
 		// Stop the background responder by closing the channel
 		if qt.ResponseQ != nil {
 			close(qt.ResponseQ)
@@ -751,6 +789,10 @@ func NewTaskQueue(project string, mgt string, creds string, w wrapper.Wrapper) (
 		tq, err = runner.NewRabbitMQ(project, mgt, creds, w, logger)
 	case strings.HasPrefix(project, "/"):
 		tq = runner.NewLocalQueue(project, w, logger)
+	case strings.HasPrefix(project, "nats://"), strings.HasPrefix(project, "tls://"):
+		tq, err = runner.NewNATS(project, creds, *natsCredsOpt, w, logger)
+	case strings.HasPrefix(project, "kafka://"):
+		tq, err = runner.NewKafka(project, creds, w, logger)
 	default:
 		// SQS uses a number of credential and config file names
 		files := strings.Split(creds, ",")
@@ -7,6 +7,7 @@ import (
 	"github.com/leaf-ai/go-service/pkg/server"
 	"github.com/leaf-ai/studio-go-runner/internal/resources"
 	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
 
 	"github.com/dustin/go-humanize"
 	"github.com/go-stack/stack"
@@ -58,8 +59,10 @@ func allocResource(rsc *server.Resource, id string, live bool) (alloc *resources
 
 	logables := []interface{}{"experiment_id", id, "before", machineRcs.String()}
 
+	// A lack of free resources is not a failure of the request itself so the message is refused
+	// to be retried later without using its retry budget
 	if alloc, err = machineResources.Alloc(rqst, live); err != nil {
-		return nil, err
+		return nil, task.Refused(err)
 	}
 
 	logables = append(logables, rqst.Logable()...)
@@ -12,6 +12,7 @@ require (
 	github.com/Masterminds/sprig/v3 v3.2.2
 	github.com/Microsoft/go-winio v0.5.0 // indirect
 	github.com/Rhymond/go-money v1.0.3
+	github.com/Shopify/sarama v1.31.1
 	github.com/awnumar/memguard v0.22.2
 	github.com/aws/aws-sdk-go v1.40.43
 	github.com/benbjohnson/clock v1.1.0 // indirect
@@ -51,7 +52,7 @@ require (
 	github.com/karlmutch/petname v0.0.0-20190202005206-caff460d43c2 // indirect
 	github.com/karlmutch/vtclean v0.0.0-20170504063817-d14193dfc626
 	github.com/karlseguin/expect v1.0.7 // indirect
-	github.com/klauspost/compress v1.13.0 // indirect
+	github.com/klauspost/compress v1.14.2
 	github.com/klauspost/cpuid/v2 v2.0.6 // indirect
 	github.com/klauspost/pgzip v1.2.5 // indirect
 	github.com/leaf-ai/go-service v0.0.0-20210911031305-5410b30da8d1
@@ -62,6 +63,8 @@ require (
 	github.com/minio/minio-go/v7 v7.0.14
 	github.com/mitchellh/copystructure v1.2.0
 	github.com/montanaflynn/stats v0.6.6 // indirect
+	github.com/nats-io/nats-server/v2 v2.3.0
+	github.com/nats-io/nats.go v1.11.0
 	github.com/otiai10/copy v1.6.0
 	github.com/prometheus/client_golang v1.11.0
 	github.com/prometheus/client_model v0.2.0
@@ -76,17 +79,16 @@ require (
 	github.com/streadway/amqp v1.0.1-0.20200716223359-e6b33f460591
 	github.com/tebeka/atexit v0.3.0
 	github.com/tklauser/go-sysconf v0.3.5 // indirect
-	github.com/ulikunitz/xz v0.5.10 // indirect
+	github.com/ulikunitz/xz v0.5.10
 	github.com/valyala/fastjson v1.6.3
 	github.com/ventu-io/go-shortid v0.0.0-20201117134242-e59966efd125 // indirect
 	go.opentelemetry.io/otel v0.20.0
 	go.uber.org/atomic v1.9.0
 	go.uber.org/goleak v1.1.10 // indirect
-	golang.org/x/crypto v0.0.0-20210915214749-c084706c2272
+	golang.org/x/crypto v0.0.0-20220128200615-198e4374d7ed
 	golang.org/x/exp v0.0.0-20200331195152-e8c3332aa8e5 // indirect
-	golang.org/x/net v0.0.0-20210916014120-12bc252f5db8
+	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd
 	golang.org/x/oauth2 v0.0.0-20210805134026-6f1e6394065a // indirect
-	golang.org/x/term v0.0.0-20210615171337-6886f2dfbf5b // indirect
 	google.golang.org/genproto v0.0.0-20210805201207-89edb61ffb67 // indirect
 	google.golang.org/protobuf v1.27.1
 	k8s.io/api v0.22.1
@@ -0,0 +1,504 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package archives // import "github.com/leaf-ai/studio-go-runner/internal/archives"
+
+// This file contains the implementation of the archive formats used for artifacts, tar archives
+// that are uncompressed or compressed using gzip, bzip2, zstd or xz, and zip archives.  The
+// unpacking of every format applies the same checks against files escaping the output directory.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leaf-ai/go-service/pkg/archive"
+	"github.com/leaf-ai/go-service/pkg/mime"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+
+	bzip2w "github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	uploadCompressionOpt = flag.String("upload-compression", "zstd", "the compression used for uploaded artifacts when neither the artifact compression, nor an archive extension of the artifact key, specify one, one of zstd, gzip, bzip2, xz, zip or none")
+)
+
+// The types of the supported archives
+const (
+	Tar   = "application/tar"
+	Gzip  = "application/x-gzip"
+	Bzip2 = "application/bzip2"
+	Zstd  = "application/zstd"
+	XZ    = "application/x-xz"
+	Zip   = "application/zip"
+
+	// octetStream is the type of content that could not be characterized, by convention
+	// these are treated as bzip2 compressed archives
+	octetStream = "application/octet-stream"
+)
+
+// FromCompression returns the archive type for the name of a compression used in artifacts,
+// 'none' being an uncompressed tar archive
+//
+func FromCompression(compression string) (fileType string, err kv.Error) {
+	switch strings.ToLower(compression) {
+	case "none", "tar":
+		return Tar, nil
+	case "gzip", "gz":
+		return Gzip, nil
+	case "bzip2", "bz2":
+		return Bzip2, nil
+	case "zstd", "zst":
+		return Zstd, nil
+	case "xz":
+		return XZ, nil
+	case "zip":
+		return Zip, nil
+	}
+	return "", kv.NewError("unknown compression").With("compression", compression).With("stack", stack.Trace().TrimRuntime())
+}
+
+// compressionExt returns the archive type for file name extensions that identify a compression
+//
+func compressionExt(name string) (fileType string, isPresent bool) {
+	switch filepath.Ext(name) {
+	case ".gzip", ".gz":
+		return Gzip, true
+	case ".tgz": // Non standard extension as a result of studioml python code
+		return Bzip2, true
+	case ".tb2", ".tbz", ".tbz2", ".bzip2", ".bz2":
+		return Bzip2, true
+	case ".zst", ".zstd", ".tzst":
+		return Zstd, true
+	case ".xz", ".txz":
+		return XZ, true
+	case ".zip":
+		return Zip, true
+	}
+	return "", false
+}
+
+// IsArchive returns true if the name has the extension of a supported archive
+//
+func IsArchive(name string) bool {
+	if archive.IsTar(name) {
+		return true
+	}
+	_, isPresent := compressionExt(name)
+	return isPresent
+}
+
+// FetchType returns the archive type expected for a download using the compression of the
+// artifact, when present, and the name otherwise.  The content of archives is also examined
+// when they are unpacked so this is only relied upon for archives that cannot be recognized.
+//
+func FetchType(name string, compression string) (fileType string, warn kv.Error) {
+	if len(compression) != 0 {
+		return FromCompression(compression)
+	}
+	if fileType, isPresent := compressionExt(name); isPresent {
+		return fileType, nil
+	}
+	return mime.MimeFromExt(name)
+}
+
+// DepositType returns the archive type to be used for an upload using the compression of
+// the artifact, when present, then the extension of the name, with .tar being an uncompressed
+// tar archive, and finally the runner default for names without an archive extension
+//
+func DepositType(name string, compression string) (fileType string, err kv.Error) {
+	if len(compression) != 0 {
+		return FromCompression(compression)
+	}
+	if fileType, isPresent := compressionExt(name); isPresent {
+		return fileType, nil
+	}
+	if filepath.Ext(name) == ".tar" {
+		return Tar, nil
+	}
+	return FromCompression(*uploadCompressionOpt)
+}
+
+// sniff examines the start of the content to identify the archive type, returning an empty
+// type for content that is not recognized
+//
+func sniff(rdr *bufio.Reader) (fileType string) {
+	head, _ := rdr.Peek(512)
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return Gzip
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return Bzip2
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return Zstd
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return XZ
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return Zip
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return Tar
+	}
+	return ""
+}
+
+// Unpack extracts the files within an archive read from src into the output directory.  The type
+// of the archive is determined from its content, with fileType being used when the content is
+// not recognized.  The size returned is the total size of the extracted files.
+//
+func Unpack(src io.Reader, fileType string, output string, maxBytes int64) (size int64, err kv.Error) {
+	return UnpackSelected(src, fileType, output, maxBytes, nil)
+}
+
+// UnpackSelected extracts the files within an archive that are selected by the filter, a nil
+// filter selecting every file.  Files that are not selected are read but not written and so do
+// not count against the budget.
+//
+func UnpackSelected(src io.Reader, fileType string, output string, maxBytes int64, filter *Filter) (size int64, err kv.Error) {
+	rdr := bufio.NewReader(src)
+	if sniffed := sniff(rdr); len(sniffed) != 0 {
+		fileType = sniffed
+	}
+
+	var inReader io.Reader = rdr
+	errGo := error(nil)
+
+	switch fileType {
+	case Gzip:
+		gz, errGo := gzip.NewReader(rdr)
+		if errGo != nil {
+			return 0, kv.Wrap(errGo).With("fileType", fileType).With("stack", stack.Trace().TrimRuntime())
+		}
+		defer gz.Close()
+		inReader = gz
+	case Bzip2, octetStream:
+		inReader = bzip2.NewReader(rdr)
+	case Zstd:
+		zr, errGo := zstd.NewReader(rdr)
+		if errGo != nil {
+			return 0, kv.Wrap(errGo).With("fileType", fileType).With("stack", stack.Trace().TrimRuntime())
+		}
+		defer zr.Close()
+		inReader = zr
+	case XZ:
+		if inReader, errGo = xz.NewReader(rdr); errGo != nil {
+			return 0, kv.Wrap(errGo).With("fileType", fileType).With("stack", stack.Trace().TrimRuntime())
+		}
+	case Zip:
+		return unpackZip(rdr, output, maxBytes, filter)
+	}
+
+	return unpackTar(inReader, output, maxBytes, filter)
+}
+
+// checkName ensures that a file from an archive remains within the output directory
+//
+func checkName(name string, output string) (err kv.Error) {
+	escapes, err := defense.WillEscape(name, output)
+	if err != nil {
+		return kv.Wrap(err).With("filename", name, "output", output)
+	}
+	if escapes {
+		return kv.NewError("archive escaped").With("filename", name, "output", output).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// checkLink ensures that a link from an archive refers to a location within the output directory
+//
+func checkLink(name string, link string, output string) (err kv.Error) {
+	if filepath.IsAbs(link) {
+		return kv.NewError("archive escaped").With("link", link, "filename", name, "output", output).With("stack", stack.Trace().TrimRuntime())
+	}
+	if err = checkName(filepath.Join(filepath.Dir(name), link), output); err != nil {
+		return err.With("link", link)
+	}
+	return nil
+}
+
+// writeFile copies content into a new file, limited to the remaining budget
+//
+func writeFile(src io.Reader, outFN string, mode os.FileMode, budget int64) (size int64, err kv.Error) {
+	_ = os.MkdirAll(filepath.Dir(outFN), os.ModePerm)
+
+	file, errGo := os.OpenFile(outFN, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("path", outFN).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	size, errGo = io.CopyN(file, src, budget)
+	file.Close()
+	if errGo != nil && !errors.Is(errGo, io.EOF) {
+		return 0, kv.Wrap(errGo).With("path", outFN).With("stack", stack.Trace().TrimRuntime())
+	}
+	return size, nil
+}
+
+// unpackTar extracts the files within a tar archive
+//
+func unpackTar(src io.Reader, output string, maxBytes int64, filter *Filter) (size int64, err kv.Error) {
+	tarReader := tar.NewReader(src)
+
+	for {
+		header, errGo := tarReader.Next()
+		if errors.Is(errGo, io.EOF) {
+			break
+		} else if errGo != nil {
+			return 0, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		if err = checkName(header.Name, output); err != nil {
+			return 0, err
+		}
+
+		if !filter.Selected(header.Name) {
+			continue
+		}
+
+		outFN, errGo := filepath.Abs(filepath.Join(output, header.Name))
+		if errGo != nil {
+			return 0, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		if len(header.Linkname) != 0 {
+			if err = checkLink(header.Name, header.Linkname, output); err != nil {
+				return 0, err
+			}
+			_ = os.MkdirAll(filepath.Dir(outFN), os.ModePerm)
+			if errGo = os.Symlink(header.Linkname, outFN); errGo != nil {
+				return 0, kv.Wrap(errGo, "symbolic link create failed").With("stack", stack.Trace().TrimRuntime())
+			}
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if errGo = os.MkdirAll(outFN, os.FileMode(header.Mode)); errGo != nil {
+				return 0, kv.Wrap(errGo).With("path", outFN).With("stack", stack.Trace().TrimRuntime())
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			copied, err := writeFile(tarReader, outFN, os.FileMode(header.Mode), maxBytes-size)
+			if err != nil {
+				return 0, err
+			}
+			size += copied
+		default:
+			errGo = fmt.Errorf("unknown tar archive type '%c'", header.Typeflag)
+			return 0, kv.Wrap(errGo).With("path", outFN).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return size, nil
+}
+
+// unpackZip extracts the files within a zip archive.  Zip archives have their directory at the
+// end of the archive so the archive is first saved to a temporary file within the output directory.
+//
+func unpackZip(src io.Reader, output string, maxBytes int64, filter *Filter) (size int64, err kv.Error) {
+	tmp, errGo := ioutil.TempFile(output, ".unzip-")
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("output", output).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	archived, errGo := io.CopyN(tmp, src, maxBytes+1)
+	if errGo != nil && !errors.Is(errGo, io.EOF) {
+		return 0, kv.Wrap(errGo).With("path", tmp.Name()).With("stack", stack.Trace().TrimRuntime())
+	}
+	if archived > maxBytes {
+		return 0, kv.NewError("archive size exceeded").With("budget", maxBytes).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	zipReader, errGo := zip.NewReader(tmp, archived)
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	for _, file := range zipReader.File {
+		if err = checkName(file.Name, output); err != nil {
+			return 0, err
+		}
+
+		if !filter.Selected(file.Name) {
+			continue
+		}
+
+		outFN, errGo := filepath.Abs(filepath.Join(output, file.Name))
+		if errGo != nil {
+			return 0, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		info := file.FileInfo()
+		if info.IsDir() {
+			if errGo = os.MkdirAll(outFN, info.Mode().Perm()|0700); errGo != nil {
+				return 0, kv.Wrap(errGo).With("path", outFN).With("stack", stack.Trace().TrimRuntime())
+			}
+			continue
+		}
+
+		content, errGo := file.Open()
+		if errGo != nil {
+			return 0, kv.Wrap(errGo).With("filename", file.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		// The content of symbolic links within zip archives is the target of the link
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, errGo := ioutil.ReadAll(io.LimitReader(content, 4096))
+			content.Close()
+			if errGo != nil {
+				return 0, kv.Wrap(errGo).With("filename", file.Name).With("stack", stack.Trace().TrimRuntime())
+			}
+			if err = checkLink(file.Name, string(link), output); err != nil {
+				return 0, err
+			}
+			_ = os.MkdirAll(filepath.Dir(outFN), os.ModePerm)
+			if errGo = os.Symlink(string(link), outFN); errGo != nil {
+				return 0, kv.Wrap(errGo, "symbolic link create failed").With("stack", stack.Trace().TrimRuntime())
+			}
+			continue
+		}
+
+		// Archives created on some platforms carry no permissions
+		mode := info.Mode().Perm()
+		if mode == 0 {
+			mode = 0600
+		}
+		copied, err := writeFile(content, outFN, mode, maxBytes-size)
+		content.Close()
+		if err != nil {
+			return 0, err
+		}
+		size += copied
+	}
+	return size, nil
+}
+
+// Pack writes the files as an archive of the type requested into dst
+//
+func Pack(dst io.Writer, files *archive.TarWriter, fileType string) (err kv.Error) {
+	switch fileType {
+	case Tar, octetStream:
+		tw := tar.NewWriter(dst)
+		if err = files.Write(tw); err != nil {
+			return err
+		}
+		if errGo := tw.Close(); errGo != nil {
+			return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		return nil
+	case Zip:
+		return packZip(dst, files)
+	}
+
+	var outZ io.WriteCloser
+	errGo := error(nil)
+	switch fileType {
+	case Bzip2:
+		outZ, errGo = bzip2w.NewWriter(dst, &bzip2w.WriterConfig{Level: 6})
+	case Gzip:
+		outZ = gzip.NewWriter(dst)
+	case Zstd:
+		outZ, errGo = zstd.NewWriter(dst)
+	case XZ:
+		outZ, errGo = xz.NewWriter(dst)
+	default:
+		return kv.NewError("unrecognized upload compression").With("fileType", fileType).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo != nil {
+		return kv.Wrap(errGo).With("fileType", fileType).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	tw := tar.NewWriter(outZ)
+	if err = files.Write(tw); err != nil {
+		outZ.Close()
+		return err
+	}
+	if errGo = tw.Close(); errGo != nil {
+		outZ.Close()
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = outZ.Close(); errGo != nil {
+		return kv.Wrap(errGo).With("fileType", fileType).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// packZip writes the files as a zip archive.  The files are first written as a tar stream
+// which is then converted entry by entry into the zip archive.
+//
+func packZip(dst io.Writer, files *archive.TarWriter) (err kv.Error) {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		if err := files.Write(tw); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+	defer pr.Close()
+
+	zw := zip.NewWriter(dst)
+	tarReader := tar.NewReader(pr)
+	for {
+		header, errGo := tarReader.Next()
+		if errors.Is(errGo, io.EOF) {
+			break
+		} else if errGo != nil {
+			return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		zipHeader, errGo := zip.FileInfoHeader(header.FileInfo())
+		if errGo != nil {
+			return kv.Wrap(errGo).With("filename", header.Name).With("stack", stack.Trace().TrimRuntime())
+		}
+		zipHeader.Name = header.Name
+		zipHeader.Method = zip.Deflate
+
+		switch {
+		case header.Typeflag == tar.TypeDir:
+			zipHeader.Name = strings.TrimSuffix(header.Name, "/") + "/"
+			zipHeader.Method = zip.Store
+			if _, errGo = zw.CreateHeader(zipHeader); errGo != nil {
+				return kv.Wrap(errGo).With("filename", header.Name).With("stack", stack.Trace().TrimRuntime())
+			}
+		case len(header.Linkname) != 0:
+			w, errGo := zw.CreateHeader(zipHeader)
+			if errGo == nil {
+				_, errGo = w.Write([]byte(header.Linkname))
+			}
+			if errGo != nil {
+				return kv.Wrap(errGo).With("filename", header.Name).With("stack", stack.Trace().TrimRuntime())
+			}
+		default:
+			w, errGo := zw.CreateHeader(zipHeader)
+			if errGo == nil {
+				_, errGo = io.Copy(w, tarReader)
+			}
+			if errGo != nil {
+				return kv.Wrap(errGo).With("filename", header.Name).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+	}
+	if errGo := zw.Close(); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package archives
+
+// This file contains tests for the packing and unpacking of the supported archive formats
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leaf-ai/go-service/pkg/archive"
+)
+
+// TestRoundTrip packs a directory using each of the supported archive types and checks that
+// unpacking, using only the content of the archive to identify the type, restores it
+func TestRoundTrip(t *testing.T) {
+	src, errGo := ioutil.TempDir("", "archives-src")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(src)
+
+	content := make([]byte, 64*1024)
+	rand.Read(content)
+	if errGo = os.MkdirAll(filepath.Join(src, "dir"), 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(src, "dir", "data.bin"), content, 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(src, "metadata.json"), []byte("{}"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	for _, compression := range []string{"none", "gzip", "bzip2", "zstd", "xz", "zip"} {
+		fileType, err := FromCompression(compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := archive.NewTarWriter(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packed := &bytes.Buffer{}
+		if err = Pack(packed, files, fileType); err != nil {
+			t.Fatal(compression, err)
+		}
+
+		output, errGo := ioutil.TempDir("", "archives-output")
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		defer os.RemoveAll(output)
+
+		size, err := Unpack(packed, "", output, int64(2*len(content)))
+		if err != nil {
+			t.Fatal(compression, err)
+		}
+		if size != int64(len(content)+2) {
+			t.Fatal(compression, "unexpected size", size)
+		}
+		unpacked, errGo := ioutil.ReadFile(filepath.Join(output, "dir", "data.bin"))
+		if errGo != nil {
+			t.Fatal(compression, errGo)
+		}
+		if !bytes.Equal(content, unpacked) {
+			t.Fatal(compression, "unpacked content differed")
+		}
+	}
+}
+
+// TestEscapes checks that files and links within archives cannot be placed outside of the
+// output directory
+func TestEscapes(t *testing.T) {
+	tarArchive := func(header *tar.Header) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		if errGo := tw.WriteHeader(header); errGo != nil {
+			t.Fatal(errGo)
+		}
+		tw.Close()
+		return buf
+	}
+	zipArchive := func(header *zip.FileHeader, content string) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		w, errGo := zw.CreateHeader(header)
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		w.Write([]byte(content))
+		zw.Close()
+		return buf
+	}
+	link := &zip.FileHeader{Name: "link"}
+	link.SetMode(os.ModeSymlink | 0777)
+
+	archives := map[string]*bytes.Buffer{
+		"tar name":     tarArchive(&tar.Header{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0600}),
+		"tar absolute": tarArchive(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}),
+		"tar relative": tarArchive(&tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "../../escaped"}),
+		"zip name":     zipArchive(&zip.FileHeader{Name: "../escaped"}, "content"),
+		"zip link":     zipArchive(link, "../escaped"),
+	}
+
+	for name, content := range archives {
+		output, errGo := ioutil.TempDir("", "archives-escape")
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		defer os.RemoveAll(output)
+
+		if _, err := Unpack(content, "", output, 1024*1024); err == nil {
+			t.Fatal(name, "escape was not detected")
+		}
+	}
+}
+
+// TestDepositType checks the selection of the archive type used for uploads
+func TestDepositType(t *testing.T) {
+	saved := *uploadCompressionOpt
+	defer func() {
+		*uploadCompressionOpt = saved
+	}()
+
+	*uploadCompressionOpt = "zstd"
+	expected := map[[2]string]string{
+		{"output.tar", ""}:        Tar,
+		{"output", ""}:            Zstd,
+		{"output.tar.gz", ""}:     Gzip,
+		{"output.tar.xz", ""}:     XZ,
+		{"output.zip", ""}:        Zip,
+		{"output.tar.gz", "none"}: Tar,
+		{"output", "xz"}:          XZ,
+	}
+	for args, fileType := range expected {
+		actual, err := DepositType(args[0], args[1])
+		if err != nil {
+			t.Fatal(args, err)
+		}
+		if actual != fileType {
+			t.Fatal(args, "unexpected type", actual)
+		}
+	}
+
+	if _, err := DepositType("output.tar", "lz4"); err == nil {
+		t.Fatal("unknown compression was accepted")
+	}
+}
+
+// TestUnpackSelected checks that only the files selected by the include and exclude patterns are
+// unpacked, and that only those files count against the budget
+func TestUnpackSelected(t *testing.T) {
+	src, errGo := ioutil.TempDir("", "archives-src")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(src)
+
+	files := map[string]int{
+		"train/shard-0.bin": 1024,
+		"train/shard-1.bin": 1024,
+		"test/shard-0.bin":  2048,
+		"train/README":      16,
+		"large.bin":         1024 * 1024,
+	}
+	for name, size := range files {
+		if errGo = os.MkdirAll(filepath.Join(src, filepath.Dir(name)), 0700); errGo != nil {
+			t.Fatal(errGo)
+		}
+		if errGo = ioutil.WriteFile(filepath.Join(src, name), make([]byte, size), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+
+	filter, err := NewFilter([]string{"./train/", "test/*.bin"}, []string{"train/shard-1.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range []string{"gzip", "zip"} {
+		fileType, err := FromCompression(compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw, err := archive.NewTarWriter(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packed := &bytes.Buffer{}
+		if err = Pack(packed, tw, fileType); err != nil {
+			t.Fatal(compression, err)
+		}
+
+		output, errGo := ioutil.TempDir("", "archives-output")
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		defer os.RemoveAll(output)
+
+		// The budget is too small for the large file that is not selected
+		size, err := UnpackSelected(packed, "", output, int64(packed.Len()+4096), filter)
+		if err != nil {
+			t.Fatal(compression, err)
+		}
+		if size != 1024+2048+16 {
+			t.Fatal(compression, "unexpected size", size)
+		}
+		for name := range files {
+			_, errGo := os.Stat(filepath.Join(output, name))
+			selected := name != "train/shard-1.bin" && name != "large.bin"
+			if selected != (errGo == nil) {
+				t.Fatal(compression, name, "selection incorrect", errGo)
+			}
+		}
+	}
+
+	if _, err = NewFilter([]string{"train/["}, nil); err == nil {
+		t.Fatal("invalid pattern accepted")
+	}
+	if filter, _ = NewFilter(nil, nil); !filter.Selected("anything") {
+		t.Fatal("empty filter did not select")
+	}
+}
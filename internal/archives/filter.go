@@ -0,0 +1,88 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package archives
+
+// This file contains the selection of the files that are unpacked from archives.  Files are
+// selected using glob patterns, in the form used by path.Match, that are matched against the
+// name of a file and the names of the directories containing it so that a pattern naming a
+// directory selects everything beneath it.
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// Filter selects the files within an archive that are to be unpacked
+//
+type Filter struct {
+	include []string
+	exclude []string
+}
+
+// cleanName returns the name of a file within an archive relative to the root of the archive
+//
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// cleanPatterns checks the patterns and makes them relative to the root of an archive
+//
+func cleanPatterns(patterns []string) (cleaned []string, err kv.Error) {
+	for _, pattern := range patterns {
+		pattern = cleanName(pattern)
+		if _, errGo := path.Match(pattern, ""); errGo != nil {
+			return nil, kv.Wrap(errGo).With("pattern", pattern).With("stack", stack.Trace().TrimRuntime())
+		}
+		cleaned = append(cleaned, pattern)
+	}
+	return cleaned, nil
+}
+
+// NewFilter returns a filter that selects the files matching any of the include patterns, or all
+// files when there are none, that do not match any of the exclude patterns.  A nil filter is returned
+// when no patterns are supplied.
+//
+func NewFilter(include []string, exclude []string) (filter *Filter, err kv.Error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	filter = &Filter{}
+	if filter.include, err = cleanPatterns(include); err != nil {
+		return nil, err
+	}
+	if filter.exclude, err = cleanPatterns(exclude); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// matches returns true when the name, or a directory containing it, matches one of the patterns
+//
+func matches(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		for candidate := name; len(candidate) != 0 && candidate != "."; candidate = path.Dir(candidate) {
+			if matched, _ := path.Match(pattern, candidate); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Selected returns true when the named file within an archive is to be unpacked
+//
+func (f *Filter) Selected(name string) bool {
+	if f == nil {
+		return true
+	}
+	name = cleanName(name)
+	if matches(f.exclude, name) {
+		return false
+	}
+	return len(f.include) == 0 || matches(f.include, name)
+}
@@ -0,0 +1,361 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package blobstore
+
+// This file contains the implementation of Azure Blob Storage access using the REST API,
+// https://docs.microsoft.com/en-us/rest/api/storageservices/blob-service-rest-api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// azureVersion is the version of the storage REST API used by the runner
+	azureVersion = "2020-04-08"
+
+	// azureHostSuffix is the suffix of the host names for Azure Blob Storage accounts
+	azureHostSuffix = ".blob.core.windows.net"
+
+	// azureAccountEnv and azureEndpointEnv name environment variables that can supply the storage
+	// account, and an alternative endpoint such as an Azurite emulator, for azblob URIs
+	azureAccountEnv  = "AZURE_STORAGE_ACCOUNT"
+	azureEndpointEnv = "AZURE_STORAGE_BLOB_ENDPOINT"
+
+	// azureBlockSize is the size of the blocks used to upload blobs, content that fits within
+	// a single block is uploaded using a single request
+	azureBlockSize = 8 * 1024 * 1024
+)
+
+type azurePlatform struct {
+	endpoint  string
+	account   string
+	container string
+	key       []byte
+	token     string
+	sas       url.Values
+	client    *http.Client
+}
+
+type azureBlobList struct {
+	Blobs struct {
+		Blob []struct {
+			Name string `xml:"Name"`
+		} `xml:"Blob"`
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+type azureBlockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+// IsAzureHost returns true if the host is that of an Azure Blob Storage account
+//
+func IsAzureHost(host string) (isAzure bool) {
+	return strings.HasSuffix(strings.ToLower(host), azureHostSuffix)
+}
+
+// NewAzureStorage is used to initialize a client that will communicate with Azure Blob Storage.
+//
+// The endpoint is the URL of the blob service for the account, when empty it is taken from the
+// AZURE_STORAGE_BLOB_ENDPOINT environment variable, or formed from the account name.  The account
+// name when empty is taken from the user of the plain credentials, or the AZURE_STORAGE_ACCOUNT
+// environment variable.
+//
+// Plain credentials carry the account name and the base64 encoded account key used for Shared
+// Key authorization.  A JWT token carries either a shared access signature, or an OAuth2
+// access token.  Without credentials anonymous access is used.
+//
+func NewAzureStorage(ctx context.Context, creds request.Credentials, env map[string]string, endpoint string, account string, container string, key string, compression string) (s *blobStorage, err kv.Error) {
+
+	if len(container) == 0 {
+		return nil, kv.NewError("container name missing").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	getenv := func(name string) string {
+		if value := env[name]; len(value) != 0 {
+			return value
+		}
+		return os.Getenv(name)
+	}
+
+	p := &azurePlatform{
+		account:   account,
+		container: container,
+		client:    &http.Client{},
+	}
+
+	if len(p.account) == 0 && creds.Plain != nil {
+		p.account = creds.Plain.User
+	}
+	if len(p.account) == 0 {
+		p.account = getenv(azureAccountEnv)
+	}
+	if len(p.account) == 0 {
+		return nil, kv.NewError("storage account missing").With("container", container).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if len(endpoint) == 0 {
+		endpoint = getenv(azureEndpointEnv)
+	}
+	if len(endpoint) == 0 {
+		endpoint = "https://" + p.account + azureHostSuffix
+	}
+	p.endpoint = strings.TrimSuffix(endpoint, "/")
+
+	switch {
+	case creds.Plain != nil:
+		accountKey, errGo := base64.StdEncoding.DecodeString(creds.Plain.Password)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo, "account key invalid").With("account", p.account).With("stack", stack.Trace().TrimRuntime())
+		}
+		p.key = accountKey
+	case creds.JWT != nil:
+		if sas, errGo := url.ParseQuery(strings.TrimPrefix(creds.JWT.Token, "?")); errGo == nil && len(sas.Get("sig")) != 0 {
+			p.sas = sas
+		} else {
+			p.token = creds.JWT.Token
+		}
+	}
+
+	return &blobStorage{
+		platform:    p,
+		key:         key,
+		compression: compression,
+	}, nil
+}
+
+func (p *azurePlatform) describe(err kv.Error) kv.Error {
+	return err.With("account", p.account, "container", p.container, "endpoint", p.endpoint)
+}
+
+func (p *azurePlatform) blobURL(key string) string {
+	return p.endpoint + "/" + url.PathEscape(p.container) + "/" + strings.ReplaceAll(url.PathEscape(key), "%2F", "/")
+}
+
+// sign adds the Shared Key authorization to a request, for details please see
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+//
+func (p *azurePlatform) sign(req *http.Request) {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	headers := []string{}
+	for name := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+
+	toSign := &strings.Builder{}
+	for _, value := range []string{req.Method, req.Header.Get("Content-Encoding"), req.Header.Get("Content-Language"),
+		contentLength, req.Header.Get("Content-MD5"), req.Header.Get("Content-Type"), "",
+		req.Header.Get("If-Modified-Since"), req.Header.Get("If-Match"), req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"), req.Header.Get("Range")} {
+		toSign.WriteString(value + "\n")
+	}
+	for _, name := range headers {
+		toSign.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	toSign.WriteString("/" + p.account + req.URL.EscapedPath())
+
+	query := req.URL.Query()
+	params := []string{}
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		toSign.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(toSign.String()))
+	req.Header.Set("Authorization", "SharedKey "+p.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func (p *azurePlatform) do(ctx context.Context, method string, addr string, query url.Values, headers map[string]string, body io.Reader) (resp *http.Response, err kv.Error) {
+	for name, values := range p.sas {
+		query[name] = values
+	}
+	if len(query) != 0 {
+		addr += "?" + query.Encode()
+	}
+
+	req, errGo := http.NewRequestWithContext(ctx, method, addr, body)
+	if errGo != nil {
+		return nil, p.describe(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	switch {
+	case len(p.key) != 0:
+		p.sign(req)
+	case len(p.token) != 0:
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, errGo = p.client.Do(req)
+	if err = checkResponse(resp, errGo); err != nil {
+		return nil, p.describe(err.With("method", method))
+	}
+	return resp, nil
+}
+
+// stat retrieves the properties of a blob, the hash being the MD5 of the blob, or the ETag for
+// blobs that have no MD5
+//
+func (p *azurePlatform) stat(ctx context.Context, key string) (hash string, size int64, err kv.Error) {
+	resp, err := p.do(ctx, http.MethodHead, p.blobURL(key), url.Values{}, nil, nil)
+	if err != nil {
+		return "", 0, err.With("key", key)
+	}
+	resp.Body.Close()
+
+	if size, errGo := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); errGo == nil {
+		if md5, errGo := base64.StdEncoding.DecodeString(resp.Header.Get("Content-MD5")); errGo == nil && len(md5) != 0 {
+			return hex.EncodeToString(md5), size, nil
+		}
+		return strings.Trim(resp.Header.Get("ETag"), "\""), size, nil
+	}
+	return "", 0, p.describe(kv.NewError("blob size invalid").With("key", key, "size", resp.Header.Get("Content-Length")).With("stack", stack.Trace().TrimRuntime()))
+}
+
+func (p *azurePlatform) get(ctx context.Context, key string) (body io.ReadCloser, err kv.Error) {
+	resp, err := p.do(ctx, http.MethodGet, p.blobURL(key), url.Values{}, nil, nil)
+	if err != nil {
+		return nil, err.With("key", key)
+	}
+	return resp.Body, nil
+}
+
+func (p *azurePlatform) list(ctx context.Context, prefix string) (keys []string, err kv.Error) {
+	keys = []string{}
+	marker := ""
+	for {
+		query := url.Values{}
+		query.Set("restype", "container")
+		query.Set("comp", "list")
+		query.Set("prefix", prefix)
+		if len(marker) != 0 {
+			query.Set("marker", marker)
+		}
+		resp, err := p.do(ctx, http.MethodGet, p.endpoint+"/"+url.PathEscape(p.container), query, nil, nil)
+		if err != nil {
+			return nil, err.With("prefix", prefix)
+		}
+
+		blobs := &azureBlobList{}
+		errGo := xml.NewDecoder(resp.Body).Decode(blobs)
+		resp.Body.Close()
+		if errGo != nil {
+			return nil, p.describe(kv.Wrap(errGo).With("prefix", prefix).With("stack", stack.Trace().TrimRuntime()))
+		}
+		for _, blob := range blobs.Blobs.Blob {
+			keys = append(keys, blob.Name)
+		}
+		if marker = blobs.NextMarker; len(marker) == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// put uploads a blob.  Content that fits within a single block is uploaded using a single request,
+// larger content is uploaded as a series of blocks that are then committed.  The MD5 of the
+// content is recorded against the blob in both cases.
+//
+func (p *azurePlatform) put(ctx context.Context, key string, rdr io.Reader) (err kv.Error) {
+	buf := make([]byte, azureBlockSize)
+	hash := md5.New()
+	blocks := []string{}
+
+	for {
+		filled, errGo := io.ReadFull(rdr, buf)
+		if errGo != nil && !errors.Is(errGo, io.EOF) && !errors.Is(errGo, io.ErrUnexpectedEOF) {
+			return p.describe(kv.Wrap(errGo).With("key", key).With("stack", stack.Trace().TrimRuntime()))
+		}
+		hash.Write(buf[:filled])
+
+		if errGo != nil && len(blocks) == 0 {
+			digest := md5.Sum(buf[:filled])
+			headers := map[string]string{
+				"x-ms-blob-type": "BlockBlob",
+				"Content-Type":   "application/octet-stream",
+				"Content-MD5":    base64.StdEncoding.EncodeToString(digest[:]),
+			}
+			resp, err := p.do(ctx, http.MethodPut, p.blobURL(key), url.Values{}, headers, bytes.NewReader(buf[:filled]))
+			if err != nil {
+				return err.With("key", key)
+			}
+			resp.Body.Close()
+			return nil
+		}
+
+		if filled != 0 {
+			// Block IDs must all be the same length within a blob
+			blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(blocks))))
+			query := url.Values{}
+			query.Set("comp", "block")
+			query.Set("blockid", blockID)
+			resp, err := p.do(ctx, http.MethodPut, p.blobURL(key), query, nil, bytes.NewReader(buf[:filled]))
+			if err != nil {
+				return err.With("key", key, "block", len(blocks))
+			}
+			resp.Body.Close()
+			blocks = append(blocks, blockID)
+		}
+
+		if errGo != nil {
+			break
+		}
+	}
+
+	content, errGo := xml.Marshal(&azureBlockList{Latest: blocks})
+	if errGo != nil {
+		return p.describe(kv.Wrap(errGo).With("key", key).With("stack", stack.Trace().TrimRuntime()))
+	}
+	query := url.Values{}
+	query.Set("comp", "blocklist")
+	headers := map[string]string{
+		"x-ms-blob-content-type": "application/octet-stream",
+		"x-ms-blob-content-md5":  base64.StdEncoding.EncodeToString(hash.Sum(nil)),
+	}
+	resp, err := p.do(ctx, http.MethodPut, p.blobURL(key), query, headers, bytes.NewReader(append([]byte(xml.Header), content...)))
+	if err != nil {
+		return err.With("key", key)
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,357 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package blobstore // import "github.com/leaf-ai/studio-go-runner/internal/blobstore"
+
+// This file contains the implementation of the storage sub system for cloud blob storage
+// platforms that are accessed using their REST APIs, such as Google Cloud Storage and Azure
+// Blob Storage.  The platform specific operations are implemented by the platform interface
+// with the handling of archives and budgets shared across platforms.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/leaf-ai/go-service/pkg/archive"
+
+	"github.com/leaf-ai/studio-go-runner/internal/archives"
+	"github.com/leaf-ai/studio-go-runner/internal/integrity"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// platform is implemented by each of the blob storage platforms that are supported
+//
+type platform interface {
+	// stat returns the hash and size of a blob
+	stat(ctx context.Context, key string) (hash string, size int64, err kv.Error)
+	// get returns the contents of a blob
+	get(ctx context.Context, key string) (body io.ReadCloser, err kv.Error)
+	// list returns the names of the blobs that start with the prefix
+	list(ctx context.Context, prefix string) (keys []string, err kv.Error)
+	// put uploads the contents of the reader as a blob
+	put(ctx context.Context, key string, rdr io.Reader) (err kv.Error)
+	// describe adds the details of the platform to errors
+	describe(err kv.Error) kv.Error
+}
+
+type blobStorage struct {
+	platform platform
+	key      string
+	// compression selects the archive format used for the artifact
+	compression string
+	// expected is the hash supplied with the artifact, when present the content of the
+	// artifact is checked against it
+	expected string
+}
+
+func (s *blobStorage) Close() {
+}
+
+// Hash returns the platform specific hash of the contents of the blob, a hex encoded MD5 where
+// the platform has one, or the ETag of the blob where it does not
+//
+func (s *blobStorage) Hash(ctx context.Context, name string) (hash string, err kv.Error) {
+	key := name
+	if len(key) == 0 {
+		key = s.key
+	}
+	// Artifacts with a known hash are identified by it, allowing artifacts with the same
+	// content to share cached copies
+	if len(s.expected) != 0 && key == s.key {
+		return strings.ReplaceAll(strings.ToLower(s.expected), ":", "-"), nil
+	}
+	hash, _, err = s.platform.stat(ctx, key)
+	return hash, err
+}
+
+// Gather is used to retrieve files prefixed with a specific key.  It is used to retrieve the individual files
+// associated with a previous Hoard operation.
+//
+func (s *blobStorage) Gather(ctx context.Context, keyPrefix string, outputDir string, maxBytes int64, tap io.Writer, failFast bool) (size int64, warnings []kv.Error, err kv.Error) {
+
+	// Prefixes can end with a glob pattern that is matched against the full keys that were listed
+	prefix, pattern := request.KeyPattern(keyPrefix)
+	names, err := s.platform.list(ctx, prefix)
+	if err != nil {
+		return size, warnings, err
+	}
+	if len(pattern) != 0 {
+		names = request.MatchKeys(names, pattern)
+	}
+
+	// Place names into the gathered pool in sorted order to allow testing to
+	// predictably download items when using the maxBytes parameter
+	sort.Strings(names)
+
+	for _, key := range names {
+		// Objects are placed using the path of their key beneath the prefix
+		rel, ok := request.GatheredPath(keyPrefix, key)
+		if !ok {
+			warnings = append(warnings, kv.NewError("object outside of the prefix skipped").With("key", key, "prefix", keyPrefix).With("stack", stack.Trace().TrimRuntime()))
+			continue
+		}
+		dir := filepath.Join(outputDir, filepath.Dir(filepath.FromSlash(rel)))
+		if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+			return size, warnings, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+		s, w, e := s.Fetch(ctx, key, false, dir, maxBytes, tap)
+		if len(w) != 0 {
+			warnings = append(warnings, w...)
+		}
+		if e != nil {
+			if failFast {
+				return size, warnings, e
+			}
+			err = e
+		}
+		size += s
+		maxBytes -= s
+	}
+	return size, warnings, err
+}
+
+// Fetch is used to retrieve a blob and either copy it directly into a directory, or unpack
+// the blob into the same directory.
+//
+// Calling this function with output not being a valid directory will result in an error
+// being returned.
+//
+// The tap can be used to make a side copy of the content that is being read.
+//
+func (s *blobStorage) Fetch(ctx context.Context, name string, unpack bool, output string, maxBytes int64, tap io.Writer) (size int64, warns []kv.Error, err kv.Error) {
+
+	key := name
+	if len(key) == 0 {
+		key = s.key
+	}
+	errCtx := kv.With("output", output).With("name", name).With("key", key)
+
+	// Make sure output is an existing directory
+	info, errGo := os.Stat(output)
+	if errGo != nil {
+		return 0, warns, s.platform.describe(errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !info.IsDir() {
+		return 0, warns, s.platform.describe(errCtx.NewError("a directory was not used, or did not exist").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	fileType, w := archives.FetchType(key, s.compression)
+	if w != nil {
+		warns = append(warns, w)
+	}
+
+	// Check before downloading the blob if it would on its own without decompression
+	// blow the disk space budget assigned to it
+	_, blobSize, err := s.platform.stat(ctx, key)
+	if err != nil {
+		return 0, warns, err
+	}
+	if blobSize > maxBytes {
+		return 0, warns, s.platform.describe(errCtx.NewError("blob size exceeded").With("size", humanize.Bytes(uint64(blobSize)), "budget", humanize.Bytes(uint64(maxBytes))).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	body, err := s.platform.get(ctx, key)
+	if err != nil {
+		return 0, warns, err
+	}
+	defer body.Close()
+
+	// Create a stack of readers that first tee off any data read to a tap
+	// the tap being able to send data to things like caches etc
+	var src io.Reader = body
+	if tap != nil {
+		src = io.TeeReader(body, tap)
+	}
+
+	// When the hash of the artifact is known the content is passed through a verifier as it is read
+	var verifier *integrity.Verifier
+	if len(s.expected) != 0 && key == s.key {
+		if verifier, err = integrity.NewVerifier(s.expected); err != nil {
+			return 0, warns, err
+		}
+		src = io.TeeReader(src, verifier)
+	}
+
+	outFN := filepath.Join(output, filepath.Base(key))
+	if unpack {
+		size, err = archives.Unpack(src, fileType, output, maxBytes)
+	} else {
+		size, err = copyBlob(src, outFN, maxBytes)
+	}
+	if err != nil {
+		return 0, warns, s.platform.describe(err.With("key", key))
+	}
+
+	// Archives can end before the content does, for example with padding, so the remainder
+	// is read to complete the digest and any copy being made by the tap
+	if _, errGo = io.Copy(ioutil.Discard, src); errGo != nil {
+		return 0, warns, s.platform.describe(errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	if verifier != nil {
+		if err = verifier.Verify(); err != nil {
+			if !unpack {
+				os.Remove(outFN)
+			}
+			return 0, warns, s.platform.describe(err.With("key", key))
+		}
+	}
+	return size, warns, nil
+}
+
+// copyBlob copies the contents of a blob into the named file
+//
+func copyBlob(src io.Reader, path string, maxBytes int64) (size int64, err kv.Error) {
+	f, errGo := os.Create(path)
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("path", path).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer f.Close()
+
+	outf := bufio.NewWriter(f)
+	size, errGo = io.CopyN(outf, src, maxBytes)
+	if errGo != nil && !errors.Is(errGo, io.EOF) {
+		return 0, kv.Wrap(errGo).With("path", path).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = outf.Flush(); errGo != nil {
+		return 0, kv.Wrap(errGo).With("path", path).With("stack", stack.Trace().TrimRuntime())
+	}
+	return size, nil
+}
+
+// Hoard is used to upload the contents of a directory to the storage server as individual files rather than a single
+// archive
+//
+func (s *blobStorage) Hoard(ctx context.Context, srcDir string, keyPrefix string) (warnings []kv.Error, err kv.Error) {
+
+	prefix := keyPrefix
+	if len(prefix) == 0 {
+		prefix = s.key
+	}
+
+	// Walk files taking each uploadable file and placing into a collection
+	files := []string{}
+	errGo := filepath.Walk(srcDir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	for _, aFile := range files {
+		key := filepath.Join(prefix, strings.TrimPrefix(aFile, srcDir))
+		if err = s.uploadFile(ctx, aFile, key); err != nil {
+			warnings = append(warnings, err)
+		}
+	}
+
+	if len(warnings) != 0 {
+		err = kv.NewError("one or more uploads failed").With("stack", stack.Trace().TrimRuntime()).With("src", srcDir, "warnings", warnings)
+	}
+	return warnings, err
+}
+
+// uploadFile transmits a single file to the storage platform
+//
+func (s *blobStorage) uploadFile(ctx context.Context, src string, key string) (err kv.Error) {
+	file, errGo := os.Open(filepath.Clean(src))
+	if errGo != nil {
+		return kv.Wrap(errGo).With("src", src).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer file.Close()
+
+	if err = s.platform.put(ctx, key, file); err != nil {
+		return err.With("src", src)
+	}
+	return nil
+}
+
+// Deposit is used to archive the contents of a directory and upload the archive
+//
+func (s *blobStorage) Deposit(ctx context.Context, src string, dest string) (warns []kv.Error, err kv.Error) {
+
+	key := dest
+	if len(key) == 0 {
+		key = s.key
+	}
+
+	files, err := archive.NewTarWriter(src)
+	if err != nil {
+		return warns, err
+	}
+
+	if !files.HasFiles() {
+		warns = append(warns, kv.NewError("no files found").With("src", src).With("stack", stack.Trace().TrimRuntime()))
+		return warns, nil
+	}
+
+	typ, err := archives.DepositType(dest, s.compression)
+	if err != nil {
+		return warns, err.With("key", dest)
+	}
+
+	pr, pw := io.Pipe()
+	go writeArchive(pw, files, typ)
+
+	if err = s.platform.put(ctx, key, pr); err != nil {
+		// Release the writer of the archive that would otherwise block on the pipe
+		pr.CloseWithError(err)
+		return warns, err
+	}
+	pr.Close()
+
+	return warns, nil
+}
+
+// writeArchive writes the files as an archive of the requested type into the pipe
+//
+func writeArchive(pw *io.PipeWriter, files *archive.TarWriter, typ string) {
+
+	err := kv.Error(nil)
+	defer func() {
+		if r := recover(); r != nil {
+			err = kv.NewError(fmt.Sprint(r)).With("stack", stack.Trace().TrimRuntime())
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+
+	err = archives.Pack(pw, files, typ)
+}
+
+// checkResponse returns an error for unsuccessful HTTP responses, including the start of
+// any message sent by the platform in the response body
+//
+func checkResponse(resp *http.Response, errGo error) (err kv.Error) {
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+
+	return kv.NewError(http.StatusText(resp.StatusCode)).With("status", resp.StatusCode, "response", strings.TrimSpace(string(msg))).With("stack", stack.Trace().TrimRuntime())
+}
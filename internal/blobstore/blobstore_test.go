@@ -0,0 +1,396 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package blobstore
+
+// This file contains tests for the Google Cloud Storage and Azure Blob Storage platforms.  When the
+// STORAGE_EMULATOR_HOST, or AZURE_STORAGE_BLOB_ENDPOINT, environment variables are set the tests
+// use the emulator they refer to, such as fake-gcs-server, or Azurite.  Otherwise minimal in
+// process emulations of the platform REST APIs are used.
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/rs/xid"
+)
+
+const (
+	// The well known development account used by Azurite
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// fakeBlobs is the content held by the in process emulations
+type fakeBlobs struct {
+	blobs  map[string][]byte
+	blocks map[string][]byte
+	sync.Mutex
+}
+
+func (f *fakeBlobs) names(prefix string) (names []string) {
+	f.Lock()
+	defer f.Unlock()
+	for name := range f.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *fakeBlobs) blob(name string) (content []byte, isPresent bool) {
+	f.Lock()
+	defer f.Unlock()
+	content, isPresent = f.blobs[name]
+	return content, isPresent
+}
+
+func (f *fakeBlobs) store(name string, content []byte) {
+	f.Lock()
+	defer f.Unlock()
+	f.blobs[name] = content
+}
+
+// fakeGCS emulates the subset of the Google Cloud Storage JSON API used by the runner
+func fakeGCS(t *testing.T) (server *httptest.Server) {
+	f := &fakeBlobs{blobs: map[string][]byte{}}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+		switch {
+		case r.Method == http.MethodPost && strings.HasPrefix(path, "/upload/storage/v1/b/"):
+			content, _ := ioutil.ReadAll(r.Body)
+			f.store(r.URL.Query().Get("name"), content)
+			w.Write([]byte("{}"))
+
+		case r.Method == http.MethodPost && path == "/storage/v1/b":
+			w.Write([]byte("{}"))
+
+		case r.Method == http.MethodGet && strings.HasSuffix(path, "/o"):
+			objs := &gcsObjects{}
+			for _, name := range f.names(r.URL.Query().Get("prefix")) {
+				objs.Items = append(objs.Items, gcsObject{Name: name})
+			}
+			json.NewEncoder(w).Encode(objs)
+
+		case r.Method == http.MethodGet && strings.Contains(path, "/o/"):
+			name, _ := url.PathUnescape(path[strings.Index(path, "/o/")+3:])
+			content, isPresent := f.blob(name)
+			if !isPresent {
+				http.NotFound(w, r)
+				return
+			}
+			if r.URL.Query().Get("alt") == "media" {
+				w.Write(content)
+				return
+			}
+			digest := md5.Sum(content)
+			json.NewEncoder(w).Encode(&gcsObject{
+				Name:    name,
+				Size:    strconv.Itoa(len(content)),
+				MD5Hash: base64.StdEncoding.EncodeToString(digest[:]),
+			})
+		default:
+			t.Error("unexpected request", r.Method, r.URL.String())
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+}
+
+// fakeAzure emulates the subset of the Azure Blob Storage REST API used by the runner
+func fakeAzure(t *testing.T) (server *httptest.Server) {
+	f := &fakeBlobs{blobs: map[string][]byte{}, blocks: map[string][]byte{}}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+azuriteAccount+":") {
+			http.Error(w, "unauthorized", http.StatusForbidden)
+			return
+		}
+
+		// Path style addressing as used by Azurite, /account/container/blob
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+		query := r.URL.Query()
+
+		switch {
+		case len(parts) == 2 && query.Get("restype") == "container" && r.Method == http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+
+		case len(parts) == 2 && query.Get("comp") == "list":
+			list := &azureBlobList{}
+			for _, name := range f.names(query.Get("prefix")) {
+				list.Blobs.Blob = append(list.Blobs.Blob, struct {
+					Name string `xml:"Name"`
+				}{Name: name})
+			}
+			xml.NewEncoder(w).Encode(struct {
+				XMLName xml.Name `xml:"EnumerationResults"`
+				*azureBlobList
+			}{azureBlobList: list})
+
+		case len(parts) == 3 && r.Method == http.MethodPut && query.Get("comp") == "block":
+			content, _ := ioutil.ReadAll(r.Body)
+			f.Lock()
+			f.blocks[parts[2]+"/"+query.Get("blockid")] = content
+			f.Unlock()
+			w.WriteHeader(http.StatusCreated)
+
+		case len(parts) == 3 && r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+			list := &azureBlockList{}
+			if errGo := xml.NewDecoder(r.Body).Decode(list); errGo != nil {
+				http.Error(w, errGo.Error(), http.StatusBadRequest)
+				return
+			}
+			content := []byte{}
+			f.Lock()
+			for _, id := range list.Latest {
+				content = append(content, f.blocks[parts[2]+"/"+id]...)
+			}
+			f.Unlock()
+			f.store(parts[2], content)
+			w.WriteHeader(http.StatusCreated)
+
+		case len(parts) == 3 && r.Method == http.MethodPut:
+			content, _ := ioutil.ReadAll(r.Body)
+			f.store(parts[2], content)
+			w.WriteHeader(http.StatusCreated)
+
+		case len(parts) == 3 && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+			content, isPresent := f.blob(parts[2])
+			if !isPresent {
+				http.NotFound(w, r)
+				return
+			}
+			digest := md5.Sum(content)
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(digest[:]))
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			if r.Method == http.MethodGet {
+				w.Write(content)
+			}
+		default:
+			t.Error("unexpected request", r.Method, r.URL.String())
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+}
+
+// storageTest exercises the Storage operations of a platform
+func storageTest(t *testing.T, s *blobStorage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, errGo := ioutil.TempDir("", "blobstore-test")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files larger than a single Azure block are used to exercise block uploads
+	contents := map[string][]byte{
+		"a.txt":     []byte("a small file"),
+		"sub/b.bin": make([]byte, azureBlockSize+1024),
+	}
+	rand.Read(contents["sub/b.bin"])
+
+	src := filepath.Join(dir, "src")
+	for name, content := range contents {
+		fn := filepath.Join(src, name)
+		if errGo = os.MkdirAll(filepath.Dir(fn), 0700); errGo != nil {
+			t.Fatal(errGo)
+		}
+		if errGo = ioutil.WriteFile(fn, content, 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+
+	prefix := xid.New().String()
+
+	// Archives are uploaded and unpacked
+	if _, err := s.Deposit(ctx, src, prefix+"/output.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := s.Hash(ctx, prefix+"/output.tar.gz"); err != nil || len(hash) == 0 {
+		t.Fatal("hash unavailable", err)
+	}
+
+	unpacked := filepath.Join(dir, "unpacked")
+	if errGo = os.MkdirAll(unpacked, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, _, err := s.Fetch(ctx, prefix+"/output.tar.gz", true, unpacked, 64*1024*1024, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range contents {
+		fetched, errGo := ioutil.ReadFile(filepath.Join(unpacked, name))
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if !bytes.Equal(fetched, content) {
+			t.Fatal("unpacked file differed", name)
+		}
+	}
+
+	// Keys without an archive extension are uploaded using the default compression, zstd
+	if _, err := s.Deposit(ctx, src, prefix+"/output"); err != nil {
+		t.Fatal(err)
+	}
+	raw := filepath.Join(dir, "raw")
+	if errGo = os.MkdirAll(raw, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, _, err := s.Fetch(ctx, prefix+"/output", false, raw, 64*1024*1024, nil); err != nil {
+		t.Fatal(err)
+	}
+	stream, errGo := ioutil.ReadFile(filepath.Join(raw, "output"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !bytes.HasPrefix(stream, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		t.Fatal("extensionless upload was not a zstd stream")
+	}
+
+	// Individual files are uploaded and gathered
+	if _, err := s.Hoard(ctx, src, prefix+"/files"); err != nil {
+		t.Fatal(err)
+	}
+	gathered := filepath.Join(dir, "gathered")
+	if errGo = os.MkdirAll(gathered, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	size, _, err := s.Gather(ctx, prefix+"/files", gathered, 64*1024*1024, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := int64(0)
+	for name, content := range contents {
+		total += int64(len(content))
+		fetched, errGo := ioutil.ReadFile(filepath.Join(gathered, name))
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if !bytes.Equal(fetched, content) {
+			t.Fatal("gathered file differed", name)
+		}
+	}
+	if size != total {
+		t.Fatal("gathered size was incorrect", size, total)
+	}
+
+	// Glob patterns select a subset of the files
+	globbed := filepath.Join(dir, "globbed")
+	if errGo = os.MkdirAll(globbed, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if size, _, err = s.Gather(ctx, prefix+"/files/*.txt", globbed, 64*1024*1024, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := ioutil.ReadDir(globbed); len(items) != 1 || items[0].Name() != "a.txt" || size != int64(len(contents["a.txt"])) {
+		t.Fatal("glob gathered the wrong files", items, size)
+	}
+
+	// Keys containing glob characters are used literally unless the artifact opts in to globs
+	if _, err := s.Hoard(ctx, src, prefix+"/run[1]"); err != nil {
+		t.Fatal(err)
+	}
+	literal := filepath.Join(dir, "literal")
+	if errGo = os.MkdirAll(literal, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	art := &request.Artifact{Key: prefix + "/run[1]/"}
+	if size, _, err = s.Gather(ctx, art.GatherKey(), literal, 64*1024*1024, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if size != total {
+		t.Fatal("literal prefix gathered the wrong files", size, total)
+	}
+	if _, errGo = os.Stat(filepath.Join(literal, "sub", "b.bin")); errGo != nil {
+		t.Fatal("gathered file was not placed using its path beneath the prefix", errGo)
+	}
+
+	// The hash of an uploaded file is the MD5 of its contents
+	digest := md5.Sum(contents["sub/b.bin"])
+	if hash, err := s.Hash(ctx, prefix+"/files/sub/b.bin"); err != nil || hash != hex.EncodeToString(digest[:]) {
+		t.Fatal("hash was incorrect", hash, err)
+	}
+
+	// Budgets are respected
+	if _, _, err = s.Fetch(ctx, prefix+"/files/sub/b.bin", false, gathered, 1024, nil); err == nil {
+		t.Fatal("blob larger than the budget was fetched")
+	}
+}
+
+func TestGCSStorage(t *testing.T) {
+	env := map[string]string{}
+	if len(os.Getenv(gcsEmulatorEnv)) == 0 {
+		server := fakeGCS(t)
+		defer server.Close()
+		env[gcsEmulatorEnv] = server.URL
+	}
+
+	bucket := strings.ToLower(xid.New().String())
+	creds := request.Credentials{JWT: &request.JWTCredential{Token: "test-token"}}
+
+	s, err := NewGCSStorage(context.Background(), creds, env, bucket, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Buckets are created for the test when using an emulator
+	p := s.platform.(*gcsPlatform)
+	resp, err := p.do(context.Background(), http.MethodPost, p.endpoint+"/storage/v1/b?project=test", strings.NewReader(`{"name": "`+bucket+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	storageTest(t, s)
+}
+
+func TestAzureStorage(t *testing.T) {
+	env := map[string]string{}
+	if len(os.Getenv(azureEndpointEnv)) == 0 {
+		server := fakeAzure(t)
+		defer server.Close()
+		env[azureEndpointEnv] = server.URL + "/" + azuriteAccount
+	}
+
+	container := strings.ToLower(xid.New().String())
+	creds := request.Credentials{Plain: &request.PlainCredential{User: azuriteAccount, Password: azuriteKey}}
+
+	s, err := NewAzureStorage(context.Background(), creds, env, "", "", container, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Containers are created for the test when using an emulator
+	p := s.platform.(*azurePlatform)
+	query := url.Values{}
+	query.Set("restype", "container")
+	resp, err := p.do(context.Background(), http.MethodPut, p.endpoint+"/"+container, query, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	storageTest(t, s)
+}
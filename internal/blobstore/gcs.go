@@ -0,0 +1,201 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package blobstore
+
+// This file contains the implementation of Google Cloud Storage access using the JSON API,
+// https://cloud.google.com/storage/docs/json_api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// gcsEndpoint is the address of the Google Cloud Storage JSON API
+	gcsEndpoint = "https://storage.googleapis.com"
+
+	// gcsEmulatorEnv is the environment variable used by Google tooling to redirect storage
+	// requests to an emulator such as fake-gcs-server
+	gcsEmulatorEnv = "STORAGE_EMULATOR_HOST"
+)
+
+type gcsPlatform struct {
+	endpoint string
+	bucket   string
+	token    string
+	client   *http.Client
+}
+
+// gcsObject contains the fields of the Google Cloud Storage object resource used by the runner
+//
+type gcsObject struct {
+	Name    string `json:"name"`
+	Size    string `json:"size"`
+	MD5Hash string `json:"md5Hash"`
+	ETag    string `json:"etag"`
+}
+
+type gcsObjects struct {
+	Items         []gcsObject `json:"items"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+// NewGCSStorage is used to initialize a client that will communicate with Google Cloud Storage.
+//
+// An OAuth2 access token for a service account can be supplied using either the JWT token,
+// or the password of the plain credentials, without credentials anonymous access is used.
+// The STORAGE_EMULATOR_HOST environment variable, from either the experiment or the runner,
+// can be used to direct requests to an emulator.
+//
+func NewGCSStorage(ctx context.Context, creds request.Credentials, env map[string]string, bucket string, key string, compression string) (s *blobStorage, err kv.Error) {
+
+	if len(bucket) == 0 {
+		return nil, kv.NewError("bucket name missing").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	p := &gcsPlatform{
+		endpoint: gcsEndpoint,
+		bucket:   bucket,
+		client:   &http.Client{},
+	}
+
+	emulator := env[gcsEmulatorEnv]
+	if len(emulator) == 0 {
+		emulator = os.Getenv(gcsEmulatorEnv)
+	}
+	if len(emulator) != 0 {
+		if !strings.Contains(emulator, "://") {
+			emulator = "http://" + emulator
+		}
+		p.endpoint = strings.TrimSuffix(emulator, "/")
+	}
+
+	switch {
+	case creds.JWT != nil:
+		p.token = creds.JWT.Token
+	case creds.Plain != nil:
+		p.token = creds.Plain.Password
+	}
+
+	return &blobStorage{
+		platform:    p,
+		key:         key,
+		compression: compression,
+	}, nil
+}
+
+func (p *gcsPlatform) describe(err kv.Error) kv.Error {
+	return err.With("bucket", p.bucket, "endpoint", p.endpoint)
+}
+
+func (p *gcsPlatform) objectURL(key string) string {
+	return p.endpoint + "/storage/v1/b/" + url.PathEscape(p.bucket) + "/o/" + url.PathEscape(key)
+}
+
+func (p *gcsPlatform) do(ctx context.Context, method string, addr string, body io.Reader) (resp *http.Response, err kv.Error) {
+	req, errGo := http.NewRequestWithContext(ctx, method, addr, body)
+	if errGo != nil {
+		return nil, p.describe(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if len(p.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	resp, errGo = p.client.Do(req)
+	if err = checkResponse(resp, errGo); err != nil {
+		return nil, p.describe(err.With("method", method))
+	}
+	return resp, nil
+}
+
+// stat retrieves the metadata for an object, the hash being the MD5 of the object, or the
+// ETag for composite objects that have no MD5
+//
+func (p *gcsPlatform) stat(ctx context.Context, key string) (hash string, size int64, err kv.Error) {
+	resp, err := p.do(ctx, http.MethodGet, p.objectURL(key), nil)
+	if err != nil {
+		return "", 0, err.With("key", key)
+	}
+	defer resp.Body.Close()
+
+	obj := &gcsObject{}
+	if errGo := json.NewDecoder(resp.Body).Decode(obj); errGo != nil {
+		return "", 0, p.describe(kv.Wrap(errGo).With("key", key).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	if size, errGo := strconv.ParseInt(obj.Size, 10, 64); errGo == nil {
+		if md5, errGo := base64.StdEncoding.DecodeString(obj.MD5Hash); errGo == nil && len(md5) != 0 {
+			return hex.EncodeToString(md5), size, nil
+		}
+		return obj.ETag, size, nil
+	}
+	return "", 0, p.describe(kv.NewError("object size invalid").With("key", key, "size", obj.Size).With("stack", stack.Trace().TrimRuntime()))
+}
+
+func (p *gcsPlatform) get(ctx context.Context, key string) (body io.ReadCloser, err kv.Error) {
+	resp, err := p.do(ctx, http.MethodGet, p.objectURL(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, err.With("key", key)
+	}
+	return resp.Body, nil
+}
+
+func (p *gcsPlatform) list(ctx context.Context, prefix string) (keys []string, err kv.Error) {
+	keys = []string{}
+	pageToken := ""
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		if len(pageToken) != 0 {
+			query.Set("pageToken", pageToken)
+		}
+		resp, err := p.do(ctx, http.MethodGet, p.endpoint+"/storage/v1/b/"+url.PathEscape(p.bucket)+"/o?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err.With("prefix", prefix)
+		}
+
+		objs := &gcsObjects{}
+		errGo := json.NewDecoder(resp.Body).Decode(objs)
+		resp.Body.Close()
+		if errGo != nil {
+			return nil, p.describe(kv.Wrap(errGo).With("prefix", prefix).With("stack", stack.Trace().TrimRuntime()))
+		}
+		for _, obj := range objs.Items {
+			keys = append(keys, obj.Name)
+		}
+		if pageToken = objs.NextPageToken; len(pageToken) == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// put uploads an object using a single media upload request streaming the contents
+//
+func (p *gcsPlatform) put(ctx context.Context, key string, rdr io.Reader) (err kv.Error) {
+	query := url.Values{}
+	query.Set("uploadType", "media")
+	query.Set("name", key)
+
+	resp, err := p.do(ctx, http.MethodPost, p.endpoint+"/upload/storage/v1/b/"+url.PathEscape(p.bucket)+"/o?"+query.Encode(), rdr)
+	if err != nil {
+		return err.With("key", key)
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package blobstore
+
+// This file contains the implementation of read only artifacts published on HTTP servers.
+// Downloads that are interrupted are resumed using range requests when the server supports
+// them, and the content is checked against the hash of the artifact when one is supplied.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/leaf-ai/studio-go-runner/internal/integrity"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// httpResumes is the number of times an interrupted download will be resumed
+	httpResumes = 5
+)
+
+type httpPlatform struct {
+	base     string
+	query    string
+	token    string
+	user     string
+	password string
+	client   *http.Client
+}
+
+// NewHTTPStorage is used to initialize a read only client that retrieves artifacts from HTTP servers.
+// The key is the path of the artifact on the server, when empty the path of the URI is used.
+//
+// A JWT token is sent as a bearer token, and plain credentials are sent using basic authentication.
+// When the expected hash of the artifact is supplied, as a hex encoded digest optionally prefixed
+// by the algorithm, for example sha256:<digest>, downloads are checked against it.  Without an
+// algorithm prefix the algorithm is selected using the length of the digest.
+//
+func NewHTTPStorage(ctx context.Context, creds request.Credentials, uri *url.URL, key string, compression string, expected string) (s *blobStorage, err kv.Error) {
+
+	if len(uri.Host) == 0 {
+		return nil, kv.NewError("host name missing").With("uri", uri.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if len(expected) != 0 {
+		if _, err = integrity.NewVerifier(expected); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &httpPlatform{
+		base:   uri.Scheme + "://" + uri.Host,
+		query:  uri.RawQuery,
+		client: &http.Client{},
+	}
+
+	switch {
+	case creds.JWT != nil:
+		p.token = creds.JWT.Token
+	case creds.Plain != nil:
+		p.user = creds.Plain.User
+		p.password = creds.Plain.Password
+	}
+
+	if len(key) == 0 {
+		key = uri.EscapedPath()
+	}
+
+	return &blobStorage{
+		platform:    p,
+		key:         key,
+		compression: compression,
+		expected:    expected,
+	}, nil
+}
+
+func (p *httpPlatform) describe(err kv.Error) kv.Error {
+	return err.With("endpoint", p.base)
+}
+
+func (p *httpPlatform) url(key string) string {
+	addr := p.base + "/" + strings.TrimPrefix(key, "/")
+	if len(p.query) != 0 {
+		addr += "?" + p.query
+	}
+	return addr
+}
+
+func (p *httpPlatform) do(ctx context.Context, method string, key string, headers map[string]string) (resp *http.Response, err kv.Error) {
+	req, errGo := http.NewRequestWithContext(ctx, method, p.url(key), nil)
+	if errGo != nil {
+		return nil, p.describe(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	switch {
+	case len(p.token) != 0:
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	case len(p.user) != 0:
+		req.SetBasicAuth(p.user, p.password)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, errGo = p.client.Do(req)
+	if err = checkResponse(resp, errGo); err != nil {
+		return nil, p.describe(err.With("method", method, "key", key))
+	}
+	return resp, nil
+}
+
+// stat returns an identifier for the current content of the artifact and its size, the size
+// is -1 when the server does not supply it.  The identifier is derived from the ETag, or the
+// modification time when there is no ETag, of the artifact.
+//
+func (p *httpPlatform) stat(ctx context.Context, key string) (hash string, size int64, err kv.Error) {
+	resp, err := p.do(ctx, http.MethodHead, key, nil)
+	if err != nil {
+		// Some servers only implement GET
+		if resp, err = p.do(ctx, http.MethodGet, key, nil); err != nil {
+			return "", 0, err
+		}
+	}
+	resp.Body.Close()
+
+	size = resp.ContentLength
+
+	digest := sha256.New()
+	for _, value := range []string{p.url(key), resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), strconv.FormatInt(size, 10)} {
+		digest.Write([]byte(value + "\n"))
+	}
+	return hex.EncodeToString(digest.Sum(nil)), size, nil
+}
+
+func (p *httpPlatform) get(ctx context.Context, key string) (body io.ReadCloser, err kv.Error) {
+	resp, err := p.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rdr := &resumingReader{
+		ctx:  ctx,
+		p:    p,
+		key:  key,
+		body: resp.Body,
+		size: resp.ContentLength,
+	}
+	// Resuming requires the server to support ranges and a strong ETag to ensure that the
+	// parts come from the same content
+	if etag := resp.Header.Get("ETag"); resp.Header.Get("Accept-Ranges") == "bytes" && len(etag) != 0 && !strings.HasPrefix(etag, "W/") {
+		rdr.etag = etag
+	}
+	return rdr, nil
+}
+
+func (p *httpPlatform) list(ctx context.Context, prefix string) (keys []string, err kv.Error) {
+	return nil, p.describe(kv.NewError("HTTP artifacts cannot be listed").With("prefix", prefix).With("stack", stack.Trace().TrimRuntime()))
+}
+
+func (p *httpPlatform) put(ctx context.Context, key string, rdr io.Reader) (err kv.Error) {
+	return p.describe(kv.NewError("HTTP artifacts are read only").With("key", key).With("stack", stack.Trace().TrimRuntime()))
+}
+
+// resumingReader reads the body of a download, resuming the download from the point
+// of failure using range requests when the connection to the server fails
+//
+type resumingReader struct {
+	ctx     context.Context
+	p       *httpPlatform
+	key     string
+	etag    string
+	body    io.ReadCloser
+	offset  int64
+	size    int64
+	resumes int
+}
+
+func (r *resumingReader) Read(b []byte) (n int, errGo error) {
+	n, errGo = r.body.Read(b)
+	r.offset += int64(n)
+
+	// Content that ends before the size sent by the server is treated as a failure
+	if errors.Is(errGo, io.EOF) && r.size > 0 && r.offset < r.size {
+		errGo = io.ErrUnexpectedEOF
+	}
+	if errGo == nil || errors.Is(errGo, io.EOF) {
+		return n, errGo
+	}
+
+	if len(r.etag) == 0 || r.resumes >= httpResumes || r.ctx.Err() != nil {
+		return n, errGo
+	}
+	r.resumes++
+
+	r.body.Close()
+	resp, err := r.p.do(r.ctx, http.MethodGet, r.key, map[string]string{
+		"Range":    fmt.Sprintf("bytes=%d-", r.offset),
+		"If-Range": r.etag,
+	})
+	if err != nil {
+		r.body = http.NoBody
+		return n, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		// The content changed, or the range was not honoured
+		resp.Body.Close()
+		r.body = http.NoBody
+		return n, r.p.describe(kv.NewError("download could not be resumed").With("key", r.key, "status", resp.StatusCode).With("stack", stack.Trace().TrimRuntime()))
+	}
+	r.body = resp.Body
+
+	if n != 0 {
+		return n, nil
+	}
+	return r.Read(b)
+}
+
+func (r *resumingReader) Close() (errGo error) {
+	return r.body.Close()
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package blobstore
+
+// This file contains tests for read only artifacts published on HTTP servers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+)
+
+func TestHTTPStorage(t *testing.T) {
+	content := make([]byte, 256*1024)
+	rand.Read(content)
+	digest := sha256.Sum256(content)
+	modTime := time.Now()
+
+	// The first download of the artifact is cut short so that it must be resumed
+	downloads := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method == http.MethodGet && len(r.Header.Get("Range")) == 0 && atomic.AddInt32(&downloads, 1) == 1 {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(content[:len(content)/3])
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "data.bin", modTime, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir, errGo := ioutil.TempDir("", "http-storage-test")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	uri, errGo := url.Parse(server.URL + "/datasets/data.bin")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	creds := request.Credentials{JWT: &request.JWTCredential{Token: "test-token"}}
+	ctx := context.Background()
+
+	s, err := NewHTTPStorage(ctx, creds, uri, "", "", "sha256:"+hex.EncodeToString(digest[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Artifacts with a known hash are identified by it within caches
+	if hash, err := s.Hash(ctx, ""); err != nil || hash != "sha256-"+hex.EncodeToString(digest[:]) {
+		t.Fatal("unexpected hash", hash, err)
+	}
+
+	size, _, err := s.Fetch(ctx, "", false, dir, int64(len(content)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content)) {
+		t.Fatal("unexpected size", size)
+	}
+	fetched, errGo := ioutil.ReadFile(filepath.Join(dir, "data.bin"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !bytes.Equal(fetched, content) {
+		t.Fatal("resumed download differed from the artifact")
+	}
+
+	// Downloads that do not match the hash of the artifact fail and are removed
+	other := sha256.Sum256([]byte("other"))
+	if s, err = NewHTTPStorage(ctx, creds, uri, "", "", hex.EncodeToString(other[:])); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.Fetch(ctx, "", false, dir, int64(len(content)), nil); err == nil {
+		t.Fatal("hash mismatch was not detected")
+	}
+	if _, errGo = os.Stat(filepath.Join(dir, "data.bin")); !os.IsNotExist(errGo) {
+		t.Fatal("mismatched download was retained", errGo)
+	}
+
+	// HTTP artifacts are read only
+	if errGo = ioutil.WriteFile(filepath.Join(dir, "output.txt"), content, 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, err = s.Deposit(ctx, dir, "output.tar"); err == nil {
+		t.Fatal("deposit to an HTTP server succeeded")
+	}
+
+	// Invalid hashes are rejected
+	if _, err = NewHTTPStorage(ctx, creds, uri, "", "", "sha256:1234"); err == nil {
+		t.Fatal("invalid hash accepted")
+	}
+
+	// Credentials are required by the server
+	if s, err = NewHTTPStorage(ctx, request.Credentials{}, uri, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.Fetch(ctx, "", false, dir, int64(len(content)), nil); err == nil {
+		t.Fatal("download without credentials succeeded")
+	}
+}
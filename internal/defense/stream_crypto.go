@@ -0,0 +1,248 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package defense
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// This file contains code for the encryption of streams, such as artifact archives, that are
+// too large to be held in memory.  It uses the same secretbox approach as the block functions
+// with the stream being divided into chunks that are each sealed using a nonce made from a
+// random prefix and the position of the chunk.  The final chunk is marked within its nonce so
+// that streams that have been truncated, or reordered, will fail to decrypt.
+//
+// The stream starts with a magic string and the 16 byte nonce prefix, followed by each chunk
+// as a 4 byte big endian length and then the sealed chunk.
+
+const (
+	streamChunkSize = 64 * 1024
+	streamFinal     = uint64(1) << 63
+)
+
+var (
+	streamMagic = []byte("SGRENC01")
+)
+
+// NewDataKey generates a random secret for the encryption of a stream
+//
+func NewDataKey() (key [32]byte, err kv.Error) {
+	if _, errGo := io.ReadFull(rand.Reader, key[:]); errGo != nil {
+		return key, kv.Wrap(errGo, "secret could not be generated").With("stack", stack.Trace().TrimRuntime())
+	}
+	return key, nil
+}
+
+// SealDataKey encrypts a stream secret using an RSA public key so that it can be stored
+// alongside the encrypted stream
+//
+func SealDataKey(key [32]byte, pub *rsa.PublicKey) (sealed string, err kv.Error) {
+	return HybridSeal(key[:], pub)
+}
+
+// UnsealDataKey decrypts a stream secret sealed using SealDataKey
+//
+func UnsealDataKey(sealed string, prvKey *rsa.PrivateKey) (key [32]byte, err kv.Error) {
+	clear, err := Unseal(sealed, prvKey)
+	if err != nil {
+		return key, err
+	}
+	if len(clear) != len(key) {
+		return key, kv.NewError("sealed secret has an invalid length").With("stack", stack.Trace().TrimRuntime())
+	}
+	copy(key[:], clear)
+	return key, nil
+}
+
+// ParseDataKey decodes a base64 encoded stream secret, as carried by requests
+//
+func ParseDataKey(encoded string) (key [32]byte, err kv.Error) {
+	decoded, errGo := base64.StdEncoding.DecodeString(encoded)
+	if errGo != nil {
+		return key, kv.Wrap(errGo, "secret is not base64 encoded").With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(decoded) != len(key) {
+		return key, kv.NewError("secret has an invalid length").With("stack", stack.Trace().TrimRuntime())
+	}
+	copy(key[:], decoded)
+	return key, nil
+}
+
+type streamWriter struct {
+	dst    io.Writer
+	key    [32]byte
+	prefix [16]byte
+	count  uint64
+	buf    []byte
+	closed bool
+}
+
+// EncryptStream returns a writer that encrypts the data written to it before passing it to dst.
+// The writer must be closed for the final chunk to be written.
+//
+func EncryptStream(dst io.Writer, key [32]byte) (w io.WriteCloser, err kv.Error) {
+	sw := &streamWriter{
+		dst: dst,
+		key: key,
+		buf: make([]byte, 0, streamChunkSize),
+	}
+	if _, errGo := io.ReadFull(rand.Reader, sw.prefix[:]); errGo != nil {
+		return nil, kv.Wrap(errGo, "nonce could not be generated").With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo := dst.Write(append(append([]byte{}, streamMagic...), sw.prefix[:]...)); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return sw, nil
+}
+
+func streamNonce(prefix [16]byte, count uint64) (nonce [24]byte) {
+	copy(nonce[:], prefix[:])
+	binary.BigEndian.PutUint64(nonce[16:], count)
+	return nonce
+}
+
+func (w *streamWriter) seal(chunk []byte, final bool) (err error) {
+	count := w.count
+	if final {
+		count |= streamFinal
+	}
+	w.count++
+	nonce := streamNonce(w.prefix, count)
+
+	sealed := secretbox.Seal(make([]byte, 4, 4+len(chunk)+secretbox.Overhead), chunk, &nonce, &w.key)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	if _, errGo := w.dst.Write(sealed); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// Write buffers the data and encrypts each complete chunk, a full chunk is retained until
+// more data arrives as the last chunk is only known once the writer is closed
+//
+func (w *streamWriter) Write(p []byte) (n int, err error) {
+	if w.closed {
+		return 0, kv.NewError("write to closed stream").With("stack", stack.Trace().TrimRuntime())
+	}
+	n = len(p)
+	for len(p) != 0 {
+		if len(w.buf) == streamChunkSize {
+			if err = w.seal(w.buf, false); err != nil {
+				return 0, err
+			}
+			w.buf = w.buf[:0]
+		}
+		copied := copy(w.buf[len(w.buf):streamChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+copied]
+		p = p[copied:]
+	}
+	return n, nil
+}
+
+// Close writes the final chunk, it does not close the destination writer
+//
+func (w *streamWriter) Close() (err error) {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(w.buf, true)
+}
+
+type streamReader struct {
+	src    io.Reader
+	key    [32]byte
+	prefix [16]byte
+	count  uint64
+	clear  []byte
+	final  bool
+	err    error
+}
+
+// DecryptStream returns a reader that decrypts a stream produced using EncryptStream, an error is
+// returned by the reader if the stream has been altered or truncated
+//
+func DecryptStream(src io.Reader, key [32]byte) (r io.Reader, err kv.Error) {
+	header := make([]byte, len(streamMagic)+16)
+	if _, errGo := io.ReadFull(src, header); errGo != nil {
+		return nil, kv.Wrap(errGo, "encrypted stream header missing").With("stack", stack.Trace().TrimRuntime())
+	}
+	if !bytes.Equal(header[:len(streamMagic)], streamMagic) {
+		return nil, kv.NewError("encrypted stream header invalid").With("stack", stack.Trace().TrimRuntime())
+	}
+	sr := &streamReader{
+		src: src,
+		key: key,
+	}
+	copy(sr.prefix[:], header[len(streamMagic):])
+	return sr, nil
+}
+
+func (r *streamReader) open() (err error) {
+	// A missing chunk is never the end of the stream, only the final chunk can end it
+	length := [4]byte{}
+	if _, errGo := io.ReadFull(r.src, length[:]); errGo != nil {
+		if errGo == io.EOF {
+			errGo = io.ErrUnexpectedEOF
+		}
+		return kv.Wrap(errGo, "encrypted stream truncated").With("stack", stack.Trace().TrimRuntime())
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size < secretbox.Overhead || size > streamChunkSize+secretbox.Overhead {
+		return kv.NewError("encrypted stream chunk invalid").With("size", size).With("stack", stack.Trace().TrimRuntime())
+	}
+	sealed := make([]byte, size)
+	if _, errGo := io.ReadFull(r.src, sealed); errGo != nil {
+		if errGo == io.EOF {
+			errGo = io.ErrUnexpectedEOF
+		}
+		return kv.Wrap(errGo, "encrypted stream truncated").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// The final chunk is identified by trying the final nonce when the other fails
+	nonce := streamNonce(r.prefix, r.count)
+	clear, ok := secretbox.Open(nil, sealed, &nonce, &r.key)
+	if !ok {
+		nonce = streamNonce(r.prefix, r.count|streamFinal)
+		if clear, ok = secretbox.Open(nil, sealed, &nonce, &r.key); !ok {
+			return kv.NewError("decryption failure").With("stack", stack.Trace().TrimRuntime())
+		}
+		r.final = true
+	}
+	r.count++
+	r.clear = clear
+	return nil
+}
+
+// Read returns decrypted data, errors are retained and returned by all subsequent reads so that
+// callers that retry cannot skip a chunk that failed to decrypt
+//
+func (r *streamReader) Read(p []byte) (n int, err error) {
+	for len(r.clear) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.final {
+			// Data following the final chunk indicates the stream was altered
+			if n, _ := r.src.Read(make([]byte, 1)); n != 0 {
+				r.err = kv.NewError("encrypted stream has trailing data").With("stack", stack.Trace().TrimRuntime())
+				continue
+			}
+			return 0, io.EOF
+		}
+		r.err = r.open()
+	}
+	n = copy(p, r.clear)
+	r.clear = r.clear[n:]
+	return n, nil
+}
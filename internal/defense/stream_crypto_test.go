@@ -0,0 +1,119 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package defense
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"testing"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv"
+)
+
+// TestStreamCrypt validates the chunked encryption of streams including the detection of
+// streams that were truncated, or altered, after encryption
+func TestStreamCrypt(t *testing.T) {
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, streamChunkSize, 2*streamChunkSize + 5} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		encrypted := &bytes.Buffer{}
+		w, err := EncryptStream(encrypted, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Write in odd sized pieces to exercise the chunk boundaries
+		for i := 0; i < len(data); i += 1000 {
+			end := i + 1000
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, errGo := w.Write(data[i:end]); errGo != nil {
+				t.Fatal(errGo)
+			}
+		}
+		if errGo := w.Close(); errGo != nil {
+			t.Fatal(errGo)
+		}
+
+		r, err := DecryptStream(bytes.NewReader(encrypted.Bytes()), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, errGo := ioutil.ReadAll(r)
+		if errGo != nil {
+			t.Fatal(size, errGo)
+		}
+		if !bytes.Equal(data, decrypted) {
+			t.Fatal(kv.NewError("encryption decryption cycle failed").With("size", size).With("stack", stack.Trace().TrimRuntime()))
+		}
+
+		// A truncated stream must not decrypt
+		truncated := encrypted.Bytes()[:encrypted.Len()-1]
+		if r, err = DecryptStream(bytes.NewReader(truncated), key); err == nil {
+			if _, errGo = ioutil.ReadAll(r); errGo == nil {
+				t.Fatal(kv.NewError("truncated stream was accepted").With("size", size).With("stack", stack.Trace().TrimRuntime()))
+			}
+		}
+
+		// An altered stream must not decrypt
+		altered := append([]byte{}, encrypted.Bytes()...)
+		altered[len(altered)-1] ^= 0xff
+		if r, err = DecryptStream(bytes.NewReader(altered), key); err != nil {
+			t.Fatal(err)
+		}
+		if _, errGo = ioutil.ReadAll(r); errGo == nil {
+			t.Fatal(kv.NewError("altered stream was accepted").With("size", size).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	// Streams that are missing whole chunks from the end must not decrypt
+	data := make([]byte, 2*streamChunkSize+5)
+	encrypted := &bytes.Buffer{}
+	w, err := EncryptStream(encrypted, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	w.Close()
+	shortened := encrypted.Bytes()[:len(streamMagic)+16+2*(4+streamChunkSize+16)]
+	r, err := DecryptStream(bytes.NewReader(shortened), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, errGo := ioutil.ReadAll(r); errGo == nil {
+		t.Fatal(kv.NewError("stream missing its final chunk was accepted").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestSealDataKey checks that stream secrets can be sealed using a public key and recovered
+// using the private key
+func TestSealDataKey(t *testing.T) {
+	prvKey, errGo := rsa.GenerateKey(rand.Reader, 2048)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := SealDataKey(key, &prvKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsealed, err := UnsealDataKey(sealed, prvKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != unsealed {
+		t.Fatal(kv.NewError("sealed secret was not recovered").With("stack", stack.Trace().TrimRuntime()))
+	}
+}
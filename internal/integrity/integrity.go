@@ -0,0 +1,231 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package integrity
+
+// This file contains the verification of downloaded artifacts against the hash declared
+// for them by the experimenter.  Content is written to a Verifier as it is downloaded, the
+// verifier computing the declared digest along with a SHA256 that is used to record the
+// provenance of the artifacts used by experiments.
+//
+// Declared hashes are hex encoded digests optionally prefixed by the algorithm, for example
+// sha256:<digest>.  The md5, sha1, sha256 and sha512 algorithms are supported along with the
+// etag algorithm used by S3 for the ETag of objects uploaded in parts, <md5 of the part
+// md5s>-<number of parts>.
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	// ErrMismatch is the cause of errors for artifacts whose content did not match their declared hash,
+	// these errors will not be resolved by retrying
+	ErrMismatch = errors.New("artifact hash mismatch")
+
+	// etagPartSizes are the part sizes commonly used by S3 clients, multipart ETags are checked
+	// against each of them as the part size is not recorded by S3
+	etagPartSizes = []int64{5, 8, 16, 32, 64, 128, 256, 512}
+)
+
+// IsMismatch returns true when the error was caused by content that did not match its declared hash
+//
+func IsMismatch(err error) bool {
+	return errors.Is(err, ErrMismatch)
+}
+
+// newDigest returns the hash function and expected hex digest for an artifact hash
+//
+func newDigest(algorithm string, sum string, declared string) (digest hash.Hash, err kv.Error) {
+	if _, errGo := hex.DecodeString(sum); errGo != nil {
+		return nil, kv.Wrap(errGo, "artifact hash invalid").With("hash", declared).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if len(algorithm) == 0 {
+		algorithm = map[int]string{
+			2 * md5.Size:    "md5",
+			2 * sha1.Size:   "sha1",
+			2 * sha256.Size: "sha256",
+			2 * sha512.Size: "sha512",
+		}[len(sum)]
+	}
+
+	switch algorithm {
+	case "md5", "etag":
+		digest = md5.New()
+	case "sha1":
+		digest = sha1.New()
+	case "sha256":
+		digest = sha256.New()
+	case "sha512":
+		digest = sha512.New()
+	default:
+		return nil, kv.NewError("artifact hash algorithm unrecognized").With("hash", declared).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(sum) != 2*digest.Size() {
+		return nil, kv.NewError("artifact hash length invalid").With("hash", declared).With("stack", stack.Trace().TrimRuntime())
+	}
+	return digest, nil
+}
+
+// etagPart tracks the multipart ETag of content for a single part size
+//
+type etagPart struct {
+	size    int64
+	written int64
+	part    hash.Hash
+	sums    []byte
+	parts   int
+}
+
+func (p *etagPart) write(b []byte) {
+	for len(b) != 0 {
+		chunk := b
+		if remaining := p.size - p.written; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		p.part.Write(chunk)
+		p.written += int64(len(chunk))
+		b = b[len(chunk):]
+		if p.written == p.size {
+			p.complete()
+		}
+	}
+}
+
+func (p *etagPart) complete() {
+	p.sums = p.part.Sum(p.sums)
+	p.parts++
+	p.part.Reset()
+	p.written = 0
+}
+
+func (p *etagPart) etag() (etag string) {
+	if p.written != 0 {
+		p.complete()
+	}
+	return fmt.Sprintf("%x-%d", md5.Sum(p.sums), p.parts)
+}
+
+// Verifier computes the digests of the content written to it
+//
+type Verifier struct {
+	declared string
+	sum      string
+
+	digest hash.Hash
+	parts  int
+	etags  []*etagPart
+	sha256 hash.Hash
+	size   int64
+}
+
+// NewVerifier returns a Verifier for content with the declared hash, when no hash is declared
+// only the SHA256 of the content is computed
+//
+func NewVerifier(declared string) (v *Verifier, err kv.Error) {
+	v = &Verifier{
+		declared: declared,
+		sha256:   sha256.New(),
+	}
+	if len(declared) == 0 {
+		return v, nil
+	}
+
+	// ETags are quoted by S3 and can be supplied as they were received
+	algorithm, sum := "", strings.Trim(strings.ToLower(declared), "\"")
+	if pos := strings.Index(sum, ":"); pos != -1 {
+		algorithm, sum = sum[:pos], sum[pos+1:]
+	}
+	if pos := strings.Index(sum, "-"); pos != -1 && (algorithm == "" || algorithm == "etag") {
+		parts, errGo := strconv.Atoi(sum[pos+1:])
+		if errGo != nil || parts < 1 {
+			return nil, kv.NewError("artifact etag parts invalid").With("hash", declared).With("stack", stack.Trace().TrimRuntime())
+		}
+		algorithm, sum, v.parts = "etag", sum[:pos], parts
+	}
+	if v.digest, err = newDigest(algorithm, sum, declared); err != nil {
+		return nil, err
+	}
+	v.sum = sum
+	if v.parts != 0 {
+		v.digest = nil
+		v.sum = sum + "-" + strconv.Itoa(v.parts)
+		for _, size := range etagPartSizes {
+			v.etags = append(v.etags, &etagPart{size: size * 1024 * 1024, part: md5.New()})
+		}
+	}
+	return v, nil
+}
+
+// Write passes content through the digests
+//
+func (v *Verifier) Write(p []byte) (n int, err error) {
+	v.size += int64(len(p))
+	v.sha256.Write(p)
+	if v.digest != nil {
+		v.digest.Write(p)
+	}
+	etags := v.etags[:0]
+	for _, etag := range v.etags {
+		// Part sizes that would need more parts than the ETag has are abandoned
+		if etag.size*int64(v.parts) < v.size {
+			continue
+		}
+		etag.write(p)
+		etags = append(etags, etag)
+	}
+	v.etags = etags
+	return len(p), nil
+}
+
+// Reset discards the content written so far so that the Verifier can be used with a fresh download
+//
+func (v *Verifier) Reset() {
+	fresh, _ := NewVerifier(v.declared)
+	*v = *fresh
+}
+
+// Declared returns the hash that was declared for the content
+//
+func (v *Verifier) Declared() (declared string) {
+	return v.declared
+}
+
+// SHA256 returns the hex encoded SHA256 of the content written to the Verifier
+//
+func (v *Verifier) SHA256() (sum string) {
+	return hex.EncodeToString(v.sha256.Sum(nil))
+}
+
+// Verify checks the content written to the Verifier against the declared hash, a nil error
+// is returned when no hash was declared
+//
+func (v *Verifier) Verify() (err kv.Error) {
+	if len(v.declared) == 0 {
+		return nil
+	}
+	actual := ""
+	if v.digest != nil {
+		actual = hex.EncodeToString(v.digest.Sum(nil))
+	}
+	for _, etag := range v.etags {
+		if actual = etag.etag(); actual == v.sum {
+			break
+		}
+	}
+	if actual != v.sum {
+		return kv.Wrap(ErrMismatch).With("expected", v.declared, "actual", actual).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package integrity
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// etag computes the S3 ETag of content uploaded in parts of the specified size
+func etag(data []byte, partSize int) (tag string) {
+	sums := []byte{}
+	parts := 0
+	for i := 0; i < len(data); i += partSize {
+		end := i + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[i:end])
+		sums = append(sums, sum[:]...)
+		parts++
+	}
+	return fmt.Sprintf("\"%x-%d\"", md5.Sum(sums), parts)
+}
+
+// TestVerifier checks that content is verified against the supported hash formats, and that
+// content which has been changed is reported as a mismatch
+func TestVerifier(t *testing.T) {
+	data := make([]byte, 11*1024*1024+7)
+	rand.Read(data)
+
+	md5Sum := md5.Sum(data)
+	shaSum := sha256.Sum256(data)
+
+	declared := []string{
+		hex.EncodeToString(shaSum[:]),
+		"sha256:" + hex.EncodeToString(shaSum[:]),
+		"MD5:" + hex.EncodeToString(md5Sum[:]),
+		hex.EncodeToString(md5Sum[:]),
+		etag(data, 5*1024*1024),
+		etag(data, 8*1024*1024),
+	}
+
+	for _, hash := range declared {
+		v, err := NewVerifier(hash)
+		if err != nil {
+			t.Fatal(hash, err)
+		}
+		// Write in odd sized pieces to exercise the part boundaries
+		for i := 0; i < len(data); i += 100003 {
+			end := i + 100003
+			if end > len(data) {
+				end = len(data)
+			}
+			v.Write(data[i:end])
+		}
+		if err = v.Verify(); err != nil {
+			t.Fatal(hash, err)
+		}
+		if v.SHA256() != hex.EncodeToString(shaSum[:]) {
+			t.Fatal(hash, "sha256 incorrect", v.SHA256())
+		}
+
+		// Content that has been changed must be detected
+		v.Reset()
+		v.Write(data[1:])
+		err = v.Verify()
+		if err == nil {
+			t.Fatal(hash, "mismatch not detected")
+		}
+		if !IsMismatch(err) {
+			t.Fatal(hash, "mismatch not identified", err)
+		}
+	}
+
+	for _, hash := range []string{"sha256:1234", "zz", "crc:" + hex.EncodeToString(md5Sum[:]), hex.EncodeToString(md5Sum[:]) + "-x"} {
+		if _, err := NewVerifier(hash); err == nil {
+			t.Fatal(hash, "invalid hash accepted")
+		}
+	}
+}
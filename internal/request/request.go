@@ -12,6 +12,8 @@ package request
 
 import (
 	"encoding/json"
+	"path"
+	"strings"
 
 	"github.com/go-stack/stack"
 	"github.com/jjeffery/kv" // MIT License
@@ -30,6 +32,7 @@ type Config struct {
 	Env                    map[string]string `json:"env"`
 	Pip                    []string          `json:"pip"`
 	Runner                 RunnerCustom      `json:"runner"`
+	GracePeriod            string            `json:"terminationGracePeriod"`
 }
 
 // RunnerCustom defines a custom type of resource used by the go runner to implement a slack
@@ -56,6 +59,7 @@ type Database struct {
 type Experiment struct {
 	Args               []string            `json:"args"`
 	Artifacts          map[string]Artifact `json:"artifacts"`
+	Container          string              `json:"container,omitempty"`
 	Filename           string              `json:"filename"`
 	Git                interface{}         `json:"git"`
 	Info               Info                `json:"info"`
@@ -119,6 +123,74 @@ type Credentials struct {
 	AWS   *AWSCredential   `json:"aws"`
 }
 
+// MountReadOnly is the artifact mount mode used for immutable artifacts that are unpacked
+// once and shared, read only, between experiments
+const MountReadOnly = "readonly"
+
+// keyGlobChars are the characters that mark an artifact key as a glob pattern
+const keyGlobChars = "*?["
+
+// KeyPattern splits a key that selects multiple objects into the literal prefix used to list the
+// objects and the glob pattern, if any, that the keys of the listed objects must match.  Glob
+// characters escaped using a \ are treated as being part of the literal prefix.
+func KeyPattern(key string) (prefix string, pattern string) {
+	literal := strings.Builder{}
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; {
+		case c == '\\' && i+1 < len(key):
+			i++
+			literal.WriteByte(key[i])
+		case strings.IndexByte(keyGlobChars, c) != -1:
+			return literal.String(), key
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	return literal.String(), ""
+}
+
+// QuoteKey escapes the glob characters within a key so that it is used as a literal prefix
+func QuoteKey(key string) (quoted string) {
+	escaped := strings.Builder{}
+	for i := 0; i < len(key); i++ {
+		if strings.IndexByte(keyGlobChars+"\\", key[i]) != -1 {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteByte(key[i])
+	}
+	return escaped.String()
+}
+
+// MatchKeys returns the keys that match a glob pattern, using the syntax of path.Match
+func MatchKeys(keys []string, pattern string) (matched []string) {
+	for _, key := range keys {
+		if isMatch, _ := path.Match(pattern, key); isMatch {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+// GatheredPath returns the path, relative to the directory objects are gathered into, for an
+// object selected by a key prefix or glob pattern.  The path of the key beneath the prefix, or
+// beneath the directory containing a glob pattern, is retained.  Keys that would be placed
+// outside of the directory are rejected.
+func GatheredPath(keyPrefix string, key string) (rel string, ok bool) {
+	prefix, pattern := KeyPattern(keyPrefix)
+	if len(pattern) != 0 {
+		prefix = prefix[:strings.LastIndex(prefix, "/")+1]
+	}
+	rel = strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/")
+	if len(rel) == 0 {
+		rel = path.Base(key)
+	}
+	rel = path.Clean(rel)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
 // Artifact is a marshalled component of a StudioML experiment definition that
 // is used to encapsulate files and other external data sources
 // that the runner retrieve and/or upload as the experiment progresses
@@ -129,20 +201,51 @@ type Artifact struct {
 	Local       string      `json:"local,omitempty"`
 	Mutable     bool        `json:"mutable"`
 	Unpack      bool        `json:"unpack"`
+	Compression string      `json:"compression,omitempty"`
+	Incremental bool        `json:"incremental,omitempty"`
+	Mount       string      `json:"mount,omitempty"`
+	Encrypt     bool        `json:"encrypt,omitempty"`
+	DataKey     string      `json:"data_key,omitempty"`
+	Glob        bool        `json:"glob,omitempty"`
+	Include     []string    `json:"include,omitempty"`
+	Exclude     []string    `json:"exclude,omitempty"`
 	Qualified   string      `json:"qualified"`
 	Credentials Credentials `json:"credentials"`
 }
 
+// IsGathered returns true when the key of the artifact selects multiple objects, being either a
+// prefix ending with a / or, when the glob flag is set, a glob pattern
+func (a *Artifact) IsGathered() bool {
+	return strings.HasSuffix(a.Key, "/") || (a.Glob && strings.ContainsAny(a.Key, keyGlobChars))
+}
+
+// GatherKey returns the key passed to the storage platform to gather the objects selected by the
+// artifact, glob characters being escaped when the glob flag is not set
+func (a *Artifact) GatherKey() (key string) {
+	if a.Glob {
+		return a.Key
+	}
+	return QuoteKey(a.Key)
+}
+
 // Clone is a full on duplication of the original artifact
 func (a *Artifact) Clone() (b *Artifact) {
 	b = &Artifact{
-		Bucket:    a.Bucket[:],
-		Key:       a.Key[:],
-		Hash:      a.Hash[:],
-		Local:     a.Local[:],
-		Mutable:   a.Mutable,
-		Unpack:    a.Unpack,
-		Qualified: a.Qualified[:],
+		Bucket:      a.Bucket[:],
+		Key:         a.Key[:],
+		Hash:        a.Hash[:],
+		Local:       a.Local[:],
+		Mutable:     a.Mutable,
+		Unpack:      a.Unpack,
+		Compression: a.Compression[:],
+		Incremental: a.Incremental,
+		Mount:       a.Mount[:],
+		Encrypt:     a.Encrypt,
+		DataKey:     a.DataKey[:],
+		Glob:        a.Glob,
+		Include:     append([]string{}, a.Include...),
+		Exclude:     append([]string{}, a.Exclude...),
+		Qualified:   a.Qualified[:],
 	}
 	b.Credentials = Credentials{}
 	if a.Credentials.Plain != nil {
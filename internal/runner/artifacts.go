@@ -10,14 +10,14 @@ package runner
 //
 import (
 	"context"
+	"crypto/rsa"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 
-	"github.com/leaf-ai/go-service/pkg/archive"
-
+	"github.com/leaf-ai/studio-go-runner/internal/archives"
 	"github.com/leaf-ai/studio-go-runner/internal/request"
 
 	hasher "github.com/karlmutch/hashstructure"
@@ -31,6 +31,12 @@ import (
 //
 type ArtifactCache struct {
 	upHashes map[string]uint64
+	// manifests contains the most recent manifest of incremental artifacts
+	manifests map[string]*Manifest
+	// mounts contains the read only artifacts in use by each experiment directory
+	mounts map[string][]mountRef
+	// provenance contains the artifacts used, and produced, by each experiment directory
+	provenance map[string]*Provenance
 	sync.Mutex
 
 	// This can be used by the application layer to receive diagnostic and other information
@@ -46,8 +52,11 @@ type ArtifactCache struct {
 //
 func NewArtifactCache() (cache *ArtifactCache) {
 	return &ArtifactCache{
-		upHashes: map[string]uint64{},
-		ErrorC:   make(chan kv.Error),
+		upHashes:   map[string]uint64{},
+		manifests:  map[string]*Manifest{},
+		mounts:     map[string][]mountRef{},
+		provenance: map[string]*Provenance{},
+		ErrorC:     make(chan kv.Error),
 	}
 }
 
@@ -136,6 +145,15 @@ func (cache *ArtifactCache) Fetch(ctx context.Context, art *request.Artifact, pr
 		return 0, warns, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dest", dest)
 	}
 
+	// The include and exclude paths select the files that are unpacked from archives
+	filter, err := archives.NewFilter(art.Include, art.Exclude)
+	if err != nil {
+		return 0, warns, err.With("group", group)
+	}
+	if filter != nil && !art.Unpack {
+		warns = append(warns, kv.NewError("include and exclude paths are only applied to unpacked artifacts").With("stack", stack.Trace().TrimRuntime()))
+	}
+
 	storage, err := NewObjStore(
 		ctx,
 		&StoreOpts{
@@ -151,24 +169,65 @@ func (cache *ArtifactCache) Fetch(ctx context.Context, art *request.Artifact, pr
 		return 0, warns, err
 	}
 
-	if art.Unpack && !archive.IsTar(art.Key) {
-		return 0, warns, kv.NewError("the unpack flag was set for an unsupported file format (tar gzip/bzip2 only supported)").With("stack", stack.Trace().TrimRuntime())
+	if art.Unpack && !art.Incremental && !art.IsGathered() && !archives.IsArchive(art.Key) && len(art.Compression) == 0 {
+		return 0, warns, kv.NewError("the unpack flag was set for an unsupported file format (tar gzip/bzip2/zstd/xz and zip only supported)").With("stack", stack.Trace().TrimRuntime())
 	}
 
+	// Warnings raised before the download are retained along with those from the download
+	prior := warns
 	switch group {
 	case "_metadata":
 		//The following is disabled until we look into how to efficiently do downloads of
 		// experiment related retries rather than downloading an entire hosts worth of activity
 		// size, warns, err = storage.Gather(ctx, "metadata/", dest)
 	default:
+		if art.IsGathered() {
+			if art.Mutable || art.Incremental || len(art.DataKey) != 0 {
+				err = kv.NewError("prefix and glob keys are only supported for immutable artifacts that are neither incremental nor encrypted").With("key", art.Key).With("stack", stack.Trace().TrimRuntime())
+				break
+			}
+			size, warns, err = fetchGathered(ctx, storage, art, dest, maxBytes, filter)
+			break
+		}
+		if art.Mount == request.MountReadOnly {
+			if !art.Mutable && art.Unpack && len(art.DataKey) == 0 && filter == nil && len(mountCacheRoot()) != 0 {
+				size, warns, err = cache.fetchMount(ctx, storage, art.Key, dir, dest, maxBytes)
+				break
+			}
+			prior = append(prior, kv.NewError("read only mount requires an immutable unpacked unencrypted artifact without include or exclude paths and the cache-dir option, copying instead").With("stack", stack.Trace().TrimRuntime()))
+		}
+		if len(art.DataKey) != 0 {
+			size, warns, err = fetchEncrypted(ctx, storage, art, dest, maxBytes, filter)
+			break
+		}
+		if art.Incremental {
+			var manifest *Manifest
+			if manifest, size, warns, err = fetchIncremental(ctx, storage, art.Key, dest, maxBytes); err != nil {
+				break
+			}
+			if manifest != nil {
+				cache.setManifest(dest, manifest)
+				break
+			}
+			// Artifacts without a manifest were uploaded as a single archive
+		}
+		if art.Unpack && filter != nil {
+			size, warns, err = fetchSelected(ctx, storage, art, dest, maxBytes, filter)
+			break
+		}
 		size, warns, err = storage.Fetch(ctx, art.Key, art.Unpack, dest, maxBytes)
 	}
 	storage.Close()
+	warns = append(prior, warns...)
 
 	if err != nil {
 		return 0, warns, err
 	}
 
+	if group != "_metadata" {
+		cache.record(dir, group, newProvenanceEntry(art, storage), false)
+	}
+
 	// Immutable artifacts need just to be downloaded and nothing else
 	if !art.Mutable && !strings.HasPrefix(art.Qualified, "file://") {
 		return size, warns, nil
@@ -199,6 +258,18 @@ func (cache *ArtifactCache) updateHash(dir string) (err kv.Error) {
 	return nil
 }
 
+func (cache *ArtifactCache) manifest(dir string) (manifest *Manifest) {
+	cache.Lock()
+	defer cache.Unlock()
+	return cache.manifests[dir]
+}
+
+func (cache *ArtifactCache) setManifest(dir string, manifest *Manifest) {
+	cache.Lock()
+	cache.manifests[dir] = manifest
+	cache.Unlock()
+}
+
 func (cache *ArtifactCache) checkHash(dir string) (isValid bool, err kv.Error) {
 
 	cache.Lock()
@@ -229,7 +300,7 @@ func (cache *ArtifactCache) Local(group string, dir string, file string) (fn str
 
 // Restore the artifacts that have been marked mutable and that have changed
 //
-func (cache *ArtifactCache) Restore(ctx context.Context, art *request.Artifact, projectId string, group string, env map[string]string, dir string) (uploaded bool, warns []kv.Error, err kv.Error) {
+func (cache *ArtifactCache) Restore(ctx context.Context, art *request.Artifact, projectId string, group string, env map[string]string, dir string, sealKey *rsa.PublicKey) (uploaded bool, warns []kv.Error, err kv.Error) {
 
 	// Immutable artifacts need just to be downloaded and nothing else
 	if !art.Mutable {
@@ -280,11 +351,39 @@ func (cache *ArtifactCache) Restore(ctx context.Context, art *request.Artifact,
 			}
 		}
 	default:
+		if art.IsGathered() {
+			return false, warns, kv.NewError("prefix and glob keys cannot be uploaded").With(kvDetails...).With("stack", stack.Trace().TrimRuntime())
+		}
+		if art.Encrypt {
+			if art.Incremental {
+				warns = append(warns, kv.NewError("encrypted artifacts are uploaded as a single archive, incremental ignored").With(kvDetails...))
+			}
+			w, err := depositEncrypted(ctx, storage, art, source, sealKey)
+			warns = append(warns, w...)
+			if err != nil {
+				return false, warns, err.With("group", group)
+			}
+			break
+		}
+		if art.Incremental {
+			// Only the files that changed since the previous checkpoint are uploaded
+			manifest, w, err := depositIncremental(ctx, storage, art.Key, source, cache.manifest(source))
+			warns = append(warns, w...)
+			if err != nil {
+				return false, warns, err.With("group", group)
+			}
+			cache.setManifest(source, manifest)
+			break
+		}
 		if warns, err = storage.Deposit(ctx, source, art.Key); err != nil {
 			return false, warns, err.With("group", group)
 		}
 	}
 
+	if group != "_metadata" {
+		cache.recordOutput(ctx, storage, art, group, dir)
+	}
+
 	if errHash == nil {
 		// Having obtained the artifact if it is mutable then we add a set of upload area hashes for all files and directories the artifact included
 		cache.Lock()
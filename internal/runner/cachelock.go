@@ -0,0 +1,155 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the advisory file locks used to share the artifact cache directory between
+// runners on the same node.  Downloads are serialized using exclusive locks on lock files within
+// the partial downloads directory, and blobs being read from the cache are protected from
+// being groomed using shared locks on the blob files.  Locks are released by the operating
+// system if a runner exits without releasing them.
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	// lockSuffix is appended to the name of a partial download to name its lock file
+	lockSuffix = ".lock"
+)
+
+// sameFile checks that the locked file is still the file found at its path, files can be
+// removed, or replaced, between being opened and the lock being obtained
+//
+func sameFile(lock *os.File) bool {
+	locked, errGo := lock.Stat()
+	if errGo != nil {
+		return false
+	}
+	current, errGo := os.Stat(lock.Name())
+	if errGo != nil {
+		return false
+	}
+	return os.SameFile(locked, current)
+}
+
+// lockShared obtains a shared lock on an existing file, waiting for any exclusive lock to be
+// released.  A nil lock is returned when the file does not exist.
+//
+func lockShared(fn string) (lock *os.File, err kv.Error) {
+	lock, errGo := os.Open(fn)
+	if errGo != nil {
+		if os.IsNotExist(errGo) {
+			return nil, nil
+		}
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = syscall.Flock(int(lock.Fd()), syscall.LOCK_SH); errGo != nil {
+		lock.Close()
+		return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if !sameFile(lock) {
+		unlock(lock)
+		return nil, nil
+	}
+	return lock, nil
+}
+
+// lockSharedWait obtains a shared lock on a lock file, creating it if needed, and waits for
+// any exclusive lock to be released, or the context to be cancelled
+//
+func lockSharedWait(ctx context.Context, fn string) (lock *os.File, err kv.Error) {
+	for {
+		lock, errGo := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600)
+		if errGo != nil {
+			return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		for {
+			errGo = syscall.Flock(int(lock.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+			if !errors.Is(errGo, syscall.EWOULDBLOCK) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				lock.Close()
+				return nil, kv.Wrap(ctx.Err()).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+			case <-time.After(time.Second):
+			}
+		}
+		if errGo != nil {
+			lock.Close()
+			return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if sameFile(lock) {
+			return lock, nil
+		}
+		// A lock file that was removed by its previous holder is replaced by a new one
+		unlock(lock)
+	}
+}
+
+// downgrade converts an exclusive lock into a shared lock, the conversion is not atomic
+// so callers should check the state protected by the lock once this returns
+//
+func downgrade(lock *os.File) (err kv.Error) {
+	if errGo := syscall.Flock(int(lock.Fd()), syscall.LOCK_SH); errGo != nil {
+		return kv.Wrap(errGo).With("file", lock.Name()).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// tryLockExclusive obtains an exclusive lock on a file without waiting.  When create is true
+// the file is created if needed, otherwise a nil lock is returned for files that do not exist.
+// A nil lock is also returned when the lock is held by another runner, or goroutine.
+//
+func tryLockExclusive(fn string, create bool) (lock *os.File, err kv.Error) {
+	flags := os.O_RDONLY
+	if create {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	for {
+		lock, errGo := os.OpenFile(fn, flags, 0600)
+		if errGo != nil {
+			if os.IsNotExist(errGo) && !create {
+				return nil, nil
+			}
+			return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if errGo = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); errGo != nil {
+			lock.Close()
+			if errors.Is(errGo, syscall.EWOULDBLOCK) {
+				return nil, nil
+			}
+			return nil, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+		if sameFile(lock) {
+			return lock, nil
+		}
+		unlock(lock)
+		// A lock file that was removed by its previous holder is replaced by a new one
+		if !create {
+			return nil, nil
+		}
+	}
+}
+
+// unlock releases a lock
+//
+func unlock(lock *os.File) {
+	_ = syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	lock.Close()
+}
+
+// unlockRemove removes a lock file and then releases the lock, other holders that opened the
+// file before it was removed will detect this and retry using a new lock file
+//
+func unlockRemove(lock *os.File) {
+	_ = os.Remove(lock.Name())
+	unlock(lock)
+}
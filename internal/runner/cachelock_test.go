@@ -0,0 +1,111 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/kv" // MIT License
+	"github.com/karlmutch/ccache"
+)
+
+// TestCacheLocks checks the locks used to coordinate runners sharing a cache directory
+func TestCacheLocks(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "cache-locks")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only one downloader can hold the lock for a partial download
+	lockName := filepath.Join(dir, "hash"+lockSuffix)
+	first, err := tryLockExclusive(lockName, true)
+	if err != nil || first == nil {
+		t.Fatal("lock was not obtained", err)
+	}
+	if second, err := tryLockExclusive(lockName, true); err != nil || second != nil {
+		t.Fatal("lock was obtained twice", err)
+	}
+	unlockRemove(first)
+	if _, errGo = os.Stat(lockName); !os.IsNotExist(errGo) {
+		t.Fatal("lock file was retained", errGo)
+	}
+	second, err := tryLockExclusive(lockName, true)
+	if err != nil || second == nil {
+		t.Fatal("released lock was not obtained", err)
+	}
+	unlockRemove(second)
+
+	// Blobs being read cannot be removed
+	blob := filepath.Join(dir, "blob")
+	if errGo = ioutil.WriteFile(blob, []byte("blob"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	reader, err := lockShared(blob)
+	if err != nil || reader == nil {
+		t.Fatal("shared lock was not obtained", err)
+	}
+	if removed, err := removeBlob(blob); err != nil || removed {
+		t.Fatal("blob being read was removed", err)
+	}
+	unlock(reader)
+	if removed, err := removeBlob(blob); err != nil || !removed {
+		t.Fatal("blob was not removed", err)
+	}
+	if reader, err = lockShared(blob); err != nil || reader != nil {
+		t.Fatal("missing blob was locked", err)
+	}
+}
+
+// TestCacheShared checks that grooming retains blobs downloaded, or in use, by other runners
+func TestCacheShared(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "cache-shared")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	savedCache := cache
+	defer func() {
+		cache = savedCache
+	}()
+	cache = ccache.New(ccache.Configure().MaxSize(1024 * 1024).GetsPerPromote(1).ItemsToPrune(1))
+	defer cache.Stop()
+
+	old := time.Now().Add(-2 * cacheTTL)
+	for _, name := range []string{"recent", "old", "reading"} {
+		fn := filepath.Join(dir, name)
+		if errGo = ioutil.WriteFile(fn, []byte(name), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+		if name != "recent" {
+			if errGo = os.Chtimes(fn, old, old); errGo != nil {
+				t.Fatal(errGo)
+			}
+		}
+	}
+	reader, err := lockShared(filepath.Join(dir, "reading"))
+	if err != nil || reader == nil {
+		t.Fatal("shared lock was not obtained", err)
+	}
+	defer unlock(reader)
+
+	removedC := make(chan os.FileInfo, 3)
+	errorC := make(chan kv.Error, 3)
+	groom(dir, removedC, errorC)
+
+	expected := map[string]bool{"recent": true, "old": false, "reading": true}
+	for name, retained := range expected {
+		_, errGo := os.Stat(filepath.Join(dir, name))
+		if retained != (errGo == nil) {
+			t.Fatal("unexpected grooming", name, errGo)
+		}
+	}
+	if item := cache.Sample("recent"); item == nil || item.Expired() {
+		t.Fatal("blob from another runner was not adopted")
+	}
+}
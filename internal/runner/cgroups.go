@@ -0,0 +1,277 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of cgroup v2 based enforcement of the resource
+// limits the runner allocates to experiments.  Each experiment is placed into its own
+// cgroup named using the accession ID of the experiment with the CPU, memory and process
+// limits set from the resources allocated to it.
+//
+// Controllers can only be delegated by cgroups that do not contain processes, so when the
+// runner is within the parent of the cgroup root, as is the case when it is the main process
+// of a container, the processes of the parent are first moved into a leaf cgroup.
+
+import (
+	"bufio"
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/resources"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	cgroupRootOpt = flag.String("cgroup-root", "/sys/fs/cgroup/studioml", "the cgroup v2 directory under which per experiment cgroups are created to enforce resource limits, an empty string disables enforcement")
+	cgroupPidsOpt     = flag.Uint("cgroup-pids-max", 8192, "the maximum number of processes and threads an experiment can have when cgroup enforcement is enabled, 0 for no limit")
+	cgroupRequiredOpt = flag.Bool("cgroup-required", false, "fail experiments whose resource limits cannot be applied using cgroups rather than running them without enforcement")
+
+	cgroupFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_cgroup_failures",
+			Help: "Number of experiments whose resource limits could not be applied using cgroups.",
+		},
+		[]string{"host"},
+	)
+
+	// cgroupDelegation serializes the moving of processes and the delegation of controllers
+	cgroupDelegation sync.Mutex
+)
+
+func init() {
+	prometheus.MustRegister(cgroupFailures)
+}
+
+const (
+	// cgroupCPUPeriod is the scheduling period, in microseconds, that the CPU quota is measured against
+	cgroupCPUPeriod = 100000
+
+	// cgroupControllers are the controllers delegated to the experiment cgroups
+	cgroupControllers = "+cpu +memory +pids"
+
+	// cgroupRunnerLeaf is the name of the cgroup, created alongside the cgroup root, into which
+	// processes are moved when they are within the parent of the cgroup root
+	cgroupRunnerLeaf = "studioml-runner"
+)
+
+// Cgroup represents a cgroup v2 directory into which the processes of a single
+// experiment are placed
+//
+type Cgroup struct {
+	Dir string // The full path of the cgroup directory within the cgroup v2 file system
+}
+
+// cgroupsAvailable checks that the parent of the cgroup root directory is within a
+// cgroup v2 unified hierarchy
+//
+func cgroupsAvailable(root string) (available bool) {
+	if len(root) == 0 {
+		return false
+	}
+	_, errGo := os.Stat(filepath.Join(filepath.Dir(filepath.Clean(root)), "cgroup.controllers"))
+	return errGo == nil
+}
+
+func writeCgroupFile(dir string, name string, value string) (err kv.Error) {
+	fn := filepath.Join(dir, name)
+	if errGo := os.WriteFile(fn, []byte(value), 0644); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn, "value", value)
+	}
+	return nil
+}
+
+// vacate moves the processes within a non root cgroup into a leaf cgroup alongside the cgroup
+// root so that the cgroup is able to delegate controllers to its children.  The root of the
+// hierarchy, identified by its lack of a cgroup.type file, is exempt from this restriction.
+//
+func vacate(parent string) (err kv.Error) {
+	if _, errGo := os.Stat(filepath.Join(parent, "cgroup.type")); errGo != nil {
+		return nil
+	}
+
+	fn := filepath.Join(parent, "cgroup.procs")
+	procs, errGo := os.ReadFile(fn)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	pids := strings.Fields(string(procs))
+	if len(pids) == 0 {
+		return nil
+	}
+
+	leaf := filepath.Join(parent, cgroupRunnerLeaf)
+	if errGo := os.Mkdir(leaf, 0755); errGo != nil && !os.IsExist(errGo) {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dir", leaf)
+	}
+	for _, pid := range pids {
+		if err = writeCgroupFile(leaf, "cgroup.procs", pid); err != nil {
+			// Processes that have exited since the list was read cannot be moved
+			if _, errGo := os.Stat(filepath.Join("/proc", pid)); os.IsNotExist(errGo) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// delegate enables the controllers needed for enforcement within the parent of the cgroup
+// root and within the root itself, moving processes out of the parent if needed
+//
+func delegate(root string) (err kv.Error) {
+	cgroupDelegation.Lock()
+	defer cgroupDelegation.Unlock()
+
+	parent := filepath.Dir(filepath.Clean(root))
+	if err = vacate(parent); err != nil {
+		return err
+	}
+	if err = writeCgroupFile(parent, "cgroup.subtree_control", cgroupControllers); err != nil {
+		return err
+	}
+
+	if errGo := os.MkdirAll(root, 0755); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dir", root)
+	}
+
+	// The root does not contain processes itself and delegates the controllers
+	// needed for enforcement to the experiment cgroups
+	return writeCgroupFile(root, "cgroup.subtree_control", cgroupControllers)
+}
+
+// NewCgroup creates a cgroup for an experiment underneath the root directory and applies the
+// limits from the allocated resources.  If cgroup v2 is not available, or the root is empty, a nil
+// Cgroup is returned without an error to indicate that no enforcement will be done.  Failures to
+// apply limits when cgroup v2 is available are counted by the runner_cgroup_failures metric.
+//
+func NewCgroup(root string, id string, alloc *resources.Allocated) (cg *Cgroup, err kv.Error) {
+	if !cgroupsAvailable(root) {
+		return nil, nil
+	}
+
+	defer func() {
+		if err != nil {
+			cgroupFailures.With(prometheus.Labels{"host": host}).Inc()
+		}
+	}()
+
+	if err = delegate(root); err != nil {
+		return nil, err
+	}
+
+	cg = &Cgroup{
+		Dir: filepath.Join(root, id),
+	}
+	if errGo := os.Mkdir(cg.Dir, 0755); errGo != nil && !os.IsExist(errGo) {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dir", cg.Dir)
+	}
+
+	if err = cg.limit(alloc); err != nil {
+		cg.Remove()
+		return nil, err
+	}
+	return cg, nil
+}
+
+// limit applies the resource limits for the experiment to the cgroup
+//
+func (cg *Cgroup) limit(alloc *resources.Allocated) (err kv.Error) {
+	if alloc != nil && alloc.CPU != nil {
+		if alloc.CPU.Cores != 0 {
+			quota := strconv.FormatUint(uint64(alloc.CPU.Cores)*cgroupCPUPeriod, 10) + " " + strconv.Itoa(cgroupCPUPeriod)
+			if err = writeCgroupFile(cg.Dir, "cpu.max", quota); err != nil {
+				return err
+			}
+		}
+		if alloc.CPU.Mem != 0 {
+			if err = writeCgroupFile(cg.Dir, "memory.max", strconv.FormatUint(alloc.CPU.Mem, 10)); err != nil {
+				return err
+			}
+			// When the memory limit is reached kill all of the experiments processes
+			// rather than leaving it partially running
+			if err = writeCgroupFile(cg.Dir, "memory.oom.group", "1"); err != nil {
+				return err
+			}
+		}
+	}
+	if *cgroupPidsOpt != 0 {
+		if err = writeCgroupFile(cg.Dir, "pids.max", strconv.FormatUint(uint64(*cgroupPidsOpt), 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enter returns a shell command that will move the shell running it, and all
+// processes it subsequently starts, into the cgroup
+//
+func (cg *Cgroup) Enter() (cmd string) {
+	if cg == nil {
+		return ""
+	}
+	return "echo $$ > " + filepath.Join(cg.Dir, "cgroup.procs") + "; "
+}
+
+// OOMKills returns the number of processes within the cgroup that have been killed
+// by the kernel OOM killer as a result of reaching the memory limit
+//
+func (cg *Cgroup) OOMKills() (kills uint64, err kv.Error) {
+	if cg == nil {
+		return 0, nil
+	}
+	fn := filepath.Join(cg.Dir, "memory.events")
+	f, errGo := os.Open(fn)
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 || fields[0] != "oom_kill" {
+			continue
+		}
+		if kills, errGo = strconv.ParseUint(fields[1], 10, 64); errGo != nil {
+			return 0, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+		}
+		return kills, nil
+	}
+	if errGo = s.Err(); errGo != nil {
+		return 0, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	return 0, nil
+}
+
+// Remove will kill any processes that remain within the cgroup and then remove it
+//
+func (cg *Cgroup) Remove() (err kv.Error) {
+	if cg == nil {
+		return nil
+	}
+
+	// cgroup.kill is only present on newer kernels
+	if _, errGo := os.Stat(filepath.Join(cg.Dir, "cgroup.kill")); errGo == nil {
+		_ = writeCgroupFile(cg.Dir, "cgroup.kill", "1")
+	}
+
+	// Processes that have been killed take a short time to leave the cgroup
+	for i := 0; ; i++ {
+		errGo := os.Remove(cg.Dir)
+		if errGo == nil || os.IsNotExist(errGo) {
+			return nil
+		}
+		if i == 10 {
+			return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dir", cg.Dir)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
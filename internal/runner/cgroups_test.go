@@ -0,0 +1,95 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the cgroup v2 resource enforcement using a simulated cgroup file system.
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/leaf-ai/studio-go-runner/internal/cpu_resource"
+	"github.com/leaf-ai/studio-go-runner/internal/resources"
+)
+
+func TestCgroupLimits(t *testing.T) {
+	dir, errGo := os.MkdirTemp("", "cgroup-test")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	alloc := &resources.Allocated{
+		CPU: &cpu_resource.CPUAllocated{
+			Cores: 2,
+			Mem:   512 * 1024 * 1024,
+		},
+	}
+
+	// Without a cgroup v2 hierarchy enforcement is silently disabled
+	root := filepath.Join(dir, "studioml")
+	cg, err := NewCgroup(root, "accession", alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cg != nil {
+		t.Fatal("cgroup created without a cgroup v2 hierarchy")
+	}
+
+	// Simulate the unified hierarchy with the runner inside the non root parent of the cgroup root,
+	// as it is when running as the main process of a container
+	simulated := map[string]string{
+		"cgroup.controllers": "cpu memory pids",
+		"cgroup.type":        "domain",
+		"cgroup.procs":       strconv.Itoa(os.Getpid()) + "\n",
+	}
+	for name, value := range simulated {
+		if errGo = os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+	if cg, err = NewCgroup(root, "accession", alloc); err != nil {
+		t.Fatal(err)
+	}
+	if cg == nil {
+		t.Fatal("cgroup not created")
+	}
+
+	expected := map[string]string{
+		filepath.Join(dir, cgroupRunnerLeaf, "cgroup.procs"): strconv.Itoa(os.Getpid()),
+		filepath.Join(dir, "cgroup.subtree_control"):         "+cpu +memory +pids",
+		filepath.Join(root, "cgroup.subtree_control"):        "+cpu +memory +pids",
+		filepath.Join(cg.Dir, "cpu.max"):                     "200000 100000",
+		filepath.Join(cg.Dir, "memory.max"):                  "536870912",
+		filepath.Join(cg.Dir, "memory.oom.group"):            "1",
+	}
+	for fn, value := range expected {
+		data, errGo := os.ReadFile(fn)
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if string(data) != value {
+			t.Fatalf("unexpected value '%s' in %s, expected '%s'", string(data), fn, value)
+		}
+	}
+
+	if !strings.Contains(cg.Enter(), filepath.Join(cg.Dir, "cgroup.procs")) {
+		t.Fatalf("unexpected cgroup entry command '%s'", cg.Enter())
+	}
+
+	// The OOM kill count is reported by the kernel in the memory events
+	events := "low 0\nhigh 0\nmax 12\noom 2\noom_kill 1\n"
+	if errGo = os.WriteFile(filepath.Join(cg.Dir, "memory.events"), []byte(events), 0644); errGo != nil {
+		t.Fatal(errGo)
+	}
+	kills, err := cg.OOMKills()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kills != 1 {
+		t.Fatalf("unexpected OOM kill count %d", kills)
+	}
+}
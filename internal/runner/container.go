@@ -0,0 +1,306 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of an execution module for OCI container images
+// within the studioML go runner.  Experiments are run using a podman compatible command line
+// runtime, which in turn uses a low level OCI runtime such as runc or crun.
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/resources"
+
+	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	containerRuntimeOpt    = flag.String("container-runtime", "podman", "the podman compatible command used to run experiments packaged as OCI container images, for example podman, or docker")
+	containerOCIRuntimeOpt = flag.String("container-oci-runtime", "", "the low level OCI runtime, for example runc or crun, to be used by the container runtime, defaults to the container runtimes own configuration")
+)
+
+const (
+	// ContainerArtifact is the name of the artifact group used to specify the OCI image for an experiment
+	ContainerArtifact = "_container"
+
+	// containerMount is the directory within the container at which the experiment directory is mounted
+	containerMount = "/experiment"
+)
+
+// Container is a data structure that contains the description of an OCI container image based
+// experiment.  The handling of the runtime process is shared with the python virtual environment
+// executor with the container runtime being launched by the generated script.
+//
+type Container struct {
+	VirtualEnv
+	BaseDir    string // The experiment directory that is mounted into the container
+	Image      string // The OCI image reference for the experiment
+	Runtime    string // The podman compatible command used to run the container
+	OCIRuntime string // The low level OCI runtime the Runtime is to use, optional
+}
+
+// ContainerImage returns the OCI image reference the request specifies, if any
+//
+func ContainerImage(rqst *request.Request) (image string) {
+	if len(rqst.Experiment.Container) != 0 {
+		return rqst.Experiment.Container
+	}
+	if art, isPresent := rqst.Experiment.Artifacts[ContainerArtifact]; isPresent {
+		return art.Qualified
+	}
+	return ""
+}
+
+// NewContainer is used to instantiate an OCI container executor based upon a request, typically sent
+// across a go channel or similar
+//
+func NewContainer(rqst *request.Request, dir string, uniqueID string, responseQ chan<- *runnerReports.Report) (c *Container, err kv.Error) {
+
+	image := ContainerImage(rqst)
+	if len(image) == 0 {
+		return nil, kv.NewError("container image is missing").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	env, err := NewVirtualEnv(rqst, dir, uniqueID, responseQ)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Container{
+		VirtualEnv: *env,
+		BaseDir:    dir,
+		Image:      image,
+		Runtime:    *containerRuntimeOpt,
+		OCIRuntime: *containerOCIRuntimeOpt,
+	}, nil
+}
+
+// shellQuote returns a value quoted so that it is used as a single word by POSIX shells without
+// any expansion or interpretation of its contents
+//
+func shellQuote(value string) (quoted string) {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// containerGPUs returns the command line options that pass the GPUs allocated to an experiment
+// into its container.  Docker uses its --gpus option while podman, and other runtimes, use
+// the Container Device Interface names of the devices.
+//
+func containerGPUs(runtime string, alloc *resources.Allocated) (opts []string) {
+	devices := []string{}
+	seen := map[string]struct{}{}
+	for _, gpu := range alloc.GPU {
+		device := gpu.Env["NVIDIA_VISIBLE_DEVICES"]
+		if len(device) == 0 {
+			continue
+		}
+		if _, isPresent := seen[device]; isPresent {
+			continue
+		}
+		seen[device] = struct{}{}
+		devices = append(devices, device)
+	}
+	if len(devices) == 0 {
+		return opts
+	}
+
+	if filepath.Base(runtime) == "docker" {
+		return []string{"--gpus", `"device=` + strings.Join(devices, ",") + `"`}
+	}
+	for _, device := range devices {
+		opts = append(opts, "--device", "nvidia.com/gpu="+device)
+	}
+	return opts
+}
+
+// containerEnv produces the environment table for the container, only those variables
+// specified by the experimenter and those describing the allocated resources are used, the
+// environment of the runner itself is not passed into the container
+//
+func (c *Container) containerEnv(alloc *resources.Allocated) (envs []string) {
+	for k, v := range c.Request.Config.Env {
+		envs = append(envs, k+"="+v)
+	}
+	sort.Strings(envs)
+
+	envs = append(envs, "STUDIOML_EXPERIMENT="+c.Request.Experiment.Key)
+	envs = append(envs, "STUDIOML_HOME="+containerMount)
+
+	if alloc.CPU != nil && alloc.CPU.Cores > 1 {
+		envs = append(envs, "OPENMP=True")
+		envs = append(envs, "MKL_NUM_THREADS="+strconv.Itoa(int(alloc.CPU.Cores)-1))
+		envs = append(envs, "GOTO_NUM_THREADS="+strconv.Itoa(int(alloc.CPU.Cores)-1))
+		envs = append(envs, "OMP_NUM_THREADS="+strconv.Itoa(int(alloc.CPU.Cores)-1))
+	}
+
+	// Add GPU environment variables to the container environment table
+	return append(envs, gpuEnv(alloc)...)
+}
+
+// Make is used to generate the script that runs the container along with the environment
+// file for the experiment, and the entry point script used inside the container
+//
+func (c *Container) Make(alloc *resources.Allocated, e interface{}) (err kv.Error) {
+
+	// Retain the allocation so that limits can be enforced when the experiment is run
+	c.alloc = alloc
+
+	runnerDir := filepath.Dir(c.Script)
+
+	envFile := filepath.Join(runnerDir, "container.env")
+	envs := strings.Join(c.containerEnv(alloc), "\n") + "\n"
+	if errGo := ioutil.WriteFile(envFile, []byte(envs), 0600); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", envFile)
+	}
+
+	_, cfgPips, _, _ := pythonModules(c.Request, alloc)
+
+	params := struct {
+		C        *Container
+		Name     string
+		EnvFile  string
+		Mount    string
+		Entry    string
+		CPUs     uint
+		Memory   uint64
+		CfgPips  []string
+		Filename string
+		Args     []string
+		GPUs     []string
+	}{
+		C:        c,
+		Name:     c.name(),
+		EnvFile:  envFile,
+		Mount:    containerMount,
+		Entry:    filepath.Join(containerMount, filepath.Base(runnerDir), "entry.sh"),
+		CfgPips:  cfgPips,
+		Filename: c.Request.Experiment.Filename,
+		Args:     c.Request.Experiment.Args,
+		GPUs:     containerGPUs(c.Runtime, alloc),
+	}
+	if alloc.CPU != nil {
+		params.CPUs = alloc.CPU.Cores
+		params.Memory = alloc.CPU.Mem
+	}
+
+	// The entry point run inside the container installs any pips from the configuration and then
+	// runs the experiment in the same manner as the python virtual environment executor
+	funcs := template.FuncMap{"quote": shellQuote}
+
+	// All values taken from the request are quoted so that they cannot be interpreted by
+	// the shells running the scripts
+	entryTmpl, errGo := template.New("containerEntry").Funcs(funcs).Parse(
+		`#!/bin/sh
+cd {{.Mount}}/workspace
+{{if .CfgPips}}
+echo "installing cfg pips"
+python -m pip install {{range .CfgPips}} {{quote .}}{{end}}
+echo "finished installing cfg pips"
+{{end}}
+exec python {{quote .Filename}} {{range .Args}}{{quote .}} {{end}}
+`)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	content := new(bytes.Buffer)
+	if errGo = entryTmpl.Execute(content, params); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	entryFile := filepath.Join(runnerDir, "entry.sh")
+	if errGo = ioutil.WriteFile(entryFile, content.Bytes(), 0700); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("script", entryFile)
+	}
+
+	// The runner script launches the container runtime in the foreground, signals sent to the runtime
+	// by the runner when stopping experiments are forwarded by the runtime to the container.  The
+	// container is removed by Run should the runtime be killed before the container has stopped.
+	tmpl, errGo := template.New("containerRunner").Funcs(funcs).Parse(
+		`#!/bin/bash -x
+echo "{\"studioml\": {\"log\": [{\"ts\": \"` + "`" + `date -u -Ins` + "`" + `\", \"msg\":\"Init\"},{\"ts\":\"0\", \"msg\":\"\"}]}}" | jq -c '.'
+echo "{\"studioml\": {\"load_time\": \"` + "`" + `date '+%FT%T.%N%:z'` + "`" + `\"}}" | jq -c '.'
+echo "{\"studioml\": {\"host\": \"` + hostname + `\"}}" | jq -c '.'
+jq -n -c --arg key {{quote .C.Request.Experiment.Key}} '{"studioml": {"experiment": {"key": $key}}}'
+jq -n -c --arg image {{quote .C.Image}} '{"studioml": {"experiment": {"image": $image}}}'
+echo "{\"studioml\": {\"start_time\": \"` + "`" + `date '+%FT%T.%N%:z'` + "`" + `\"}}" | jq -c '.'
+echo "[{\"op\": \"add\", \"path\": \"/studioml/log/-\", \"value\": {\"ts\": \"` + "`" + `date -u -Ins` + "`" + `\", \"msg\":\"Start\"}}]" | jq -c '.'
+{{quote .C.Runtime}} {{if .C.OCIRuntime}}--runtime {{quote .C.OCIRuntime}} {{end}}run --rm --init --name {{quote .Name}} \
+    --env-file {{quote .EnvFile}} \
+    {{if .CPUs}}--cpus {{.CPUs}} {{end}}{{if .Memory}}--memory {{.Memory}} {{end}}\
+    {{range .GPUs}}{{quote .}} {{end}}\
+    --volume {{quote (print .C.BaseDir ":" .Mount)}} \
+    --workdir {{quote (print .Mount "/workspace")}} \
+    -- {{quote .C.Image}} /bin/sh {{quote .Entry}}
+result=$?
+echo $result
+echo "[{\"op\": \"add\", \"path\": \"/studioml/log/-\", \"value\": {\"ts\": \"` + "`" + `date -u -Ins` + "`" + `\", \"msg\":\"Stop\"}}]" | jq -c '.'
+echo "{\"studioml\": {\"stop_time\": \"` + "`" + `date '+%FT%T.%N%:z'` + "`" + `\"}}" | jq -c '.'
+exit $result
+`)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	content = new(bytes.Buffer)
+	if errGo = tmpl.Execute(content, params); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if errGo = ioutil.WriteFile(c.Script, content.Bytes(), 0700); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("script", c.Script)
+	}
+	return nil
+}
+
+// name returns the name given to the container of the experiment by the runtime
+//
+func (c *Container) name() (name string) {
+	return "studioml-" + c.uniqueID
+}
+
+// Run will run the experiment using the container runtime and then remove the container.  Containers
+// are run by a monitor process, such as conmon or dockerd, rather than by the runtime command that
+// the runner signals when terminating experiments.  Killing the runtime command at the end of the
+// grace period would otherwise leave the container running, and holding its resources, after the
+// runner has released them.
+//
+func (c *Container) Run(ctx context.Context, refresh map[string]request.Artifact) (err kv.Error) {
+	err = c.VirtualEnv.Run(ctx, refresh)
+
+	if errRemove := c.remove(); errRemove != nil {
+		if err == nil {
+			return errRemove
+		}
+		return err.With("remove_error", errRemove.Error())
+	}
+	return err
+}
+
+// remove will forcibly remove the container of the experiment, containers that were removed
+// by the runtime when they exited are ignored
+//
+func (c *Container) remove() (err kv.Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// #nosec
+	output, errGo := exec.CommandContext(ctx, c.Runtime, "rm", "-f", c.name()).CombinedOutput()
+	if errGo != nil && !strings.Contains(strings.ToLower(string(output)), "no such container") {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("container", c.name(), "output", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
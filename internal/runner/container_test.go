@@ -0,0 +1,243 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the OCI container executor using a fake container runtime.
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/cpu_resource"
+	"github.com/leaf-ai/studio-go-runner/internal/cuda"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/resources"
+)
+
+// fakeRuntime is a podman compatible runtime that echos the command line it was
+// given along with the environment file supplied to it
+const fakeRuntime = `#!/bin/bash
+echo "fake-runtime $@"
+while [[ $# -gt 0 ]]; do
+    if [[ "$1" == "--env-file" ]]; then
+        cat "$2"
+    fi
+    shift
+done
+`
+
+func TestContainerExecutor(t *testing.T) {
+	dir, errGo := os.MkdirTemp("", "container-test")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	exprDir := filepath.Join(dir, "experiment")
+	if errGo = os.MkdirAll(filepath.Join(exprDir, "workspace"), 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	runtime := filepath.Join(dir, "fake-runtime")
+	if errGo = os.WriteFile(runtime, []byte(fakeRuntime), 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	rqst := &request.Request{
+		Config: request.Config{
+			Env: map[string]string{"TEST_VAR": "test-value"},
+		},
+		Experiment: request.Experiment{
+			Key:       "container-experiment",
+			Filename:  "train.py",
+			Args:      []string{"--epochs", "1"},
+			Container: "example.com/studioml/test:1.0",
+		},
+	}
+
+	if image := ContainerImage(rqst); image != rqst.Experiment.Container {
+		t.Fatalf("unexpected container image '%s'", image)
+	}
+
+	c, err := NewContainer(rqst, exprDir, "accession", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Runtime = runtime
+	c.OCIRuntime = "crun"
+
+	alloc := &resources.Allocated{
+		CPU: &cpu_resource.CPUAllocated{
+			Cores: 2,
+			Mem:   1024 * 1024 * 1024,
+		},
+	}
+	if err = c.Make(alloc, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err = c.Run(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	output, errGo := os.ReadFile(filepath.Join(exprDir, "output", "output"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	expected := []string{
+		"fake-runtime --runtime crun run --rm --init --name studioml-accession",
+		"--cpus 2 --memory 1073741824",
+		"--volume " + exprDir + ":/experiment",
+		"--workdir /experiment/workspace",
+		"example.com/studioml/test:1.0 /bin/sh /experiment/_runner/entry.sh",
+		"TEST_VAR=test-value",
+		"STUDIOML_EXPERIMENT=container-experiment",
+		"OMP_NUM_THREADS=1",
+	}
+	for _, item := range expected {
+		if !strings.Contains(string(output), item) {
+			t.Fatalf("'%s' missing from output %s", item, string(output))
+		}
+	}
+
+	entry, errGo := os.ReadFile(filepath.Join(exprDir, "_runner", "entry.sh"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !strings.Contains(string(entry), "exec python 'train.py' '--epochs' '1'") {
+		t.Fatalf("unexpected container entry point %s", string(entry))
+	}
+
+	// Values from the request must not be interpreted by the shell launching the runtime
+	marker := filepath.Join(dir, "injected")
+	rqst.Experiment.Container = "example.com/studioml/test:1.0; touch " + marker
+	if c, err = NewContainer(rqst, exprDir, "accession", nil); err != nil {
+		t.Fatal(err)
+	}
+	c.Runtime = runtime
+	if err = c.Make(alloc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Run(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, errGo = os.Stat(marker); errGo == nil {
+		t.Fatal("container image was interpreted by the shell")
+	}
+}
+
+func TestContainerGPUs(t *testing.T) {
+	alloc := &resources.Allocated{
+		GPU: cuda.GPUAllocations{
+			&cuda.GPUAllocated{Env: map[string]string{"NVIDIA_VISIBLE_DEVICES": "GPU-1"}},
+			&cuda.GPUAllocated{Env: map[string]string{"NVIDIA_VISIBLE_DEVICES": "GPU-1"}},
+			&cuda.GPUAllocated{Env: map[string]string{"NVIDIA_VISIBLE_DEVICES": "GPU-2"}},
+		},
+	}
+
+	expected := map[string]string{
+		"podman":          "--device nvidia.com/gpu=GPU-1 --device nvidia.com/gpu=GPU-2",
+		"/usr/bin/docker": `--gpus "device=GPU-1,GPU-2"`,
+	}
+	for runtime, opts := range expected {
+		if found := strings.Join(containerGPUs(runtime, alloc), " "); found != opts {
+			t.Fatalf("unexpected GPU options '%s' for %s, expected '%s'", found, runtime, opts)
+		}
+	}
+
+	if opts := containerGPUs("podman", &resources.Allocated{}); len(opts) != 0 {
+		t.Fatalf("unexpected GPU options %v without GPUs", opts)
+	}
+}
+
+// detachedRuntime is a podman compatible runtime that runs its container in a session of its
+// own, as conmon does, recording the process of the container in the state directory so that
+// it can be removed
+const detachedRuntime = `#!/bin/bash
+state="$(dirname "$0")/state"
+mkdir -p "$state"
+if [[ "$1" == "rm" ]]; then
+    if [[ ! -f "$state/$3" ]]; then
+        echo "Error: no such container $3" >&2
+        exit 1
+    fi
+    kill -9 "$(cat "$state/$3")"
+    rm "$state/$3"
+    exit 0
+fi
+while [[ $# -gt 0 ]]; do
+    if [[ "$1" == "--name" ]]; then
+        name="$2"
+    fi
+    shift
+done
+setsid sleep 600 </dev/null >/dev/null 2>&1 &
+echo $! > "$state/$name"
+while kill -0 "$(cat "$state/$name")" 2>/dev/null; do
+    sleep 0.1
+done
+`
+
+func TestContainerKilled(t *testing.T) {
+	dir := t.TempDir()
+
+	exprDir := filepath.Join(dir, "experiment")
+	if errGo := os.MkdirAll(filepath.Join(exprDir, "workspace"), 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	runtime := filepath.Join(dir, "detached-runtime")
+	if errGo := os.WriteFile(runtime, []byte(detachedRuntime), 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	rqst := &request.Request{
+		Config: request.Config{
+			GracePeriod: "0s",
+		},
+		Experiment: request.Experiment{
+			Key:       "container-killed",
+			Filename:  "train.py",
+			Container: "example.com/studioml/test:1.0",
+		},
+	}
+
+	c, err := NewContainer(rqst, exprDir, "killed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Runtime = runtime
+	if err = c.Make(&resources.Allocated{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the container has started the experiment is stopped, killing the process group
+	// of the runtime command but not the container
+	state := filepath.Join(dir, "state", "studioml-killed")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			if _, errGo := os.Stat(state); errGo == nil {
+				cancel()
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	if err = c.Run(ctx, nil); err == nil {
+		t.Fatal("killed experiment did not fail")
+	}
+	if _, errGo := os.Stat(state); !os.IsNotExist(errGo) {
+		t.Fatalf("container was left running after the experiment was killed - %v", errGo)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of artifacts that are encrypted at rest within storage.
+// Artifacts are packed into an archive that is encrypted using a secret generated for each
+// upload, the secret is then sealed using the public key for the response queue of the
+// experiment and stored alongside the archive.  The owner of the matching private key unseals
+// the secret and supplies it within requests that download the artifact.
+
+import (
+	"context"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+
+	"github.com/leaf-ai/go-service/pkg/archive"
+
+	"github.com/leaf-ai/studio-go-runner/internal/archives"
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+)
+
+const (
+	// dataKeySuffix is appended to the key of an encrypted artifact to name the sealed secret
+	dataKeySuffix = ".datakey"
+)
+
+// fetchEncrypted downloads an encrypted artifact and decrypts it into the dest directory using
+// the secret carried by the artifact, unpacking the files selected by the filter if requested
+//
+func fetchEncrypted(ctx context.Context, storage incrStore, art *request.Artifact, dest string, maxBytes int64, filter *archives.Filter) (size int64, warns []kv.Error, err kv.Error) {
+
+	key, err := defense.ParseDataKey(art.DataKey)
+	if err != nil {
+		return 0, warns, err.With("key", art.Key)
+	}
+
+	staging, errGo := ioutil.TempDir(filepath.Dir(dest), ".encrypted-")
+	if errGo != nil {
+		return 0, warns, kv.Wrap(errGo).With("dir", filepath.Dir(dest)).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer os.RemoveAll(staging)
+
+	fn, _, warns, err := fetchSingle(ctx, storage, art.Key, staging, maxBytes)
+	if err != nil {
+		return 0, warns, err
+	}
+
+	file, errGo := os.Open(fn)
+	if errGo != nil {
+		return 0, warns, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer file.Close()
+
+	clear, err := defense.DecryptStream(file, key)
+	if err != nil {
+		return 0, warns, err.With("key", art.Key)
+	}
+
+	if art.Unpack {
+		fileType, warn := archives.FetchType(art.Key, art.Compression)
+		if warn != nil {
+			warns = append(warns, warn)
+		}
+		if size, err = archives.UnpackSelected(clear, fileType, dest, maxBytes, filter); err != nil {
+			return 0, warns, err.With("key", art.Key)
+		}
+		return size, warns, nil
+	}
+
+	outFN := filepath.Join(dest, filepath.Base(art.Key))
+	out, errGo := os.OpenFile(outFN, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if errGo != nil {
+		return 0, warns, kv.Wrap(errGo).With("file", outFN).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer out.Close()
+
+	if size, errGo = io.Copy(out, io.LimitReader(clear, maxBytes+1)); errGo != nil {
+		return 0, warns, kv.Wrap(errGo).With("file", outFN, "key", art.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+	if size > maxBytes {
+		return 0, warns, kv.NewError("artifact exceeded the maximum size").With("file", outFN, "max_bytes", maxBytes).With("stack", stack.Trace().TrimRuntime())
+	}
+	return size, warns, nil
+}
+
+// depositEncrypted packs and encrypts the src directory, and uploads it along with the sealed secret
+// needed to decrypt it
+//
+func depositEncrypted(ctx context.Context, storage incrStore, art *request.Artifact, src string, pub *rsa.PublicKey) (warns []kv.Error, err kv.Error) {
+
+	if pub == nil {
+		return warns, kv.NewError("encrypted artifacts require a response queue public key").With("key", art.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	fileType, err := archives.DepositType(art.Key, art.Compression)
+	if err != nil {
+		return warns, err.With("key", art.Key)
+	}
+
+	files, err := archive.NewTarWriter(src)
+	if err != nil {
+		return warns, err
+	}
+	if !files.HasFiles() {
+		warns = append(warns, kv.NewError("no files found").With("src", src).With("stack", stack.Trace().TrimRuntime()))
+		return warns, nil
+	}
+
+	// The encrypted archive is staged beside the source so that the upload can be retried by the
+	// storage implementation
+	staging, errGo := ioutil.TempDir(filepath.Dir(src), ".encrypted-")
+	if errGo != nil {
+		return warns, kv.Wrap(errGo).With("dir", filepath.Dir(src)).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer os.RemoveAll(staging)
+
+	key, err := defense.NewDataKey()
+	if err != nil {
+		return warns, err
+	}
+
+	fn := filepath.Join(staging, filepath.Base(art.Key))
+	if err = encryptArchive(fn, files, fileType, key); err != nil {
+		return warns, err.With("key", art.Key)
+	}
+
+	sealed, err := defense.SealDataKey(key, pub)
+	if err != nil {
+		return warns, err.With("key", art.Key)
+	}
+	if errGo = ioutil.WriteFile(fn+dataKeySuffix, []byte(sealed), 0600); errGo != nil {
+		return warns, kv.Wrap(errGo).With("file", fn+dataKeySuffix).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	return storage.Hoard(ctx, staging, filepath.Dir(art.Key))
+}
+
+// encryptArchive writes an encrypted archive of the files to the file fn
+//
+func encryptArchive(fn string, files *archive.TarWriter, fileType string, key [32]byte) (err kv.Error) {
+	out, errGo := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer out.Close()
+
+	w, err := defense.EncryptStream(out, key)
+	if err != nil {
+		return err
+	}
+	if err = archives.Pack(w, files, fileType); err != nil {
+		return err
+	}
+	if errGo = w.Close(); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = out.Close(); errGo != nil {
+		return kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+)
+
+// TestEncrypted uploads an encrypted artifact and checks that it is not stored in the clear,
+// and that it can be downloaded using the secret recovered with the private key
+func TestEncrypted(t *testing.T) {
+	ctx := context.Background()
+
+	dir, errGo := ioutil.TempDir("", "encrypted")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	prvKey, errGo := rsa.GenerateKey(rand.Reader, 2048)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	store := &dirStore{dir: filepath.Join(dir, "store")}
+	src := filepath.Join(dir, "experiment", "output")
+	for _, d := range []string{store.dir, src} {
+		if errGo = os.MkdirAll(d, 0700); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+	content := bytes.Repeat([]byte("sensitive training data "), 1024)
+	if errGo = ioutil.WriteFile(filepath.Join(src, "data.txt"), content, 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	art := &request.Artifact{
+		Key:         "output.tar",
+		Compression: "none",
+		Mutable:     true,
+		Unpack:      true,
+		Encrypt:     true,
+	}
+	if _, err := depositEncrypted(ctx, store, art, src, nil); err == nil {
+		t.Fatal("encrypted upload without a public key was accepted")
+	}
+	if _, err := depositEncrypted(ctx, store, art, src, &prvKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, errGo := ioutil.ReadFile(filepath.Join(store.dir, art.Key))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if bytes.Contains(stored, []byte("sensitive training data")) {
+		t.Fatal("artifact was stored in the clear")
+	}
+
+	sealed, errGo := ioutil.ReadFile(filepath.Join(store.dir, art.Key+dataKeySuffix))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	key, err := defense.UnsealDataKey(string(sealed), prvKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	art.DataKey = base64.StdEncoding.EncodeToString(key[:])
+
+	dest := filepath.Join(dir, "restored", "output")
+	if errGo = os.MkdirAll(dest, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, _, err = fetchEncrypted(ctx, store, art, dest, 1024*1024, nil); err != nil {
+		t.Fatal(err)
+	}
+	restored, errGo := ioutil.ReadFile(filepath.Join(dest, "data.txt"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !bytes.Equal(content, restored) {
+		t.Fatal("restored content differed")
+	}
+
+	// The wrong secret must not decrypt the artifact
+	key[0] ^= 0xff
+	art.DataKey = base64.StdEncoding.EncodeToString(key[:])
+	if _, _, err = fetchEncrypted(ctx, store, art, dest, 1024*1024, nil); err == nil {
+		t.Fatal("artifact was decrypted using the wrong secret")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of artifacts that select multiple objects using a key
+// prefix, or glob pattern, and of the selective unpacking of artifacts using the include and
+// exclude paths of the artifact.
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+
+	"github.com/leaf-ai/studio-go-runner/internal/archives"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+)
+
+// unpackFile unpacks the files selected by the filter from the downloaded archive fn, the key of
+// the archive and the compression of the artifact being used to determine the archive type when
+// the content of the archive is not recognized
+//
+func unpackFile(fn string, key string, compression string, dest string, maxBytes int64, filter *archives.Filter) (size int64, warns []kv.Error, err kv.Error) {
+	file, errGo := os.Open(fn)
+	if errGo != nil {
+		return 0, warns, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer file.Close()
+
+	fileType, warn := archives.FetchType(key, compression)
+	if warn != nil {
+		warns = append(warns, warn)
+	}
+	if size, err = archives.UnpackSelected(file, fileType, dest, maxBytes, filter); err != nil {
+		return 0, warns, err.With("key", key)
+	}
+	return size, warns, nil
+}
+
+// fetchSelected downloads an archive and unpacks the files selected by the filter into the dest directory
+//
+func fetchSelected(ctx context.Context, storage incrStore, art *request.Artifact, dest string, maxBytes int64, filter *archives.Filter) (size int64, warns []kv.Error, err kv.Error) {
+	staging, errGo := ioutil.TempDir(filepath.Dir(dest), ".selected-")
+	if errGo != nil {
+		return 0, warns, kv.Wrap(errGo).With("dir", filepath.Dir(dest)).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer os.RemoveAll(staging)
+
+	fn, _, warns, err := fetchSingle(ctx, storage, art.Key, staging, maxBytes)
+	if err != nil {
+		return 0, warns, err
+	}
+
+	size, w, err := unpackFile(fn, art.Key, art.Compression, dest, maxBytes, filter)
+	return size, append(warns, w...), err
+}
+
+// fetchGathered downloads the objects selected by an artifact key that is a prefix, or a glob
+// pattern, into the dest directory, retaining the path of each key beneath the prefix, or
+// unpacking each of them when requested.  The budget covers both
+// the downloaded objects and the files unpacked from them.
+//
+func fetchGathered(ctx context.Context, storage *objStore, art *request.Artifact, dest string, maxBytes int64, filter *archives.Filter) (size int64, warns []kv.Error, err kv.Error) {
+	staging, errGo := ioutil.TempDir(filepath.Dir(dest), ".gathered-")
+	if errGo != nil {
+		return 0, warns, kv.Wrap(errGo).With("dir", filepath.Dir(dest)).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer os.RemoveAll(staging)
+
+	gathered, warns, err := storage.Gather(ctx, art.GatherKey(), staging, maxBytes, true)
+	if err != nil {
+		return 0, warns, err.With("key", art.Key)
+	}
+
+	items, errGo := ioutil.ReadDir(staging)
+	if errGo != nil {
+		return 0, warns, kv.Wrap(errGo).With("dir", staging).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(items) == 0 {
+		return 0, warns, kv.NewError("no objects matched the artifact key").With("key", art.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if !art.Unpack {
+		for _, item := range items {
+			if errGo = os.Rename(filepath.Join(staging, item.Name()), filepath.Join(dest, item.Name())); errGo != nil {
+				return 0, warns, kv.Wrap(errGo).With("file", item.Name(), "dest", dest).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+		return gathered, warns, nil
+	}
+
+	// The downloaded archives remain on disk until every one has been unpacked
+	budget := maxBytes - gathered
+	errGo = filepath.Walk(staging, func(path string, info os.FileInfo, errGo error) error {
+		if errGo != nil {
+			return errGo
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		unpacked, w, err := unpackFile(path, info.Name(), art.Compression, dest, budget-size, filter)
+		warns = append(warns, w...)
+		if err != nil {
+			return err
+		}
+		size += unpacked
+		return nil
+	})
+	if errGo != nil {
+		if err, isKV := errGo.(kv.Error); isKV {
+			return 0, warns, err
+		}
+		return 0, warns, kv.Wrap(errGo).With("dir", staging).With("stack", stack.Trace().TrimRuntime())
+	}
+	return size, warns, nil
+}
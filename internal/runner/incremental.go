@@ -0,0 +1,385 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of incremental artifacts.  Rather than being uploaded
+// as a single archive on every checkpoint the files within an incremental artifact are stored as
+// individual objects named using the SHA256 of their content, with a manifest describing the
+// directory being written for each checkpoint.  Only files that have changed since the previous
+// checkpoint are uploaded.
+//
+// For an artifact with the key 'output.tar' the storage layout is as follows,
+//
+//   output.tar.incr/manifest.json                the manifest for the most recent checkpoint
+//   output.tar.incr/manifests/<unix nano>.json   the manifest for each checkpoint
+//   output.tar.incr/objects/<sha256>             the contents of files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/integrity"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+const (
+	incrSuffix   = ".incr"
+	manifestName = "manifest.json"
+)
+
+// incrStore contains the storage operations used by incremental artifacts
+type incrStore interface {
+	Hash(ctx context.Context, name string) (hash string, err kv.Error)
+	Fetch(ctx context.Context, name string, unpack bool, output string, maxBytes int64) (size int64, warns []kv.Error, err kv.Error)
+	Hoard(ctx context.Context, srcDir string, destPrefix string) (warns []kv.Error, err kv.Error)
+}
+
+// ManifestFile describes a file, directory, or symbolic link within an incremental artifact
+//
+type ManifestFile struct {
+	Path    string      `json:"path"`
+	Mode    os.FileMode `json:"mode"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime time.Time   `json:"modTime"`
+	Hash    string      `json:"hash,omitempty"`
+	Link    string      `json:"link,omitempty"`
+}
+
+// Manifest describes the contents of the directory for an incremental artifact
+// at the time of a checkpoint
+//
+type Manifest struct {
+	Created time.Time      `json:"created"`
+	Files   []ManifestFile `json:"files"`
+}
+
+func incrPrefix(key string) string {
+	return key + incrSuffix
+}
+
+// fetchSingle retrieves a single object into a temporary directory within dir and
+// returns the name of the downloaded file, which is not necessarily named using the
+// key when it was supplied by the object cache
+//
+func fetchSingle(ctx context.Context, storage incrStore, key string, dir string, maxBytes int64) (fn string, size int64, warns []kv.Error, err kv.Error) {
+	output, errGo := ioutil.TempDir(dir, "object-")
+	if errGo != nil {
+		return "", 0, warns, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	if size, warns, err = storage.Fetch(ctx, key, false, output, maxBytes); err != nil {
+		return "", 0, warns, err
+	}
+	items, errGo := ioutil.ReadDir(output)
+	if errGo != nil {
+		return "", 0, warns, kv.Wrap(errGo).With("dir", output).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(items) != 1 {
+		return "", 0, warns, kv.NewError("object download not found").With("key", key, "dir", output).With("stack", stack.Trace().TrimRuntime())
+	}
+	return filepath.Join(output, items[0].Name()), size, warns, nil
+}
+
+// fileHash returns the hex encoded SHA256 of the contents of a file
+//
+func fileHash(fn string) (hash string, err kv.Error) {
+	file, errGo := os.Open(fn)
+	if errGo != nil {
+		return "", kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer file.Close()
+
+	digest := sha256.New()
+	if _, errGo = io.Copy(digest, file); errGo != nil {
+		return "", kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// linkOrCopy places the contents of the src file at dest using a hard link when possible
+//
+func linkOrCopy(src string, dest string) (err kv.Error) {
+	if errGo := os.Link(src, dest); errGo == nil {
+		return nil
+	}
+
+	in, errGo := os.Open(src)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", src).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer in.Close()
+
+	out, errGo := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("file", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo = io.Copy(out, in); errGo != nil {
+		out.Close()
+		return kv.Wrap(errGo).With("file", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = out.Close(); errGo != nil {
+		return kv.Wrap(errGo).With("file", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// fetchIncremental retrieves the most recent checkpoint of an incremental artifact into the
+// dest directory.  A nil manifest is returned when the artifact has no manifest which is the
+// case for artifacts that were uploaded as a single archive.
+//
+func fetchIncremental(ctx context.Context, storage incrStore, key string, dest string, maxBytes int64) (manifest *Manifest, size int64, warns []kv.Error, err kv.Error) {
+
+	prefix := incrPrefix(key)
+	if _, err = storage.Hash(ctx, prefix+"/"+manifestName); err != nil {
+		return nil, 0, warns, nil
+	}
+
+	// Downloads are staged within the parent of the destination so that they can be
+	// moved into place without being copied
+	staging, errGo := ioutil.TempDir(filepath.Dir(dest), ".incremental-")
+	if errGo != nil {
+		return nil, 0, warns, kv.Wrap(errGo).With("dest", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer os.RemoveAll(staging)
+
+	fn, _, w, err := fetchSingle(ctx, storage, prefix+"/"+manifestName, staging, maxBytes)
+	warns = append(warns, w...)
+	if err != nil {
+		return nil, 0, warns, err
+	}
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		return nil, 0, warns, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	manifest = &Manifest{}
+	if errGo = json.Unmarshal(data, manifest); errGo != nil {
+		return nil, 0, warns, kv.Wrap(errGo).With("key", prefix+"/"+manifestName).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Check the manifest as a whole before downloading anything
+	for _, file := range manifest.Files {
+		size += file.Size
+		if escapes, err := defense.WillEscape(file.Path, dest); escapes || err != nil {
+			if err == nil {
+				err = kv.NewError("manifest file escaped").With("stack", stack.Trace().TrimRuntime())
+			}
+			return nil, 0, warns, err.With("path", file.Path, "dest", dest)
+		}
+		if len(file.Link) != 0 {
+			if filepath.IsAbs(file.Link) {
+				return nil, 0, warns, kv.NewError("manifest link escaped").With("path", file.Path, "link", file.Link).With("stack", stack.Trace().TrimRuntime())
+			}
+			if escapes, err := defense.WillEscape(filepath.Join(filepath.Dir(file.Path), file.Link), dest); escapes || err != nil {
+				if err == nil {
+					err = kv.NewError("manifest link escaped").With("stack", stack.Trace().TrimRuntime())
+				}
+				return nil, 0, warns, err.With("path", file.Path, "link", file.Link, "dest", dest)
+			}
+		}
+	}
+	if size > maxBytes {
+		return nil, 0, warns, kv.NewError("artifact size exceeded").With("size", size, "budget", maxBytes).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Files with the same contents are downloaded once
+	downloaded := map[string]string{}
+	for _, file := range manifest.Files {
+		path := filepath.Join(dest, file.Path)
+
+		switch {
+		case file.Mode.IsDir():
+			if errGo = os.MkdirAll(path, file.Mode.Perm()|0700); errGo != nil {
+				return nil, 0, warns, kv.Wrap(errGo).With("path", path).With("stack", stack.Trace().TrimRuntime())
+			}
+			continue
+		case len(file.Link) != 0:
+			_ = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+			_ = os.Remove(path)
+			if errGo = os.Symlink(file.Link, path); errGo != nil {
+				return nil, 0, warns, kv.Wrap(errGo, "symbolic link create failed").With("path", path).With("stack", stack.Trace().TrimRuntime())
+			}
+			continue
+		}
+
+		fn, isPresent := downloaded[file.Hash]
+		if !isPresent {
+			fn, _, w, err = fetchSingle(ctx, storage, prefix+"/objects/"+file.Hash, staging, file.Size)
+			warns = append(warns, w...)
+			if err != nil {
+				return nil, 0, warns, err.With("path", file.Path)
+			}
+			hash, err := fileHash(fn)
+			if err != nil {
+				return nil, 0, warns, err
+			}
+			if hash != file.Hash {
+				return nil, 0, warns, kv.Wrap(integrity.ErrMismatch).With("path", file.Path, "expected", file.Hash, "actual", hash).With("stack", stack.Trace().TrimRuntime())
+			}
+			downloaded[file.Hash] = fn
+		}
+
+		_ = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		_ = os.Remove(path)
+		if err = linkOrCopy(fn, path); err != nil {
+			return nil, 0, warns, err
+		}
+		if errGo = os.Chmod(path, file.Mode.Perm()); errGo != nil {
+			return nil, 0, warns, kv.Wrap(errGo).With("path", path).With("stack", stack.Trace().TrimRuntime())
+		}
+		// The modification time is restored so that unchanged files are recognized by
+		// the next checkpoint without having to be hashed
+		if errGo = os.Chtimes(path, file.ModTime, file.ModTime); errGo != nil {
+			return nil, 0, warns, kv.Wrap(errGo).With("path", path).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return manifest, size, warns, nil
+}
+
+// buildManifest describes the contents of the src directory, the hashes of files that are unchanged
+// from the previous manifest are reused
+//
+func buildManifest(src string, previous *Manifest) (manifest *Manifest, err kv.Error) {
+	known := map[string]ManifestFile{}
+	if previous != nil {
+		for _, file := range previous.Files {
+			known[file.Path] = file
+		}
+	}
+
+	manifest = &Manifest{
+		Created: time.Now(),
+		Files:   []ManifestFile{},
+	}
+	errGo := filepath.Walk(src, func(path string, info os.FileInfo, errGo error) error {
+		if errGo != nil {
+			return errGo
+		}
+		rel, errGo := filepath.Rel(src, path)
+		if errGo != nil || rel == "." {
+			return errGo
+		}
+		file := ManifestFile{
+			Path:    filepath.ToSlash(rel),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime().UTC(),
+		}
+		switch {
+		case info.IsDir():
+		case info.Mode()&os.ModeSymlink != 0:
+			if file.Link, errGo = os.Readlink(path); errGo != nil {
+				return errGo
+			}
+		case info.Mode().IsRegular():
+			file.Size = info.Size()
+			if prev, isPresent := known[file.Path]; isPresent && prev.Size == file.Size && prev.Mode == file.Mode && prev.ModTime.Equal(file.ModTime) {
+				file.Hash = prev.Hash
+				break
+			}
+			hash, err := fileHash(path)
+			if err != nil {
+				return err
+			}
+			file.Hash = hash
+		default:
+			// Sockets, devices and the like are not retained
+			return nil
+		}
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	})
+	if errGo != nil {
+		if err, isKV := errGo.(kv.Error); isKV {
+			return nil, err
+		}
+		return nil, kv.Wrap(errGo).With("src", src).With("stack", stack.Trace().TrimRuntime())
+	}
+	return manifest, nil
+}
+
+// depositIncremental uploads the files within src that are not present in the previous manifest,
+// followed by a manifest for the checkpoint
+//
+func depositIncremental(ctx context.Context, storage incrStore, key string, src string, previous *Manifest) (manifest *Manifest, warns []kv.Error, err kv.Error) {
+
+	if manifest, err = buildManifest(src, previous); err != nil {
+		return nil, warns, err
+	}
+
+	uploaded := map[string]struct{}{}
+	if previous != nil {
+		for _, file := range previous.Files {
+			if len(file.Hash) != 0 {
+				uploaded[file.Hash] = struct{}{}
+			}
+		}
+	}
+
+	// Uploads are staged beside the source directory so that files can be hard linked
+	staging, errGo := ioutil.TempDir(filepath.Dir(src), ".checkpoint-")
+	if errGo != nil {
+		return nil, warns, kv.Wrap(errGo).With("src", src).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer os.RemoveAll(staging)
+
+	objects := filepath.Join(staging, "objects")
+	manifests := filepath.Join(staging, "manifests")
+	for _, dir := range []string{objects, filepath.Join(manifests, "manifests")} {
+		if errGo = os.MkdirAll(dir, 0700); errGo != nil {
+			return nil, warns, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	changed := 0
+	for _, file := range manifest.Files {
+		if len(file.Hash) == 0 {
+			continue
+		}
+		if _, isPresent := uploaded[file.Hash]; isPresent {
+			continue
+		}
+		if err = linkOrCopy(filepath.Join(src, file.Path), filepath.Join(objects, file.Hash)); err != nil {
+			return nil, warns, err
+		}
+		uploaded[file.Hash] = struct{}{}
+		changed++
+	}
+
+	prefix := incrPrefix(key)
+	if changed != 0 {
+		w, err := storage.Hoard(ctx, objects, prefix+"/objects")
+		warns = append(warns, w...)
+		if err != nil {
+			return nil, warns, err
+		}
+	}
+
+	// The manifest is only written once all of the files it refers to have been uploaded
+	data, errGo := json.MarshalIndent(manifest, "", "  ")
+	if errGo != nil {
+		return nil, warns, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	for _, fn := range []string{
+		filepath.Join(manifests, manifestName),
+		filepath.Join(manifests, "manifests", strconv.FormatInt(manifest.Created.UnixNano(), 10)+".json"),
+	} {
+		if errGo = ioutil.WriteFile(fn, data, 0600); errGo != nil {
+			return nil, warns, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	w, err := storage.Hoard(ctx, manifests, prefix)
+	warns = append(warns, w...)
+	if err != nil {
+		return nil, warns, err
+	}
+	return manifest, warns, nil
+}
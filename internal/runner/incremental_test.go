@@ -0,0 +1,163 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// dirStore is a storage implementation for incremental artifacts that retains objects
+// within a directory and records the keys that are uploaded
+type dirStore struct {
+	dir      string
+	uploaded []string
+}
+
+func (s *dirStore) Hash(ctx context.Context, name string) (hash string, err kv.Error) {
+	if _, errGo := os.Stat(filepath.Join(s.dir, name)); errGo != nil {
+		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return name, nil
+}
+
+func (s *dirStore) Fetch(ctx context.Context, name string, unpack bool, output string, maxBytes int64) (size int64, warns []kv.Error, err kv.Error) {
+	data, errGo := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if errGo != nil {
+		return 0, warns, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(output, filepath.Base(name)), data, 0600); errGo != nil {
+		return 0, warns, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return int64(len(data)), warns, nil
+}
+
+func (s *dirStore) Hoard(ctx context.Context, srcDir string, destPrefix string) (warns []kv.Error, err kv.Error) {
+	errGo := filepath.Walk(srcDir, func(path string, info os.FileInfo, errGo error) error {
+		if errGo != nil || info.IsDir() {
+			return errGo
+		}
+		key := filepath.Join(destPrefix, strings.TrimPrefix(path, srcDir))
+		data, errGo := ioutil.ReadFile(path)
+		if errGo != nil {
+			return errGo
+		}
+		_ = os.MkdirAll(filepath.Dir(filepath.Join(s.dir, key)), 0700)
+		s.uploaded = append(s.uploaded, key)
+		return ioutil.WriteFile(filepath.Join(s.dir, key), data, 0600)
+	})
+	if errGo != nil {
+		return warns, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return warns, nil
+}
+
+// TestIncremental checkpoints a directory twice and checks that only the changed file is
+// uploaded by the second checkpoint, and that the directory is reassembled from the manifest
+func TestIncremental(t *testing.T) {
+	ctx := context.Background()
+
+	dir, errGo := ioutil.TempDir("", "incremental")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &dirStore{dir: filepath.Join(dir, "store")}
+	src := filepath.Join(dir, "experiment", "output")
+	for _, d := range []string{store.dir, filepath.Join(src, "logs")} {
+		if errGo = os.MkdirAll(d, 0700); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+
+	contents := map[string][]byte{
+		"model.bin":     bytes.Repeat([]byte("weights"), 1024),
+		"logs/run.log":  []byte("epoch 1\n"),
+		"logs/copy.bin": bytes.Repeat([]byte("weights"), 1024),
+	}
+	for name, content := range contents {
+		if errGo = ioutil.WriteFile(filepath.Join(src, name), content, 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+	if errGo = os.Symlink("model.bin", filepath.Join(src, "latest")); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	// Artifacts uploaded as a single archive have no manifest
+	manifest, _, _, err := fetchIncremental(ctx, store, "output.tar", filepath.Join(dir, "missing"), 1024*1024)
+	if err != nil || manifest != nil {
+		t.Fatal("artifact without a manifest was not recognized", err)
+	}
+
+	first, _, err := depositIncremental(ctx, store, "output.tar", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Files with the same content are uploaded once, along with the two manifests
+	if len(store.uploaded) != 4 {
+		t.Fatal("unexpected uploads", store.uploaded)
+	}
+
+	store.uploaded = nil
+	contents["logs/run.log"] = []byte("epoch 1\nepoch 2\n")
+	if errGo = ioutil.WriteFile(filepath.Join(src, "logs/run.log"), contents["logs/run.log"], 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, _, err = depositIncremental(ctx, store, "output.tar", src, first); err != nil {
+		t.Fatal(err)
+	}
+	objects := 0
+	for _, key := range store.uploaded {
+		if strings.HasPrefix(key, "output.tar.incr/objects/") {
+			objects++
+		}
+	}
+	if objects != 1 {
+		t.Fatal("unchanged files were uploaded", store.uploaded)
+	}
+
+	// The most recent checkpoint is reassembled
+	dest := filepath.Join(dir, "restored", "output")
+	if errGo = os.MkdirAll(dest, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if manifest, _, _, err = fetchIncremental(ctx, store, "output.tar", dest, 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range contents {
+		restored, errGo := ioutil.ReadFile(filepath.Join(dest, name))
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if !bytes.Equal(content, restored) {
+			t.Fatal("restored content differed", name)
+		}
+	}
+	if link, errGo := os.Readlink(filepath.Join(dest, "latest")); errGo != nil || link != "model.bin" {
+		t.Fatal("symbolic link was not restored", link, errGo)
+	}
+
+	// A checkpoint of the restored directory uploads nothing other than the manifests
+	store.uploaded = nil
+	if _, _, err = depositIncremental(ctx, store, "output.tar", dest, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.uploaded) != 2 {
+		t.Fatal("unchanged files were uploaded", store.uploaded)
+	}
+
+	// The budget applies to the artifact as a whole
+	if _, _, _, err = fetchIncremental(ctx, store, "output.tar", dest, 1024); err == nil {
+		t.Fatal("artifact size budget was not applied")
+	}
+}
@@ -0,0 +1,665 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This contains the implementation of a Kafka client that will be used to
+// retrieve work from Kafka topics.
+//
+// Each topic is treated as a StudioML queue and is identified using a subscription
+// that is the name of the topic.  Work is retrieved by a member of a consumer group
+// shared by all of the runners servicing the topic, the group assigning the partitions
+// of the topic to its members.  Offsets are only committed once the message at the
+// offset has been acknowledged by the runner.
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
+
+	"github.com/leaf-ai/go-service/pkg/log"
+	"github.com/leaf-ai/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+	"github.com/leaf-ai/studio-go-runner/pkg/wrapper"
+
+	"github.com/Shopify/sarama"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	kafkaGroupOpt      = flag.String("kafka-group", "studioml", "the consumer group shared by runners retrieving work from Kafka topics, control topics use a group unique to each runner")
+	kafkaRetryLimitOpt = flag.Uint("kafka-retry-limit", 5, "the number of times a message will be presented from a Kafka topic before being skipped, 0 disables the limit")
+)
+
+// Kafka encapsulates the configuration for a Kafka cluster and the consumer group members
+// used to retrieve work from its topics
+//
+type Kafka struct {
+	url      string          // URL of the Kafka cluster including any credentials
+	Identity string          // A URL stripped of the user name and password, making it safe for logging etc
+	brokers  []string        // The addresses of the bootstrap brokers for the cluster
+	config   *sarama.Config  // The client configuration shared by all connections to the cluster
+	wrapper  wrapper.Wrapper // Decryption information for messages with encrypted payloads
+	logger   *log.Logger
+
+	members map[string]*kafkaMember // The consumer group members for topics, keyed by topic
+	sync.Mutex
+}
+
+// kafkaOffer is a message presented by a consumer group member to the runner for processing, the
+// runner sends the outcome of processing using the result channel.  The revoked channel is closed
+// when the partition of the message is assigned to another member while it is being processed.
+//
+type kafkaOffer struct {
+	msg      *sarama.ConsumerMessage
+	failures uint      // The number of times the message was processed and not acknowledged
+	refused  bool      // Set by the runner before sending the result if the message was refused
+	result   chan bool // Present while the message is being processed
+	revoked  chan struct{}
+}
+
+// kafkaMember is a long lived member of a consumer group that is retrieving messages from a
+// single topic.  Messages from the partitions assigned to the member are offered to the runner
+// one at a time.
+//
+type kafkaMember struct {
+	topic   string
+	group   sarama.ConsumerGroup
+	offers  chan *kafkaOffer
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	logger  *log.Logger
+
+	pending  map[int32]*sarama.ConsumerMessage // The messages, by partition, waiting to be offered
+	inflight map[int32]*kafkaOffer             // The offers, by partition, unfinished when their session ended
+	sync.Mutex
+}
+
+// NewKafka takes the URL of a Kafka cluster, a comma separated list of bootstrap brokers using
+// the kafka scheme, and optional user information, being a SASL user name and password as
+// returned in the Cred of the queue descriptions from GetKnown, and will configure the client
+// data structure needed to call methods against the cluster
+//
+func NewKafka(serverURL string, userInfo string, w wrapper.Wrapper, logger *log.Logger) (kq *Kafka, err kv.Error) {
+
+	if serverURL, err = withUserInfo(os.ExpandEnv(serverURL), userInfo); err != nil {
+		return nil, err
+	}
+	identity, errGo := url.Parse(serverURL)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if identity.Scheme != "kafka" || len(identity.Host) == 0 {
+		return nil, kv.NewError("kafka url malformed").With("stack", stack.Trace().TrimRuntime()).With("uri", identity.Redacted())
+	}
+
+	config := sarama.NewConfig()
+	config.ClientID = "studio-go-runner"
+	config.Version = sarama.V2_0_0_0
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategySticky
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+
+	if identity.User != nil {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = identity.User.Username()
+		config.Net.SASL.Password, _ = identity.User.Password()
+	}
+
+	identity.User = nil
+	identity.RawQuery = ""
+	identity.Fragment = ""
+
+	return &Kafka{
+		url:      serverURL,
+		Identity: identity.String(),
+		brokers:  strings.Split(identity.Host, ","),
+		config:   config,
+		wrapper:  w,
+		logger:   logger,
+		members:  map[string]*kafkaMember{},
+	}, nil
+}
+
+func (kq *Kafka) IsEncrypted() (encrypted bool) {
+	return nil != kq.wrapper
+}
+
+// attach opens a client connection to the Kafka cluster
+//
+func (kq *Kafka) attach() (client sarama.Client, err kv.Error) {
+	client, errGo := sarama.NewClient(kq.brokers, kq.config)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", kq.Identity)
+	}
+	return client, nil
+}
+
+// kafkaGroup returns the name of the consumer group used for a topic.  Runners share a group
+// for work topics, commands on control topics are needed by every runner so each runner
+// uses a group of its own.
+//
+func kafkaGroup(topic string) (group string) {
+	if strings.HasSuffix(topic, ControlSuffix) {
+		return *kafkaGroupOpt + "-" + host
+	}
+	return *kafkaGroupOpt
+}
+
+// member returns the consumer group member retrieving messages from a topic, starting one if
+// needed.  Starting is true when the member was started by this call.
+//
+func (kq *Kafka) member(topic string) (m *kafkaMember, starting bool, err kv.Error) {
+	kq.Lock()
+	defer kq.Unlock()
+
+	if m = kq.members[topic]; m != nil {
+		return m, false, nil
+	}
+
+	group, errGo := sarama.NewConsumerGroup(kq.brokers, kafkaGroup(topic), kq.config)
+	if errGo != nil {
+		return nil, false, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", kq.Identity, "topic", topic)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m = &kafkaMember{
+		topic:    topic,
+		group:    group,
+		offers:   make(chan *kafkaOffer),
+		cancel:   cancel,
+		stopped:  make(chan struct{}),
+		logger:   kq.logger,
+		pending:  map[int32]*sarama.ConsumerMessage{},
+		inflight: map[int32]*kafkaOffer{},
+	}
+	go m.consume(ctx)
+
+	kq.members[topic] = m
+	return m, true, nil
+}
+
+// Close will stop all of the consumer group members started by the receiver, kq, leaving
+// their groups
+//
+func (kq *Kafka) Close() {
+	kq.Lock()
+	defer kq.Unlock()
+
+	for topic, m := range kq.members {
+		m.cancel()
+		<-m.stopped
+		delete(kq.members, topic)
+	}
+}
+
+// consume runs the consumer group sessions of the member until the ctx is canceled, a new
+// session is started after each rebalance of the group
+//
+func (m *kafkaMember) consume(ctx context.Context) {
+	defer close(m.stopped)
+	defer m.group.Close()
+	defer m.revoke(nil)
+
+	for {
+		if errGo := m.group.Consume(ctx, []string{m.topic}, m); errGo != nil {
+			if errors.Is(errGo, sarama.ErrClosedConsumerGroup) {
+				return
+			}
+			m.logger.Warn("consumer group session failed", "topic", m.topic, "error", errGo.Error())
+			// Without a session the member cannot know which partitions it still owns
+			m.revoke(nil)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Setup is called by the consumer group at the start of a session.  Messages that were being
+// processed when the previous session ended continue to be processed if their partitions are
+// still assigned to the member.
+//
+func (m *kafkaMember) Setup(session sarama.ConsumerGroupSession) error {
+	claimed := map[int32]bool{}
+	for _, partition := range session.Claims()[m.topic] {
+		claimed[partition] = true
+	}
+	m.revoke(claimed)
+	return nil
+}
+
+// revoke drops the unfinished offers of partitions that are not claimed by the member, canceling
+// any experiment processing them as the message will be presented to the new owner of the partition
+//
+func (m *kafkaMember) revoke(claimed map[int32]bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	for partition, o := range m.inflight {
+		if claimed[partition] {
+			continue
+		}
+		if o.result != nil {
+			m.logger.Warn("partition reassigned during processing, canceling experiment", "topic", m.topic, "partition", partition, "offset", o.msg.Offset)
+			close(o.revoked)
+		}
+		delete(m.inflight, partition)
+	}
+}
+
+// Cleanup is called by the consumer group at the end of a session
+//
+func (m *kafkaMember) Cleanup(session sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim offers the messages of a partition assigned to the member to the runner one
+// at a time, in partition order, until the session ends
+//
+func (m *kafkaMember) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	// A message left unfinished by the previous session is finished first, the messages of the
+	// claim starting from its offset as it was not committed
+	skip := int64(-1)
+
+	m.Lock()
+	o := m.inflight[claim.Partition()]
+	delete(m.inflight, claim.Partition())
+	m.Unlock()
+
+	if o != nil {
+		if !m.deliver(session, o) {
+			return nil
+		}
+		skip = o.msg.Offset
+	}
+
+	for {
+		select {
+		case msg, isOpen := <-claim.Messages():
+			if !isOpen {
+				return nil
+			}
+			if msg.Offset <= skip {
+				continue
+			}
+			if !m.deliver(session, &kafkaOffer{msg: msg}) {
+				return nil
+			}
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// kafkaBackoff returns the time to wait before presenting a message again, doubling with each
+// failure to process the message up to a minute
+//
+func kafkaBackoff(failures uint) (backoff time.Duration) {
+	if failures > 6 {
+		return time.Minute
+	}
+	if backoff = time.Second << failures; backoff > time.Minute {
+		return time.Minute
+	}
+	return backoff
+}
+
+// deliver offers a message to the runner until it is acknowledged, or its retry budget is exhausted,
+// and then commits the offset following the message.  Messages that were not acknowledged are
+// presented again after a backoff, messages refused by the runner not using their retry budget.
+//
+// False is returned when the session ended before the message was finished with, leaving its offset
+// uncommitted.  The offer is kept by the member so that the next session can finish it if the
+// partition is still assigned to the member.
+//
+func (m *kafkaMember) deliver(session sarama.ConsumerGroupSession, o *kafkaOffer) (finished bool) {
+	// Commands on control topics that were not acknowledged are for experiments running
+	// on other runners, each of which has its own group
+	isControl := strings.HasSuffix(m.topic, ControlSuffix)
+
+	for {
+		ack, finished := m.offer(session, o)
+		if !finished {
+			m.Lock()
+			m.inflight[o.msg.Partition] = o
+			m.Unlock()
+			return false
+		}
+		if ack || isControl {
+			break
+		}
+		if !o.refused {
+			o.failures++
+			if *kafkaRetryLimitOpt != 0 && o.failures >= *kafkaRetryLimitOpt {
+				deadLettered.With(prometheus.Labels{"host": host, "queue_type": "kafka", "queue_name": m.topic}).Inc()
+				m.logger.Warn("message skipped", "topic", m.topic, "partition", o.msg.Partition, "offset", o.msg.Offset, "deliveries", o.failures)
+				break
+			}
+			redelivered.With(prometheus.Labels{"host": host, "queue_type": "kafka", "queue_name": m.topic}).Inc()
+		}
+
+		select {
+		case <-time.After(kafkaBackoff(o.failures)):
+		case <-session.Context().Done():
+			m.Lock()
+			m.inflight[o.msg.Partition] = o
+			m.Unlock()
+			return false
+		}
+	}
+	session.MarkMessage(o.msg, "")
+	session.Commit()
+	return true
+}
+
+// offer waits for the runner to take a message, unless it is already being processed, and then for
+// the outcome of processing it.  While the message is being processed fetching from its partition
+// is paused, the group heartbeats continuing in the background so that long running experiments do
+// not cause the group to be rebalanced.
+//
+// If the group is rebalanced anyway the message continues to be processed, the experiment only being
+// canceled by Setup if the new assignment of the group gives the partition to another member.
+//
+func (m *kafkaMember) offer(session sarama.ConsumerGroupSession, o *kafkaOffer) (ack bool, finished bool) {
+	if o.result == nil {
+		o.refused = false
+		o.result = make(chan bool, 1)
+		o.revoked = make(chan struct{})
+
+		m.Lock()
+		m.pending[o.msg.Partition] = o.msg
+		m.Unlock()
+
+		select {
+		case m.offers <- o:
+			m.Lock()
+			delete(m.pending, o.msg.Partition)
+			m.Unlock()
+		case <-session.Context().Done():
+			m.Lock()
+			delete(m.pending, o.msg.Partition)
+			m.Unlock()
+			o.result = nil
+			return false, false
+		}
+	}
+
+	partitions := map[string][]int32{o.msg.Topic: {o.msg.Partition}}
+	m.group.Pause(partitions)
+	defer m.group.Resume(partitions)
+
+	select {
+	case ack = <-o.result:
+		o.result = nil
+		return ack, true
+	case <-session.Context().Done():
+		return false, false
+	}
+}
+
+// peek returns a message that is waiting to be offered to the runner, or nil if there are none
+//
+func (m *kafkaMember) peek() (msg *sarama.ConsumerMessage) {
+	m.Lock()
+	defer m.Unlock()
+	for _, msg = range m.pending {
+		return msg
+	}
+	return nil
+}
+
+// Refresh will examine the topics of the Kafka cluster and extract a list of the topics
+// that relate to StudioML work
+//
+func (kq *Kafka) Refresh(ctx context.Context, matcher *regexp.Regexp, mismatcher *regexp.Regexp) (known map[string]interface{}, err kv.Error) {
+
+	known = map[string]interface{}{}
+
+	client, err := kq.attach()
+	if err != nil {
+		return known, err
+	}
+	defer client.Close()
+
+	topics, errGo := client.Topics()
+	if errGo != nil {
+		return known, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", kq.Identity)
+	}
+
+	for _, topic := range topics {
+		// Make sure any retrieved topics match the caller supplied regular expression
+		if matcher != nil && !matcher.MatchString(topic) {
+			continue
+		}
+		// We cannot allow an excluded topic
+		if mismatcher != nil && mismatcher.MatchString(topic) {
+			continue
+		}
+		known[topic] = kq.Identity
+	}
+
+	return known, nil
+}
+
+// GetKnown will return the Kafka cluster as the only project, individual topics are treated
+// as queues within the project using the Refresh method.  The project is identified using the
+// URL of the cluster without the user name and password, which are returned in the Cred of
+// the description.
+//
+func (kq *Kafka) GetKnown(ctx context.Context, matcher *regexp.Regexp, mismatcher *regexp.Regexp) (found map[string]task.QueueDesc, err kv.Error) {
+	known, err := kq.Refresh(ctx, matcher, mismatcher)
+	if err != nil {
+		return nil, err
+	}
+
+	found = make(map[string]task.QueueDesc, 1)
+	if len(known) != 0 {
+		found[kq.Identity] = task.QueueDesc{
+			Proj: kq.Identity,
+			Cred: userInfo(kq.url),
+		}
+	}
+	return found, nil
+}
+
+// Exists will connect to the Kafka cluster identified in the receiver, kq, and will
+// query it to see if the topic identified by the studio go runner subscription exists
+//
+func (kq *Kafka) Exists(ctx context.Context, subscription string) (exists bool, err kv.Error) {
+	client, err := kq.attach()
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	topics, errGo := client.Topics()
+	if errGo != nil {
+		return false, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", kq.Identity)
+	}
+	for _, topic := range topics {
+		if topic == subscription {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetShortQName is useful for storing queue specific information in collections etc
+//
+func (kq *Kafka) GetShortQName(qt *task.QueueTask) (shortName string, err kv.Error) {
+	if len(qt.Subscription) == 0 {
+		return "", kv.NewError("malformed kafka subscription").With("stack", stack.Trace().TrimRuntime()).With("subscription", qt.Subscription)
+	}
+	return qt.Subscription, nil
+}
+
+// Work will see if the consumer group member for the topic identified by the go runner subscription
+// has a message waiting and present it to the handler for processing.  The offset of the message
+// is committed once the handler has acknowledged it.  The ctx passed to the handler is canceled if the
+// partition of the message is assigned to another member of the group during processing.
+//
+func (kq *Kafka) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool, resource *server.Resource, err kv.Error) {
+
+	m, _, err := kq.member(qt.Subscription)
+	if err != nil {
+		return false, nil, err
+	}
+
+	var o *kafkaOffer
+	select {
+	case o = <-m.offers:
+	case <-time.After(2 * time.Second):
+		return false, nil, nil
+	case <-ctx.Done():
+		return false, nil, nil
+	}
+
+	qt.Msg = o.msg.Value
+	qt.ShortQName = qt.Subscription
+
+	// The member reuses the offer if the message is presented again
+	result, revoked := o.result, o.revoked
+
+	hCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-revoked:
+			cancel()
+		case <-hCtx.Done():
+		}
+	}()
+
+	rsc, ack, err := qt.Handler(hCtx, qt)
+
+	// Messages refused by the handler, or interrupted by the runner stopping, are presented
+	// again without using their retry budget
+	o.refused = task.IsRefused(err) || ctx.Err() != nil
+	result <- ack
+
+	return true, rsc, err
+}
+
+// HasWork will look to see if the consumer group member for the topic has messages waiting to be
+// processed.  Topics without a member have one started and are assumed to have work.
+//
+func (kq *Kafka) HasWork(ctx context.Context, subscription string) (hasWork bool, err kv.Error) {
+	m, starting, err := kq.member(subscription)
+	if err != nil {
+		return false, err
+	}
+	return starting || m.peek() != nil, nil
+}
+
+// Peek will return the resources requested by a message that the consumer group member for the
+// topic has waiting to be processed, without it being processed.  Members process partitions
+// concurrently so the message peeked at may not be the next message processed.
+//
+func (kq *Kafka) Peek(ctx context.Context, subscription string) (resource *server.Resource, err kv.Error) {
+	m, _, err := kq.member(subscription)
+	if err != nil {
+		return nil, err
+	}
+	msg := m.peek()
+	if msg == nil {
+		return nil, nil
+	}
+	if resource, err = task.PeekResource(msg.Value); err != nil {
+		return nil, err.With("subscription", subscription, "partition", msg.Partition, "offset", msg.Offset)
+	}
+	return resource, nil
+}
+
+// Publish is a shim method for tests to use for sending requests to a topic
+//
+func (kq *Kafka) Publish(topic string, contentType string, msg []byte) (err kv.Error) {
+	producer, errGo := sarama.NewSyncProducer(kq.brokers, kq.config)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", kq.Identity)
+	}
+	defer producer.Close()
+
+	if _, _, errGo = producer.SendMessage(&sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(msg)}); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", kq.Identity, "topic", topic)
+	}
+	return nil
+}
+
+// Responder is used to open a connection to an existing response topic if
+// one was made available and also to provision a channel into which the
+// runner can place report messages
+//
+func (kq *Kafka) Responder(ctx context.Context, subscription string, encryptKey *rsa.PublicKey) (sender chan *runnerReports.Report, err kv.Error) {
+	exists, err := kq.Exists(ctx, subscription)
+	if !exists {
+		if err == nil {
+			err = kv.NewError("response topic not found").With("stack", stack.Trace().TrimRuntime()).With("subscription", subscription)
+		}
+		return nil, err
+	}
+	if encryptKey == nil {
+		return nil, kv.NewError("response topic encryption key missing").With("stack", stack.Trace().TrimRuntime()).With("subscription", subscription)
+	}
+
+	producer, errGo := sarama.NewSyncProducer(kq.brokers, kq.config)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", kq.Identity)
+	}
+
+	// Allow up to 64 logging and report messages to be queued before refusing to send more
+	sender = make(chan *runnerReports.Report, 64)
+
+	go func() {
+		defer producer.Close()
+		for {
+			select {
+			case data := <-sender:
+				if data == nil {
+					// If the responder channel is closed then there is nothing left
+					// to report so we stop
+					return
+				}
+				buf, errGo := protojson.Marshal(data)
+				if errGo != nil {
+					kq.logger.Warn(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).Error())
+					continue
+				}
+				payload, err := defense.HybridSeal(buf, encryptKey)
+				if err != nil {
+					kq.logger.Warn(err.Error())
+					continue
+				}
+				if _, _, errGo := producer.SendMessage(&sarama.ProducerMessage{Topic: subscription, Value: sarama.StringEncoder(payload)}); errGo != nil {
+					kq.logger.Warn(errGo.Error(), "topic", subscription, "stack", stack.Trace().TrimRuntime())
+				}
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sender, nil
+}
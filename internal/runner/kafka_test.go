@@ -0,0 +1,464 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the Kafka task queue implementation using an in-process mock broker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/go-service/pkg/log"
+	"github.com/leaf-ai/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+
+	"github.com/Shopify/sarama"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// startKafka runs a mock broker that leads a single partition for each of the topics and
+// coordinates the consumer group used by runners, messages for the topics are served using
+// the returned fetch response
+//
+func startKafka(t *testing.T, topics ...string) (broker *sarama.MockBroker, fetch *sarama.MockFetchResponse) {
+	broker = sarama.NewMockBroker(t, 1)
+	t.Cleanup(broker.Close)
+
+	metadata := sarama.NewMockMetadataResponse(t).
+		SetBroker(broker.Addr(), broker.BrokerID()).
+		SetController(broker.BrokerID())
+	offsets := sarama.NewMockOffsetResponse(t).SetVersion(1)
+	committed := sarama.NewMockOffsetFetchResponse(t)
+	assignment := &sarama.ConsumerGroupMemberAssignment{Topics: map[string][]int32{}}
+
+	for _, topic := range topics {
+		metadata.SetLeader(topic, 0, broker.BrokerID())
+		offsets.SetOffset(topic, 0, sarama.OffsetOldest, 0).SetOffset(topic, 0, sarama.OffsetNewest, 1)
+		committed.SetOffset(*kafkaGroupOpt, topic, 0, -1, "", sarama.ErrNoError)
+		assignment.Topics[topic] = []int32{0}
+	}
+
+	fetch = sarama.NewMockFetchResponse(t, 1).SetVersion(7)
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest":        metadata,
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).SetCoordinator(sarama.CoordinatorGroup, *kafkaGroupOpt, broker),
+		"JoinGroupRequest":       sarama.NewMockJoinGroupResponse(t).SetGroupProtocol(sarama.StickyBalanceStrategyName).SetMemberId("runner").SetLeaderId("other"),
+		"SyncGroupRequest":       sarama.NewMockSyncGroupResponse(t).SetMemberAssignment(assignment),
+		"HeartbeatRequest":       sarama.NewMockHeartbeatResponse(t),
+		"LeaveGroupRequest":      sarama.NewMockLeaveGroupResponse(t),
+		"OffsetFetchRequest":     committed,
+		"OffsetCommitRequest":    sarama.NewMockOffsetCommitResponse(t),
+		"OffsetRequest":          offsets,
+		"FetchRequest":           fetch,
+		"ProduceRequest":         sarama.NewMockProduceResponse(t).SetVersion(3),
+	})
+	return broker, fetch
+}
+
+// countRequests returns the number of requests of the same type as the example received by the broker
+//
+func countRequests(broker *sarama.MockBroker, example interface{}) (count int) {
+	for _, rr := range broker.History() {
+		switch rr.Request.(type) {
+		case *sarama.OffsetCommitRequest:
+			if _, isCommit := example.(*sarama.OffsetCommitRequest); isCommit {
+				count++
+			}
+		case *sarama.ProduceRequest:
+			if _, isProduce := example.(*sarama.ProduceRequest); isProduce {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestKafkaQueue(t *testing.T) {
+	topic := "kafka_project"
+	broker, fetch := startKafka(t, topic, topic+"_response", "other")
+
+	envelope := &defense.Envelope{
+		Message: defense.Message{
+			Resource: server.Resource{Cpus: 2, Ram: "4gb", Hdd: "10gb"},
+			Payload:  "encrypted",
+		},
+	}
+	buf, errGo := envelope.Marshal()
+	if errGo != nil {
+		t.Fatalf("FAILED to marshal envelope - %v", errGo)
+	}
+	fetch.SetMessage(topic, 0, 0, sarama.ByteEncoder(buf)).SetHighWaterMark(topic, 0, 1)
+
+	logger := log.NewLogger("kafka-queue")
+	kq, err := NewKafka("kafka://"+broker.Addr(), "", nil, logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer kq.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Topics are discovered using the queue matching expressions
+	known, err := kq.Refresh(ctx, regexp.MustCompile("^kafka_"), regexp.MustCompile("_response$"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, isPresent := known[topic]; !isPresent || len(known) != 1 {
+		t.Fatalf("unexpected topics %v found", known)
+	}
+	if exists, err := kq.Exists(ctx, topic); err != nil || !exists {
+		t.Fatalf("topic %s not found - %v", topic, err)
+	}
+	if exists, err := kq.Exists(ctx, "missing"); err != nil || exists {
+		t.Fatalf("missing topic was found - %v", err)
+	}
+
+	// Known clusters are keyed on the identity of the cluster which never carries credentials
+	found, err := kq.GetKnown(ctx, regexp.MustCompile("^kafka_"), regexp.MustCompile("_response$"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if desc, isPresent := found[kq.Identity]; !isPresent || len(found) != 1 || desc.Proj != kq.Identity {
+		t.Fatalf("unexpected clusters %v found", found)
+	}
+
+	// Topics are assumed to have work until the consumer group member has joined the group
+	if hasWork, err := kq.HasWork(ctx, topic); err != nil || !hasWork {
+		t.Fatalf("topic without a member not seen as having work - %v", err)
+	}
+
+	var rsc *server.Resource
+	for rsc == nil && ctx.Err() == nil {
+		if rsc, err = kq.Peek(ctx, topic); err != nil {
+			t.Fatal(err.Error())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if rsc == nil || rsc.Cpus != 2 || rsc.Ram != "4gb" {
+		t.Fatalf("unexpected resource %v peeked", rsc)
+	}
+	if hasWork, err := kq.HasWork(ctx, topic); err != nil || !hasWork {
+		t.Fatalf("waiting message not seen as work - %v", err)
+	}
+
+	// A message that is not acknowledged is presented again, and one that is acknowledged has
+	// its offset committed
+	deliveries := 0
+	qt := &task.QueueTask{
+		Subscription: topic,
+		Handler: func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+			deliveries++
+			if string(qt.Msg) != string(buf) || qt.ShortQName != topic {
+				t.Errorf("unexpected message %s delivered from %s", string(qt.Msg), qt.ShortQName)
+			}
+			return nil, deliveries > 1, nil
+		},
+	}
+
+	processed, _, err := kq.Work(ctx, qt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !processed {
+		t.Fatal("message not delivered")
+	}
+	if commits := countRequests(broker, &sarama.OffsetCommitRequest{}); commits != 0 {
+		t.Fatalf("offset committed for a message that was not acknowledged")
+	}
+
+	// The message is presented again once its backoff has passed
+	for processed = false; !processed && ctx.Err() == nil; {
+		if processed, _, err = kq.Work(ctx, qt); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if !processed {
+		t.Fatal("message not presented again")
+	}
+	if deliveries != 2 {
+		t.Fatalf("unexpected number of deliveries %d", deliveries)
+	}
+	for countRequests(broker, &sarama.OffsetCommitRequest{}) == 0 && ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("offset not committed for an acknowledged message")
+	}
+
+	if processed, _, err := kq.Work(ctx, qt); err != nil || processed {
+		t.Fatalf("acknowledged message was presented again - %v", err)
+	}
+	if hasWork, err := kq.HasWork(ctx, topic); err != nil || hasWork {
+		t.Fatalf("empty topic seen as having work - %v", err)
+	}
+}
+
+// revokedGroup is a consumer group that ignores requests to pause and resume fetching
+//
+type revokedGroup struct {
+	sarama.ConsumerGroup
+}
+
+func (revokedGroup) Pause(partitions map[string][]int32)  {}
+func (revokedGroup) Resume(partitions map[string][]int32) {}
+
+// revokedSession is a consumer group session that ends when its ctx is canceled, the offset
+// of the last message marked being recorded
+//
+type revokedSession struct {
+	sarama.ConsumerGroupSession
+	ctx    context.Context
+	claims map[string][]int32
+	marked int64
+}
+
+func (s *revokedSession) Context() context.Context {
+	return s.ctx
+}
+
+func (s *revokedSession) Claims() map[string][]int32 {
+	return s.claims
+}
+
+func (s *revokedSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.marked = msg.Offset
+}
+
+func (s *revokedSession) Commit() {}
+
+func TestKafkaRevoked(t *testing.T) {
+	topic := "kafka_project"
+	logger := log.NewLogger("kafka-queue")
+
+	m := &kafkaMember{
+		topic:    topic,
+		group:    revokedGroup{},
+		offers:   make(chan *kafkaOffer),
+		logger:   logger,
+		pending:  map[int32]*sarama.ConsumerMessage{},
+		inflight: map[int32]*kafkaOffer{},
+	}
+	kq := &Kafka{
+		logger:  logger,
+		members: map[string]*kafkaMember{topic: m},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	msg := &sarama.ConsumerMessage{Topic: topic, Partition: 0, Offset: 7}
+
+	// A rebalance that leaves the partition with the member does not cancel the experiment, the
+	// message being finished by the next session
+	firstCtx, endFirst := context.WithCancel(ctx)
+	defer endFirst()
+	second := &revokedSession{ctx: ctx, claims: map[string][]int32{topic: {0}}}
+
+	finished := make(chan bool, 1)
+	go func() {
+		finished <- m.deliver(&revokedSession{ctx: firstCtx}, &kafkaOffer{msg: msg})
+	}()
+
+	qt := &task.QueueTask{
+		Subscription: topic,
+		Handler: func(hCtx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+			endFirst()
+			if isFinished := <-finished; isFinished {
+				t.Error("message finished by an ended session")
+			}
+			if errGo := m.Setup(second); errGo != nil {
+				t.Error(errGo)
+			}
+			select {
+			case <-hCtx.Done():
+				t.Error("experiment canceled when its partition was kept")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			m.Lock()
+			o := m.inflight[msg.Partition]
+			delete(m.inflight, msg.Partition)
+			m.Unlock()
+			if o == nil {
+				t.Error("unfinished message not kept for the next session")
+				return nil, true, nil
+			}
+			go func() {
+				finished <- m.deliver(second, o)
+			}()
+			return nil, true, nil
+		},
+	}
+
+	if processed, _, err := kq.Work(ctx, qt); err != nil || !processed {
+		t.Fatalf("message not delivered - %v", err)
+	}
+	if isFinished := <-finished; !isFinished || second.marked != msg.Offset {
+		t.Fatal("kept message not finished by the next session")
+	}
+
+	// The experiment is canceled when the partition of its message is assigned to another member
+	thirdCtx, endThird := context.WithCancel(ctx)
+	defer endThird()
+
+	go func() {
+		finished <- m.deliver(&revokedSession{ctx: thirdCtx}, &kafkaOffer{msg: msg})
+	}()
+
+	qt.Handler = func(hCtx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+		endThird()
+		if isFinished := <-finished; isFinished {
+			t.Error("message finished by an ended session")
+		}
+		if errGo := m.Setup(&revokedSession{ctx: ctx}); errGo != nil {
+			t.Error(errGo)
+		}
+		select {
+		case <-hCtx.Done():
+		case <-ctx.Done():
+			t.Error("experiment not canceled when its partition was revoked")
+		}
+		return nil, true, nil
+	}
+
+	if processed, _, err := kq.Work(ctx, qt); err != nil || !processed {
+		t.Fatalf("message not delivered - %v", err)
+	}
+	if len(m.inflight) != 0 {
+		t.Fatal("revoked message kept by the member")
+	}
+}
+
+// TestKafkaRetries checks that messages are presented again after a backoff until their retry
+// budget is used, refusals not using the budget
+//
+func TestKafkaRetries(t *testing.T) {
+	topic := "kafka_project"
+	logger := log.NewLogger("kafka-queue")
+
+	limit := *kafkaRetryLimitOpt
+	*kafkaRetryLimitOpt = 2
+	defer func() {
+		*kafkaRetryLimitOpt = limit
+	}()
+
+	m := &kafkaMember{
+		topic:    topic,
+		group:    revokedGroup{},
+		offers:   make(chan *kafkaOffer),
+		logger:   logger,
+		pending:  map[int32]*sarama.ConsumerMessage{},
+		inflight: map[int32]*kafkaOffer{},
+	}
+	kq := &Kafka{
+		logger:  logger,
+		members: map[string]*kafkaMember{topic: m},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	msg := &sarama.ConsumerMessage{Topic: topic, Partition: 0, Offset: 3}
+	session := &revokedSession{ctx: ctx}
+
+	finished := make(chan bool, 1)
+	go func() {
+		finished <- m.deliver(session, &kafkaOffer{msg: msg})
+	}()
+
+	deliveries := 0
+	last := time.Now()
+	qt := &task.QueueTask{
+		Subscription: topic,
+		Handler: func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+			deliveries++
+			if deliveries > 1 && time.Since(last) < time.Second {
+				t.Errorf("message presented again after %v", time.Since(last))
+			}
+			last = time.Now()
+			if deliveries == 1 {
+				return nil, false, task.Refused(kv.NewError("insufficient resources"))
+			}
+			return nil, false, kv.NewError("failed")
+		},
+	}
+
+	for deliveries < 3 && ctx.Err() == nil {
+		if _, _, err := kq.Work(ctx, qt); err != nil && deliveries == 0 {
+			t.Fatal(err.Error())
+		}
+	}
+	if isFinished := <-finished; !isFinished || session.marked != msg.Offset {
+		t.Fatal("message not skipped once its retry budget was used")
+	}
+	if processed, _, _ := kq.Work(ctx, qt); processed || deliveries != 3 {
+		t.Fatalf("unexpected number of deliveries %d", deliveries)
+	}
+}
+
+func TestKafkaResponder(t *testing.T) {
+	topic := "kafka_project_response"
+	broker, _ := startKafka(t, topic)
+
+	logger := log.NewLogger("kafka-queue")
+	kq, err := NewKafka("kafka://"+broker.Addr(), "", nil, logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer kq.Close()
+
+	prvKey, errGo := rsa.GenerateKey(rand.Reader, 2048)
+	if errGo != nil {
+		t.Fatalf("FAILED to generate key: %v", errGo)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Responders are only available for response topics that experimenters have created
+	if _, err := kq.Responder(ctx, "missing_response", &prvKey.PublicKey); err == nil {
+		t.Fatal("responder created for a missing topic")
+	}
+
+	responseQ, err := kq.Responder(ctx, topic, &prvKey.PublicKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	responseQ <- &runnerReports.Report{
+		Time: timestamppb.Now(),
+		ExecutorId: &wrapperspb.StringValue{
+			Value: "test",
+		},
+		Payload: &runnerReports.Report_Logging{
+			Logging: &runnerReports.LogEntry{
+				Time:     timestamppb.Now(),
+				Severity: runnerReports.LogSeverity_Info,
+				Message: &wrapperspb.StringValue{
+					Value: "responder test",
+				},
+			},
+		},
+	}
+
+	for countRequests(broker, &sarama.ProduceRequest{}) == 0 && ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("no report was produced to %s", topic)
+	}
+	close(responseQ)
+}
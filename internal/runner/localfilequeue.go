@@ -9,10 +9,12 @@ import (
 	"bufio"
 	"context"
 	"crypto/rsa"
+	"flag"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"time"
 
 	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
@@ -20,31 +22,66 @@ import (
 	"github.com/leaf-ai/go-service/pkg/log"
 	"github.com/leaf-ai/go-service/pkg/server"
 
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
 	"github.com/leaf-ai/studio-go-runner/internal/task"
 	"github.com/leaf-ai/studio-go-runner/pkg/wrapper"
 
+	"google.golang.org/protobuf/encoding/protojson"
+
 	"github.com/go-stack/stack"
 	"github.com/jjeffery/kv" // MIT License
 	"github.com/rs/xid"
 )
 
+// InflightDir is the name of the sub-directory within each queue directory into which
+// messages are moved while they are claimed by a runner
+const InflightDir = "inflight"
+
+// reapingSuffix is appended to the runner ID to name the directory within the inflight directory
+// into which a runner moves expired claims while it returns them to the queue
+const reapingSuffix = ".reaping"
+
+var (
+	localQueueLeaseOpt = flag.Duration("local-queue-lease", time.Duration(5*time.Minute), "the period of time a claim on a local queue message remains valid without being renewed by the runner holding it")
+)
+
+// ValidateLocalQueueOpts checks the command line options used by local queues, the lease
+// is renewed on a fraction of its period and so must be positive
+//
+func ValidateLocalQueueOpts() (errs []kv.Error) {
+	if *localQueueLeaseOpt <= 0 {
+		errs = append(errs, kv.NewError("the local-queue-lease option must be positive").With("local-queue-lease", localQueueLeaseOpt.String()))
+	}
+	return errs
+}
+
 // LocalQueue "project" is basically a local root directory
 // containing queues sub-directories.
+//
+// Messages are claimed by being renamed into an inflight/<runner-id> sub-directory of
+// their queue with the modification time of the claimed file acting as the lease timestamp.
+// This allows multiple runners to share a queue root directory, for example on NFS, and
+// for messages held by a runner that has crashed to be returned to their queue once
+// their lease has expired.
 type LocalQueue struct {
-	RootDir string          // full file path to root queues "server" directory
-	timeout time.Duration   // timeout in seconds for lock/unlock operations
-	wrapper wrapper.Wrapper // Decryption information for messages with encrypted payloads
-	logger  *log.Logger
+	RootDir  string          // full file path to root queues "server" directory
+	timeout  time.Duration   // timeout in seconds for lock/unlock operations
+	lease    time.Duration   // period of time for which a claim on a message is valid without renewal
+	runnerID string          // unique identifier for this runner used to name its inflight directory
+	wrapper  wrapper.Wrapper // Decryption information for messages with encrypted payloads
+	logger   *log.Logger
 }
 
 func NewLocalQueue(root string, w wrapper.Wrapper, logger *log.Logger) (fq *LocalQueue) {
 	timeout := 10 * time.Second
 
 	fqp := &LocalQueue{
-		RootDir: root,
-		timeout: timeout,
-		wrapper: w,
-		logger:  logger,
+		RootDir:  root,
+		timeout:  timeout,
+		lease:    *localQueueLeaseOpt,
+		runnerID: host + "-" + strconv.Itoa(os.Getpid()),
+		wrapper:  w,
+		logger:   logger,
 	}
 	return fqp
 }
@@ -168,7 +205,7 @@ func (fq *LocalQueue) GetKnown(ctx context.Context, matcher *regexp.Regexp, mism
 // does exist as sub-directory under root "server" directory.
 //
 func (fq *LocalQueue) Exists(ctx context.Context, subscription string) (exists bool, err kv.Error) {
-	queuePath := path.Join(fq.RootDir, subscription)
+	queuePath := fq.queuePath(subscription)
 	fileInfo, errGo := os.Stat(queuePath)
 	if os.IsNotExist(errGo) {
 		return false, nil
@@ -182,9 +219,19 @@ func (fq *LocalQueue) Exists(ctx context.Context, subscription string) (exists b
 	return true, nil
 }
 
+// queuePath will return the full path of a queue directory, subscriptions are accepted as
+// either the name of a queue or the full path of the queue directory
+//
+func (fq *LocalQueue) queuePath(subscription string) (queuePath string) {
+	if filepath.IsAbs(subscription) || filepath.Dir(subscription) == filepath.Clean(fq.RootDir) {
+		return subscription
+	}
+	return path.Join(fq.RootDir, subscription)
+}
+
 // GetShortQName GetShortQueueName is useful for storing queue specific information in collections etc
 func (fq *LocalQueue) GetShortQName(qt *task.QueueTask) (shortName string, err kv.Error) {
-	return qt.Subscription, nil
+	return filepath.Base(qt.Subscription), nil
 }
 
 func getOldest(listInfo []os.FileInfo) (result int) {
@@ -245,28 +292,164 @@ func (fq *LocalQueue) getOldestItem(subscription string) (item os.FileInfo, err
 	return listInfo[itemInx], nil
 }
 
+// Get will claim the oldest message on the queue by moving it into the inflight directory
+// for this runner.  The MsgID returned is the path of the claimed message and must be
+// passed to either Ack or Nack once processing of the message is done.
+//
 func (fq *LocalQueue) Get(subscription string) (Msg []byte, MsgID string, err kv.Error) {
 	queueDirPath := subscription
-	itemInfo, err := fq.getOldestItem(subscription)
-	if err != nil {
-		return nil, "", err
+
+	if _, err = fq.Reap(subscription); err != nil {
+		fq.logger.Warn("unable to reap expired leases", "queue", queueDirPath, "error", err.Error())
 	}
-	if itemInfo == nil {
-		fq.logger.Debug("No item was selected", "queue", queueDirPath)
-		// Nothing is found in our "queue"
-		return nil, "", nil
+
+	claimDir := path.Join(queueDirPath, InflightDir, fq.runnerID)
+	if errGo := os.MkdirAll(claimDir, os.ModeDir|0o775); errGo != nil {
+		return nil, "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", claimDir)
 	}
-	MsgID = path.Join(queueDirPath, itemInfo.Name())
-	// Read the whole file into []byte
-	Msg, err = readBytes(MsgID)
-	if err != nil {
-		return Msg, MsgID, err
+
+	// Other runners sharing the queue directory might claim the item we select
+	// before we can so a limited number of attempts are made to claim one
+	for attempt := 0; attempt != 5; attempt++ {
+		itemInfo, err := fq.getOldestItem(subscription)
+		if err != nil {
+			return nil, "", err
+		}
+		if itemInfo == nil {
+			fq.logger.Debug("No item was selected", "queue", queueDirPath)
+			// Nothing is found in our "queue"
+			return nil, "", nil
+		}
+
+		// The lease is started before the item is claimed as the reapers of other runners
+		// would otherwise see the publishing time of a claimed item as an expired lease
+		item := path.Join(queueDirPath, itemInfo.Name())
+		if err = fq.renew(item); err != nil {
+			if _, errGo := os.Stat(item); os.IsNotExist(errGo) {
+				continue
+			}
+			return nil, "", err
+		}
+
+		// Renaming is atomic so only one runner will succeed in claiming the item
+		MsgID = path.Join(claimDir, itemInfo.Name())
+		if errGo := os.Rename(item, MsgID); errGo != nil {
+			if os.IsNotExist(errGo) {
+				continue
+			}
+			return nil, "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", MsgID)
+		}
+
+		// Read the whole file into []byte
+		Msg, err = readBytes(MsgID)
+		if err != nil {
+			return Msg, MsgID, err
+		}
+		return Msg, MsgID, nil
+	}
+	return nil, "", nil
+}
+
+// renew will update the lease timestamp on a claimed message
+//
+func (fq *LocalQueue) renew(MsgID string) (err kv.Error) {
+	now := time.Now()
+	if errGo := os.Chtimes(MsgID, now, now); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", MsgID)
 	}
+	return nil
+}
 
+// Ack will remove a claimed message from the queue once it has been processed
+//
+func (fq *LocalQueue) Ack(MsgID string) (err kv.Error) {
 	if errGo := os.Remove(MsgID); errGo != nil {
-		return Msg, MsgID, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", MsgID)
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", MsgID)
 	}
-	return Msg, MsgID, nil
+	return nil
+}
+
+// Nack will return a claimed message to its queue so that it can be processed again
+//
+func (fq *LocalQueue) Nack(MsgID string) (err kv.Error) {
+	// The claimed message is held in <queue>/inflight/<runner-id>/<message>
+	queuePath := filepath.Dir(filepath.Dir(filepath.Dir(MsgID)))
+	dest := path.Join(queuePath, filepath.Base(MsgID))
+	if errGo := os.Rename(MsgID, dest); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", MsgID).With("dest", dest)
+	}
+	return nil
+}
+
+// Reap will examine the inflight directories of all runners using the queue and will
+// return any messages whose lease has expired to the queue.
+//
+// An expired claim is first moved into a directory private to this runner and its lease checked
+// again, as the runner holding the claim may have renewed it after it was first checked.  Claims
+// renewed in this way are moved back to where they were found.
+//
+func (fq *LocalQueue) Reap(subscription string) (reaped int, err kv.Error) {
+	inflightDir := path.Join(subscription, InflightDir)
+
+	claims, errGo := filepath.Glob(path.Join(inflightDir, "*", "*"))
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", inflightDir)
+	}
+
+	// Claims left in the reaping directories of runners that stopped while reaping are
+	// also found here and will be reaped in the same way as other claims
+	reapingDir := path.Join(inflightDir, fq.runnerID+reapingSuffix)
+	if len(claims) != 0 {
+		if errGo := os.MkdirAll(reapingDir, os.ModeDir|0o775); errGo != nil {
+			return 0, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", reapingDir)
+		}
+	}
+
+	expired := time.Now().Add(-1 * fq.lease)
+	for _, claim := range claims {
+		info, errGo := os.Stat(claim)
+		if errGo != nil {
+			// Claims can be concurrently completed by their owners
+			if os.IsNotExist(errGo) {
+				continue
+			}
+			return reaped, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", claim)
+		}
+		if info.IsDir() || info.ModTime().After(expired) {
+			continue
+		}
+
+		// Other runners might reap the same claim in which case the claim will not be found
+		reaping := path.Join(reapingDir, filepath.Base(claim))
+		if errGo := os.Rename(claim, reaping); errGo != nil {
+			if os.IsNotExist(errGo) {
+				continue
+			}
+			return reaped, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", claim).With("dest", reaping)
+		}
+		if info, errGo = os.Stat(reaping); errGo != nil {
+			if os.IsNotExist(errGo) {
+				continue
+			}
+			return reaped, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", reaping)
+		}
+		if info.ModTime().After(expired) {
+			if errGo := os.Rename(reaping, claim); errGo != nil && !os.IsNotExist(errGo) {
+				return reaped, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", reaping).With("dest", claim)
+			}
+			continue
+		}
+
+		if err = fq.Nack(reaping); err != nil {
+			if _, errGo := os.Stat(reaping); os.IsNotExist(errGo) {
+				continue
+			}
+			return reaped, err
+		}
+		fq.logger.Info("expired lease returned to queue", "queue", subscription, "path", claim)
+		reaped++
+	}
+	return reaped, nil
 }
 
 // Work will connect to the FileQueue "server" identified in the receiver, fq, and will see if any work
@@ -280,6 +463,9 @@ func (fq *LocalQueue) Work(ctx context.Context, qt *task.QueueTask) (msgProcesse
 
 	msgBytes, filePath, err := fq.Get(qt.Subscription)
 	if err != nil {
+		if len(filePath) != 0 {
+			fq.Nack(filePath)
+		}
 		return false, nil, err
 	}
 	if msgBytes == nil {
@@ -291,16 +477,41 @@ func (fq *LocalQueue) Work(ctx context.Context, qt *task.QueueTask) (msgProcesse
 	fq.logger.Info("Got request in:", filePath, "length", len(msgBytes))
 
 	qt.Msg = msgBytes
-	qt.ShortQName = qt.Subscription
+	qt.ShortQName = filepath.Base(qt.Subscription)
+
+	// Keep renewing the lease on the message while the handler is running
+	// so that the reapers of other runners leave it alone
+	renewCtx, renewCancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(fq.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+				if err := fq.renew(filePath); err != nil {
+					fq.logger.Warn("lease renewal failed", "path", filePath, "error", err.Error())
+				}
+			}
+		}
+	}()
 
 	fq.logger.Debug("About to handle task request: ", filePath)
 	rsc, ack, err := qt.Handler(ctx, qt)
+	renewCancel()
+
 	if !ack {
 		fq.logger.Debug("Got NACK on task request: ", filePath, "resubmit to queue: ", qt.Subscription)
-		// Resubmit task again for another chance to execute:
-		fq.Publish(filepath.Base(qt.Subscription), "application/json", msgBytes)
+		// Return the task to the queue for another chance to execute:
+		if errNack := fq.Nack(filePath); errNack != nil {
+			fq.logger.Warn("unable to return task to queue", "path", filePath, "error", errNack.Error())
+		}
 	} else {
 		fq.logger.Debug("Got ACK on task request: ", filePath)
+		if errAck := fq.Ack(filePath); errAck != nil {
+			fq.logger.Warn("unable to remove task from queue", "path", filePath, "error", errAck.Error())
+		}
 		resource = rsc
 	}
 
@@ -312,6 +523,9 @@ func (fq *LocalQueue) Work(ctx context.Context, qt *task.QueueTask) (msgProcesse
 // lot of overhead.
 //
 func (fq *LocalQueue) HasWork(ctx context.Context, subscription string) (hasWork bool, err kv.Error) {
+	if _, err = fq.Reap(subscription); err != nil {
+		fq.logger.Warn("unable to reap expired leases", "queue", subscription, "error", err.Error())
+	}
 	itemInfo, err := fq.getOldestItem(subscription)
 	if err != nil {
 		return false, err
@@ -319,9 +533,83 @@ func (fq *LocalQueue) HasWork(ctx context.Context, subscription string) (hasWork
 	return itemInfo != nil, nil
 }
 
+// Peek will return the resources requested by the oldest message on the local file queue without
+// claiming it.  Messages claimed by other runners between being selected and being read are treated
+// as an empty queue.
+//
+func (fq *LocalQueue) Peek(ctx context.Context, subscription string) (resource *server.Resource, err kv.Error) {
+	itemInfo, err := fq.getOldestItem(subscription)
+	if err != nil || itemInfo == nil {
+		return nil, err
+	}
+
+	itemPath := path.Join(subscription, itemInfo.Name())
+	msg, err := readBytes(itemPath)
+	if err != nil {
+		if _, errGo := os.Stat(itemPath); os.IsNotExist(errGo) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if resource, err = task.PeekResource(msg); err != nil {
+		return nil, err.With("path", itemPath)
+	}
+	return resource, nil
+}
+
 // Responder is used to open a connection to an existing response queue if
 // one was made available and also to provision a channel into which the
-// runner can place report messages
+// runner can place report messages.
+//
+// Reports are encoded as JSON protobuf messages, sealed using the public key supplied
+// by the experimenter, and published as individual files into the response queue directory
+// in the same manner as requests are placed into work queues.  Consumers can use the Get
+// and Ack functions to retrieve reports in the order they were written.
+//
 func (fq *LocalQueue) Responder(ctx context.Context, subscription string, encryptKey *rsa.PublicKey) (sender chan *runnerReports.Report, err kv.Error) {
-	return nil, kv.NewError("Not implemented").With("stack", stack.Trace().TrimRuntime())
+	exists, err := fq.Exists(ctx, subscription)
+	if !exists {
+		if err == nil {
+			err = kv.NewError("response queue not found").With("stack", stack.Trace().TrimRuntime()).With("path", fq.queuePath(subscription))
+		}
+		return nil, err
+	}
+	if encryptKey == nil {
+		return nil, kv.NewError("response queue encryption key missing").With("stack", stack.Trace().TrimRuntime()).With("path", fq.queuePath(subscription))
+	}
+
+	queueName := filepath.Base(fq.queuePath(subscription))
+
+	// Allow up to 64 logging and report messages to be queued before refusing to send more
+	sender = make(chan *runnerReports.Report, 64)
+
+	go func() {
+		for {
+			select {
+			case data := <-sender:
+				if data == nil {
+					// If the responder channel is closed then there is nothing left
+					// to report so we stop
+					return
+				}
+				buf, errGo := protojson.Marshal(data)
+				if errGo != nil {
+					fq.logger.Warn(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).Error())
+					continue
+				}
+				payload, err := defense.HybridSeal(buf, encryptKey)
+				if err != nil {
+					fq.logger.Warn(err.Error())
+					continue
+				}
+				if err := fq.Publish(queueName, "text/plain", []byte(payload)); err != nil {
+					fq.logger.Warn(err.Error(), "stack", stack.Trace().TrimRuntime())
+				}
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sender, nil
 }
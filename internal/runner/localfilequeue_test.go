@@ -6,13 +6,25 @@ package runner
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
 	"github.com/jjeffery/kv" // MIT License
 	"os"
 	"path"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/leaf-ai/go-service/pkg/log"
+	"github.com/leaf-ai/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type TestRequest struct {
@@ -33,10 +45,13 @@ func publish(server *LocalQueue, queue string, r *TestRequest) (err kv.Error) {
 
 func getExpected(server *LocalQueue, queue string, rmap *map[string]int) (err kv.Error) {
 	queuePath := path.Join(server.RootDir, queue)
-	msgBytes, _, err := server.Get(queuePath)
+	msgBytes, msgID, err := server.Get(queuePath)
 	if err != nil {
 		return err.With("queue", queue)
 	}
+	if err = server.Ack(msgID); err != nil {
+		return err.With("queue", queue)
+	}
 	read := &TestRequest{}
 	errGo := json.Unmarshal(msgBytes, read)
 	if errGo != nil {
@@ -173,3 +188,243 @@ func TestFileQueue(t *testing.T) {
 		return
 	}
 }
+
+func TestFileQueueLease(t *testing.T) {
+	dir, errGo := os.MkdirTemp("", "lfq-test")
+	if errGo != nil {
+		t.Fatalf("FAILED to create temp. directory: %v", errGo)
+		return
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	logger := log.NewLogger("local-queue")
+	server := NewLocalQueue(dir, nil, logger)
+
+	queue := "queue1"
+	queuePath := path.Join(server.RootDir, queue)
+	req := TestRequest{
+		Name:  "Iam#1",
+		Value: 111,
+	}
+	if err := publish(server, queue, &req); err != nil {
+		t.Fatalf("FAILED to publish to queue %s - %s", queue, err.Error())
+	}
+
+	// A message published long ago must not be seen by the reapers of other runners as having
+	// an expired lease once claimed
+	published, errGo := filepath.Glob(path.Join(queuePath, "*"))
+	if errGo != nil {
+		t.Fatalf("FAILED to list queue %s - %v", queue, errGo)
+	}
+	for _, item := range published {
+		old := time.Now().Add(-2 * server.lease)
+		if errGo = os.Chtimes(item, old, old); errGo != nil {
+			t.Fatalf("FAILED to age message %s - %v", item, errGo)
+		}
+	}
+
+	// A claimed message should not be visible to other consumers
+	_, msgID, err := server.Get(queuePath)
+	if err != nil {
+		t.Fatalf("FAILED to claim from queue %s - %s", queue, err.Error())
+	}
+	if reaped, err := NewLocalQueue(dir, nil, logger).Reap(queuePath); err != nil || reaped != 0 {
+		t.Fatalf("fresh claim %s reaped - %v", msgID, err)
+	}
+	if filepath.Base(filepath.Dir(filepath.Dir(msgID))) != InflightDir {
+		t.Fatalf("claimed message %s not inflight", msgID)
+	}
+	if err = verifyEmpty(server, queue); err != nil {
+		t.Fatalf("VERIFY QUEUE is empty while claimed: queue %s - %s", queue, err.Error())
+	}
+
+	// A negative acknowledgement returns the message to the queue
+	if err = server.Nack(msgID); err != nil {
+		t.Fatalf("FAILED to nack %s - %s", msgID, err.Error())
+	}
+	if err = verifyEmpty(server, queue); err == nil {
+		t.Fatalf("nacked message was not returned to queue %s", queue)
+	}
+
+	// A claim whose lease has expired is returned to the queue by the reaper
+	if _, msgID, err = server.Get(queuePath); err != nil {
+		t.Fatalf("FAILED to claim from queue %s - %s", queue, err.Error())
+	}
+	expired := time.Now().Add(-2 * server.lease)
+	if errGo = os.Chtimes(msgID, expired, expired); errGo != nil {
+		t.Fatalf("FAILED to age lease %s - %v", msgID, errGo)
+	}
+	reaped, err := server.Reap(queuePath)
+	if err != nil {
+		t.Fatalf("FAILED to reap queue %s - %s", queue, err.Error())
+	}
+	if reaped != 1 {
+		t.Fatalf("unexpected number of reaped leases %d", reaped)
+	}
+
+	// Claims left behind by a runner that stopped while reaping are also reaped
+	if _, msgID, err = server.Get(queuePath); err != nil {
+		t.Fatalf("FAILED to claim from queue %s - %s", queue, err.Error())
+	}
+	abandoned := path.Join(queuePath, InflightDir, "stopped"+reapingSuffix, filepath.Base(msgID))
+	if errGo = os.MkdirAll(filepath.Dir(abandoned), 0o775); errGo != nil {
+		t.Fatalf("FAILED to create reaping directory - %v", errGo)
+	}
+	if errGo = os.Rename(msgID, abandoned); errGo != nil {
+		t.Fatalf("FAILED to abandon lease %s - %v", msgID, errGo)
+	}
+	if errGo = os.Chtimes(abandoned, expired, expired); errGo != nil {
+		t.Fatalf("FAILED to age lease %s - %v", abandoned, errGo)
+	}
+	if reaped, err = server.Reap(queuePath); err != nil || reaped != 1 {
+		t.Fatalf("abandoned lease not reaped %d - %v", reaped, err)
+	}
+
+	// Once acknowledged the message is gone
+	rmap := map[string]int{req.Name: req.Value}
+	if err = getExpected(server, queue, &rmap); err != nil {
+		t.Fatalf("READ BACK data error: queue %s - %s", queue, err.Error())
+	}
+	if err = verifyEmpty(server, queue); err != nil {
+		t.Fatalf("VERIFY QUEUE is empty: queue %s - %s", queue, err.Error())
+	}
+}
+
+func TestFileQueueResponder(t *testing.T) {
+	dir, errGo := os.MkdirTemp("", "lfq-test")
+	if errGo != nil {
+		t.Fatalf("FAILED to create temp. directory: %v", errGo)
+		return
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	logger := log.NewLogger("local-queue")
+	server := NewLocalQueue(dir, nil, logger)
+
+	prvKey, errGo := rsa.GenerateKey(rand.Reader, 2048)
+	if errGo != nil {
+		t.Fatalf("FAILED to generate key: %v", errGo)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Responders are only available for response queues that experimenters have created
+	queue := "queue1_response"
+	if _, err := server.Responder(ctx, queue, &prvKey.PublicKey); err == nil {
+		t.Fatalf("responder created for missing queue %s", queue)
+	}
+	if _, err := server.ensureQueueExists(queue); err != nil {
+		t.Fatalf("FAILED to create queue %s - %s", queue, err.Error())
+	}
+	responseQ, err := server.Responder(ctx, queue, &prvKey.PublicKey)
+	if err != nil {
+		t.Fatalf("FAILED to create responder for queue %s - %s", queue, err.Error())
+	}
+
+	responseQ <- &runnerReports.Report{
+		Time: timestamppb.Now(),
+		ExecutorId: &wrapperspb.StringValue{
+			Value: "test",
+		},
+		Payload: &runnerReports.Report_Logging{
+			Logging: &runnerReports.LogEntry{
+				Time:     timestamppb.Now(),
+				Severity: runnerReports.LogSeverity_Info,
+				Message: &wrapperspb.StringValue{
+					Value: "responder test",
+				},
+			},
+		},
+	}
+
+	queuePath := path.Join(server.RootDir, queue)
+	msg := []byte{}
+	msgID := ""
+	for i := 0; i != 50 && len(msg) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if msg, msgID, err = server.Get(queuePath); err != nil {
+			t.Fatalf("FAILED to read queue %s - %s", queue, err.Error())
+		}
+	}
+	if len(msg) == 0 {
+		t.Fatalf("no report was written to queue %s", queue)
+	}
+	if err = server.Ack(msgID); err != nil {
+		t.Fatalf("FAILED to ack %s - %s", msgID, err.Error())
+	}
+
+	buf, err := defense.Unseal(string(msg), prvKey)
+	if err != nil {
+		t.Fatalf("FAILED to unseal report - %s", err.Error())
+	}
+	report := &runnerReports.Report{}
+	if errGo = protojson.Unmarshal(buf, report); errGo != nil {
+		t.Fatalf("FAILED to decode report - %v", errGo)
+	}
+	if report.GetLogging().GetMessage().GetValue() != "responder test" {
+		t.Fatalf("unexpected report contents %s", string(buf))
+	}
+}
+
+func TestFileQueuePeek(t *testing.T) {
+	dir, errGo := os.MkdirTemp("", "lfq-test")
+	if errGo != nil {
+		t.Fatalf("FAILED to create temp. directory: %v", errGo)
+		return
+	}
+	defer os.RemoveAll(dir) // clean up
+
+	logger := log.NewLogger("local-queue")
+	fq := NewLocalQueue(dir, nil, logger)
+
+	queue := "queue1"
+	queuePath := path.Join(fq.RootDir, queue)
+
+	if _, err := fq.ensureQueueExists(queue); err != nil {
+		t.Fatalf("FAILED to create queue %s - %s", queue, err.Error())
+	}
+	rsc, err := fq.Peek(context.Background(), queuePath)
+	if err != nil {
+		t.Fatalf("FAILED to peek at queue %s - %s", queue, err.Error())
+	}
+	if rsc != nil {
+		t.Fatalf("empty queue %s returned a resource %v", queue, rsc)
+	}
+
+	// The clear text resource request of an encrypted message is available without claiming the message
+	envelope := &defense.Envelope{
+		Message: defense.Message{
+			Resource: server.Resource{Cpus: 4, Gpus: 1, Ram: "8gb", Hdd: "10gb"},
+			Payload:  "encrypted",
+		},
+	}
+	buf, errGo := envelope.Marshal()
+	if errGo != nil {
+		t.Fatalf("FAILED to marshal envelope - %v", errGo)
+	}
+	if err = fq.Publish(queue, "application/json", buf); err != nil {
+		t.Fatalf("FAILED to publish to queue %s - %s", queue, err.Error())
+	}
+
+	if rsc, err = fq.Peek(context.Background(), queuePath); err != nil {
+		t.Fatalf("FAILED to peek at queue %s - %s", queue, err.Error())
+	}
+	if rsc == nil || rsc.Cpus != 4 || rsc.Gpus != 1 || rsc.Ram != "8gb" {
+		t.Fatalf("unexpected resource %v peeked from queue %s", rsc, queue)
+	}
+	if err = verifyEmpty(fq, queue); err == nil {
+		t.Fatalf("peeked message was claimed from queue %s", queue)
+	}
+
+	msg, msgID, err := fq.Get(queuePath)
+	if err != nil {
+		t.Fatalf("FAILED to claim from queue %s - %s", queue, err.Error())
+	}
+	if string(msg) != string(buf) {
+		t.Fatalf("claimed message differs from the published message on queue %s", queue)
+	}
+	if err = fq.Ack(msgID); err != nil {
+		t.Fatalf("FAILED to ack %s - %s", msgID, err.Error())
+	}
+}
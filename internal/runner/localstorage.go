@@ -6,20 +6,15 @@ package runner
 // be used by the runner to retrieve storage from local storage
 
 import (
-	"archive/tar"
 	"bufio"
-	"compress/bzip2"
-	"compress/gzip"
 	"context"
 	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 
-	"github.com/leaf-ai/go-service/pkg/mime"
-	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/archives"
 
 	"github.com/go-stack/stack"
 
@@ -74,7 +69,7 @@ func (s *localStorage) Fetch(ctx context.Context, name string, unpack bool, outp
 		return 0, warns, kv.NewError(output+" is not a directory").With("stack", stack.Trace().TrimRuntime())
 	}
 
-	fileType, err := mime.MimeFromExt(name)
+	fileType, err := archives.FetchType(name, "")
 	if err != nil {
 		warns = append(warns, kv.Wrap(err).With("fn", name).With("type", fileType).With("stack", stack.Trace().TrimRuntime()))
 	} else {
@@ -87,80 +82,31 @@ func (s *localStorage) Fetch(ctx context.Context, name string, unpack bool, outp
 	}
 	defer obj.Close()
 
-	return fetcher(obj, name, output, maxBytes, fileType, unpack)
-}
+	// Create a stack of readers that first tee off any data read to a tap
+	var src io.Reader = obj
+	if tap != nil {
+		src = io.TeeReader(obj, tap)
+	}
 
-func addReader(obj *os.File, fileType string) (inReader io.ReadCloser, err kv.Error) {
-	switch fileType {
-	case "application/x-gzip", "application/zip":
-		reader, errGo := gzip.NewReader(obj)
-		if errGo != nil {
-			return reader, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	if size, warns, err = fetcher(src, name, output, maxBytes, fileType, unpack); err != nil {
+		return 0, warns, err
+	}
+
+	if tap != nil {
+		// Archives can end before the content does, for example with padding, so the
+		// remainder is read to complete the copy being made by the tap
+		if _, errGo = io.Copy(ioutil.Discard, src); errGo != nil {
+			return 0, warns, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 		}
-		inReader = reader
-	case "application/bzip2", "application/octet-stream":
-		inReader = ioutil.NopCloser(bzip2.NewReader(obj))
-	default:
-		inReader = ioutil.NopCloser(obj)
 	}
-	return inReader, err
+	return size, warns, nil
 }
 
-func fetcher(obj *os.File, name string, output string, maxBytes int64, fileType string, unpack bool) (size int64, warns []kv.Error, err kv.Error) {
-	// If the unpack flag is set then use a tar decompressor and unpacker
-	// but first make sure the output location is an existing directory
+func fetcher(obj io.Reader, name string, output string, maxBytes int64, fileType string, unpack bool) (size int64, warns []kv.Error, err kv.Error) {
+	// If the unpack flag is set then use an archive decompressor and unpacker
 	if unpack {
-
-		inReader, err := addReader(obj, fileType)
-		if err != nil {
-			return 0, warns, err
-		}
-		defer inReader.Close()
-
-		tarReader := tar.NewReader(inReader)
-
-		for {
-			header, errGo := tarReader.Next()
-			if errors.Is(errGo, io.EOF) {
-				break
-			} else if errGo != nil {
-				return 0, warns, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-			}
-
-			if escapes, err := defense.WillEscape(header.Name, output); escapes {
-				if err != nil {
-					return 0, warns, kv.Wrap(err).With("filename", header.Name, "output", output)
-				} else {
-					return 0, warns, kv.NewError("archive escaped").With("filename", header.Name, "output", output)
-				}
-			}
-
-			path, _ := filepath.Abs(filepath.Join(output, header.Name))
-			if !strings.HasPrefix(path, output) {
-				return 0, warns, kv.NewError("archive file name escaped").With("filename", header.Name).With("stack", stack.Trace().TrimRuntime())
-			}
-
-			info := header.FileInfo()
-			if info.IsDir() {
-				if errGo = os.MkdirAll(path, info.Mode()); errGo != nil {
-					return 0, warns, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-				}
-				continue
-			}
-
-			file, errGo := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
-			if errGo != nil {
-				return 0, warns, kv.Wrap(errGo).With("file", path).With("stack", stack.Trace().TrimRuntime())
-			}
-
-			size, errGo = io.CopyN(file, tarReader, maxBytes)
-			file.Close()
-			if errGo != nil {
-				if !errors.Is(errGo, io.EOF) {
-					return 0, warns, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-				}
-				errGo = nil
-			}
+		if size, err = archives.Unpack(obj, fileType, output, maxBytes); err != nil {
+			return 0, warns, err.With("name", name, "fileType", fileType)
 		}
 	} else {
 		fn := filepath.Join(output, filepath.Base(name))
@@ -148,7 +148,7 @@ func s3AnonAccess(t *testing.T, mts *minio_local.MinioTestServer, logger *log.Lo
 	env := map[string]string{}
 
 	for i, bucket := range bucketsAndBlobs {
-		authS3, err := s3.NewS3storage(ctx, creds, env, mts.Address, bucket.name, "", false, false)
+		authS3, err := s3.NewS3storage(ctx, creds, env, mts.Address, bucket.name, "", "", false, false)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -163,7 +163,7 @@ func s3AnonAccess(t *testing.T, mts *minio_local.MinioTestServer, logger *log.Lo
 		creds.SecretKey = ""
 		// The last bucket is the one with the anonymous access
 		if i == len(bucketsAndBlobs)-1 {
-			anonS3, err := s3.NewS3storage(ctx, creds, env, mts.Address, bucket.name, "", false, false)
+			anonS3, err := s3.NewS3storage(ctx, creds, env, mts.Address, bucket.name, "", "", false, false)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -177,7 +177,7 @@ func s3AnonAccess(t *testing.T, mts *minio_local.MinioTestServer, logger *log.Lo
 
 		// Take the first bucket and make sure we cannot access it and get an error of some description as a negative test
 		if i == 0 {
-			anonS3, err := s3.NewS3storage(ctx, creds, env, mts.Address, bucket.name, "", false, false)
+			anonS3, err := s3.NewS3storage(ctx, creds, env, mts.Address, bucket.name, "", "", false, false)
 			if err != nil {
 				continue
 			}
@@ -217,7 +217,7 @@ func limitTest(ctx context.Context, t *testing.T, mts *minio_local.MinioTestServ
 
 	env := map[string]string{}
 
-	authS3, err := s3.NewS3storage(ctx, creds, env, mts.Address, test.bucket, "", false, false)
+	authS3, err := s3.NewS3storage(ctx, creds, env, mts.Address, test.bucket, "", "", false, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,519 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of read only artifacts.  Immutable artifacts that are
+// marked for read only mounting are unpacked once into a directory within the artifact cache
+// named using the hash of the artifact, and then mounted into the directories of the
+// experiments that use them using read only bind mounts.  Runners without the privileges
+// needed for bind mounts hard link the files instead, and the unpacked files have their
+// write permissions removed.
+//
+// Experiments using an unpacked artifact hold a reference to it, both within the runner and
+// using a shared file lock visible to other runners sharing the cache directory, and referenced
+// artifacts are never removed by the groomer.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	mountCacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_mount_cache_hits",
+			Help: "Number of read only artifacts that were already unpacked.",
+		},
+		[]string{"host", "hash"},
+	)
+	mountCacheMisses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_mount_cache_misses",
+			Help: "Number of read only artifacts that needed unpacking.",
+		},
+		[]string{"host", "hash"},
+	)
+
+	// mountInUse counts the experiments using each of the unpacked artifacts
+	mountInUse     = map[string]int{}
+	mountInUseSync sync.Mutex
+)
+
+const (
+	// mountCacheDir is the directory within the artifact cache in which read only artifacts are
+	// unpacked, being a dot directory it is ignored by the artifact groomer
+	mountCacheDir = ".mounts"
+
+	// mountCachePrefix is used to distinguish unpacked artifacts within the LRU cache
+	mountCachePrefix = "mount-"
+)
+
+// mountRef is a reference held by an experiment to an unpacked artifact
+//
+type mountRef struct {
+	key  string
+	lock *os.File
+	// target is the bind mount within the experiment directory, empty when hard links were used
+	target string
+}
+
+// Inode identifies a file independently of the paths used to reach it
+//
+type Inode struct {
+	Dev uint64
+	Ino uint64
+}
+
+// FileInode returns the inode of a file from the information returned when it was examined
+//
+func FileInode(info os.FileInfo) (inode Inode, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inode, false
+	}
+	return Inode{Dev: uint64(stat.Dev), Ino: stat.Ino}, true
+}
+
+// mountEntry is the value stored in the LRU cache for each unpacked artifact, its size
+// is used by the cache to count the artifact against the cache size budget
+//
+type mountEntry struct {
+	size int64
+}
+
+// Size returns the number of bytes the unpacked artifact occupies on disk
+//
+func (e *mountEntry) Size() int64 {
+	return e.size
+}
+
+// mountCacheRoot returns the directory in which read only artifacts are unpacked, or an
+// empty string if the artifact cache is not being used
+//
+func mountCacheRoot() (root string) {
+	if len(backingDir) == 0 || cache == nil {
+		return ""
+	}
+	return filepath.Join(backingDir, mountCacheDir)
+}
+
+// mountKey produces the name of the directory for an unpacked artifact from the hash of the artifact
+// supplied by the storage platform.  The name of the artifact is included as it can determine
+// the archive format.
+//
+func mountKey(hash string, name string) (key string) {
+	digest := sha256.New()
+	io.WriteString(digest, hash+"\n"+filepath.Base(name))
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// setWritable adds, or removes, the owner write permission for the files and directories within dir
+//
+func setWritable(dir string, writable bool) (err kv.Error) {
+	errGo := filepath.Walk(dir, func(path string, info os.FileInfo, errGo error) error {
+		if errGo != nil {
+			return errGo
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		mode := info.Mode().Perm() &^ 0222
+		if writable {
+			mode |= 0200
+		}
+		return os.Chmod(path, mode)
+	})
+	if errGo != nil {
+		return kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// removeMount removes an unpacked artifact from the disk
+//
+func removeMount(dir string) (err kv.Error) {
+	// Directories without write permissions cannot have their contents removed
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, errGo error) error {
+		if errGo == nil && info.IsDir() {
+			_ = os.Chmod(path, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+	if errGo := os.RemoveAll(dir); errGo != nil {
+		return kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// bindReadOnly mounts an unpacked artifact onto the dest directory using a read only bind
+// mount so that experiments cannot alter the shared files, even by changing their permissions.
+// Bind mounts need the runner to have the CAP_SYS_ADMIN capability.
+//
+func bindReadOnly(dir string, dest string) (err kv.Error) {
+	if errGo := os.MkdirAll(dest, 0700); errGo != nil {
+		return kv.Wrap(errGo).With("dir", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo := syscall.Mount(dir, dest, "", syscall.MS_BIND, ""); errGo != nil {
+		return kv.Wrap(errGo).With("dir", dir, "dest", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+	// The read only flag is ignored by the initial bind and has to be applied using a remount
+	if errGo := syscall.Mount("", dest, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); errGo != nil {
+		_ = syscall.Unmount(dest, syscall.MNT_DETACH)
+		return kv.Wrap(errGo).With("dir", dir, "dest", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// acquireMount returns the directory of an unpacked artifact along with a shared lock that
+// prevents it being removed.  If the artifact has not been unpacked the unpack function is
+// called to do so using a staging directory, unless another runner is doing the same in which
+// case the artifact is waited for.
+//
+func acquireMount(ctx context.Context, root string, key string, unpack func(staging string) kv.Error) (dir string, lock *os.File, err kv.Error) {
+
+	if errGo := os.MkdirAll(root, 0700); errGo != nil {
+		return "", nil, kv.Wrap(errGo).With("dir", root).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	dir = filepath.Join(root, key)
+	hit := true
+
+	for {
+		if lock, err = tryLockExclusive(dir+lockSuffix, true); err != nil {
+			return "", nil, err
+		}
+		if lock != nil {
+			if _, errGo := os.Stat(dir); errGo != nil {
+				hit = false
+				if err = unpackMount(root, dir, unpack); err != nil {
+					unlock(lock)
+					return "", nil, err
+				}
+			}
+			if err = downgrade(lock); err != nil {
+				unlock(lock)
+				return "", nil, err
+			}
+		} else {
+			// Another runner, or experiment, holds the lock either while unpacking the artifact
+			// or while using it
+			if lock, err = lockSharedWait(ctx, dir+lockSuffix); err != nil {
+				return "", nil, err
+			}
+		}
+
+		// Once the lock is shared it could have been taken by the groomer of another runner
+		if _, errGo := os.Stat(dir); errGo == nil && sameFile(lock) {
+			break
+		}
+		unlock(lock)
+
+		if ctx.Err() != nil {
+			return "", nil, kv.Wrap(ctx.Err()).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	// Record the use of the artifact for other runners sharing the cache directory
+	now := time.Now()
+	_ = os.Chtimes(dir, now, now)
+
+	mountInUseSync.Lock()
+	mountInUse[key]++
+	mountInUseSync.Unlock()
+
+	if hit {
+		// Getting the item promotes it within the LRU
+		if item := cache.Get(mountCachePrefix + key); item != nil && !item.Expired() {
+			item.Extend(cacheTTL)
+		}
+		mountCacheHits.With(prometheus.Labels{"host": host, "hash": key}).Inc()
+	} else {
+		mountCacheMisses.With(prometheus.Labels{"host": host, "hash": key}).Inc()
+	}
+	if item := cache.Sample(mountCachePrefix + key); item == nil || item.Expired() {
+		if size, err := pythonEnvSize(dir); err == nil {
+			addMount(key, size, cacheTTL)
+		}
+	}
+	return dir, lock, nil
+}
+
+// unpackMount unpacks an artifact into a staging directory that, once complete, is made read
+// only and moved into place
+//
+func unpackMount(root string, dir string, unpack func(staging string) kv.Error) (err kv.Error) {
+	staging, errGo := ioutil.TempDir(root, ".staging-")
+	if errGo != nil {
+		return kv.Wrap(errGo).With("dir", root).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if err = unpack(staging); err == nil {
+		if err = setWritable(staging, false); err == nil {
+			if errGo = os.Rename(staging, dir); errGo != nil {
+				err = kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+	}
+	if err != nil {
+		_ = removeMount(staging)
+	}
+	return err
+}
+
+// releaseMount is used once an experiment has finished with an unpacked artifact
+//
+func releaseMount(ref mountRef) {
+	mountInUseSync.Lock()
+	if mountInUse[ref.key]--; mountInUse[ref.key] <= 0 {
+		delete(mountInUse, ref.key)
+	}
+	mountInUseSync.Unlock()
+
+	if len(ref.target) != 0 {
+		_ = syscall.Unmount(ref.target, syscall.MNT_DETACH)
+	}
+	unlock(ref.lock)
+}
+
+// addMount records an unpacked artifact in the LRU cache
+//
+func addMount(key string, size int64, ttl time.Duration) {
+	cacheKnownSync.Lock()
+	cacheKnown[mountCachePrefix+key] = struct{}{}
+	cacheKnownSync.Unlock()
+
+	cache.Set(mountCachePrefix+key, &mountEntry{size: size}, ttl)
+}
+
+// copyTree copies the files of an unpacked artifact into the dest directory retaining their
+// permissions.  Files are never hard linked as experiments would then share the inodes of the
+// cache and could change the files seen by every other experiment.  Directories are created
+// writable so that they can be removed once the experiment is complete.
+//
+func copyTree(src string, dest string) (size int64, err kv.Error) {
+	errGo := filepath.Walk(src, func(path string, info os.FileInfo, errGo error) error {
+		if errGo != nil {
+			return errGo
+		}
+		rel, errGo := filepath.Rel(src, path)
+		if errGo != nil {
+			return errGo
+		}
+		target := filepath.Join(dest, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, errGo := os.Readlink(path)
+			if errGo != nil {
+				return errGo
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			size += info.Size()
+			in, errGo := os.Open(path)
+			if errGo != nil {
+				return errGo
+			}
+			defer in.Close()
+			out, errGo := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+			if errGo != nil {
+				return errGo
+			}
+			if _, errGo = io.Copy(out, in); errGo != nil {
+				out.Close()
+				return errGo
+			}
+			return out.Close()
+		}
+		return nil
+	})
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("src", src, "dest", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+	return size, nil
+}
+
+// loadMounts populates the LRU cache with the artifacts that were unpacked by previous runs of
+// the runner, or by other runners sharing the cache directory
+//
+func loadMounts(root string) {
+	dirs, errGo := ioutil.ReadDir(root)
+	if errGo != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		if size, err := pythonEnvSize(filepath.Join(root, dir.Name())); err == nil {
+			addMount(dir.Name(), size, cacheTTL)
+		}
+	}
+}
+
+// groomMounts removes unpacked artifacts that have been evicted from, or have expired within,
+// the LRU cache and that are not being used by any experiments of this, or any other, runner.
+// Artifacts unpacked, or used recently, by other runners are added to the LRU cache.
+//
+func groomMounts(root string, errorC chan kv.Error) {
+	dirs, errGo := ioutil.ReadDir(root)
+	if errGo != nil {
+		return
+	}
+
+	mountInUseSync.Lock()
+	defer mountInUseSync.Unlock()
+
+	for _, dir := range dirs {
+		key := dir.Name()
+		path := filepath.Join(root, key)
+
+		// Staging directories are left by runners that failed while unpacking
+		if strings.HasPrefix(key, ".staging-") {
+			if time.Since(dir.ModTime()) > cacheTTL {
+				_ = removeMount(path)
+			}
+			continue
+		}
+		if !dir.IsDir() || strings.HasPrefix(key, ".") {
+			continue
+		}
+		if _, isPresent := mountInUse[key]; isPresent {
+			continue
+		}
+		item := cache.Sample(mountCachePrefix + key)
+		if item != nil && !item.Expired() {
+			continue
+		}
+		if used := time.Since(dir.ModTime()); used < cacheTTL {
+			cacheKnownSync.Lock()
+			_, isKnown := cacheKnown[mountCachePrefix+key]
+			cacheKnownSync.Unlock()
+			if item != nil || !isKnown {
+				if size, err := pythonEnvSize(path); err == nil {
+					addMount(key, size, cacheTTL-used)
+					continue
+				}
+			}
+		}
+
+		lock, err := tryLockExclusive(path+lockSuffix, true)
+		if err != nil || lock == nil {
+			continue
+		}
+		if err = removeMount(path); err != nil {
+			unlock(lock)
+			select {
+			case errorC <- kv.Wrap(err, "read only artifact remove failed").With("dir", path):
+			default:
+			}
+			continue
+		}
+		unlockRemove(lock)
+	}
+}
+
+// fetchMount retrieves an immutable artifact that is to be mounted read only into the experiment
+// directory dest, holding a reference to it on behalf of the experiment using the directory
+// expDir
+//
+func (cache *ArtifactCache) fetchMount(ctx context.Context, storage *objStore, key string, expDir string, dest string, maxBytes int64) (size int64, warns []kv.Error, err kv.Error) {
+
+	hash, err := storage.Hash(ctx, key)
+	if err != nil {
+		return 0, warns, err
+	}
+
+	unpack := func(staging string) (err kv.Error) {
+		w := []kv.Error{}
+		_, w, err = storage.Fetch(ctx, key, true, staging, maxBytes)
+		warns = append(warns, w...)
+		return err
+	}
+
+	dir, lock, err := acquireMount(ctx, mountCacheRoot(), mountKey(hash, key), unpack)
+	if err != nil {
+		return 0, warns, err
+	}
+
+	ref := mountRef{key: mountKey(hash, key), lock: lock}
+	if bindReadOnly(dir, dest) == nil {
+		ref.target = dest
+
+		cache.Lock()
+		cache.mounts[expDir] = append(cache.mounts[expDir], ref)
+		cache.Unlock()
+
+		size, err = pythonEnvSize(dir)
+		return size, warns, err
+	}
+
+	// Without the privileges needed for bind mounts the experiment is given a copy of the files
+	// that, being its own, counts against its disk space
+	defer releaseMount(ref)
+
+	if size, err = copyTree(dir, dest); err != nil {
+		return 0, warns, err
+	}
+	warns = append(warns, kv.NewError("read only artifact copied, bind mounts are not available to the runner").With("dir", dir, "dest", dest).With("stack", stack.Trace().TrimRuntime()))
+	return size, warns, nil
+}
+
+// MountedInodes returns the inodes of the files within the read only artifacts used by the
+// experiment in dir.  These files are shared with other experiments and so are not counted
+// against the disk space used by the experiment.
+//
+func (cache *ArtifactCache) MountedInodes(dir string) (inodes map[Inode]struct{}) {
+	inodes = map[Inode]struct{}{}
+	if cache == nil {
+		return inodes
+	}
+
+	cache.Lock()
+	refs := append([]mountRef{}, cache.mounts[dir]...)
+	cache.Unlock()
+
+	for _, ref := range refs {
+		_ = filepath.Walk(filepath.Join(mountCacheRoot(), ref.key), func(path string, info os.FileInfo, errGo error) error {
+			if errGo != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			if inode, ok := FileInode(info); ok {
+				inodes[inode] = struct{}{}
+			}
+			return nil
+		})
+	}
+	return inodes
+}
+
+// Release is used once an experiment is complete to release the read only artifacts it was using,
+// and the record of the artifacts it used, dir being the directory of the experiment
+//
+func (cache *ArtifactCache) Release(dir string) {
+	cache.Lock()
+	refs := cache.mounts[dir]
+	delete(cache.mounts, dir)
+	delete(cache.provenance, dir)
+	cache.Unlock()
+
+	for _, ref := range refs {
+		releaseMount(ref)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+	"github.com/karlmutch/ccache"
+)
+
+// TestMounts checks that read only artifacts are unpacked once, linked into experiment
+// directories without write permissions, and retained until no longer in use
+func TestMounts(t *testing.T) {
+	ctx := context.Background()
+
+	dir, errGo := ioutil.TempDir("", "mounts")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	savedDir, savedCache := backingDir, cache
+	defer func() {
+		backingDir, cache = savedDir, savedCache
+	}()
+	backingDir = dir
+	cache = ccache.New(ccache.Configure().MaxSize(1024 * 1024).GetsPerPromote(1).ItemsToPrune(1))
+	defer cache.Stop()
+
+	root := mountCacheRoot()
+	unpacked := 0
+	unpack := func(staging string) kv.Error {
+		unpacked++
+		if errGo := os.MkdirAll(filepath.Join(staging, "data"), 0700); errGo != nil {
+			return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		if errGo := ioutil.WriteFile(filepath.Join(staging, "data", "train.csv"), []byte("1,2,3\n"), 0600); errGo != nil {
+			return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		return nil
+	}
+
+	key := mountKey("hash", "dataset.tar")
+	refs := []mountRef{}
+	for i := 0; i != 2; i++ {
+		src, lock, err := acquireMount(ctx, root, key, unpack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, mountRef{key: key, lock: lock})
+
+		dest := filepath.Join(dir, "experiment", "dataset")
+		if _, err = copyTree(src, dest); err != nil {
+			t.Fatal(err)
+		}
+		info, errGo := os.Stat(filepath.Join(dest, "data", "train.csv"))
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if info.Mode().Perm()&0222 != 0 {
+			t.Fatal("read only artifact was writable", info.Mode())
+		}
+
+		// Copies must not share the files of the cache that other experiments use
+		cached, errGo := os.Stat(filepath.Join(src, "data", "train.csv"))
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if os.SameFile(info, cached) {
+			t.Fatal("read only artifact shares its files with the cache")
+		}
+		if errGo = os.RemoveAll(filepath.Join(dir, "experiment")); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+	if unpacked != 1 {
+		t.Fatal("artifact was unpacked more than once", unpacked)
+	}
+
+	// Artifacts in use survive grooming even once they are evicted
+	cache.Delete(mountCachePrefix + key)
+	groomMounts(root, nil)
+	if _, errGo = os.Stat(filepath.Join(root, key)); errGo != nil {
+		t.Fatal("artifact in use was removed", errGo)
+	}
+
+	for _, ref := range refs {
+		releaseMount(ref)
+	}
+	cache.Delete(mountCachePrefix + key)
+	cacheKnownSync.Lock()
+	delete(cacheKnown, mountCachePrefix+key)
+	cacheKnownSync.Unlock()
+	old := time.Now().Add(-2 * cacheTTL)
+	if errGo = os.Chtimes(filepath.Join(root, key), old, old); errGo != nil {
+		t.Fatal(errGo)
+	}
+	groomMounts(root, nil)
+	if _, errGo = os.Stat(filepath.Join(root, key)); !os.IsNotExist(errGo) {
+		t.Fatal("evicted artifact was retained", errGo)
+	}
+}
+
+// TestBindReadOnly checks that artifacts mounted using bind mounts cannot be written to, the
+// test is skipped when the privileges needed for bind mounts are not available
+func TestBindReadOnly(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "mounts-bind")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if errGo = os.MkdirAll(src, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(src, "train.csv"), []byte("1,2,3\n"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	dest := filepath.Join(dir, "experiment", "dataset")
+	if err := bindReadOnly(src, dest); err != nil {
+		t.Skip("bind mounts are not available", err.Error())
+	}
+	defer syscall.Unmount(dest, syscall.MNT_DETACH)
+
+	if errGo = os.Chmod(filepath.Join(dest, "train.csv"), 0600); errGo == nil {
+		t.Fatal("bind mounted artifact permissions were changed")
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(dest, "train.csv"), []byte("4,5,6\n"), 0600); errGo == nil {
+		t.Fatal("bind mounted artifact was written")
+	}
+}
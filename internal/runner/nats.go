@@ -0,0 +1,527 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This contains the implementation of a NATS JetStream client that will be used to
+// retrieve work from subjects within JetStream streams.
+//
+// Each subject, without wildcards, captured by a stream is treated as a StudioML queue
+// and is identified using a subscription of the form stream?subject.  Work is retrieved
+// using a durable pull consumer for each subject which is shared by all of the runners
+// servicing the subject.
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
+
+	"github.com/leaf-ai/go-service/pkg/log"
+	"github.com/leaf-ai/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+	"github.com/leaf-ai/studio-go-runner/pkg/wrapper"
+
+	"github.com/nats-io/nats.go"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	natsAckWaitOpt    = flag.Duration("nats-ack-wait", time.Duration(time.Minute), "the period of time a NATS JetStream message is held by a runner without acknowledgement before being redelivered, runners send in progress heartbeats while experiments run")
+	natsRetryLimitOpt = flag.Uint("nats-retry-limit", 5, "the number of times a message will be delivered from a NATS JetStream subject before being terminated, 0 disables the limit")
+
+	// natsConsumerChars matches the characters that cannot be used in the names of durable consumers
+	natsConsumerChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+// ValidateNATSOpts checks the command line options used by NATS queues, in progress heartbeats
+// are sent on a fraction of the acknowledgement wait and so it must be positive
+//
+func ValidateNATSOpts() (errs []kv.Error) {
+	if *natsAckWaitOpt <= 0 {
+		errs = append(errs, kv.NewError("the nats-ack-wait option must be positive").With("nats-ack-wait", natsAckWaitOpt.String()))
+	}
+	return errs
+}
+
+// NATS encapsulates the configuration for a NATS server with JetStream enabled
+//
+type NATS struct {
+	url      string          // URL of the NATS server including any credentials
+	Identity string          // A URL stripped of the user name and password, making it safe for logging etc
+	creds    string          // An optional NATS credentials file
+	timeout  time.Duration   // The timeout used for JetStream API requests
+	wrapper  wrapper.Wrapper // Decryption information for messages with encrypted payloads
+	logger   *log.Logger
+}
+
+// NewNATS takes the URL of a NATS server, optional user information, being a user name and
+// password, or a token, as returned in the Cred of the queue descriptions from GetKnown, and an
+// optional credentials file, and will configure the client data structure needed to call methods
+// against the server
+//
+func NewNATS(serverURL string, userInfo string, creds string, w wrapper.Wrapper, logger *log.Logger) (nq *NATS, err kv.Error) {
+
+	if serverURL, err = withUserInfo(os.ExpandEnv(serverURL), userInfo); err != nil {
+		return nil, err
+	}
+	identity, errGo := url.Parse(serverURL)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	identity.User = nil
+	identity.RawQuery = ""
+	identity.Fragment = ""
+
+	return &NATS{
+		url:      serverURL,
+		Identity: identity.String(),
+		creds:    creds,
+		timeout:  15 * time.Second,
+		wrapper:  w,
+		logger:   logger,
+	}, nil
+}
+
+// userInfo returns the user information, a user name and password or a token, within a URL in
+// its encoded form, or an empty string when there is none
+//
+func userInfo(serverURL string) (info string) {
+	parsed, errGo := url.Parse(serverURL)
+	if errGo != nil || parsed.User == nil {
+		return ""
+	}
+	return parsed.User.String()
+}
+
+// withUserInfo returns the URL with the encoded user information added, replacing any that
+// was already present.  Empty user information leaves the URL unchanged.
+//
+func withUserInfo(serverURL string, info string) (result string, err kv.Error) {
+	if len(info) == 0 {
+		return serverURL, nil
+	}
+	parsed, errGo := url.Parse(serverURL)
+	if errGo != nil {
+		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	user, errGo := url.Parse("//" + info + "@")
+	if errGo != nil {
+		return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	parsed.User = user.User
+	return parsed.String(), nil
+}
+
+func (nq *NATS) IsEncrypted() (encrypted bool) {
+	return nil != nq.wrapper
+}
+
+// attach opens a connection to the NATS server and a JetStream context for the connection
+//
+func (nq *NATS) attach() (nc *nats.Conn, js nats.JetStreamContext, err kv.Error) {
+	opts := []nats.Option{
+		nats.Name("studio-go-runner " + host),
+		nats.Timeout(nq.timeout),
+	}
+	if len(nq.creds) != 0 {
+		opts = append(opts, nats.UserCredentials(nq.creds))
+	}
+
+	nc, errGo := nats.Connect(nq.url, opts...)
+	if errGo != nil {
+		return nil, nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", nq.Identity)
+	}
+	if js, errGo = nc.JetStream(nats.MaxWait(nq.timeout)); errGo != nil {
+		nc.Close()
+		return nil, nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", nq.Identity)
+	}
+	return nc, js, nil
+}
+
+// natsSubscription splits a subscription into the stream and subject it refers to, subscriptions
+// without a stream are used when only a subject is known
+//
+func natsSubscription(subscription string) (stream string, subject string) {
+	splits := strings.SplitN(subscription, "?", 2)
+	if len(splits) != 2 {
+		return "", strings.Trim(subscription, "/")
+	}
+	return splits[0], strings.Trim(splits[1], "/")
+}
+
+// natsConsumer returns the name of the durable consumer shared by runners for a subject
+//
+func natsConsumer(subject string) (durable string) {
+	return "studioml-" + natsConsumerChars.ReplaceAllString(subject, "_")
+}
+
+// isWildcard is used to detect stream subjects that cannot be used as queues
+//
+func isWildcard(subject string) bool {
+	return strings.ContainsAny(subject, "*>")
+}
+
+// findStream returns the name of the stream that captures the subject, or an empty string if
+// no stream captures it
+//
+func (nq *NATS) findStream(js nats.JetStreamContext, subject string) (stream string) {
+	for info := range js.StreamsInfo() {
+		for _, captured := range info.Config.Subjects {
+			if captured == subject {
+				return info.Config.Name
+			}
+		}
+	}
+	return ""
+}
+
+// Refresh will examine the streams of the NATS server and extract a list of the subjects
+// that relate to StudioML work
+//
+func (nq *NATS) Refresh(ctx context.Context, matcher *regexp.Regexp, mismatcher *regexp.Regexp) (known map[string]interface{}, err kv.Error) {
+
+	known = map[string]interface{}{}
+
+	nc, js, err := nq.attach()
+	if err != nil {
+		return known, err
+	}
+	defer nc.Close()
+
+	for info := range js.StreamsInfo(nats.Context(ctx)) {
+		for _, subject := range info.Config.Subjects {
+			if isWildcard(subject) {
+				continue
+			}
+			// Make sure any retrieved subjects match the caller supplied regular expression
+			if matcher != nil && !matcher.MatchString(subject) {
+				continue
+			}
+			// We cannot allow an excluded subject
+			if mismatcher != nil && mismatcher.MatchString(subject) {
+				continue
+			}
+			known[info.Config.Name+"?"+subject] = info.Config.Name
+		}
+	}
+
+	if errGo := ctx.Err(); errGo != nil {
+		return known, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", nq.Identity)
+	}
+	return known, nil
+}
+
+// GetKnown will return the NATS server as the only project, individual subjects are treated
+// as queues within the project using the Refresh method.  The project is identified using the
+// URL of the server without any user information, which is returned in the Cred of the
+// description.
+//
+func (nq *NATS) GetKnown(ctx context.Context, matcher *regexp.Regexp, mismatcher *regexp.Regexp) (found map[string]task.QueueDesc, err kv.Error) {
+	known, err := nq.Refresh(ctx, matcher, mismatcher)
+	if err != nil {
+		return nil, err
+	}
+
+	found = make(map[string]task.QueueDesc, 1)
+	if len(known) != 0 {
+		found[nq.Identity] = task.QueueDesc{
+			Proj: nq.Identity,
+			Cred: userInfo(nq.url),
+		}
+	}
+	return found, nil
+}
+
+// Exists will connect to the NATS server identified in the receiver, nq, and will
+// query it to see if the subject identified by the studio go runner subscription is
+// captured by its stream
+//
+func (nq *NATS) Exists(ctx context.Context, subscription string) (exists bool, err kv.Error) {
+	stream, subject := natsSubscription(subscription)
+
+	nc, js, err := nq.attach()
+	if err != nil {
+		return false, err
+	}
+	defer nc.Close()
+
+	if len(stream) == 0 {
+		return len(nq.findStream(js, subject)) != 0, nil
+	}
+
+	info, errGo := js.StreamInfo(stream, nats.Context(ctx))
+	if errGo != nil {
+		if strings.Contains(errGo.Error(), "not found") {
+			return false, nil
+		}
+		return false, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", nq.Identity, "stream", stream)
+	}
+	for _, captured := range info.Config.Subjects {
+		if captured == subject {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetShortQName is useful for storing queue specific information in collections etc
+//
+func (nq *NATS) GetShortQName(qt *task.QueueTask) (shortName string, err kv.Error) {
+	_, subject := natsSubscription(qt.Subscription)
+	if len(subject) == 0 {
+		return "", kv.NewError("malformed nats subscription").With("stack", stack.Trace().TrimRuntime()).With("subscription", qt.Subscription)
+	}
+	return subject, nil
+}
+
+// subscribe binds to the durable pull consumer used by runners for the subject, creating it if needed
+//
+func (nq *NATS) subscribe(js nats.JetStreamContext, stream string, subject string) (sub *nats.Subscription, err kv.Error) {
+	sub, errGo := js.PullSubscribe(subject, natsConsumer(subject),
+		nats.BindStream(stream),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.AckWait(*natsAckWaitOpt),
+		nats.DeliverAll(),
+	)
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", nq.Identity, "stream", stream, "subject", subject)
+	}
+	return sub, nil
+}
+
+// Work will connect to the NATS server identified in the receiver, nq, and will see if any work
+// can be found on the subject identified by the go runner subscription and present work
+// to the handler for processing
+//
+func (nq *NATS) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool, resource *server.Resource, err kv.Error) {
+
+	stream, subject := natsSubscription(qt.Subscription)
+	if len(stream) == 0 {
+		return false, nil, kv.NewError("malformed nats subscription").With("stack", stack.Trace().TrimRuntime()).With("subscription", qt.Subscription)
+	}
+
+	nc, js, err := nq.attach()
+	if err != nil {
+		return false, nil, err
+	}
+	// Closing the connection leaves the durable consumer in place for other runners
+	defer nc.Close()
+
+	sub, err := nq.subscribe(js, stream, subject)
+	if err != nil {
+		return false, nil, err
+	}
+
+	msgs, errGo := sub.Fetch(1, nats.MaxWait(2*time.Second))
+	if errGo != nil {
+		if errors.Is(errGo, nats.ErrTimeout) || errors.Is(errGo, context.DeadlineExceeded) {
+			return false, nil, nil
+		}
+		return false, nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subscription", qt.Subscription)
+	}
+	if len(msgs) == 0 {
+		return false, nil, nil
+	}
+	msg := msgs[0]
+
+	qt.Msg = msg.Data
+	qt.ShortQName = subject
+
+	// Keep telling the server the message is being worked on while the handler is running
+	// so that it is not redelivered to other runners during long experiments
+	heartbeatCtx, heartbeatCancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(*natsAckWaitOpt / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-heartbeatCtx.Done():
+				return
+			case <-ticker.C:
+				if errGo := msg.InProgress(); errGo != nil {
+					nq.logger.Warn("in progress heartbeat failed", "subscription", qt.Subscription, "error", errGo.Error())
+				}
+			}
+		}
+	}()
+
+	rsc, ack, err := qt.Handler(ctx, qt)
+	heartbeatCancel()
+
+	if ack {
+		if errGo := msg.AckSync(); errGo != nil {
+			return false, rsc, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subscription", qt.Subscription)
+		}
+		return true, rsc, err
+	}
+
+	// The message was not processed successfully so check its retry budget and if it has been
+	// exhausted stop it from being redelivered.  Control commands are returned without a budget
+	// as they are passed between runners until the runner with the experiment they apply to is found
+	if meta, errGo := msg.Metadata(); errGo == nil && *natsRetryLimitOpt != 0 && meta.NumDelivered >= uint64(*natsRetryLimitOpt) && !strings.HasSuffix(subject, ControlSuffix) {
+		if errGo = msg.Term(); errGo != nil {
+			nq.logger.Warn("terminate failed", "subscription", qt.Subscription, "error", errGo.Error())
+		} else {
+			deadLettered.With(prometheus.Labels{"host": host, "queue_type": "nats", "queue_name": subject}).Inc()
+			return true, rsc, err
+		}
+	}
+
+	redelivered.With(prometheus.Labels{"host": host, "queue_type": "nats", "queue_name": subject}).Inc()
+	if errGo := msg.Nak(); errGo != nil {
+		nq.logger.Warn("negative acknowledgement failed", "subscription", qt.Subscription, "error", errGo.Error())
+	}
+
+	return true, rsc, err
+}
+
+// HasWork will look at the durable consumer for the subject to see if there are messages that are
+// yet to be delivered, or that are being redelivered.  Messages delivered to other runners and still
+// waiting for acknowledgement are not work for this runner.  Subjects without a consumer are assumed
+// to have work.
+//
+func (nq *NATS) HasWork(ctx context.Context, subscription string) (hasWork bool, err kv.Error) {
+	stream, subject := natsSubscription(subscription)
+
+	nc, js, err := nq.attach()
+	if err != nil {
+		return false, err
+	}
+	defer nc.Close()
+
+	info, errGo := js.ConsumerInfo(stream, natsConsumer(subject), nats.Context(ctx))
+	if errGo != nil {
+		if strings.Contains(errGo.Error(), "not found") {
+			return true, nil
+		}
+		return false, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subscription", subscription)
+	}
+	return info.NumPending+uint64(info.NumRedelivered) != 0, nil
+}
+
+// Peek will return the resources requested by the next message on the subject that has yet to be
+// delivered to a runner, without it being delivered.  The messages of the stream following the last
+// message delivered by the durable consumer are read directly from the stream.
+//
+func (nq *NATS) Peek(ctx context.Context, subscription string) (resource *server.Resource, err kv.Error) {
+	stream, subject := natsSubscription(subscription)
+
+	nc, js, err := nq.attach()
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+
+	info, errGo := js.StreamInfo(stream, nats.Context(ctx))
+	if errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subscription", subscription)
+	}
+
+	seq := info.State.FirstSeq
+	if consumer, errGo := js.ConsumerInfo(stream, natsConsumer(subject), nats.Context(ctx)); errGo == nil && consumer.Delivered.Stream >= seq {
+		seq = consumer.Delivered.Stream + 1
+	}
+
+	// Streams can hold messages for other subjects, or have had messages removed, so a limited
+	// number of messages are examined
+	for examined := 0; seq <= info.State.LastSeq && examined != 64; seq, examined = seq+1, examined+1 {
+		msg, errGo := js.GetMsg(stream, seq, nats.Context(ctx))
+		if errGo != nil || msg.Subject != subject {
+			continue
+		}
+		if resource, err = task.PeekResource(msg.Data); err != nil {
+			return nil, err.With("subscription", subscription, "sequence", seq)
+		}
+		return resource, nil
+	}
+	return nil, nil
+}
+
+// Publish is a shim method for tests to use for sending requests to a subject
+//
+func (nq *NATS) Publish(subject string, contentType string, msg []byte) (err kv.Error) {
+	nc, js, err := nq.attach()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	if _, errGo := js.Publish(subject, msg); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", nq.Identity, "subject", subject)
+	}
+	return nil
+}
+
+// Responder is used to open a connection to an existing response subject if
+// one was made available and also to provision a channel into which the
+// runner can place report messages
+//
+func (nq *NATS) Responder(ctx context.Context, subscription string, encryptKey *rsa.PublicKey) (sender chan *runnerReports.Report, err kv.Error) {
+	exists, err := nq.Exists(ctx, subscription)
+	if !exists {
+		if err == nil {
+			err = kv.NewError("response subject not found").With("stack", stack.Trace().TrimRuntime()).With("subscription", subscription)
+		}
+		return nil, err
+	}
+	if encryptKey == nil {
+		return nil, kv.NewError("response subject encryption key missing").With("stack", stack.Trace().TrimRuntime()).With("subscription", subscription)
+	}
+
+	_, subject := natsSubscription(subscription)
+
+	nc, js, err := nq.attach()
+	if err != nil {
+		return nil, err
+	}
+
+	// Allow up to 64 logging and report messages to be queued before refusing to send more
+	sender = make(chan *runnerReports.Report, 64)
+
+	go func() {
+		defer nc.Close()
+		for {
+			select {
+			case data := <-sender:
+				if data == nil {
+					// If the responder channel is closed then there is nothing left
+					// to report so we stop
+					return
+				}
+				buf, errGo := protojson.Marshal(data)
+				if errGo != nil {
+					nq.logger.Warn(kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).Error())
+					continue
+				}
+				payload, err := defense.HybridSeal(buf, encryptKey)
+				if err != nil {
+					nq.logger.Warn(err.Error())
+					continue
+				}
+				if _, errGo := js.Publish(subject, []byte(payload)); errGo != nil {
+					nq.logger.Warn(errGo.Error(), "subject", subject, "stack", stack.Trace().TrimRuntime())
+				}
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sender, nil
+}
@@ -0,0 +1,266 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the NATS JetStream task queue implementation using an embedded server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/go-service/pkg/log"
+	"github.com/leaf-ai/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
+	"github.com/leaf-ai/studio-go-runner/internal/task"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// startNATS runs an embedded NATS server with JetStream enabled for the duration of a test
+//
+func startNATS(t *testing.T) (url string) {
+	opts := &natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	}
+	srv, errGo := natsserver.NewServer(opts)
+	if errGo != nil {
+		t.Fatalf("FAILED to create NATS server - %v", errGo)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(10 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(srv.Shutdown)
+	return srv.ClientURL()
+}
+
+func TestNATSQueue(t *testing.T) {
+	url := startNATS(t)
+
+	logger := log.NewLogger("nats-queue")
+	nq, err := NewNATS(url, "", "", nil, logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	subject := "nats_project"
+	responseSubject := subject + "_response"
+	stream := "STUDIOML"
+
+	nc, js, err := nq.attach()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer nc.Close()
+
+	_, errGo := js.AddStream(&nats.StreamConfig{
+		Name:      stream,
+		Subjects:  []string{subject, responseSubject, "other.>"},
+		Retention: nats.WorkQueuePolicy,
+	})
+	if errGo != nil {
+		t.Fatalf("FAILED to create stream - %v", errGo)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Subjects are discovered using the queue matching expressions, wildcard subjects are ignored
+	known, err := nq.Refresh(ctx, regexp.MustCompile("^nats_"), regexp.MustCompile("_response$"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	subscription := stream + "?" + subject
+	if _, isPresent := known[subscription]; !isPresent || len(known) != 1 {
+		t.Fatalf("unexpected subjects %v found", known)
+	}
+	if exists, err := nq.Exists(ctx, subscription); err != nil || !exists {
+		t.Fatalf("subscription %s not found - %v", subscription, err)
+	}
+	if exists, err := nq.Exists(ctx, stream+"?missing"); err != nil || exists {
+		t.Fatalf("missing subject was found - %v", err)
+	}
+
+	// Known servers are keyed on the identity of the server which never carries credentials
+	found, err := nq.GetKnown(ctx, regexp.MustCompile("^nats_"), regexp.MustCompile("_response$"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if desc, isPresent := found[nq.Identity]; !isPresent || len(found) != 1 || desc.Proj != nq.Identity {
+		t.Fatalf("unexpected servers %v found", found)
+	}
+
+	envelope := &defense.Envelope{
+		Message: defense.Message{
+			Resource: server.Resource{Cpus: 2, Ram: "4gb", Hdd: "10gb"},
+			Payload:  "encrypted",
+		},
+	}
+	buf, errGo := envelope.Marshal()
+	if errGo != nil {
+		t.Fatalf("FAILED to marshal envelope - %v", errGo)
+	}
+	if err = nq.Publish(subject, "application/json", buf); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if hasWork, err := nq.HasWork(ctx, subscription); err != nil || !hasWork {
+		t.Fatalf("published message not seen as work - %v", err)
+	}
+	rsc, err := nq.Peek(ctx, subscription)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if rsc == nil || rsc.Cpus != 2 || rsc.Ram != "4gb" {
+		t.Fatalf("unexpected resource %v peeked", rsc)
+	}
+
+	// A message that is not acknowledged is redelivered, and one that is acknowledged is removed
+	deliveries := 0
+	qt := &task.QueueTask{
+		Subscription: subscription,
+		Handler: func(ctx context.Context, qt *task.QueueTask) (resource *server.Resource, ack bool, err kv.Error) {
+			deliveries++
+			if string(qt.Msg) != string(buf) || qt.ShortQName != subject {
+				t.Errorf("unexpected message %s delivered from %s", string(qt.Msg), qt.ShortQName)
+			}
+			// A message held by a runner is not work for other runners
+			if deliveries == 1 {
+				if hasWork, err := nq.HasWork(ctx, subscription); err != nil || hasWork {
+					t.Errorf("message being processed seen as work - %v", err)
+				}
+			}
+			return nil, deliveries > 1, nil
+		},
+	}
+	for i := 0; i != 2; i++ {
+		processed, _, err := nq.Work(ctx, qt)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !processed {
+			t.Fatalf("message not delivered on attempt %d", i+1)
+		}
+	}
+	if deliveries != 2 {
+		t.Fatalf("unexpected number of deliveries %d", deliveries)
+	}
+	if processed, _, err := nq.Work(ctx, qt); err != nil || processed {
+		t.Fatalf("acknowledged message was redelivered - %v", err)
+	}
+	if hasWork, err := nq.HasWork(ctx, subscription); err != nil || hasWork {
+		t.Fatalf("empty subject seen as having work - %v", err)
+	}
+}
+
+func TestNATSUserInfo(t *testing.T) {
+	logger := log.NewLogger("nats-queue")
+	nq, err := NewNATS("nats://127.0.0.1:4222", "user:p%40ss", "", nil, logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if nq.Identity != "nats://127.0.0.1:4222" {
+		t.Fatalf("credentials leaked into identity %s", nq.Identity)
+	}
+	// The user information from GetKnown must reproduce the original server URL
+	if info := userInfo(nq.url); info != "user:p%40ss" {
+		t.Fatalf("unexpected user information %s", info)
+	}
+	if serverURL, err := withUserInfo(nq.Identity, userInfo(nq.url)); err != nil || serverURL != nq.url {
+		t.Fatalf("unexpected server URL %s - %v", serverURL, err)
+	}
+}
+
+func TestNATSResponder(t *testing.T) {
+	url := startNATS(t)
+
+	logger := log.NewLogger("nats-queue")
+	nq, err := NewNATS(url, "", "", nil, logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	prvKey, errGo := rsa.GenerateKey(rand.Reader, 2048)
+	if errGo != nil {
+		t.Fatalf("FAILED to generate key: %v", errGo)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Responders are only available for response subjects that experimenters have created
+	subject := "nats_project_response"
+	if _, err := nq.Responder(ctx, subject, &prvKey.PublicKey); err == nil {
+		t.Fatalf("responder created for missing subject %s", subject)
+	}
+
+	nc, js, err := nq.attach()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer nc.Close()
+
+	if _, errGo = js.AddStream(&nats.StreamConfig{Name: "RESPONSES", Subjects: []string{subject}}); errGo != nil {
+		t.Fatalf("FAILED to create stream - %v", errGo)
+	}
+	sub, errGo := js.SubscribeSync(subject)
+	if errGo != nil {
+		t.Fatalf("FAILED to subscribe to %s - %v", subject, errGo)
+	}
+
+	responseQ, err := nq.Responder(ctx, subject, &prvKey.PublicKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	responseQ <- &runnerReports.Report{
+		Time: timestamppb.Now(),
+		ExecutorId: &wrapperspb.StringValue{
+			Value: "test",
+		},
+		Payload: &runnerReports.Report_Logging{
+			Logging: &runnerReports.LogEntry{
+				Time:     timestamppb.Now(),
+				Severity: runnerReports.LogSeverity_Info,
+				Message: &wrapperspb.StringValue{
+					Value: "responder test",
+				},
+			},
+		},
+	}
+
+	msg, errGo := sub.NextMsg(10 * time.Second)
+	if errGo != nil {
+		t.Fatalf("no report was published to %s - %v", subject, errGo)
+	}
+
+	buf, err := defense.Unseal(string(msg.Data), prvKey)
+	if err != nil {
+		t.Fatalf("FAILED to unseal report - %s", err.Error())
+	}
+	report := &runnerReports.Report{}
+	if errGo = protojson.Unmarshal(buf, report); errGo != nil {
+		t.Fatalf("FAILED to decode report - %v", errGo)
+	}
+	if report.GetLogging().GetMessage().GetValue() != "responder test" {
+		t.Fatalf("unexpected report contents %s", string(buf))
+	}
+}
@@ -4,19 +4,29 @@ package runner
 
 // This file contains the implementation of storage that can use an internal cache along with the MD5
 // hash of the files contents to avoid downloads that are not needed.
+//
+// The cache directory can be shared by several runners on the same node.  Only one runner
+// downloads a blob at a time, with the others waiting for it to appear in the cache, and blobs
+// that runners are reading from the cache are not groomed.  Blobs downloaded by other runners
+// are adopted into the cache of each runner, and using a blob updates its modification time
+// so that runners can see blobs that are still in use by others.
 
 import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/leaf-ai/studio-go-runner/internal/integrity"
 	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/leaf-ai/studio-go-runner/internal/s3"
 
 	"github.com/go-stack/stack"
 	"github.com/jjeffery/kv" // MIT License
@@ -45,10 +55,26 @@ var (
 		},
 		[]string{"host", "hash"},
 	)
+	cacheBytesSaved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_cache_bytes_saved",
+			Help: "Number of artifact bytes read from the cache rather than being downloaded.",
+		},
+		[]string{"host"},
+	)
 
 	host = ""
 )
 
+const (
+	// partsDir is the directory within the partial downloads directory that retains the parts
+	// of downloads that can be resumed after a failure, or restart
+	partsDir = "parts"
+
+	// cacheTTL is the period that blobs are retained within the cache after they were last used
+	cacheTTL = 48 * time.Hour
+)
+
 func init() {
 	host, _ = os.Hostname()
 }
@@ -56,6 +82,16 @@ func init() {
 type objStore struct {
 	store  Storage
 	ErrorC chan kv.Error
+
+	// key and declared identify an immutable artifact and the hash declared for it, downloads
+	// of the artifact are checked against the declared hash
+	key      string
+	declared string
+
+	// hash and verified contain the storage hash of the artifact and the SHA256 of its
+	// content once retrieved
+	hash     string
+	verified string
 }
 
 // NewObjStore is used to instantiate an object store for the running that includes a cache
@@ -66,10 +102,15 @@ func NewObjStore(ctx context.Context, spec *StoreOpts, errorC chan kv.Error) (oS
 		return nil, err
 	}
 
-	return &objStore{
+	oStore = &objStore{
 		store:  store,
 		ErrorC: errorC,
-	}, nil
+	}
+	if spec.Art != nil && !spec.Art.Mutable {
+		oStore.key = spec.Art.Key
+		oStore.declared = spec.Art.Hash
+	}
+	return oStore, nil
 }
 
 var (
@@ -79,8 +120,68 @@ var (
 	cacheInit     sync.Once
 	cacheInitSync sync.Mutex
 	cache         *ccache.Cache
+
+	// cacheKnown contains the names of the blobs that have been added to the cache by this runner,
+	// blobs that are known but absent from the cache were evicted and can be removed
+	cacheKnown     = map[string]struct{}{}
+	cacheKnownSync sync.Mutex
 )
 
+// cacheAdd places a blob into the cache
+//
+func cacheAdd(info os.FileInfo, ttl time.Duration) {
+	cacheKnownSync.Lock()
+	cacheKnown[info.Name()] = struct{}{}
+	cacheKnownSync.Unlock()
+
+	cache.Fetch(info.Name(), ttl,
+		func() (interface{}, error) {
+			return info, nil
+		})
+}
+
+// adopt checks a blob that is expired, or absent, from the cache of this runner and returns true
+// if it was added to the cache, or extended, because another runner sharing the cache directory
+// downloaded, or used, it recently
+//
+func adopt(info os.FileInfo, item *ccache.Item) (adopted bool) {
+	if info.Name()[0] == '.' {
+		return false
+	}
+	used := time.Since(info.ModTime())
+	if used >= cacheTTL {
+		return false
+	}
+	if item == nil {
+		cacheKnownSync.Lock()
+		_, isKnown := cacheKnown[info.Name()]
+		cacheKnownSync.Unlock()
+		if isKnown {
+			return false
+		}
+		cacheAdd(info, cacheTTL-used)
+		return true
+	}
+	item.Extend(cacheTTL - used)
+	return true
+}
+
+// removeBlob deletes a blob from the cache directory unless it is being read by this, or
+// another, runner
+//
+func removeBlob(fn string) (removed bool, err kv.Error) {
+	lock, err := tryLockExclusive(fn, false)
+	if lock == nil || err != nil {
+		return false, err
+	}
+	defer unlock(lock)
+
+	if errGo := os.Remove(fn); errGo != nil {
+		return false, kv.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return true, nil
+}
+
 func groom(backingDir string, removedC chan os.FileInfo, errorC chan kv.Error) {
 	if cache == nil {
 		return
@@ -101,6 +202,10 @@ func groom(backingDir string, removedC chan os.FileInfo, errorC chan kv.Error) {
 		return
 	}
 
+	// Python environments are directories and are groomed separately to the artifacts
+	groomPythonEnvs(filepath.Join(backingDir, pythonEnvCacheDir), errorC)
+	groomMounts(filepath.Join(backingDir, mountCacheDir), errorC)
+
 	for _, file := range cachedFiles {
 		// Is an expired or missing file in cache data structure, if it is not a directory delete it
 		item := cache.Sample(file.Name())
@@ -110,17 +215,23 @@ func groom(backingDir string, removedC chan os.FileInfo, errorC chan kv.Error) {
 				if info.IsDir() {
 					continue
 				}
-				select {
-				case removedC <- info:
-				case <-time.After(time.Second):
+				if adopt(info, item) {
+					continue
 				}
-				if err = os.Remove(filepath.Join(backingDir, file.Name())); err != nil {
+				removed, err := removeBlob(filepath.Join(backingDir, file.Name()))
+				if err != nil {
 					select {
 					case errorC <- kv.Wrap(err, fmt.Sprintf("cache dir %s remove failed", backingDir)).With("stack", stack.Trace().TrimRuntime()):
 					case <-time.After(time.Second):
 						fmt.Printf("%s\n", kv.Wrap(err, fmt.Sprintf("cache dir %s remove failed", backingDir)).With("stack", stack.Trace().TrimRuntime()))
 					}
 				}
+				if removed {
+					select {
+					case removedC <- info:
+					case <-time.After(time.Second):
+					}
+				}
 			}
 		}
 	}
@@ -250,6 +361,36 @@ func InitObjStore(ctx context.Context, backing string, size int64, removedC chan
 		default:
 		}
 	}
+	if errGo = prometheus.Register(cacheBytesSaved); errGo != nil {
+		select {
+		case errorC <- kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()):
+		default:
+		}
+	}
+	if errGo = prometheus.Register(pythonEnvCacheHits); errGo != nil {
+		select {
+		case errorC <- kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()):
+		default:
+		}
+	}
+	if errGo = prometheus.Register(pythonEnvCacheMisses); errGo != nil {
+		select {
+		case errorC <- kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()):
+		default:
+		}
+	}
+	if errGo = prometheus.Register(mountCacheHits); errGo != nil {
+		select {
+		case errorC <- kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()):
+		default:
+		}
+	}
+	if errGo = prometheus.Register(mountCacheMisses); errGo != nil {
+		select {
+		case errorC <- kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()):
+		default:
+		}
+	}
 
 	select {
 	case errorC <- kv.NewError("cache enabled").With("stack", stack.Trace().TrimRuntime()):
@@ -261,32 +402,60 @@ func InitObjStore(ctx context.Context, backing string, size int64, removedC chan
 	cacheMax = size
 
 	// The backing store might have partial downloads inside it.  We should clear those, ignoring kv.
-	// and then re-create the partial download directory
+	// and then re-create the partial download directory.  The parts of downloads that storage
+	// platforms can resume are retained, as are downloads that other runners sharing the cache
+	// directory hold the lock for.
 	partialDir := filepath.Join(backingDir, ".partial")
-	os.RemoveAll(partialDir)
+	if entries, errGo := ioutil.ReadDir(partialDir); errGo == nil {
+		for _, entry := range entries {
+			if entry.Name() == partsDir || strings.HasSuffix(entry.Name(), lockSuffix) {
+				continue
+			}
+			lock, _ := tryLockExclusive(filepath.Join(partialDir, entry.Name()+lockSuffix), true)
+			if lock == nil {
+				continue
+			}
+			os.RemoveAll(filepath.Join(partialDir, entry.Name()))
+			unlockRemove(lock)
+		}
+	}
 
 	if errGo = os.MkdirAll(partialDir, 0700); err != nil {
 		return nil, kv.Wrap(errGo, "unable to create the partial downloads dir ", partialDir).With("stack", stack.Trace().TrimRuntime())
 	}
 
+	if err = s3.SetPartsDir(filepath.Join(partialDir, partsDir)); err != nil {
+		return nil, err
+	}
+
 	// Size the cache appropriately, and track items that are in use through to their being released,
 	// which prevents items being read from being groomed and then new copies of the same
 	// data appearing
 	cache = ccache.New(ccache.Configure().MaxSize(size).GetsPerPromote(1).ItemsToPrune(1))
 
 	// Now populate the lookaside cache with the files found in the cache directory and their sizes
-	for i, file := range cachedFiles {
+	for _, file := range cachedFiles {
 		if file.IsDir() {
 			continue
 		}
 		if file.Name()[0] != '.' {
-			cache.Fetch(file.Name(), time.Hour*48,
-				func() (interface{}, error) {
-					return cachedFiles[i], nil
-				})
+			cacheAdd(file, cacheTTL)
 		}
 	}
 
+	// Python environments built by previous runs of the runner are also counted against the
+	// cache size budget
+	if errGo = os.MkdirAll(filepath.Join(backingDir, pythonEnvCacheDir), 0700); errGo != nil {
+		return nil, kv.Wrap(errGo, "unable to create the python environments dir").With("stack", stack.Trace().TrimRuntime())
+	}
+	loadPythonEnvs(filepath.Join(backingDir, pythonEnvCacheDir))
+
+	// Artifacts unpacked for read only use are also retained between runs
+	if errGo = os.MkdirAll(filepath.Join(backingDir, mountCacheDir), 0700); errGo != nil {
+		return nil, kv.Wrap(errGo, "unable to create the read only artifacts dir").With("stack", stack.Trace().TrimRuntime())
+	}
+	loadMounts(filepath.Join(backingDir, mountCacheDir))
+
 	// Now start the directory groomer
 	cacheInit.Do(func() {
 		triggerC = groomDir(ctx, backingDir, removedC, errorC)
@@ -306,7 +475,10 @@ func CacheProbe(key string) bool {
 // resource being stored.
 //
 func (s *objStore) Hash(ctx context.Context, name string) (hash string, err kv.Error) {
-	return s.store.Hash(ctx, name)
+	if hash, err = s.store.Hash(ctx, name); err == nil && len(name) != 0 && name == s.key {
+		s.hash = hash
+	}
+	return hash, err
 }
 
 // Gather is used to retrieve files prefixed with a specific key.  It is used to retrieve the individual files
@@ -322,23 +494,41 @@ func (s *objStore) Gather(ctx context.Context, keyPrefix string, outputDir strin
 //
 func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output string, maxBytes int64) (size int64, warns []kv.Error, err kv.Error) {
 	// Check for meta data, MD5, from the upstream and then examine our cache for a match
-	hash, err := s.store.Hash(ctx, name)
+	hash, err := s.Hash(ctx, name)
 	if err != nil {
 		return 0, warns, err
 	}
 
-	// If there is no cache simply download the file, and so we supply a nil for the tap
-	// for our tap
+	// The content of the artifact is passed through a verifier, both when downloaded and when
+	// retrieved from the cache
+	var verifier *integrity.Verifier
+	if len(name) != 0 && name == s.key {
+		if verifier, err = integrity.NewVerifier(s.declared); err != nil {
+			return 0, warns, err.With("key", name)
+		}
+	}
+
+	// If there is no cache simply download the file, and so we supply the verifier for
+	// our tap
 	if len(backingDir) == 0 {
 		cacheMisses.With(prometheus.Labels{"host": host, "hash": hash}).Inc()
-		return s.store.Fetch(ctx, name, unpack, output, maxBytes, nil)
+		if verifier == nil {
+			return s.store.Fetch(ctx, name, unpack, output, maxBytes, nil)
+		}
+		if size, warns, err = s.store.Fetch(ctx, name, unpack, output, maxBytes, verifier); err != nil {
+			return 0, warns, err
+		}
+		if err = s.verify(verifier); err != nil {
+			return 0, warns, err.With("key", name)
+		}
+		return size, warns, nil
 	}
 
 	// triggers LRU to elevate the item being retrieved
 	if len(hash) != 0 {
 		if item := cache.Get(hash); item != nil {
 			if !item.Expired() {
-				item.Extend(48 * time.Hour)
+				item.Extend(cacheTTL)
 			}
 		}
 	}
@@ -351,40 +541,42 @@ func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output s
 	waitOnPartial := time.Duration(33 * time.Second)
 
 	// If there is caching we should loop until we have a good file in the cache, and
-	// if appropriate based on the contents of the partial download directory be doing
-	// or waiting for the download to happen, respecting the notion that only one of
-	// the waiters should be downloading actively
+	// if appropriate based on the lock for the partial download, be doing or waiting
+	// for the download to happen, respecting the notion that only one of the waiters,
+	// across all of the runners sharing the cache, should be downloading actively
 	//
 	downloader := false
 
+	// If the cached copy of the artifact cannot be used then it is replaced by a fresh download
+	useCache := true
+
 	// Loop termination conditions include a timeout and successful completion
 	// of the download
 	for {
 		// Examine the local file cache and use the file from there if present
 		localName := filepath.Join(backingDir, hash)
-		if _, errGo := os.Stat(localName); errGo == nil {
-			spec := StoreOpts{
-				Art: &request.Artifact{
-					Qualified: fmt.Sprintf("file:///%s", localName),
-				},
-				Validate: true,
-			}
-			localFS, err := NewStorage(ctx, &spec)
-			if err != nil {
-				return 0, warns, err
-			}
-			// Because the file is already in the cache we dont supply a tap here
-			size, w, err := localFS.Fetch(ctx, localName, unpack, output, maxBytes, nil)
-			if err == nil {
-				cacheHits.With(prometheus.Labels{"host": host, "hash": hash}).Inc()
-				return size, warns, nil
-			}
+		if useCache {
+			size, w, isPresent, err := fetchCached(ctx, localName, unpack, output, maxBytes, verifier)
+			if isPresent {
+				if err == nil {
+					// A cached copy that does not match the declared hash is replaced by a
+					// fresh download which is then checked
+					if err = s.verify(verifier); err == nil {
+						cacheHits.With(prometheus.Labels{"host": host, "hash": hash}).Inc()
+						return size, warns, nil
+					}
+				}
+				if verifier != nil {
+					verifier.Reset()
+				}
 
-			// Drops through to allow for a fresh download, after saving the errors
-			// as warnings for the caller so that caching failures can be observed
-			// and diagnosed
-			warns = append(warns, w...)
-			warns = append(warns, err)
+				// Drops through to allow for a fresh download, after saving the errors
+				// as warnings for the caller so that caching failures can be observed
+				// and diagnosed
+				warns = append(warns, w...)
+				warns = append(warns, err)
+				useCache = false
+			}
 		}
 		cacheMisses.With(prometheus.Labels{"host": host, "hash": hash}).Inc()
 
@@ -396,11 +588,19 @@ func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output s
 		}
 		downloader = false
 
-		// Look for partial downloads, if a downloader is found then wait for the file to appear
-		// inside the main directory
+		// Try to obtain the lock for the partial download, if another downloader holds it
+		// then wait for the file to appear inside the main directory.  The lock is released
+		// by the operating system should a downloader exit without completing.
 		//
 		partial := filepath.Join(backingDir, ".partial", hash)
-		if _, errGo := os.Stat(partial); errGo == nil {
+		lock, err := tryLockExclusive(partial+lockSuffix, true)
+		if err != nil {
+			select {
+			case s.ErrorC <- kv.Wrap(err, "file lock failure").With("stack", stack.Trace().TrimRuntime()).With("file", partial):
+			default:
+			}
+		}
+		if lock == nil {
 			select {
 			case <-ctx.Done():
 				return 0, warns, err
@@ -411,12 +611,16 @@ func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output s
 			continue
 		}
 
-		// If there is no partial file yet try to create a partial file with
-		// the exclusive and create flags set which avoids two threads
-		// creating the file on top of each other
-		//
-		file, errGo := os.OpenFile(partial, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		// Another downloader might have completed while the lock was being obtained
+		if _, errGo := os.Stat(localName); errGo == nil && useCache {
+			unlockRemove(lock)
+			continue
+		}
+
+		// Any partial file left by a downloader that failed is replaced
+		file, errGo := os.OpenFile(partial, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 		if errGo != nil {
+			unlockRemove(lock)
 			select {
 			case s.ErrorC <- kv.Wrap(errGo, "file open failure").With("stack", stack.Trace().TrimRuntime()).With("file", partial):
 			case <-ctx.Done():
@@ -439,7 +643,11 @@ func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output s
 		// Having gained the file to download into call the fetch method and supply the io.WriteClose
 		// to the concrete downloader
 		//
-		size, w, err := s.store.Fetch(ctx, name, unpack, output, maxBytes, tapWriter)
+		var tap io.Writer = tapWriter
+		if verifier != nil {
+			tap = io.MultiWriter(tapWriter, verifier)
+		}
+		size, w, err := s.store.Fetch(ctx, name, unpack, output, maxBytes, tap)
 
 		tapWriter.Flush()
 		file.Close()
@@ -448,16 +656,23 @@ func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output s
 		// unrecoverable errors
 		warns = append(warns, w...)
 
+		// Content that does not match the declared hash is not cached, and is not retried
+		if err == nil {
+			if err = s.verify(verifier); err != nil {
+				os.Remove(partial)
+				unlockRemove(lock)
+				return 0, warns, err.With("key", name)
+			}
+		}
+
 		if err == nil {
 			info, errGo := os.Stat(partial)
 			if errGo == nil {
-				cache.Fetch(info.Name(), time.Hour*48,
-					func() (interface{}, error) {
-						return info, nil
-					})
+				cacheAdd(info, cacheTTL)
 			} else {
 				select {
 				case <-ctx.Done():
+					unlockRemove(lock)
 					return 0, warns, err
 				case s.ErrorC <- kv.Wrap(errGo, "file cache failure").With("stack", stack.Trace().TrimRuntime()).With("file", partial).With("file", localName):
 				default:
@@ -473,6 +688,7 @@ func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output s
 				default:
 				}
 			}
+			unlockRemove(lock)
 
 			return size, warns, nil
 		}
@@ -482,11 +698,17 @@ func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output s
 		}
 		fmt.Println(spew.Sdump(err), "stack", stack.Trace().TrimRuntime())
 		// If we had a working file get rid of it, this is because leaving it in place will
-		// block further download attempts
+		// waste space until the next download attempt
 		if errGo = os.Remove(partial); errGo != nil {
 			warn := kv.Wrap(errGo).With("since", time.Since(startTime).String(), "partial", partial, "file", name, "stack", stack.Trace().TrimRuntime())
 			warns = append(warns, warn)
 		}
+		unlockRemove(lock)
+
+		// Content that does not match its declared hash will not change when retried
+		if integrity.IsMismatch(err) {
+			return 0, warns, err
+		}
 
 		select {
 		case <-ctx.Done():
@@ -499,6 +721,67 @@ func (s *objStore) Fetch(ctx context.Context, name string, unpack bool, output s
 	// unreachable
 }
 
+// verify checks the content of an artifact against its declared hash and records the SHA256
+// of the content
+//
+func (s *objStore) verify(verifier *integrity.Verifier) (err kv.Error) {
+	if verifier == nil {
+		return nil
+	}
+	if err = verifier.Verify(); err != nil {
+		return err
+	}
+	s.verified = verifier.SHA256()
+	return nil
+}
+
+// Identity returns the storage hash of an immutable artifact and the SHA256 of its content,
+// once they are known
+//
+func (s *objStore) Identity() (hash string, sum string) {
+	return s.hash, s.verified
+}
+
+// fetchCached retrieves an artifact from the cache, if present, while holding a shared lock
+// on the cached blob that prevents it being groomed by this, or another, runner
+//
+func fetchCached(ctx context.Context, localName string, unpack bool, output string, maxBytes int64, verifier *integrity.Verifier) (size int64, warns []kv.Error, isPresent bool, err kv.Error) {
+	lock, err := lockShared(localName)
+	if lock == nil {
+		return 0, warns, false, err
+	}
+	defer unlock(lock)
+
+	// Record the use of the blob for other runners sharing the cache directory
+	now := time.Now()
+	_ = os.Chtimes(localName, now, now)
+
+	spec := StoreOpts{
+		Art: &request.Artifact{
+			Qualified: fmt.Sprintf("file:///%s", localName),
+		},
+		Validate: true,
+	}
+	localFS, err := NewStorage(ctx, &spec)
+	if err != nil {
+		return 0, warns, true, err
+	}
+	// Because the file is already in the cache the tap is used only for verification
+	var tap io.Writer
+	if verifier != nil {
+		tap = verifier
+	}
+	size, warns, err = localFS.Fetch(ctx, localName, unpack, output, maxBytes, tap)
+	if err != nil {
+		return 0, warns, true, err
+	}
+
+	if info, errGo := lock.Stat(); errGo == nil {
+		cacheBytesSaved.With(prometheus.Labels{"host": host}).Add(float64(info.Size()))
+	}
+	return size, nil, true, nil
+}
+
 // Hoard is used to place a directory with individual files into the storage resource within the storage implemented
 // by a specific implementation.
 //
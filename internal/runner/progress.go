@@ -0,0 +1,160 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of the recognition of structured progress information
+// within the output of experiments so that it can be sent to the response queue for the
+// experiment while it is running.
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/leaf-ai/go-service/pkg/network"
+	"github.com/valyala/fastjson"
+
+	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// MetricPrefix starts lines of output from experiments that contain metrics in
+	// the form 'STUDIOML_METRIC name=value [name=value...] [step=n]'
+	MetricPrefix = "STUDIOML_METRIC"
+
+	// maxProgressLine is the longest line of experiment output that will be examined for
+	// progress information, longer lines are dropped
+	maxProgressLine = 64 * 1024
+)
+
+// ProgressJSON examines a line of experiment output and if it contains a JSON patch or merge
+// document, or a metric line, returns the JSON to be sent in a Progress report.  Arrays are
+// only accepted when every element is a JSON patch operation so that printed lists are
+// not mistaken for progress.
+//
+func ProgressJSON(line string) (doc string, isProgress bool) {
+	line = strings.TrimSpace(line)
+	if len(line) <= 2 || len(line) > maxProgressLine {
+		return "", false
+	}
+
+	if line[0] == '{' && line[len(line)-1] == '}' {
+		if errGo := fastjson.Validate(line); errGo != nil {
+			return "", false
+		}
+		return line, true
+	}
+
+	if line[0] == '[' && line[len(line)-1] == ']' {
+		if !isPatch(line) {
+			return "", false
+		}
+		return line, true
+	}
+
+	if !strings.HasPrefix(line, MetricPrefix+" ") {
+		return "", false
+	}
+	return metricJSON(strings.Fields(line)[1:])
+}
+
+// isPatch tests that a JSON array contains only JSON patch operations, objects
+// having both an op and a path
+//
+func isPatch(line string) (isPatch bool) {
+	value, errGo := fastjson.Parse(line)
+	if errGo != nil {
+		return false
+	}
+	ops, errGo := value.Array()
+	if errGo != nil || len(ops) == 0 {
+		return false
+	}
+	for _, op := range ops {
+		if op.Type() != fastjson.TypeObject {
+			return false
+		}
+		if op.GetStringBytes("op") == nil || op.GetStringBytes("path") == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// metricJSON converts the name=value pairs from a metric line into a JSON document
+// of the form {"metrics": {"name": value}, "step": n}.  Values that are not numbers
+// are retained as strings.
+//
+func metricJSON(fields []string) (doc string, isProgress bool) {
+	metrics := map[string]interface{}{}
+	result := map[string]interface{}{
+		"metrics": metrics,
+	}
+
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			continue
+		}
+		if kv[0] == "step" {
+			if step, errGo := strconv.ParseInt(kv[1], 10, 64); errGo == nil {
+				result["step"] = step
+			}
+			continue
+		}
+		if value, errGo := strconv.ParseFloat(kv[1], 64); errGo == nil {
+			metrics[kv[0]] = value
+		} else {
+			metrics[kv[0]] = kv[1]
+		}
+	}
+	if len(metrics) == 0 {
+		return "", false
+	}
+
+	content, errGo := json.Marshal(result)
+	if errGo != nil {
+		return "", false
+	}
+	return string(content), true
+}
+
+// sendProgress will send any progress information found in a line of experiment output
+// to the response queue as a running Progress report
+//
+func (p *VirtualEnv) sendProgress(line string) {
+	if p.ResponseQ == nil {
+		return
+	}
+	doc, isProgress := ProgressJSON(line)
+	if !isProgress {
+		return
+	}
+	select {
+	case p.ResponseQ <- &runnerReports.Report{
+		Time: timestamppb.Now(),
+		ExecutorId: &wrappers.StringValue{
+			Value: network.GetHostName(),
+		},
+		UniqueId: &wrappers.StringValue{
+			Value: p.uniqueID,
+		},
+		ExperimentId: &wrappers.StringValue{
+			Value: p.Request.Experiment.Key,
+		},
+		Payload: &runnerReports.Report_Progress{
+			Progress: &runnerReports.Progress{
+				Time: timestamppb.Now(),
+				Json: &wrappers.StringValue{
+					Value: doc,
+				},
+				State: runnerReports.TaskState_Started,
+			},
+		},
+	}:
+	default:
+		// Dont respond to back preassure
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the recognition of progress information within experiment output.
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	runnerReports "github.com/leaf-ai/studio-go-runner/internal/gen/dev.cognizant_dev.ai/genproto/studio-go-runner/reports/v1"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+)
+
+func TestProgressJSON(t *testing.T) {
+	tests := []struct {
+		line       string
+		doc        string
+		isProgress bool
+	}{
+		{line: "plain output", isProgress: false},
+		{line: "{}", isProgress: false},
+		{line: `{"studioml": {"epoch": 1}}`, doc: `{"studioml": {"epoch": 1}}`, isProgress: true},
+		{line: `  [{"op": "add", "path": "/a", "value": 1}]  `, doc: `[{"op": "add", "path": "/a", "value": 1}]`, isProgress: true},
+		{line: `{"broken": }`, isProgress: false},
+		{line: `[1, 2, 3]`, isProgress: false},
+		{line: `["a", "b"]`, isProgress: false},
+		{line: `[{"op": "add", "path": "/a", "value": 1}, {"value": 2}]`, isProgress: false},
+		{line: `[{"op": "add", "path": "/a", "value": 1}, 2]`, isProgress: false},
+		{line: "{\"a\": \"" + strings.Repeat("x", maxProgressLine) + "\"}", isProgress: false},
+		{line: MetricPrefix + " loss=0.25 step=10", doc: `{"metrics":{"loss":0.25},"step":10}`, isProgress: true},
+		{line: MetricPrefix + " loss=0.25 acc=0.9", doc: `{"metrics":{"acc":0.9,"loss":0.25}}`, isProgress: true},
+		{line: MetricPrefix + " phase=train", doc: `{"metrics":{"phase":"train"}}`, isProgress: true},
+		{line: MetricPrefix + " step=10", isProgress: false},
+		{line: MetricPrefix + "X loss=0.25", isProgress: false},
+	}
+
+	for _, test := range tests {
+		doc, isProgress := ProgressJSON(test.line)
+		if isProgress != test.isProgress {
+			t.Fatalf("line '%s' progress detection was %v, expected %v", test.line, isProgress, test.isProgress)
+		}
+		if diff := deep.Equal(doc, test.doc); diff != nil {
+			t.Fatalf("line '%s' produced an unexpected document %v", test.line, diff)
+		}
+	}
+}
+
+// TestProgressReports checks that progress lines are sent as reports while an experiment runs
+func TestProgressReports(t *testing.T) {
+	dir, errGo := os.MkdirTemp("", "progress-test")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	responseQ := make(chan *runnerReports.Report, 100)
+
+	rqst := &request.Request{
+		Experiment: request.Experiment{
+			Key: "progress-experiment",
+		},
+	}
+	env, err := NewVirtualEnv(rqst, dir, "accession", responseQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := "#!/bin/bash\necho starting\necho '" + MetricPrefix + " loss=0.5 step=1'\necho '{\"studioml\": {\"epoch\": 1}}'\n" +
+		// Oversized lines are dropped and carriage returns end lines
+		"head -c 70000 /dev/zero | tr '\\0' '{'\necho\n" +
+		"printf '%s\\r%s\\r' '" + MetricPrefix + " loss=0.4 step=1' '{\"studioml\": {\"epoch\": 2}}'\n" +
+		"echo -n '" + MetricPrefix + " loss=0.25 step=2'\n"
+	if errGo = os.WriteFile(env.Script, []byte(script), 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err = env.Run(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	close(responseQ)
+
+	docs := []string{}
+	for report := range responseQ {
+		progress := report.GetProgress()
+		if progress == nil {
+			continue
+		}
+		if progress.GetState() != runnerReports.TaskState_Started {
+			t.Fatal("unexpected progress state", progress.GetState())
+		}
+		docs = append(docs, progress.GetJson().GetValue())
+	}
+
+	expected := []string{
+		`{"metrics":{"loss":0.5},"step":1}`,
+		`{"studioml": {"epoch": 1}}`,
+		`{"metrics":{"loss":0.4},"step":1}`,
+		`{"studioml": {"epoch": 2}}`,
+		`{"metrics":{"loss":0.25},"step":2}`,
+	}
+	if diff := deep.Equal(docs, expected); diff != nil {
+		t.Fatal(diff)
+	}
+
+	if _, errGo = os.Stat(filepath.Join(dir, "output", "output")); errGo != nil {
+		t.Fatal(errGo)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the recording of the artifacts downloaded and uploaded by experiments
+// so that the provenance of the results produced by an experiment can be established
+
+import (
+	"context"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+)
+
+// ProvenanceEntry records the identity of an artifact used, or produced, by an experiment
+//
+type ProvenanceEntry struct {
+	Qualified string `json:"qualified"`
+	Key       string `json:"key"`
+	// Declared is the hash declared for the artifact by the experimenter
+	Declared string `json:"declared,omitempty"`
+	// Verified is true when the content of the artifact was checked against the declared hash
+	Verified bool `json:"verified"`
+	// SHA256 is the hex encoded SHA256 of the content of the artifact as downloaded
+	SHA256 string `json:"sha256,omitempty"`
+	// StorageHash is the hash reported by the storage platform, for example the S3 ETag
+	StorageHash string    `json:"storage_hash,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// Provenance contains the artifacts used, and produced, by an experiment indexed by their group
+//
+type Provenance struct {
+	Inputs  map[string]ProvenanceEntry `json:"inputs"`
+	Outputs map[string]ProvenanceEntry `json:"outputs"`
+}
+
+// newProvenanceEntry initializes the record of an artifact from the storage used to transfer it
+//
+func newProvenanceEntry(art *request.Artifact, storage *objStore) (entry ProvenanceEntry) {
+	hash, sum := storage.Identity()
+	return ProvenanceEntry{
+		Qualified:   art.Qualified,
+		Key:         art.Key,
+		Declared:    art.Hash,
+		Verified:    len(art.Hash) != 0 && len(sum) != 0,
+		SHA256:      sum,
+		StorageHash: hash,
+		Time:        time.Now().UTC(),
+	}
+}
+
+// recordOutput adds an uploaded artifact to the provenance of the experiment using the directory
+// dir, the hash of the artifact is that reported by the storage platform
+//
+func (cache *ArtifactCache) recordOutput(ctx context.Context, storage *objStore, art *request.Artifact, group string, dir string) {
+	key := art.Key
+	if art.Incremental && !art.Encrypt {
+		key = incrPrefix(art.Key) + "/" + manifestName
+	}
+	entry := ProvenanceEntry{
+		Qualified: art.Qualified,
+		Key:       key,
+		Time:      time.Now().UTC(),
+	}
+	if hash, err := storage.Hash(ctx, key); err == nil {
+		entry.StorageHash = hash
+	}
+	cache.record(dir, group, entry, true)
+}
+
+// record adds an artifact to the provenance of the experiment using the directory dir
+//
+func (cache *ArtifactCache) record(dir string, group string, entry ProvenanceEntry, output bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	prov, isPresent := cache.provenance[dir]
+	if !isPresent {
+		prov = &Provenance{
+			Inputs:  map[string]ProvenanceEntry{},
+			Outputs: map[string]ProvenanceEntry{},
+		}
+		cache.provenance[dir] = prov
+	}
+	if output {
+		prov.Outputs[group] = entry
+	} else {
+		prov.Inputs[group] = entry
+	}
+}
+
+// Provenance returns a copy of the artifacts used, and produced, by the experiment using the
+// directory dir
+//
+func (cache *ArtifactCache) Provenance(dir string) (prov *Provenance) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	prov = &Provenance{
+		Inputs:  map[string]ProvenanceEntry{},
+		Outputs: map[string]ProvenanceEntry{},
+	}
+	if recorded, isPresent := cache.provenance[dir]; isPresent {
+		for group, entry := range recorded.Inputs {
+			prov.Inputs[group] = entry
+		}
+		for group, entry := range recorded.Outputs {
+			prov.Outputs[group] = entry
+		}
+	}
+	return prov
+}
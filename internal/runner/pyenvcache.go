@@ -0,0 +1,268 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of a cache of python virtual environments.  Environments
+// are identified using a hash of the python version and the resolved pip packages they contain
+// and once built are reused by later experiments with the same requirements.  Environments are
+// stored within the artifact cache directory and share its size budget and LRU eviction.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pythonEnvCacheOpt = flag.Bool("python-env-cache", true, "reuse python virtual environments between experiments with identical python versions and pip packages, only active when the cache-dir option is used")
+
+	pythonEnvCacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_pyenv_cache_hits",
+			Help: "Number of python virtual environment cache hits.",
+		},
+		[]string{"host", "hash"},
+	)
+	pythonEnvCacheMisses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_pyenv_cache_misses",
+			Help: "Number of python virtual environment cache misses.",
+		},
+		[]string{"host", "hash"},
+	)
+
+	// pythonEnvInUse counts the experiments using each of the cached environments, environments
+	// in use are never removed from the disk
+	pythonEnvInUse     = map[string]int{}
+	pythonEnvInUseSync sync.Mutex
+)
+
+const (
+	// pythonEnvCacheDir is the directory within the artifact cache in which environments are kept,
+	// being a dot directory it is ignored by the artifact groomer
+	pythonEnvCacheDir = ".pyenvs"
+
+	// pythonEnvCachePrefix is used to distinguish environments from artifacts within the LRU cache
+	pythonEnvCachePrefix = "pyenv-"
+
+	// pythonEnvComplete is the file created within an environment once it has been fully built
+	pythonEnvComplete = ".complete"
+)
+
+// pythonEnvEntry is the value stored in the LRU cache for each environment, its size
+// is used by the cache to count the environment against the cache size budget
+//
+type pythonEnvEntry struct {
+	size int64
+}
+
+// Size returns the number of bytes the environment occupies on disk
+//
+func (e *pythonEnvEntry) Size() int64 {
+	return e.size
+}
+
+// pythonEnvCacheRoot returns the directory in which cached environments are stored, or an
+// empty string if the environment cache is not being used
+//
+func pythonEnvCacheRoot() (root string) {
+	if !*pythonEnvCacheOpt || len(backingDir) == 0 || cache == nil {
+		return ""
+	}
+	return filepath.Join(backingDir, pythonEnvCacheDir)
+}
+
+// pythonEnvKey produces a content address for a python environment from the python version
+// and the fully resolved pip packages to be installed, in order.  When the studioML package
+// is a local distribution file its contents are used rather than the file name.
+//
+func pythonEnvKey(pythonVer string, pips []string, cfgPips []string, studioPIP string) (key string, err kv.Error) {
+	hash := sha256.New()
+
+	io.WriteString(hash, "python="+pythonVer+"\n")
+	for _, pip := range pips {
+		io.WriteString(hash, "pip="+pip+"\n")
+	}
+	for _, pip := range cfgPips {
+		io.WriteString(hash, "cfg="+pip+"\n")
+	}
+
+	if len(studioPIP) != 0 {
+		io.WriteString(hash, "studioml=")
+		if filepath.IsAbs(studioPIP) {
+			f, errGo := os.Open(studioPIP)
+			if errGo != nil {
+				return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", studioPIP)
+			}
+			defer f.Close()
+			if _, errGo = io.Copy(hash, f); errGo != nil {
+				return "", kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", studioPIP)
+			}
+		} else {
+			io.WriteString(hash, studioPIP)
+		}
+		io.WriteString(hash, "\n")
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// acquirePythonEnv marks a cached environment as being in use and returns the directory
+// for it.  The hit return value indicates that the environment has already been built.
+//
+func acquirePythonEnv(root string, key string) (dir string, hit bool) {
+	pythonEnvInUseSync.Lock()
+	defer pythonEnvInUseSync.Unlock()
+
+	pythonEnvInUse[key]++
+
+	dir = filepath.Join(root, key)
+	if _, errGo := os.Stat(filepath.Join(dir, pythonEnvComplete)); errGo == nil {
+		// Getting the item promotes it within the LRU
+		if item := cache.Get(pythonEnvCachePrefix + key); item != nil && !item.Expired() {
+			item.Extend(48 * time.Hour)
+		}
+		pythonEnvCacheHits.With(prometheus.Labels{"host": host, "hash": key}).Inc()
+		return dir, true
+	}
+	pythonEnvCacheMisses.With(prometheus.Labels{"host": host, "hash": key}).Inc()
+	return dir, false
+}
+
+// releasePythonEnv is used once an experiment has finished with an environment.  Environments that
+// were built successfully are recorded in the LRU cache using their size on disk.
+//
+func releasePythonEnv(root string, key string) {
+	pythonEnvInUseSync.Lock()
+	defer pythonEnvInUseSync.Unlock()
+
+	if pythonEnvInUse[key]--; pythonEnvInUse[key] <= 0 {
+		delete(pythonEnvInUse, key)
+	}
+
+	if item := cache.Sample(pythonEnvCachePrefix + key); item != nil && !item.Expired() {
+		return
+	}
+
+	dir := filepath.Join(root, key)
+	if _, errGo := os.Stat(filepath.Join(dir, pythonEnvComplete)); errGo != nil {
+		return
+	}
+	if size, err := pythonEnvSize(dir); err == nil {
+		cache.Set(pythonEnvCachePrefix+key, &pythonEnvEntry{size: size}, 48*time.Hour)
+	}
+}
+
+// pythonEnvSize returns the total size of the files within an environment
+//
+func pythonEnvSize(dir string) (size int64, err kv.Error) {
+	errGo := filepath.Walk(dir, func(path string, info os.FileInfo, errGo error) error {
+		if errGo != nil {
+			return errGo
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if errGo != nil {
+		return size, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("dir", dir)
+	}
+	return size, nil
+}
+
+// loadPythonEnvs populates the LRU cache with the environments that were built by
+// previous runs of the runner
+//
+func loadPythonEnvs(root string) {
+	envs, errGo := ioutil.ReadDir(root)
+	if errGo != nil {
+		return
+	}
+	for _, env := range envs {
+		if !env.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, env.Name())
+		if _, errGo := os.Stat(filepath.Join(dir, pythonEnvComplete)); errGo != nil {
+			continue
+		}
+		if size, err := pythonEnvSize(dir); err == nil {
+			cache.Set(pythonEnvCachePrefix+env.Name(), &pythonEnvEntry{size: size}, 48*time.Hour)
+		}
+	}
+}
+
+// makeWritable restores the write permissions that were removed from an environment once
+// it was built so that it can be removed
+//
+func makeWritable(dir string) {
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, errGo error) error {
+		if errGo == nil && info.IsDir() {
+			_ = os.Chmod(path, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+}
+
+// groomPythonEnvs removes environments that have been evicted from, or have expired within,
+// the LRU cache and that are not being used by any experiments.  Experiment scripts hold a
+// shared lock on the environments lock file while they run, which also protects environments
+// in use by other runners sharing the cache directory.
+//
+func groomPythonEnvs(root string, errorC chan kv.Error) {
+	envs, errGo := ioutil.ReadDir(root)
+	if errGo != nil {
+		return
+	}
+
+	pythonEnvInUseSync.Lock()
+	defer pythonEnvInUseSync.Unlock()
+
+	for _, env := range envs {
+		key := env.Name()
+		if !env.IsDir() || strings.HasPrefix(key, ".") {
+			continue
+		}
+		if _, isPresent := pythonEnvInUse[key]; isPresent {
+			continue
+		}
+		if item := cache.Sample(pythonEnvCachePrefix + key); item != nil && !item.Expired() {
+			continue
+		}
+		// The lock file is left in place as scripts waiting on it will not notice it being replaced
+		lock, err := tryLockExclusive(filepath.Join(root, key+lockSuffix), true)
+		if err != nil {
+			select {
+			case errorC <- err:
+			default:
+			}
+			continue
+		}
+		if lock == nil {
+			continue
+		}
+		dir := filepath.Join(root, key)
+		makeWritable(dir)
+		errGo = os.RemoveAll(dir)
+		unlock(lock)
+		if errGo != nil {
+			select {
+			case errorC <- kv.Wrap(errGo, "python environment remove failed").With("stack", stack.Trace().TrimRuntime()).With("dir", dir):
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/karlmutch/ccache"
+)
+
+// TestPythonEnvKey checks that environment keys change when the packages, or their
+// order, differ and are stable otherwise
+func TestPythonEnvKey(t *testing.T) {
+	base, err := pythonEnvKey("3.6", []string{"a==1", "b==2"}, []string{"c"}, "studioml==0.0.1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	same, err := pythonEnvKey("3.6", []string{"a==1", "b==2"}, []string{"c"}, "studioml==0.0.1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if base != same {
+		t.Fatal("identical environments produced different keys")
+	}
+
+	variants := [][]string{
+		{"3.7", "a==1", "b==2", "c"},
+		{"3.6", "b==2", "a==1", "c"},
+		{"3.6", "a==1", "b==3", "c"},
+		{"3.6", "a==1", "b==2", "d"},
+	}
+	for _, v := range variants {
+		key, err := pythonEnvKey(v[0], v[1:3], v[3:], "studioml==0.0.1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if key == base {
+			t.Fatal("differing environments produced the same key", v)
+		}
+	}
+
+	// Local distributions of studioml are identified by content rather than name
+	dir, errGo := ioutil.TempDir("", "pyenv-key")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	dist := filepath.Join(dir, "studioml-0.0.1.tar.gz")
+	keys := []string{}
+	for _, content := range []string{"first", "second"} {
+		if errGo = ioutil.WriteFile(dist, []byte(content), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+		key, err := pythonEnvKey("3.6", nil, nil, dist)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		keys = append(keys, key)
+	}
+	if keys[0] == keys[1] {
+		t.Fatal("studioml distributions with different contents produced the same key")
+	}
+}
+
+// TestPythonEnvCache exercises the hit and miss handling of cached environments along
+// with their removal once evicted and no longer in use
+func TestPythonEnvCache(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "pyenv-cache")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	savedDir, savedCache := backingDir, cache
+	defer func() {
+		backingDir, cache = savedDir, savedCache
+	}()
+	backingDir = dir
+	cache = ccache.New(ccache.Configure().MaxSize(1024 * 1024).GetsPerPromote(1).ItemsToPrune(1))
+	defer cache.Stop()
+
+	root := pythonEnvCacheRoot()
+	if len(root) == 0 {
+		t.Fatal("python environment cache was not enabled")
+	}
+	if errGo = os.MkdirAll(root, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	// The first use is a miss and the environment is built by the experiment script
+	envDir, hit := acquirePythonEnv(root, "env1")
+	if hit {
+		t.Fatal("unbuilt environment reported as a cache hit")
+	}
+	if errGo = os.MkdirAll(envDir, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	// Environments being built are not groomed
+	groomPythonEnvs(root, nil)
+	if _, errGo = os.Stat(envDir); errGo != nil {
+		t.Fatal("environment in use was removed", errGo)
+	}
+
+	if errGo = ioutil.WriteFile(filepath.Join(envDir, pythonEnvComplete), []byte{}, 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(envDir, "lib"), make([]byte, 4096), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	releasePythonEnv(root, "env1")
+
+	item := cache.Get(pythonEnvCachePrefix + "env1")
+	if item == nil {
+		t.Fatal("built environment was not added to the cache")
+	}
+	if size := item.Value().(*pythonEnvEntry).Size(); size != 4096 {
+		t.Fatal("environment size was incorrect", size)
+	}
+
+	// Subsequent uses are hits
+	if _, hit = acquirePythonEnv(root, "env1"); !hit {
+		t.Fatal("built environment reported as a cache miss")
+	}
+	releasePythonEnv(root, "env1")
+
+	groomPythonEnvs(root, nil)
+	if _, errGo = os.Stat(envDir); errGo != nil {
+		t.Fatal("cached environment was removed", errGo)
+	}
+
+	// Built environments are read only, and once evicted from the cache they are retained
+	// while an experiment script, possibly from another runner, holds the lock file
+	if errGo = os.Chmod(envDir, 0500); errGo != nil {
+		t.Fatal(errGo)
+	}
+	cache.Delete(pythonEnvCachePrefix + "env1")
+	time.Sleep(100 * time.Millisecond)
+
+	lock, err := lockSharedWait(context.Background(), envDir+lockSuffix)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	groomPythonEnvs(root, nil)
+	if _, errGo = os.Stat(envDir); errGo != nil {
+		t.Fatal("locked environment was removed", errGo)
+	}
+	unlock(lock)
+
+	// Once unlocked the evicted environment is removed from the disk
+	groomPythonEnvs(root, nil)
+	if _, errGo = os.Stat(envDir); !os.IsNotExist(errGo) {
+		t.Fatal("evicted environment was not removed", errGo)
+	}
+}
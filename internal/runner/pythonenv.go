@@ -23,6 +23,7 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/leaf-ai/go-service/pkg/network"
 
 	"github.com/golang/protobuf/ptypes/wrappers"
@@ -51,6 +52,9 @@ type VirtualEnv struct {
 	Request   *request.Request
 	Script    string
 	uniqueID  string
+	alloc     *resources.Allocated
+	envRoot   string // The cache directory of python environments, when caching is used
+	envKey    string // The content address of the python environment within the cache
 	ResponseQ chan<- *runnerReports.Report
 }
 
@@ -177,6 +181,9 @@ func gpuEnv(alloc *resources.Allocated) (envs []string) {
 //
 func (p *VirtualEnv) Make(alloc *resources.Allocated, e interface{}) (err kv.Error) {
 
+	// Retain the allocation so that limits can be enforced when the experiment is run
+	p.alloc = alloc
+
 	pips, cfgPips, studioPIP, tfVer := pythonModules(p.Request, alloc)
 
 	// The tensorflow versions 1.5.x and above all support cuda 9 and 1.4.x is cuda 8,
@@ -203,6 +210,21 @@ func (p *VirtualEnv) Make(alloc *resources.Allocated, e interface{}) (err kv.Err
 		studioPIP = matches[len(matches)-1]
 	}
 
+	// When the cache is active the python environment is built once into a directory named
+	// using the hash of the packages it contains and then reused by later experiments
+	envDir := ""
+	if root := pythonEnvCacheRoot(); len(root) != 0 {
+		if key, err := pythonEnvKey(p.Request.Experiment.PythonVer, pips, cfgPips, studioPIP); err == nil {
+			// A Make that is repeated for the same experiment holds onto the environment only once
+			if len(p.envKey) != 0 {
+				releasePythonEnv(p.envRoot, p.envKey)
+			}
+			p.envRoot = root
+			p.envKey = key
+			envDir, _ = acquirePythonEnv(root, key)
+		}
+	}
+
 	params := struct {
 		AllocEnv  []string
 		E         interface{}
@@ -212,6 +234,7 @@ func (p *VirtualEnv) Make(alloc *resources.Allocated, e interface{}) (err kv.Err
 		CudaDir   string
 		Hostname  string
 		Env       map[string]string
+		EnvDir    string
 	}{
 		AllocEnv:  []string{},
 		E:         e,
@@ -221,6 +244,7 @@ func (p *VirtualEnv) Make(alloc *resources.Allocated, e interface{}) (err kv.Err
 		CudaDir:   cudaDir,
 		Hostname:  hostname,
 		Env:       p.Request.Config.Env,
+		EnvDir:    envDir,
 	}
 
 	if alloc.CPU != nil {
@@ -260,7 +284,8 @@ function retry {
         echo "Command failed. Attempt $n/$max:"
         sleep $delay;
       else
-        fail "The command has failed after $n attempts."
+        echo "The command has failed after $n attempts." >&2
+        return 1
       fi
     }
   done
@@ -301,27 +326,58 @@ eval "$(pyenv init --path)"
 eval "$(pyenv init -)"
 eval "$(pyenv virtualenv-init -)"
 pyenv doctor
+BUILD_ENV=1
+BUILD_OK=1
+{{if .EnvDir}}
+exec 200>{{.EnvDir}}.lock
+flock -x 200
+if [ -f {{.EnvDir}}/.complete ]; then
+    BUILD_ENV=0
+else
+    chmod -R u+w {{.EnvDir}} 2>/dev/null || true
+    rm -rf {{.EnvDir}}
+    python3 -m venv {{.EnvDir}}
+fi
+source {{.EnvDir}}/bin/activate
+{{else}}
 pyenv virtualenv-delete -f studioml-{{.E.ExprSubDir}} || true
 pyenv virtualenv $PYENV_VERSION studioml-{{.E.ExprSubDir}}
 pyenv activate studioml-{{.E.ExprSubDir}}
+{{end}}
 set +e
-retry python3 -m pip install "pip==20.1" "setuptools==44.0.0" "wheel==0.35.1"
+if [ "$BUILD_ENV" == "1" ]; then
+retry python3 -m pip install "pip==20.1" "setuptools==44.0.0" "wheel==0.35.1" || BUILD_OK=0
 python3 -m pip freeze --all
 {{if .StudioPIP}}
-retry python3 -m pip install -I {{.StudioPIP}}
+retry python3 -m pip install -I {{.StudioPIP}} || BUILD_OK=0
 {{end}}
 {{if .Pips}}
 echo "installing project pip {{ .Pips }}"
-retry python3 -m pip install {{range .Pips }} {{.}}{{end}}
+retry python3 -m pip install {{range .Pips }} {{.}}{{end}} || BUILD_OK=0
 {{end}}
 echo "finished installing project pips"
-retry python3 -m pip install pyopenssl==20.0.1 pipdeptree==2.0.0
+retry python3 -m pip install pyopenssl==20.0.1 pipdeptree==2.0.0 || BUILD_OK=0
 {{if .CfgPips}}
 echo "installing cfg pips"
-retry python3 -m pip install {{range .CfgPips}} {{.}}{{end}}
+retry python3 -m pip install {{range .CfgPips}} {{.}}{{end}} || BUILD_OK=0
 echo "finished installing cfg pips"
 {{end}}
+fi
 set -e
+if [ "$BUILD_OK" != "1" ]; then
+{{if .EnvDir}}
+    deactivate || true
+    rm -rf {{.EnvDir}}
+{{end}}
+    fail "The python environment could not be built."
+fi
+{{if .EnvDir}}
+if [ "$BUILD_ENV" == "1" ]; then
+    touch {{.EnvDir}}/.complete
+    chmod -R a-w {{.EnvDir}}
+fi
+flock -s 200
+{{end}}
 export STUDIOML_EXPERIMENT={{.E.ExprSubDir}}
 export STUDIOML_HOME={{.E.RootDir}}
 {{if .AllocEnv}}
@@ -360,8 +416,12 @@ set +e
 echo "[{\"op\": \"add\", \"path\": \"/studioml/log/-\", \"value\": {\"ts\": \"` + "`" + `date -u -Ins` + "`" + `\", \"msg\":\"Stop\"}}]" | jq -c '.'
 cd -
 locale
+{{if .EnvDir}}
+deactivate || true
+{{else}}
 pyenv deactivate || true
 pyenv virtualenv-delete -f studioml-{{.E.ExprSubDir}} || true
+{{end}}
 date
 date -u
 nvidia-smi 2>/dev/null || true
@@ -433,21 +493,6 @@ func procOutput(stopWriter chan struct{}, f *os.File, outC chan []byte, errC cha
 //
 func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]request.Artifact) (err kv.Error) {
 
-	stopCmd, stopCmdCancel := context.WithCancel(context.Background())
-	// defers are stacked in LIFO order so cancelling this context is the last
-	// thing this function will do, also cancelling the stopCmd will also travel down
-	// the context hierarchy cancelling everything else
-	defer stopCmdCancel()
-
-	// Cancel our own internal context when the outer context is cancelled
-	go func() {
-		select {
-		case <-stopCmd.Done():
-		case <-ctx.Done():
-		}
-		stopCmdCancel()
-	}()
-
 	// Create a new TMPDIR because the python pip tends to leave dirt behind
 	// when doing pip builds etc
 	tmpDir, errGo := ioutil.TempDir("", p.Request.Experiment.Key)
@@ -459,9 +504,22 @@ func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]request.Artifac
 	// Move to starting the process that we will monitor with the experiment running within
 	// it
 
+	// Place the experiment into its own cgroup to enforce the resources allocated to it, if
+	// cgroups cannot be used the experiment will be run without enforcement unless
+	// enforcement is required
+	cgroup, errCgroup := NewCgroup(*cgroupRootOpt, p.uniqueID, p.alloc)
+	defer cgroup.Remove()
+	if errCgroup != nil && *cgroupRequiredOpt {
+		return errCgroup
+	}
+
+	// The experiment is run in its own process group so that when it is cancelled
+	// all of the processes it has spawned can be signalled together
+	//
 	// #nosec
-	cmd := exec.CommandContext(stopCmd, "/bin/bash", "-c", "export TMPDIR="+tmpDir+"; "+filepath.Clean(p.Script))
+	cmd := exec.Command("/bin/bash", "-c", cgroup.Enter()+"export TMPDIR="+tmpDir+"; "+filepath.Clean(p.Script))
 	cmd.Dir = path.Dir(p.Script)
+	setProcessGroup(cmd)
 
 	// Pipes are used to allow the output to be tracked interactively from the cmd
 	stdout, errGo := cmd.StdoutPipe()
@@ -510,6 +568,19 @@ func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]request.Artifac
 		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
+	if errCgroup != nil {
+		errC <- "runner could not apply resource limits, " + errCgroup.Error()
+	}
+
+	// Start the watcher that will signal the process group when the context is cancelled
+	// giving the experiment a grace period to stop before it is killed
+	exited := make(chan struct{})
+	notices := make(chan string, 2)
+	terminated := make(chan string, 1)
+	go func() {
+		terminated <- terminateGroup(ctx, cmd, GracePeriod(p.Request), exited, notices)
+	}()
+
 	// Protect the err value when running multiple goroutines
 	errCheck := sync.Mutex{}
 
@@ -524,11 +595,30 @@ func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]request.Artifac
 		time.Sleep(time.Second)
 
 		responseLine := strings.Builder{}
+		// Complete lines of output are examined for progress information that is sent
+		// to the response queue as it is produced.  Carriage returns used by progress bars
+		// also end lines, and lines longer than maxProgressLine are dropped
+		progressLine := strings.Builder{}
+		progressOverflow := false
 		s := bufio.NewScanner(stdout)
 		s.Split(bufio.ScanRunes)
 		for s.Scan() {
 			out := s.Bytes()
 			outC <- out
+			if bytes.Equal(out, []byte{'\n'}) || bytes.Equal(out, []byte{'\r'}) {
+				if !progressOverflow {
+					p.sendProgress(progressLine.String())
+				}
+				progressLine.Reset()
+				progressOverflow = false
+			} else if !progressOverflow {
+				if progressLine.Len()+len(out) > maxProgressLine {
+					progressLine.Reset()
+					progressOverflow = true
+				} else {
+					progressLine.Write(out)
+				}
+			}
 			if bytes.Compare(out, []byte{'\n'}) == 0 {
 				responseLine.Write(out)
 			} else {
@@ -563,6 +653,9 @@ func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]request.Artifac
 				}
 			}
 		}
+		if progressLine.Len() != 0 && !progressOverflow {
+			p.sendProgress(progressLine.String())
+		}
 		if errGo := s.Err(); errGo != nil {
 			errCheck.Lock()
 			defer errCheck.Unlock()
@@ -624,31 +717,65 @@ func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]request.Artifac
 	// be able to send on the channels until they have stopped.
 	waitOnIO.Wait()
 
+	// Record any actions taken to terminate the experiment in the output log
+	// while the output copy goroutine is still running
+	for done := false; !done; {
+		select {
+		case notice := <-notices:
+			errC <- notice
+		default:
+			done = true
+		}
+	}
+
+	// Processes killed as a result of exceeding the memory allocated to the experiment
+	// are a distinct failure that is reported in preference to the exit status
+	oomReason := ""
+	if kills, _ := cgroup.OOMKills(); kills != 0 {
+		oomReason = "out of memory, killed by the kernel"
+		if p.alloc != nil && p.alloc.CPU != nil && p.alloc.CPU.Mem != 0 {
+			oomReason += " after reaching the memory limit of " + humanize.Bytes(p.alloc.CPU.Mem)
+		}
+		errC <- "runner detected experiment was " + oomReason
+	}
+
 	// Now manually stop the process output copy goroutine once the exec package
 	// has finished
 	close(stopOutput)
 
 	// Wait for the process to exit, and store any error code if possible
 	// before we continue to wait on the processes output devices finishing
-	if errGo = cmd.Wait(); errGo != nil {
-		errCheck.Lock()
-		if err == nil {
-			err = kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-		}
-		errCheck.Unlock()
-	}
+	errGo = cmd.Wait()
+
+	close(exited)
+	reason := <-terminated
 
 	errCheck.Lock()
-	if err == nil && stopCmd.Err() != nil {
-		err = kv.Wrap(stopCmd.Err()).With("stack", stack.Trace().TrimRuntime())
+	defer errCheck.Unlock()
+
+	if len(oomReason) != 0 {
+		return kv.NewError("experiment terminated").With("reason", oomReason).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Experiments that were terminated by the runner have the reason in preference to
+	// the exit status that resulted from the signals
+	if len(reason) != 0 {
+		return kv.NewError("experiment terminated").With("reason", reason).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo != nil && err == nil {
+		err = kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
-	errCheck.Unlock()
 
 	return err
 }
 
 // Close is used to close any resources which the encapsulated VirtualEnv may have consumed.
 //
-func (*VirtualEnv) Close() (err kv.Error) {
+func (p *VirtualEnv) Close() (err kv.Error) {
+	// Cached python environments are retained for use by other experiments
+	if len(p.envKey) != 0 {
+		releasePythonEnv(p.envRoot, p.envKey)
+		p.envKey = ""
+	}
 	return nil
 }
@@ -0,0 +1,78 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This contains the implementation of a TTL cache that counts the number of times
+// a message has been delivered to this runner for queue platforms that do not
+// track delivery counts on behalf of consumers.
+
+import (
+	"sync"
+	"time"
+
+	ttlCache "github.com/karlmutch/go-cache"
+)
+
+// Retries uses a cache with TTL on the cache items to maintain a count of
+// the number of deliveries seen for a message, the expiry time being used
+// to clean up counters for messages that have not been seen in some time
+type Retries struct {
+	retries *ttlCache.Cache
+	ttl     time.Duration
+	sync.Mutex
+}
+
+var (
+	retriesGet  sync.Mutex
+	retriesOnce sync.Once
+	retries     *Retries
+)
+
+// NewRetries creates a delivery counter whose entries are discarded once
+// a message has not been seen for the ttl duration
+func NewRetries(ttl time.Duration) (r *Retries) {
+	return &Retries{
+		retries: ttlCache.New(ttl, time.Minute),
+		ttl:     ttl,
+	}
+}
+
+// GetRetries retrieves a reference to a singleton of the Retries structure
+func GetRetries() (r *Retries) {
+	retriesGet.Lock()
+	defer retriesGet.Unlock()
+
+	retriesOnce.Do(
+		func() {
+			retries = NewRetries(12 * time.Hour)
+		})
+	return retries
+}
+
+// Inc will record a delivery for the named message and will return the number
+// of deliveries seen for the message, including this one
+func (r *Retries) Inc(k string) (count int64) {
+	r.Lock()
+	defer r.Unlock()
+
+	if result, isPresent := r.retries.Get(k); isPresent {
+		count = result.(int64)
+	}
+	count++
+	r.retries.Set(k, count, r.ttl)
+	return count
+}
+
+// Get retrieves the number of deliveries recorded for the named message
+func (r *Retries) Get(k string) (count int64) {
+	result, isPresent := r.retries.Get(k)
+	if !isPresent {
+		return 0
+	}
+	return result.(int64)
+}
+
+// Clear removes any delivery count held for the named message
+func (r *Retries) Clear(k string) {
+	r.retries.Delete(k)
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the message delivery counter used for retry budgets.
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRetries(t *testing.T) {
+	r := NewRetries(time.Minute)
+
+	for i := int64(1); i != 4; i++ {
+		if count := r.Inc("queue?msg"); count != i {
+			t.Fatalf("unexpected delivery count %d, expected %d", count, i)
+		}
+	}
+	if count := r.Get("queue?other"); count != 0 {
+		t.Fatalf("unexpected delivery count %d for unseen message", count)
+	}
+
+	r.Clear("queue?msg")
+	if count := r.Get("queue?msg"); count != 0 {
+		t.Fatalf("unexpected delivery count %d after clear", count)
+	}
+
+	// Counters for messages that are not seen for a period should be dropped
+	r = NewRetries(50 * time.Millisecond)
+	r.Inc("queue?msg")
+	time.Sleep(100 * time.Millisecond)
+	if count := r.Inc("queue?msg"); count != 1 {
+		t.Fatalf("unexpected delivery count %d after expiry", count)
+	}
+}
+
+func TestDeliveryCount(t *testing.T) {
+	queue := "rmq_retries"
+
+	// Classic queues are counted by the runner, and failures carried by a copy of the message
+	// returned to the queue after being refused are added to the count
+	msg := &amqp.Delivery{MessageId: "classic", Body: []byte("classic")}
+	for i := int64(1); i != 3; i++ {
+		if count := deliveryCount(queue, msg); count != i {
+			t.Fatalf("unexpected delivery count %d, expected %d", count, i)
+		}
+	}
+	msg.Headers = amqp.Table{failuresHeader: int64(2)}
+	if count := deliveryCount(queue, msg); count != 3 {
+		t.Fatalf("unexpected delivery count %d for a requeued message", count)
+	}
+
+	// Quorum queues count the previous deliveries of a message in a header
+	msg = &amqp.Delivery{MessageId: "quorum", Headers: amqp.Table{"x-delivery-count": int64(1), failuresHeader: int32(2)}}
+	if count := deliveryCount(queue, msg); count != 4 {
+		t.Fatalf("unexpected delivery count %d for a quorum queue message", count)
+	}
+}
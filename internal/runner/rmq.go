@@ -9,6 +9,9 @@ package runner
 import (
 	"context"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -33,6 +36,8 @@ import (
 
 	rh "github.com/michaelklishin/rabbit-hole/v2"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	"github.com/rs/xid"
 	"github.com/streadway/amqp"
 
@@ -59,6 +64,44 @@ type RabbitMQ struct {
 // DefaultStudioRMQExchange is the topic name used within RabbitMQ for StudioML based message queuing
 const DefaultStudioRMQExchange = "StudioML.topic"
 
+// DeadLetterSuffix is appended to the name of a work queue to derive the queue into which messages
+// that have exhausted their retry budget are moved
+const DeadLetterSuffix = "_dead"
+
+// failuresHeader carries the failed deliveries of a message that was returned to the tail of its
+// queue after being refused by a runner
+const failuresHeader = "x-studioml-failures"
+
+// ControlSuffix is appended to the name of a work queue to derive the queue on which commands,
+// such as cancelling a running experiment, are sent to the runners handling the work queue
+const ControlSuffix = "_control"
+
+var (
+	amqpRetryLimit  = flag.Uint("amqp-retry-limit", 5, "the number of times a message will be delivered from a RabbitMQ queue before being dead-lettered, 0 disables dead-lettering")
+	amqpDeadLetter  = flag.String("amqp-dead-letter-queue", "", "the name of the RabbitMQ queue into which failed messages are moved, defaults to the work queue name with a '"+DeadLetterSuffix+"' suffix")
+	amqpMaxPriority = flag.Uint("amqp-max-priority", 0, "the x-max-priority argument used when the runner declares RabbitMQ queues, messages with a higher priority being delivered first, 0 declares queues without priorities")
+
+	deadLettered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_queue_dead_lettered",
+			Help: "Number of messages moved to a dead-letter queue after exhausting their retry budget.",
+		},
+		[]string{"host", "queue_type", "queue_name"},
+	)
+	redelivered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_queue_redelivered",
+			Help: "Number of messages returned to their queue for redelivery after a failure.",
+		},
+		[]string{"host", "queue_type", "queue_name"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(deadLettered)
+	prometheus.MustRegister(redelivered)
+}
+
 // NewRabbitMQ takes the uri identifing a server and will configure the client
 // data structure needed to call methods against the server
 //
@@ -359,16 +402,203 @@ func (rmq *RabbitMQ) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed
 
 	rsc, ack, err := qt.Handler(ctx, qt)
 	if ack {
+		GetRetries().Clear(deliveryKey(queue, &msg))
 		if errGo := msg.Ack(false); errGo != nil {
 			return false, rsc, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subscription", qt.Subscription)
 		}
-	} else {
-		msg.Nack(false, true)
+		return true, rsc, err
+	}
+
+	// Messages refused by the runner, for example while it waits for resources or is stopping,
+	// have not failed and so are returned to the tail of the queue without using their retry
+	// budget.  Publishing a copy, rather than requeuing the message, leaves any delivery count
+	// RabbitMQ maintains for the message behind, and allows other messages to be tried first.
+	// Commands on control queues for experiments running on other runners are returned in the
+	// same way so that they do not hold up the commands behind them.
+	if task.IsRefused(err) || ctx.Err() != nil || strings.HasSuffix(queue, ControlSuffix) {
+		if errRequeue := rmq.requeue(ch, queue, &msg); errRequeue != nil {
+			rmq.logger.Warn("requeue failed", "queue", queue, "error", errRequeue.Error())
+			msg.Nack(false, true)
+			return true, rsc, err
+		}
+		GetRetries().Clear(deliveryKey(queue, &msg))
+		if errGo := msg.Ack(false); errGo != nil {
+			return false, rsc, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subscription", qt.Subscription)
+		}
+		return true, rsc, err
+	}
+
+	// The message was not processed successfully so check its retry budget and if it has been
+	// exhausted move the message to the dead letter queue rather than return it to the work queue.
+	// Control commands are returned without a budget as they are passed between runners until
+	// the runner with the experiment they apply to is found
+	if deliveries := deliveryCount(queue, &msg); *amqpRetryLimit != 0 && deliveries >= int64(*amqpRetryLimit) && !strings.HasSuffix(queue, ControlSuffix) {
+		if errDead := rmq.deadLetter(ch, queue, &msg, deliveries, err); errDead != nil {
+			rmq.logger.Warn("dead-letter failed", "queue", queue, "error", errDead.Error())
+		} else {
+			GetRetries().Clear(deliveryKey(queue, &msg))
+			deadLettered.With(prometheus.Labels{"host": host, "queue_type": "rmq", "queue_name": queue}).Inc()
+			if errGo := msg.Ack(false); errGo != nil {
+				return false, rsc, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subscription", qt.Subscription)
+			}
+			return true, rsc, err
+		}
 	}
 
+	redelivered.With(prometheus.Labels{"host": host, "queue_type": "rmq", "queue_name": queue}).Inc()
+	msg.Nack(false, true)
+
 	return true, rsc, err
 }
 
+// Peek is not supported by RabbitMQ.  Neither AMQP nor the management API can browse a queue
+// without retrieving and returning messages, which moves them and counts as a delivery for
+// quorum queues.  ErrPeekUnsupported is returned so that messages are claimed without being
+// examined first.
+//
+func (rmq *RabbitMQ) Peek(ctx context.Context, subscription string) (resource *server.Resource, err kv.Error) {
+	return nil, task.ErrPeekUnsupported
+}
+
+// deliveryKey generates a key that identifies a message across redeliveries for the
+// purposes of counting the number of times it has been seen by this runner.  The failures
+// carried by a message returned to its queue are included so that a fresh count is kept
+// for each copy of the message.
+//
+func deliveryKey(queue string, msg *amqp.Delivery) (key string) {
+	suffix := ""
+	if failures, isPresent := headerCount(msg.Headers, failuresHeader); isPresent {
+		suffix = "?" + strconv.FormatInt(failures, 10)
+	}
+	if len(msg.MessageId) != 0 {
+		return queue + "?" + msg.MessageId + suffix
+	}
+	digest := sha256.Sum256(msg.Body)
+	return queue + "?" + hex.EncodeToString(digest[:]) + suffix
+}
+
+// headerCount returns the value of an integer message header
+//
+func headerCount(headers amqp.Table, name string) (count int64, isPresent bool) {
+	switch header := headers[name].(type) {
+	case int64:
+		return header, true
+	case int32:
+		return int64(header), true
+	case int:
+		return int64(header), true
+	}
+	return 0, false
+}
+
+// deliveryCount records a failed delivery of a message and returns the number of failed
+// deliveries including the current one.  Quorum queues maintain the x-delivery-count header
+// which counts the number of previous deliveries, for classic queues the runner keeps its own
+// count which will only be accurate for messages that are repeatedly delivered to the same
+// runner.  Failures from before the message was last returned to its queue by requeue are
+// carried in a header of their own.
+//
+func deliveryCount(queue string, msg *amqp.Delivery) (count int64) {
+	runnerCount := GetRetries().Inc(deliveryKey(queue, msg))
+	prior, _ := headerCount(msg.Headers, failuresHeader)
+
+	if deliveries, isPresent := headerCount(msg.Headers, "x-delivery-count"); isPresent {
+		return prior + deliveries + 1
+	}
+	return prior + runnerCount
+}
+
+// requeue will publish a copy of a message that the runner refused to the tail of the queue it
+// was retrieved from, carrying the failed deliveries of the message in a header.  Deliveries
+// that preceded the current one are treated as failures.
+//
+func (rmq *RabbitMQ) requeue(ch *amqp.Channel, queue string, msg *amqp.Delivery) (err kv.Error) {
+	failures, _ := headerCount(msg.Headers, failuresHeader)
+	if deliveries, isPresent := headerCount(msg.Headers, "x-delivery-count"); isPresent {
+		failures += deliveries
+	} else {
+		failures += GetRetries().Get(deliveryKey(queue, msg))
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	delete(headers, "x-delivery-count")
+	headers[failuresHeader] = failures
+
+	errGo := ch.Publish(
+		"",    // use the default exchange, every declared queue gets an implicit route to the default exchange
+		queue, // routing key
+		false, // mandatory
+		false, // immediate
+		amqp.Publishing{
+			Headers:         headers,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			DeliveryMode:    amqp.Persistent,
+			Priority:        msg.Priority,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Body:            msg.Body,
+		})
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("qName", queue, "uri", rmq.Identity)
+	}
+	return nil
+}
+
+// deadLetter will publish a copy of a failed message to the dead letter queue for the queue it was
+// retrieved from, along with headers that describe the reason for the failure.  The dead
+// letter queue is published to using the default exchange to prevent it from appearing as a
+// StudioML work queue.
+//
+func (rmq *RabbitMQ) deadLetter(ch *amqp.Channel, queue string, msg *amqp.Delivery, deliveries int64, lastErr kv.Error) (err kv.Error) {
+	deadQ := *amqpDeadLetter
+	if len(deadQ) == 0 {
+		deadQ = queue + DeadLetterSuffix
+	}
+
+	// Declare parameters are, name, durable, delete when unused,, exclusive, no-wait, arguments
+	if _, errGo := ch.QueueDeclare(deadQ, true, false, false, false, nil); errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("qName", deadQ, "uri", rmq.Identity)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers["x-studioml-source-queue"] = queue
+	headers["x-studioml-deliveries"] = deliveries
+	headers["x-studioml-runner-host"] = host
+	headers["x-studioml-dead-lettered-at"] = time.Now().UTC().Format(time.RFC3339)
+	if lastErr != nil {
+		headers["x-studioml-last-error"] = lastErr.Error()
+	} else {
+		headers["x-studioml-last-error"] = "no error was recorded"
+	}
+
+	errGo := ch.Publish(
+		"",    // use the default exchange, every declared queue gets an implicit route to the default exchange
+		deadQ, // routing key
+		false, // mandatory
+		false, // immediate
+		amqp.Publishing{
+			Headers:         headers,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			DeliveryMode:    amqp.Persistent,
+			Priority:        msg.Priority,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Body:            msg.Body,
+		})
+	if errGo != nil {
+		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("qName", deadQ, "uri", rmq.Identity)
+	}
+	return nil
+}
+
 // This file contains the implementation of a test subsystem
 // for deploying rabbitMQ in test scenarios where it
 // has been installed for the purposes of running end-to-end
@@ -550,12 +780,34 @@ func (rmq *RabbitMQ) declareQPersistent(name string) (err kv.Error) {
 		conn.Close()
 	}()
 
-	if _, errGo := ch.QueueDeclare(name, true, false, false, false, nil); errGo != nil {
+	if _, errGo := ch.QueueDeclare(name, true, false, false, false, queueArgs()); errGo != nil {
+		// A queue declared by another client, after the passive declare failed to find it, using
+		// different arguments is rejected with a 406 PRECONDITION_FAILED and is used as it is
+		if amqpErr, isAMQP := errGo.(*amqp.Error); isAMQP && amqpErr.Code == amqp.PreconditionFailed {
+			rmq.logger.Warn("queue exists with different arguments", "queue", name, "error", amqpErr.Error())
+			return nil
+		}
 		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("qName", name, "uri", rmq.mgmt, "exchange", rmq.exchange)
 	}
 	return nil
 }
 
+// queueArgs returns the arguments for declaring queues, RabbitMQ only permits priorities from 1 to 255.
+// RabbitMQ rejects declarations of existing queues using different arguments, such as a different
+// x-max-priority, with a 406 PRECONDITION_FAILED error so queues are first declared passively, see
+// declareQVariants, and existing queues retain the arguments they were declared with.
+//
+func queueArgs() (args amqp.Table) {
+	if *amqpMaxPriority == 0 {
+		return nil
+	}
+	maxPriority := *amqpMaxPriority
+	if maxPriority > 255 {
+		maxPriority = 255
+	}
+	return amqp.Table{"x-max-priority": int32(maxPriority)}
+}
+
 // QueueDestroy is a shim method for creating a queue within the rabbitMQ
 // server defined by the receiver
 //
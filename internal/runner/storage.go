@@ -12,6 +12,7 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/leaf-ai/studio-go-runner/internal/blobstore"
 	"github.com/leaf-ai/studio-go-runner/internal/request"
 	"github.com/leaf-ai/studio-go-runner/internal/s3"
 
@@ -22,7 +23,9 @@ import (
 // Storage defines an interface for implementations of a studioml artifact store
 //
 type Storage interface {
-	// Gather will retrieve contents of the named storage object using a prefix treating any items retrieved as individual files, invokes Fetch
+	// Gather will retrieve contents of the named storage object using a prefix treating any items retrieved as individual files, invokes Fetch.
+	// The prefix can end with a glob pattern, see request.KeyPattern, that the keys retrieved must match.
+	// Files are placed using the path of their key beneath the prefix, see request.GatheredPath.
 	//
 	Gather(ctx context.Context, keyPrefix string, outputDir string, maxBytes int64, tap io.Writer, failFast bool) (size int64, warnings []kv.Error, err kv.Error)
 
@@ -40,7 +43,7 @@ type Storage interface {
 	Deposit(ctx context.Context, src string, dest string) (warnings []kv.Error, err kv.Error)
 
 	// Hash can be used to retrieve the hash of the contents of the file.  The hash is
-	// retrieved not computed and so is a lightweight operation common to both S3 and Google Storage.
+	// retrieved not computed and so is a lightweight operation common to S3, Google Storage and Azure Blob Storage.
 	// The hash on some storage platforms is not a plain MD5 but uses multiple hashes from file
 	// segments to increase the speed of hashing and also to reflect the multipart download
 	// processing that was used for the file, for a full explanation please see
@@ -96,11 +99,58 @@ func NewStorage(ctx context.Context, spec *StoreOpts) (stor Storage, err kv.Erro
 		useSSL := uri.Scheme == "https"
 
 		return s3.NewS3storage(ctx, *spec.Art.Credentials.AWS, spec.Env, uri.Host,
-			spec.Art.Bucket, spec.Art.Key, spec.Validate, useSSL)
+			spec.Art.Bucket, spec.Art.Key, spec.Art.Compression, spec.Validate, useSSL)
+
+	case "gs":
+		if len(uri.Host) == 0 {
+			return nil, kv.NewError("Google Cloud Storage bucket was not specified").With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(spec.Art.Bucket) == 0 {
+			spec.Art.Bucket = uri.Host
+		}
+		if len(spec.Art.Key) == 0 {
+			spec.Art.Key = strings.TrimPrefix(uri.Path, "/")
+		}
+
+		return blobstore.NewGCSStorage(ctx, spec.Art.Credentials, spec.Env, spec.Art.Bucket, spec.Art.Key, spec.Art.Compression)
+
+	case "azblob":
+		if len(uri.Host) == 0 {
+			return nil, kv.NewError("Azure Blob Storage container was not specified").With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(spec.Art.Bucket) == 0 {
+			spec.Art.Bucket = uri.Host
+		}
+		if len(spec.Art.Key) == 0 {
+			spec.Art.Key = strings.TrimPrefix(uri.Path, "/")
+		}
+
+		return blobstore.NewAzureStorage(ctx, spec.Art.Credentials, spec.Env, "", "", spec.Art.Bucket, spec.Art.Key, spec.Art.Compression)
+
+	case "http", "https":
+		if !blobstore.IsAzureHost(uri.Host) {
+			// Artifacts published on HTTP servers are read only
+			if len(spec.Art.Key) == 0 {
+				spec.Art.Key = uri.EscapedPath()
+			}
+			return blobstore.NewHTTPStorage(ctx, spec.Art.Credentials, uri, spec.Art.Key, spec.Art.Compression, spec.Art.Hash)
+		}
+
+		// https://<account>.blob.core.windows.net/<container>/<blob>
+		uriPath := strings.SplitN(strings.TrimPrefix(uri.Path, "/"), "/", 2)
+		if len(spec.Art.Bucket) == 0 {
+			spec.Art.Bucket = uriPath[0]
+		}
+		if len(spec.Art.Key) == 0 && len(uriPath) > 1 {
+			spec.Art.Key = uriPath[1]
+		}
+		account := strings.Split(uri.Host, ".")[0]
+
+		return blobstore.NewAzureStorage(ctx, spec.Art.Credentials, spec.Env, uri.Scheme+"://"+uri.Host, account, spec.Art.Bucket, spec.Art.Key, spec.Art.Compression)
 
 	case "file":
 		return NewLocalStorage()
 	default:
-		return nil, kv.NewError(fmt.Sprintf("unknown, or unsupported URI scheme %s, s3 or gs expected", uri.Scheme)).With("stack", stack.Trace().TrimRuntime())
+		return nil, kv.NewError(fmt.Sprintf("unknown, or unsupported URI scheme %s, s3, gs, azblob, http(s) or file expected", uri.Scheme)).With("stack", stack.Trace().TrimRuntime())
 	}
 }
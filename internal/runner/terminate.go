@@ -0,0 +1,185 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// This file contains the implementation of an orderly termination for experiment processes.
+// Experiments are run within their own process group and when cancelled the group is first sent
+// a SIGTERM to allow the experiment to checkpoint, then after a grace period a SIGKILL.
+
+import (
+	"context"
+	"flag"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+)
+
+var (
+	terminationGraceOpt = flag.Duration("termination-grace", time.Duration(30*time.Second), "the default period of time experiments have to stop after being sent a SIGTERM before being killed")
+)
+
+// Termination is used to record the reason an experiment was stopped by the runner
+// so that it can be presented to the experimenter
+//
+type Termination struct {
+	reason    string
+	immediate bool // Set when the experiment is to be killed without a grace period
+	sync.Mutex
+}
+
+type terminationKey struct{}
+
+// WithTermination returns a copy of the parent context that carries a Termination
+// into which the reason for cancelling the context can be recorded
+//
+func WithTermination(ctx context.Context) (newCtx context.Context, term *Termination) {
+	term = &Termination{}
+	return context.WithValue(ctx, terminationKey{}, term), term
+}
+
+// TerminationFromContext retrieves any Termination carried by the context
+//
+func TerminationFromContext(ctx context.Context) (term *Termination) {
+	term, _ = ctx.Value(terminationKey{}).(*Termination)
+	return term
+}
+
+// Set records the reason for a termination, only the first reason
+// recorded is retained
+//
+func (t *Termination) Set(reason string) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if len(t.reason) == 0 {
+		t.reason = reason
+	}
+}
+
+// Kill records the reason for a termination, as with Set, and also indicates that the
+// experiment should be killed without being given a grace period
+//
+func (t *Termination) Kill(reason string) {
+	if t == nil {
+		return
+	}
+	t.Set(reason)
+
+	t.Lock()
+	defer t.Unlock()
+	t.immediate = true
+}
+
+// Immediate returns true if the experiment should be killed without a grace period
+//
+func (t *Termination) Immediate() (immediate bool) {
+	if t == nil {
+		return false
+	}
+	t.Lock()
+	defer t.Unlock()
+	return t.immediate
+}
+
+// Reason returns the reason recorded for a termination, if any
+//
+func (t *Termination) Reason() (reason string) {
+	if t == nil {
+		return ""
+	}
+	t.Lock()
+	defer t.Unlock()
+	return t.reason
+}
+
+// TerminationReason produces a description of why a context was cancelled using any
+// reason explicitly recorded, or the error from the context itself
+//
+func TerminationReason(ctx context.Context) (reason string) {
+	if reason = TerminationFromContext(ctx).Reason(); len(reason) != 0 {
+		return reason
+	}
+	switch ctx.Err() {
+	case nil:
+		return ""
+	case context.DeadlineExceeded:
+		return "maximum run duration exceeded"
+	default:
+		return "cancelled by the runner"
+	}
+}
+
+// GracePeriod returns the period of time an experiment has to terminate after
+// being signalled before being killed
+//
+func GracePeriod(rqst *request.Request) (grace time.Duration) {
+	grace = *terminationGraceOpt
+	if rqst == nil || len(rqst.Config.GracePeriod) == 0 {
+		return grace
+	}
+	if limit, errGo := time.ParseDuration(rqst.Config.GracePeriod); errGo == nil && limit >= 0 {
+		return limit
+	}
+	return grace
+}
+
+// setProcessGroup configures a command so that it, and any children it spawns,
+// can be signalled as a single group
+//
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// terminateGroup will wait for the context to be cancelled or the process to exit, as
+// indicated by the exited channel being closed.  When the context is cancelled first the
+// process group is sent a SIGTERM and after the grace period a SIGKILL, with notices of
+// each step being sent to the notices channel if there is room.  The reason for the
+// termination is returned and is empty if the process exited by itself.
+//
+func terminateGroup(ctx context.Context, cmd *exec.Cmd, grace time.Duration, exited <-chan struct{}, notices chan<- string) (reason string) {
+	select {
+	case <-exited:
+		return ""
+	case <-ctx.Done():
+	}
+
+	reason = TerminationReason(ctx)
+
+	if TerminationFromContext(ctx).Immediate() {
+		grace = 0
+	}
+
+	notify := func(msg string) {
+		select {
+		case notices <- msg:
+		default:
+		}
+	}
+
+	// The negative pid signals every process within the group
+	pgid := -cmd.Process.Pid
+	notify("runner terminating experiment with SIGTERM, " + reason)
+	_ = syscall.Kill(pgid, syscall.SIGTERM)
+
+	graceTimer := time.NewTimer(grace)
+	defer graceTimer.Stop()
+
+	select {
+	case <-exited:
+		return reason
+	case <-graceTimer.C:
+	}
+
+	reason += ", killed after grace period of " + grace.String()
+	notify("runner killed experiment with SIGKILL after grace period of " + grace.String())
+	_ = syscall.Kill(pgid, syscall.SIGKILL)
+	return reason
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package runner
+
+// Unit tests for the orderly termination of experiment process groups.
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runTerminated(ctx context.Context, t *testing.T, script string, grace time.Duration) (reason string, elapsed time.Duration) {
+	cmd := exec.Command("/bin/bash", "-c", script)
+	setProcessGroup(cmd)
+	if errGo := cmd.Start(); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	startedAt := time.Now()
+
+	exited := make(chan struct{})
+	terminated := make(chan string, 1)
+	go func() {
+		terminated <- terminateGroup(ctx, cmd, grace, exited, make(chan string, 2))
+	}()
+
+	_ = cmd.Wait()
+	close(exited)
+
+	return <-terminated, time.Since(startedAt)
+}
+
+func TestTerminateGroup(t *testing.T) {
+	dir, errGo := os.MkdirTemp("", "terminate-test")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	// An experiment that handles the SIGTERM should stop without being killed
+	trapped := path.Join(dir, "trapped")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reason, elapsed := runTerminated(ctx, t, "trap 'touch "+trapped+"; exit 0' TERM; sleep 30 & wait", 10*time.Second)
+	if reason != "maximum run duration exceeded" {
+		t.Fatalf("unexpected termination reason '%s'", reason)
+	}
+	if elapsed > 5*time.Second {
+		t.Fatalf("experiment took %s to stop after SIGTERM", elapsed.String())
+	}
+	if _, errGo := os.Stat(trapped); errGo != nil {
+		t.Fatal("experiment did not receive SIGTERM", errGo)
+	}
+
+	// An experiment that ignores the SIGTERM is killed after the grace period, along with any children
+	ctx, term := WithTermination(context.Background())
+	ctx, cancel = context.WithCancel(ctx)
+	term.Set("cancelled by test")
+	go func() {
+		time.Sleep(time.Second)
+		cancel()
+	}()
+
+	reason, elapsed = runTerminated(ctx, t, "trap '' TERM; sleep 30", 500*time.Millisecond)
+	if !strings.HasPrefix(reason, "cancelled by test") || !strings.Contains(reason, "killed") {
+		t.Fatalf("unexpected termination reason '%s'", reason)
+	}
+	if elapsed > 5*time.Second {
+		t.Fatalf("experiment took %s to be killed", elapsed.String())
+	}
+
+	// An experiment that completes by itself has no termination reason
+	reason, _ = runTerminated(context.Background(), t, "exit 0", time.Second)
+	if len(reason) != 0 {
+		t.Fatalf("unexpected termination reason '%s'", reason)
+	}
+}
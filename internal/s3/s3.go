@@ -6,10 +6,7 @@ package s3 // import "github.com/leaf-ai/studio-go-runner/internal/s3"
 // be used by the runner to retrieve storage from cloud providers or localized storage
 
 import (
-	"archive/tar"
 	"bufio"
-	"compress/bzip2"
-	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -27,16 +24,13 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/leaf-ai/go-service/pkg/archive"
-	"github.com/leaf-ai/go-service/pkg/mime"
 
-	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/archives"
 	"github.com/leaf-ai/studio-go-runner/internal/request"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 
-	bzip2w "github.com/dsnet/compress/bzip2"
-
 	"github.com/go-stack/stack"
 	"github.com/jjeffery/kv" // MIT License
 )
@@ -58,26 +52,31 @@ const (
 )
 
 type s3Storage struct {
-	storage    StorageImpl
-	endpoint   string
-	bucket     string
-	key        string
-	client     *minio.Client
-	anonClient *minio.Client
+	storage     StorageImpl
+	endpoint    string
+	bucket      string
+	key         string
+	compression string
+	client      *minio.Client
+	anonClient  *minio.Client
 }
 
 // NewS3storage is used to initialize a client that will communicate with S3 compatible storage.
 //
 // S3 configuration will only be respected using the AWS environment variables.
 //
+// The compression, when specified, selects the archive format used for the artifact, see
+// the archives package for the supported values.
+//
 func NewS3storage(ctx context.Context, creds request.AWSCredential, env map[string]string, endpoint string,
-	bucket string, key string, validate bool, useSSL bool) (s *s3Storage, err kv.Error) {
+	bucket string, key string, compression string, validate bool, useSSL bool) (s *s3Storage, err kv.Error) {
 
 	s = &s3Storage{
-		storage:  S3Impl,
-		endpoint: endpoint,
-		bucket:   bucket,
-		key:      key,
+		storage:     S3Impl,
+		endpoint:    endpoint,
+		bucket:      bucket,
+		key:         key,
+		compression: compression,
 	}
 
 	// When using official S3 then the region will be encoded into the endpoint and in order to
@@ -279,10 +278,15 @@ func (s *s3Storage) Gather(ctx context.Context, keyPrefix string, outputDir stri
 	names := []string{}
 	_ = names // Bypass the ineffectual assignment check
 
-	names, warnings, err = s.ListObjects(ctx, keyPrefix)
+	// Prefixes can end with a glob pattern that is matched against the full keys that were listed
+	prefix, pattern := request.KeyPattern(keyPrefix)
+	names, warnings, err = s.ListObjects(ctx, prefix)
 	if err != nil {
 		return size, warnings, err
 	}
+	if len(pattern) != 0 {
+		names = request.MatchKeys(names, pattern)
+	}
 
 	// Place names into the gathered pool in sroted order to allow testing to
 	// predictably download items when using the maxBytes parameter
@@ -290,7 +294,17 @@ func (s *s3Storage) Gather(ctx context.Context, keyPrefix string, outputDir stri
 
 	// Download the keys within the prefix, making sure not to blow the budget
 	for _, key := range names {
-		s, w, e := s.Fetch(ctx, key, false, outputDir, maxBytes, tap)
+		// Objects are placed using the path of their key beneath the prefix
+		rel, ok := request.GatheredPath(keyPrefix, key)
+		if !ok {
+			warnings = append(warnings, kv.NewError("object outside of the prefix skipped").With("key", key, "prefix", keyPrefix).With("stack", stack.Trace().TrimRuntime()))
+			continue
+		}
+		dir := filepath.Join(outputDir, filepath.Dir(filepath.FromSlash(rel)))
+		if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+			return size, warnings, kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+		s, w, e := s.Fetch(ctx, key, false, dir, maxBytes, tap)
 		if len(w) != 0 {
 			warnings = append(warnings, w...)
 		}
@@ -332,12 +346,13 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 		return 0, warns, errCtx.NewError("a directory was not used, or did not exist").With("stack", stack.Trace().TrimRuntime())
 	}
 
-	fileType, w := mime.MimeFromExt(name)
+	fileType, w := archives.FetchType(key, s.compression)
 	if w != nil {
 		warns = append(warns, w)
 	}
 
-	obj, errGo := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	client := s.client
+	obj, errGo := client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
 	if errGo == nil {
 		// Errors can be delayed until the first interaction with the storage platform so
 		// we exercise access to the meta data at least to validate the object we have
@@ -355,7 +370,8 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 	if errGo != nil {
 		originalErr := errGo
 		if minio.ToErrorResponse(errGo).Code == "AccessDenied" {
-			obj, errGo = s.anonClient.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+			client = s.anonClient
+			obj, errGo = client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
 			if errGo == nil {
 				// Errors can be delayed until the first interaction with the storage platform so
 				// we exercise access to the meta data at least to validate the object we have
@@ -376,120 +392,54 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 	}
 	defer obj.Close()
 
-	// If the unpack flag is set then use a tar decompressor and unpacker
-	// but first make sure the output location is an existing directory
-	if unpack {
-
-		var inReader io.ReadCloser
-
-		switch fileType {
-		case "application/x-gzip", "application/zip":
-			if tap != nil {
-				// Create a stack of reader that first tee off any data read to a tap
-				// the tap being able to send data to things like caches etc
-				//
-				// Second in the stack of readers after the TAP is a decompression reader
-				inReader, errGo = gzip.NewReader(io.TeeReader(obj, tap))
-			} else {
-				inReader, errGo = gzip.NewReader(obj)
-			}
-		case "application/bzip2", "application/octet-stream":
-			if tap != nil {
-				// Create a stack of reader that first tee off any data read to a tap
-				// the tap being able to send data to things like caches etc
-				//
-				// Second in the stack of readers after the TAP is a decompression reader
-				inReader = ioutil.NopCloser(bzip2.NewReader(io.TeeReader(obj, tap)))
-			} else {
-				inReader = ioutil.NopCloser(bzip2.NewReader(obj))
-			}
-		default:
-			if tap != nil {
-				// Create a stack of reader that first tee off any data read to a tap
-				// the tap being able to send data to things like caches etc
-				//
-				// Second in the stack of readers after the TAP is a decompression reader
-				inReader = ioutil.NopCloser(io.TeeReader(obj, tap))
-			} else {
-				inReader = ioutil.NopCloser(obj)
+	// Objects larger than a single part are downloaded using concurrent ranged requests
+	// with the parts being retained until the object has been processed so that failed
+	// downloads can be resumed
+	var src io.Reader = obj
+	if stat, errGo := obj.Stat(); errGo == nil {
+		useParts, partSize, errParts := parallelFetch(stat.Size)
+		if errParts != nil {
+			return 0, warns, errParts
+		}
+		if useParts {
+			// The body of the initial request is not used so it is released rather than being
+			// held open while the parts are downloaded
+			obj.Close()
+
+			parts, w, errParts := s.fetchParts(ctx, client, key, stat, partSize)
+			warns = append(warns, w...)
+			if errParts != nil {
+				return 0, warns, errParts
 			}
+			defer func() {
+				if err == nil {
+					parts.Remove()
+				} else {
+					parts.Close()
+				}
+			}()
+			src = parts
 		}
-		if errGo != nil {
-			return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-		}
-		defer inReader.Close()
-
-		// Last in the stack is a tar file handling reader
-		tarReader := tar.NewReader(inReader)
-
-		for {
-			header, errGo := tarReader.Next()
-			if errors.Is(errGo, io.EOF) {
-				break
-			} else if errGo != nil {
-				return 0, warns, errCtx.Wrap(errGo).With("fileType", fileType).With("stack", stack.Trace().TrimRuntime())
-			}
+	}
 
-			outFN, errGo := filepath.Abs(filepath.Join(output, header.Name))
-			if errGo != nil {
+	// If the unpack flag is set then use an archive decompressor and unpacker
+	if unpack {
+		if tap != nil {
+			// Create a stack of reader that first tee off any data read to a tap
+			// the tap being able to send data to things like caches etc
+			//
+			// Second in the stack of readers after the TAP is a decompression reader
+			src = io.TeeReader(src, tap)
+		}
+		if size, err = archives.Unpack(src, fileType, output, maxBytes); err != nil {
+			return 0, warns, err.With("bucket", s.bucket, "key", key, "endpoint", s.endpoint, "fileType", fileType)
+		}
+		if tap != nil {
+			// Archives can end before the content does, for example with padding, so the
+			// remainder is read to complete the copy being made by the tap
+			if _, errGo = io.Copy(ioutil.Discard, src); errGo != nil {
 				return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 			}
-
-			if len(header.Linkname) != 0 {
-				escapes, err := defense.WillEscape(header.Linkname, outFN)
-				if !escapes {
-					escapes, err = defense.WillEscape(header.Name, outFN)
-				}
-				if escapes {
-					if err != nil {
-						return 0, warns, errCtx.Wrap(err).With("link", header.Linkname, "filename", header.Name, "output", output)
-					} else {
-						return 0, warns, errCtx.NewError("archive escaped").With("filename", header.Name, "output", output)
-					}
-				}
-
-				if errGo = os.Symlink(header.Linkname, outFN); errGo != nil {
-					return 0, warns, errCtx.Wrap(errGo, "symbolic link create failed").With("stack", stack.Trace().TrimRuntime())
-				}
-				continue
-			}
-
-			switch header.Typeflag {
-			case tar.TypeDir:
-				if info.IsDir() {
-					if errGo = os.MkdirAll(outFN, os.FileMode(header.Mode)); errGo != nil {
-						return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", outFN)
-					}
-				}
-			case tar.TypeReg, tar.TypeRegA:
-
-				_ = os.MkdirAll(filepath.Dir(outFN), os.ModePerm)
-
-				if escapes, err := defense.WillEscape(header.Name, output); escapes {
-					if err != nil {
-						return 0, warns, errCtx.Wrap(err).With("filename", header.Name, "output", output, "dir", filepath.Dir(outFN))
-					} else {
-						return 0, warns, errCtx.NewError("archive escaped").With("filename", header.Name, "output", output)
-					}
-				}
-
-				file, errGo := os.OpenFile(outFN, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode))
-				if errGo != nil {
-					return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", outFN)
-				}
-
-				size, errGo = io.CopyN(file, tarReader, maxBytes)
-				file.Close()
-				if errGo != nil {
-					if !errors.Is(errGo, io.EOF) {
-						return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", outFN)
-					}
-					errGo = nil
-				}
-			default:
-				errGo = fmt.Errorf("unknown tar archive type '%c'", header.Typeflag)
-				return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", outFN)
-			}
 		}
 	} else {
 		errGo := os.MkdirAll(output, 0700)
@@ -509,7 +459,7 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 			// the tap being able to send data to things like caches etc
 			//
 			// Second in the stack of readers after the TAP is a decompression reader
-			size, errGo = io.CopyN(outf, io.TeeReader(obj, tap), maxBytes)
+			size, errGo = io.CopyN(outf, io.TeeReader(src, tap), maxBytes)
 			if errGo != nil {
 				if !errors.Is(errGo, io.EOF) {
 					return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", path)
@@ -517,7 +467,7 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 				errGo = nil
 			}
 		} else {
-			size, errGo = io.CopyN(outf, obj, maxBytes)
+			size, errGo = io.CopyN(outf, src, maxBytes)
 			if errGo != nil {
 				if !errors.Is(errGo, io.EOF) {
 					return 0, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", path)
@@ -544,19 +494,13 @@ func (s *s3Storage) uploadFile(ctx context.Context, src string, dest string) (er
 	}
 	defer file.Close()
 
-	fileStat, errGo := file.Stat()
-	if errGo != nil {
-		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("src", src)
-	}
-
 	uploadCtx, cancel := context.WithDeadline(ctx, time.Now().Add(10*time.Minute))
 	defer cancel()
 
-	_, errGo = s.client.PutObject(uploadCtx, s.bucket, dest, file, fileStat.Size(), minio.PutObjectOptions{
+	if err = s.putParts(uploadCtx, dest, file, minio.PutObjectOptions{
 		ContentType: "application/octet-stream",
-	})
-	if errGo != nil {
-		return kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("src", src, "bucket", s.bucket, "key", dest)
+	}); err != nil {
+		return err.With("src", src)
 	}
 	return nil
 }
@@ -606,15 +550,16 @@ func (s *s3Storage) Hoard(ctx context.Context, srcDir string, keyPrefix string)
 //
 func (s *s3Storage) Deposit(ctx context.Context, src string, dest string) (warns []kv.Error, err kv.Error) {
 
-	if !archive.IsTar(dest) {
-		return warns, kv.NewError("uploads must be tar, or tar compressed files").With("stack", stack.Trace().TrimRuntime()).With("key", dest)
-	}
-
 	key := dest
 	if len(key) == 0 {
 		key = s.key
 	}
 
+	typ, err := archives.DepositType(dest, s.compression)
+	if err != nil {
+		return warns, err.With("key", dest)
+	}
+
 	files, err := archive.NewTarWriter(src)
 	if err != nil {
 		return warns, err
@@ -628,7 +573,7 @@ func (s *s3Storage) Deposit(ctx context.Context, src string, dest string) (warns
 	pr, pw := io.Pipe()
 
 	swErrorC := make(chan kv.Error)
-	go streamingWriter(pr, pw, files, dest, swErrorC)
+	go streamingWriter(pr, pw, files, typ, swErrorC)
 
 	s3ErrorC := make(chan kv.Error)
 	go s.s3Put(key, pr, s3ErrorC)
@@ -669,8 +614,10 @@ func (s *s3Storage) s3Put(key string, pr *io.PipeReader, errorC chan kv.Error) {
 		}
 		close(errorC)
 	}()
-	if _, errGo := s.client.PutObject(context.Background(), s.bucket, key, pr, -1, minio.PutObjectOptions{}); errGo != nil {
-		errorC <- errS.Wrap(minio.ToErrorResponse(errGo)).With("stack", stack.Trace().TrimRuntime())
+	if err := s.putParts(context.Background(), key, pr, minio.PutObjectOptions{}); err != nil {
+		// Release the writer of the archive that would otherwise block on the pipe
+		pr.CloseWithError(err)
+		errorC <- err
 		return
 	}
 }
@@ -688,7 +635,7 @@ func (es *errSender) send(err kv.Error) {
 	}
 }
 
-func streamingWriter(pr *io.PipeReader, pw *io.PipeWriter, files *archive.TarWriter, dest string, errorC chan kv.Error) {
+func streamingWriter(pr *io.PipeReader, pw *io.PipeWriter, files *archive.TarWriter, typ string, errorC chan kv.Error) {
 
 	sender := errSender{errorC: errorC}
 
@@ -701,37 +648,5 @@ func streamingWriter(pr *io.PipeReader, pw *io.PipeWriter, files *archive.TarWri
 		close(errorC)
 	}()
 
-	typ, w := mime.MimeFromExt(dest)
-	sender.send(w)
-
-	switch typ {
-	case "application/tar", "application/octet-stream":
-		tw := tar.NewWriter(pw)
-		if errGo := files.Write(tw); errGo != nil {
-			sender.send(errGo)
-		}
-		tw.Close()
-	case "application/bzip2":
-		outZ, _ := bzip2w.NewWriter(pw, &bzip2w.WriterConfig{Level: 6})
-		tw := tar.NewWriter(outZ)
-		if errGo := files.Write(tw); errGo != nil {
-			sender.send(errGo)
-		}
-		tw.Close()
-		outZ.Close()
-	case "application/x-gzip":
-		outZ := gzip.NewWriter(pw)
-		tw := tar.NewWriter(outZ)
-		if errGo := files.Write(tw); errGo != nil {
-			sender.send(errGo)
-		}
-		tw.Close()
-		outZ.Close()
-	case "application/zip":
-		sender.send(kv.NewError("only tar archives are supported").With("stack", stack.Trace().TrimRuntime()).With("key", dest))
-		return
-	default:
-		sender.send(kv.NewError("unrecognized upload compression").With("stack", stack.Trace().TrimRuntime()).With("key", dest))
-		return
-	}
+	sender.send(archives.Pack(pw, files, typ))
 }
@@ -0,0 +1,693 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package s3
+
+// This file contains the implementation of parallel multipart transfers for S3 storage.  Downloads
+// are performed using concurrent ranged requests with each part being saved as a file so that
+// interrupted downloads can be resumed.  Uploads are performed using concurrent multipart uploads.
+// Both are checked against the ETag of the object, either an MD5 or a composite MD5 of the parts.
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/go-stack/stack"
+	"github.com/jjeffery/kv" // MIT License
+)
+
+var (
+	s3PartSize   = flag.String("s3-part-size", "64MiB", "the size of the parts used for parallel S3 uploads and downloads, the minimum is 5MiB")
+	s3Parallel   = flag.Uint("s3-parallel", 4, "the number of parts of a single S3 object transferred concurrently, 1 disables parallel transfers")
+	s3VerifyETag = flag.Bool("s3-verify-etag", true, "check S3 transfers against the MD5, or composite MD5, ETag of the object")
+
+	// partsDir is the directory into which the parts of downloads are placed so that
+	// they can be resumed, when empty a temporary directory is used for each download
+	partsDir     = ""
+	partsDirSync sync.Mutex
+)
+
+const (
+	// minPartSize is the smallest part other than the last that S3 accepts for multipart uploads
+	minPartSize = 5 * 1024 * 1024
+	// maxParts is the largest number of parts S3 accepts for a multipart upload
+	maxParts = 10000
+
+	// partsRetention is the age after which the parts of incomplete downloads are discarded
+	partsRetention = 48 * time.Hour
+)
+
+// SetPartsDir is used to specify a directory that will retain the parts of downloads so that
+// downloads interrupted by failures, or restarts, can be resumed.  Parts from downloads that
+// have not been touched within the retention period are removed.  An empty dir results in
+// temporary directories being used.
+//
+func SetPartsDir(dir string) (err kv.Error) {
+	if len(dir) == 0 {
+		partsDirSync.Lock()
+		defer partsDirSync.Unlock()
+		partsDir = ""
+		return nil
+	}
+
+	if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+		return kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	entries, errGo := ioutil.ReadDir(dir)
+	if errGo != nil {
+		return kv.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	for _, entry := range entries {
+		if time.Since(entry.ModTime()) > partsRetention {
+			os.RemoveAll(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	partsDirSync.Lock()
+	defer partsDirSync.Unlock()
+	partsDir = dir
+
+	return nil
+}
+
+// transferPartSize returns the size of the parts to be used for transfers
+//
+func transferPartSize() (size int64, err kv.Error) {
+	bytes, errGo := humanize.ParseBytes(*s3PartSize)
+	if errGo != nil {
+		return 0, kv.Wrap(errGo).With("s3-part-size", *s3PartSize).With("stack", stack.Trace().TrimRuntime())
+	}
+	if bytes < minPartSize {
+		return 0, kv.NewError("part size too small").With("s3-part-size", *s3PartSize, "minimum", humanize.IBytes(minPartSize)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return int64(bytes), nil
+}
+
+// parallel returns the number of parts to be transferred concurrently
+//
+func parallel() (count int) {
+	if *s3Parallel < 1 {
+		return 1
+	}
+	return int(*s3Parallel)
+}
+
+// numParts returns the number of parts of size partSize needed to hold size bytes
+//
+func numParts(size int64, partSize int64) (parts int64) {
+	return (size + partSize - 1) / partSize
+}
+
+// compositeETag returns the ETag S3 assigns to multipart uploads, the MD5 of the MD5 digests
+// of the individual parts, suffixed with the number of parts
+//
+func compositeETag(digests [][]byte) (etag string) {
+	hash := md5.New()
+	for _, digest := range digests {
+		hash.Write(digest)
+	}
+	return hex.EncodeToString(hash.Sum(nil)) + "-" + strconv.Itoa(len(digests))
+}
+
+// etagPart accumulates the ETag of content for a single part size, with a part size of 0
+// producing a plain MD5
+//
+type etagPart struct {
+	size    int64
+	written int64
+	part    hash.Hash
+	digests [][]byte
+}
+
+func (p *etagPart) Write(b []byte) (n int, errGo error) {
+	n = len(b)
+	if p.size == 0 {
+		p.part.Write(b)
+		return n, nil
+	}
+	for len(b) != 0 {
+		chunk := b
+		if remaining := p.size - p.written; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		p.part.Write(chunk)
+		p.written += int64(len(chunk))
+		b = b[len(chunk):]
+		if p.written == p.size {
+			p.complete()
+		}
+	}
+	return n, nil
+}
+
+func (p *etagPart) complete() {
+	p.digests = append(p.digests, p.part.Sum(nil))
+	p.part.Reset()
+	p.written = 0
+}
+
+func (p *etagPart) etag() (etag string) {
+	if p.size == 0 {
+		return hex.EncodeToString(p.part.Sum(nil))
+	}
+	if p.written != 0 {
+		p.complete()
+	}
+	return compositeETag(p.digests)
+}
+
+// contentETags returns the ETags of the content read from rdr when uploaded using each of
+// the part sizes, or as a plain MD5 for a part size of 0.  The content is read only once.
+//
+func contentETags(rdr io.Reader, partSizes []int64) (etags []string, err kv.Error) {
+	parts := make([]*etagPart, 0, len(partSizes))
+	writers := make([]io.Writer, 0, len(partSizes))
+	for _, size := range partSizes {
+		part := &etagPart{size: size, part: md5.New()}
+		parts = append(parts, part)
+		writers = append(writers, part)
+	}
+	if _, errGo := io.Copy(io.MultiWriter(writers...), rdr); errGo != nil {
+		return nil, kv.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	for _, part := range parts {
+		etags = append(etags, part.etag())
+	}
+	return etags, nil
+}
+
+// etagPartSizes returns the part sizes that could have been used to upload an object with
+// the ETag, 0 indicating a plain MD5.  The part size is not recorded by S3 so the size used
+// by the runner, the smallest MiB aligned size, and the defaults of the AWS CLI and the
+// minio client are tried.
+//
+func etagPartSizes(etag string, size int64, partSize int64) (sizes []int64, ok bool) {
+	etag = strings.Trim(etag, "\"")
+	sum, count := etag, ""
+	if pos := strings.Index(etag, "-"); pos != -1 {
+		sum, count = etag[:pos], etag[pos+1:]
+	}
+	if _, errGo := hex.DecodeString(sum); errGo != nil || len(sum) != 2*md5.Size {
+		return nil, false
+	}
+	if len(count) == 0 {
+		return []int64{0}, true
+	}
+
+	parts, errGo := strconv.ParseInt(count, 10, 64)
+	if errGo != nil || parts < 1 {
+		return nil, false
+	}
+
+	const mib = 1024 * 1024
+	candidates := []int64{partSize, (numParts(size, parts) + mib - 1) / mib * mib, 8 * mib, 16 * mib, 512 * mib}
+	for _, candidate := range candidates {
+		if candidate == 0 || numParts(size, candidate) != parts {
+			continue
+		}
+		duplicate := false
+		for _, existing := range sizes {
+			if existing == candidate {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			sizes = append(sizes, candidate)
+		}
+	}
+	return sizes, len(sizes) != 0
+}
+
+// parallelFetch returns true if objects of the size should be downloaded as parts
+//
+func parallelFetch(size int64) (use bool, partSize int64, err kv.Error) {
+	if parallel() < 2 {
+		return false, 0, nil
+	}
+	if partSize, err = transferPartSize(); err != nil {
+		return false, 0, err
+	}
+	return size > partSize, partSize, nil
+}
+
+// partsReader presents the parts of a download, in order, as a single stream
+//
+type partsReader struct {
+	dir   string
+	parts int64
+	next  int64
+	cur   *os.File
+	temp  bool
+	lock  *os.File
+}
+
+func (r *partsReader) Read(p []byte) (n int, errGo error) {
+	for {
+		if r.cur == nil {
+			if r.next >= r.parts {
+				return 0, io.EOF
+			}
+			if r.cur, errGo = os.Open(filepath.Join(r.dir, strconv.FormatInt(r.next, 10))); errGo != nil {
+				return 0, errGo
+			}
+			r.next++
+		}
+		n, errGo = r.cur.Read(p)
+		if errors.Is(errGo, io.EOF) {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			errGo = nil
+		}
+		return n, errGo
+	}
+}
+
+// Close releases the part being read and the lock on the parts, parts downloaded into
+// temporary directories are removed
+//
+func (r *partsReader) Close() (errGo error) {
+	if r.cur != nil {
+		errGo = r.cur.Close()
+		r.cur = nil
+	}
+	if r.temp {
+		os.RemoveAll(filepath.Dir(r.dir))
+	}
+	if r.lock != nil {
+		_ = syscall.Flock(int(r.lock.Fd()), syscall.LOCK_UN)
+		r.lock.Close()
+		r.lock = nil
+	}
+	return errGo
+}
+
+// Remove discards the downloaded parts once they are no longer needed to resume the download
+//
+func (r *partsReader) Remove() {
+	if r.cur != nil {
+		r.cur.Close()
+		r.cur = nil
+	}
+	os.RemoveAll(r.dir)
+	r.Close()
+}
+
+// lockParts obtains an exclusive lock on the parts of a download, waiting for other downloads of
+// the same object by this, or another, runner sharing the parts directory to finish with them
+//
+func lockParts(ctx context.Context, fn string) (lock *os.File, errGo error) {
+	if lock, errGo = os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600); errGo != nil {
+		return nil, errGo
+	}
+	for {
+		errGo = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if !errors.Is(errGo, syscall.EWOULDBLOCK) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			lock.Close()
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	if errGo != nil {
+		lock.Close()
+		return nil, errGo
+	}
+	// Lock files are retained, being removed along with abandoned parts once unused
+	now := time.Now()
+	_ = os.Chtimes(fn, now, now)
+	return lock, nil
+}
+
+// rewind returns the reader to the start of the first part
+//
+func (r *partsReader) rewind() {
+	if r.cur != nil {
+		r.cur.Close()
+		r.cur = nil
+	}
+	r.next = 0
+}
+
+// fetchParts downloads an object using concurrent ranged requests.  Each part is written to its own
+// file, parts already present from a previous attempt are not downloaded again.  The returned reader
+// presents the parts as a single stream once all have been downloaded and checked.
+//
+func (s *s3Storage) fetchParts(ctx context.Context, client *minio.Client, key string, info minio.ObjectInfo, partSize int64) (rdr *partsReader, warns []kv.Error, err kv.Error) {
+
+	errCtx := kv.With("bucket", s.bucket).With("key", key).With("endpoint", s.endpoint)
+
+	partsDirSync.Lock()
+	root := partsDir
+	partsDirSync.Unlock()
+
+	rdr = &partsReader{
+		parts: numParts(info.Size, partSize),
+	}
+
+	if len(root) == 0 {
+		tmp, errGo := ioutil.TempDir("", "s3-parts-")
+		if errGo != nil {
+			return nil, warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		root = tmp
+		rdr.temp = true
+	}
+
+	// The parts of the download are identified using the object, its version as indicated by the
+	// ETag, and the part size so that parts from different versions of the object are never mixed
+	id := sha256.Sum256([]byte(strings.Join([]string{s.endpoint, s.bucket, key, info.ETag, strconv.FormatInt(info.Size, 10), strconv.FormatInt(partSize, 10)}, "/")))
+	rdr.dir = filepath.Join(root, hex.EncodeToString(id[:16]))
+
+	if !rdr.temp {
+		lock, errGo := lockParts(ctx, rdr.dir+".lock")
+		if errGo != nil {
+			return nil, warns, errCtx.Wrap(errGo).With("dir", rdr.dir).With("stack", stack.Trace().TrimRuntime())
+		}
+		rdr.lock = lock
+	}
+
+	if errGo := os.MkdirAll(rdr.dir, 0700); errGo != nil {
+		rdr.Close()
+		return nil, warns, errCtx.Wrap(errGo).With("dir", rdr.dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	// Mark the download as being active so that the parts are retained
+	now := time.Now()
+	_ = os.Chtimes(rdr.dir, now, now)
+
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	partsC := make(chan int64, rdr.parts)
+	for i := int64(0); i < rdr.parts; i++ {
+		length := partSize
+		if i == rdr.parts-1 {
+			length = info.Size - i*partSize
+		}
+		if stat, errGo := os.Stat(filepath.Join(rdr.dir, strconv.FormatInt(i, 10))); errGo == nil && stat.Size() == length {
+			continue
+		}
+		partsC <- i
+	}
+	close(partsC)
+
+	errorC := make(chan kv.Error, parallel())
+	wg := sync.WaitGroup{}
+	for i := 0; i < parallel(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range partsC {
+				if fetchCtx.Err() != nil {
+					return
+				}
+				if err := s.fetchPart(fetchCtx, client, key, info, partSize, part, rdr.dir); err != nil {
+					errorC <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errorC)
+
+	for err = range errorC {
+		rdr.Close()
+		return nil, warns, err
+	}
+
+	if !*s3VerifyETag {
+		return rdr, warns, nil
+	}
+
+	sizes, ok := etagPartSizes(info.ETag, info.Size, partSize)
+	if !ok {
+		warns = append(warns, errCtx.NewError("ETag not checked").With("etag", info.ETag).With("stack", stack.Trace().TrimRuntime()))
+		return rdr, warns, nil
+	}
+	etags, err := contentETags(rdr, sizes)
+	rdr.rewind()
+	if err != nil {
+		rdr.Close()
+		return nil, warns, err
+	}
+	for _, etag := range etags {
+		if etag == strings.Trim(info.ETag, "\"") {
+			return rdr, warns, nil
+		}
+	}
+
+	// The parts cannot be trusted so they are discarded to prevent them being used to resume
+	rdr.Remove()
+	return nil, warns, errCtx.NewError("ETag mismatch").With("etag", info.ETag).With("stack", stack.Trace().TrimRuntime())
+}
+
+// fetchPart downloads a single part of an object using a ranged request.  The part is written to
+// a temporary file that is renamed once complete so that partially downloaded parts are never
+// mistaken for complete parts.
+//
+func (s *s3Storage) fetchPart(ctx context.Context, client *minio.Client, key string, info minio.ObjectInfo, partSize int64, part int64, dir string) (err kv.Error) {
+	start := part * partSize
+	end := start + partSize - 1
+	if end >= info.Size {
+		end = info.Size - 1
+	}
+
+	errCtx := kv.With("bucket", s.bucket).With("key", key).With("endpoint", s.endpoint).With("part", part)
+
+	opts := minio.GetObjectOptions{}
+	if errGo := opts.SetRange(start, end); errGo != nil {
+		return errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	// Prevent parts from different versions of the object being combined
+	if errGo := opts.SetMatchETag(strings.Trim(info.ETag, "\"")); errGo != nil {
+		return errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	body, _, _, errGo := minio.Core{Client: client}.GetObject(ctx, s.bucket, key, opts)
+	if errGo != nil {
+		return errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer body.Close()
+
+	partFN := filepath.Join(dir, strconv.FormatInt(part, 10))
+	tmpFN := partFN + ".tmp"
+
+	f, errGo := os.OpenFile(tmpFN, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if errGo != nil {
+		return errCtx.Wrap(errGo).With("file", tmpFN).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	copied, errGo := io.Copy(f, body)
+	if errClose := f.Close(); errGo == nil {
+		errGo = errClose
+	}
+	if errGo == nil && copied != end-start+1 {
+		errGo = fmt.Errorf("part truncated, expected %d bytes received %d", end-start+1, copied)
+	}
+	if errGo != nil {
+		os.Remove(tmpFN)
+		return errCtx.Wrap(errGo).With("file", tmpFN).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if errGo = os.Rename(tmpFN, partFN); errGo != nil {
+		return errCtx.Wrap(errGo).With("file", partFN).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// putParts uploads the content of the reader using a multipart upload with the parts being sent
+// concurrently.  Content that fits within a single part is sent using a single request.
+//
+func (s *s3Storage) putParts(ctx context.Context, key string, rdr io.Reader, opts minio.PutObjectOptions) (err kv.Error) {
+
+	errCtx := kv.With("bucket", s.bucket).With("key", key).With("endpoint", s.endpoint)
+
+	partSize, err := transferPartSize()
+	if err != nil {
+		return err
+	}
+
+	core := minio.Core{Client: s.client}
+
+	// Buffers are limited to one per concurrent upload and one being filled from the reader
+	bufs := make(chan []byte, parallel()+1)
+	for i := 0; i != cap(bufs); i++ {
+		bufs <- nil
+	}
+	getBuf := func(ctx context.Context) (buf []byte) {
+		select {
+		case buf = <-bufs:
+		case <-ctx.Done():
+			return nil
+		}
+		if buf == nil {
+			buf = make([]byte, partSize)
+		}
+		return buf
+	}
+
+	buf := getBuf(ctx)
+	if buf == nil {
+		return errCtx.NewError("upload context cancelled").With("stack", stack.Trace().TrimRuntime())
+	}
+	filled, errGo := io.ReadFull(rdr, buf)
+	if errGo != nil && !errors.Is(errGo, io.EOF) && !errors.Is(errGo, io.ErrUnexpectedEOF) {
+		return errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Content fitting within a single part is sent as a single object with a plain MD5 ETag
+	if errGo != nil {
+		digest := md5.Sum(buf[:filled])
+		info, errGo := core.PutObject(ctx, s.bucket, key, bytes.NewReader(buf[:filled]), int64(filled),
+			base64.StdEncoding.EncodeToString(digest[:]), "", opts)
+		if errGo != nil {
+			return errCtx.Wrap(minio.ToErrorResponse(errGo)).With("stack", stack.Trace().TrimRuntime())
+		}
+		if *s3VerifyETag && strings.Trim(info.ETag, "\"") != hex.EncodeToString(digest[:]) {
+			return errCtx.NewError("ETag mismatch").With("etag", info.ETag, "expected", hex.EncodeToString(digest[:])).With("stack", stack.Trace().TrimRuntime())
+		}
+		return nil
+	}
+
+	uploadID, errGo := core.NewMultipartUpload(ctx, s.bucket, key, opts)
+	if errGo != nil {
+		return errCtx.Wrap(minio.ToErrorResponse(errGo)).With("stack", stack.Trace().TrimRuntime())
+	}
+	errCtx = errCtx.With("upload_id", uploadID)
+
+	upCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type partJob struct {
+		num  int
+		data []byte
+	}
+
+	results := struct {
+		parts   []minio.CompletePart
+		digests map[int][]byte
+		err     kv.Error
+		sync.Mutex
+	}{
+		parts:   []minio.CompletePart{},
+		digests: map[int][]byte{},
+	}
+	fail := func(err kv.Error) {
+		results.Lock()
+		if results.err == nil {
+			results.err = err
+		}
+		results.Unlock()
+		cancel()
+	}
+
+	jobs := make(chan partJob)
+	wg := sync.WaitGroup{}
+	for i := 0; i < parallel(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				digest := md5.Sum(job.data)
+				part, errGo := core.PutObjectPart(upCtx, s.bucket, key, uploadID, job.num, bytes.NewReader(job.data), int64(len(job.data)),
+					base64.StdEncoding.EncodeToString(digest[:]), "", opts.ServerSideEncryption)
+				bufs <- job.data[:cap(job.data)]
+				if errGo != nil {
+					fail(errCtx.Wrap(minio.ToErrorResponse(errGo)).With("part", job.num).With("stack", stack.Trace().TrimRuntime()))
+					continue
+				}
+				results.Lock()
+				results.parts = append(results.parts, minio.CompletePart{PartNumber: job.num, ETag: part.ETag})
+				results.digests[job.num] = digest[:]
+				results.Unlock()
+			}
+		}()
+	}
+
+	job := partJob{num: 1, data: buf[:filled]}
+	for {
+		select {
+		case jobs <- job:
+		case <-upCtx.Done():
+		}
+		if upCtx.Err() != nil || int64(len(job.data)) < partSize {
+			break
+		}
+
+		if buf = getBuf(upCtx); buf == nil {
+			break
+		}
+		filled, errGo = io.ReadFull(rdr, buf)
+		if errors.Is(errGo, io.EOF) {
+			bufs <- buf
+			break
+		}
+		if errGo != nil && !errors.Is(errGo, io.ErrUnexpectedEOF) {
+			fail(errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+			break
+		}
+		if job.num == maxParts {
+			fail(errCtx.NewError("too many parts").With("s3-part-size", *s3PartSize, "maximum", maxParts).With("stack", stack.Trace().TrimRuntime()))
+			break
+		}
+		job = partJob{num: job.num + 1, data: buf[:filled]}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if results.err == nil && ctx.Err() != nil {
+		results.err = errCtx.NewError("upload context cancelled").With("stack", stack.Trace().TrimRuntime())
+	}
+	if results.err != nil {
+		_ = core.AbortMultipartUpload(context.Background(), s.bucket, key, uploadID)
+		return results.err
+	}
+
+	sort.Slice(results.parts, func(i, j int) bool {
+		return results.parts[i].PartNumber < results.parts[j].PartNumber
+	})
+	digests := make([][]byte, 0, len(results.parts))
+	for _, part := range results.parts {
+		digests = append(digests, results.digests[part.PartNumber])
+	}
+
+	etag, errGo := core.CompleteMultipartUpload(ctx, s.bucket, key, uploadID, results.parts, opts)
+	if errGo != nil {
+		_ = core.AbortMultipartUpload(context.Background(), s.bucket, key, uploadID)
+		return errCtx.Wrap(minio.ToErrorResponse(errGo)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if expected := compositeETag(digests); *s3VerifyETag && strings.Trim(etag, "\"") != expected {
+		return errCtx.NewError("ETag mismatch").With("etag", etag, "expected", expected).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package s3
+
+// This file contains tests for the parallel multipart transfers used with S3 storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	minio_local "github.com/leaf-ai/go-service/pkg/minio"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/xid"
+)
+
+// TestETagPartSizes checks the recognition of the part sizes used to produce ETags
+func TestETagPartSizes(t *testing.T) {
+	const mib = 1024 * 1024
+
+	content := make([]byte, 13*mib+7)
+	rand.Read(content)
+
+	// The ETags for all of the part sizes are produced from a single pass over the content
+	etags, err := contentETags(bytes.NewReader(content), []int64{0, 5 * mib, 8 * mib})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(etags) != 3 {
+		t.Fatal("ETags were missing", etags)
+	}
+
+	plain := md5.Sum(content)
+	etag := etags[0]
+	if etag != hex.EncodeToString(plain[:]) {
+		t.Fatal("plain ETag was incorrect", etag)
+	}
+	if sizes, ok := etagPartSizes("\""+etag+"\"", int64(len(content)), 5*mib); !ok || len(sizes) != 1 || sizes[0] != 0 {
+		t.Fatal("plain ETag was not recognized", sizes)
+	}
+
+	// Parts using the runner part size, and those from tools using MiB aligned parts
+	for i, partSize := range []int64{5 * mib, 8 * mib} {
+		etag := etags[i+1]
+		if !strings.HasSuffix(etag, "-"+map[int64]string{5 * mib: "3", 8 * mib: "2"}[partSize]) {
+			t.Fatal("composite ETag part count was incorrect", etag)
+		}
+		sizes, ok := etagPartSizes(etag, int64(len(content)), 5*mib)
+		if !ok {
+			t.Fatal("composite ETag was not recognized", etag)
+		}
+		found := false
+		for _, size := range sizes {
+			found = found || size == partSize
+		}
+		if !found {
+			t.Fatal("part size was not identified", partSize, sizes)
+		}
+	}
+
+	for _, etag := range []string{"", "not-an-etag", "0123456789abcdef-2", hex.EncodeToString(plain[:]) + "-0"} {
+		if _, ok := etagPartSizes(etag, int64(len(content)), 5*mib); ok {
+			t.Fatal("invalid ETag was accepted", etag)
+		}
+	}
+}
+
+// TestLockParts checks that the parts of a download are only used by one download at a time
+func TestLockParts(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "s3-parts-lock")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "parts.lock")
+	rdr := &partsReader{dir: filepath.Join(dir, "parts")}
+	if rdr.lock, errGo = lockParts(context.Background(), fn); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, errGo = lockParts(ctx, fn); errGo == nil {
+		t.Fatal("parts were locked by two downloads")
+	}
+
+	rdr.Close()
+	lock, errGo := lockParts(context.Background(), fn)
+	if errGo != nil {
+		t.Fatal("released parts could not be locked", errGo)
+	}
+	lock.Close()
+}
+
+// TestS3MinioParts uploads an object as concurrent parts and then downloads it, including
+// resuming a download using parts from a previous attempt
+func TestS3MinioParts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mts, _ := minio_local.InitTestingMinio(ctx, false)
+
+	aliveCtx, aliveCancel := context.WithTimeout(ctx, time.Minute)
+	defer aliveCancel()
+	if alive, err := mts.IsAlive(aliveCtx); !alive || err != nil {
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Fatal("The minio test server is not available to run this test", mts.Address)
+	}
+
+	savedPartSize := *s3PartSize
+	defer func() {
+		*s3PartSize = savedPartSize
+	}()
+	*s3PartSize = "5MiB"
+
+	bucket := xid.New().String()
+	if errGo := mts.Client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer mts.RemoveBucketAll(bucket)
+
+	dir, errGo := ioutil.TempDir("", "s3-parts-test")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, 12*1024*1024+1)
+	rand.Read(content)
+	src := filepath.Join(dir, "src.bin")
+	if errGo = ioutil.WriteFile(src, content, 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	creds := request.AWSCredential{
+		AccessKey: mts.AccessKeyId,
+		SecretKey: mts.SecretAccessKeyId,
+	}
+	s, err := NewS3storage(ctx, creds, map[string]string{}, mts.Address, bucket, "", "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err = s.uploadFile(ctx, src, "object.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, errGo := s.client.StatObject(ctx, bucket, "object.bin", minio.StatObjectOptions{})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !strings.HasSuffix(info.ETag, "-3") {
+		t.Fatal("object was not uploaded as parts", info.ETag)
+	}
+
+	if err = SetPartsDir(filepath.Join(dir, "parts")); err != nil {
+		t.Fatal(err)
+	}
+	defer SetPartsDir("")
+
+	// Corrupt a part of the download, which will be reused when resuming and then be detected
+	rdr, _, err := s.fetchParts(ctx, s.client, "object.bin", info, 5*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr.Close()
+	if errGo = ioutil.WriteFile(filepath.Join(rdr.dir, "1"), make([]byte, 5*1024*1024), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, _, err = s.fetchParts(ctx, s.client, "object.bin", info, 5*1024*1024); err == nil {
+		t.Fatal("corrupted part was not detected")
+	}
+	if _, errGo = os.Stat(rdr.dir); !os.IsNotExist(errGo) {
+		t.Fatal("corrupted parts were retained", errGo)
+	}
+
+	// A missing part is downloaded while the existing parts are reused
+	if _, _, err = s.fetchParts(ctx, s.client, "object.bin", info, 5*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if errGo = os.Remove(filepath.Join(rdr.dir, "2")); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	output := filepath.Join(dir, "output")
+	if errGo = os.MkdirAll(output, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, _, err = s.Fetch(ctx, "object.bin", false, output, int64(len(content)), nil); err != nil {
+		t.Fatal(err)
+	}
+	downloaded, errGo := ioutil.ReadFile(filepath.Join(output, "object.bin"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !bytes.Equal(content, downloaded) {
+		t.Fatal("downloaded content differed from the upload")
+	}
+	if _, errGo = os.Stat(rdr.dir); !os.IsNotExist(errGo) {
+		t.Fatal("parts were retained after the download completed", errGo)
+	}
+}
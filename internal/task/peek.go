@@ -0,0 +1,40 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package task
+
+// This file contains the extraction of resource requests from messages that have been
+// peeked at on a queue, prior to their being claimed by a runner
+
+import (
+	"github.com/leaf-ai/go-service/pkg/server"
+
+	"github.com/leaf-ai/studio-go-runner/internal/defense"
+	"github.com/leaf-ai/studio-go-runner/internal/request"
+
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// ErrPeekUnsupported is returned by the Peek method of queue platforms that cannot examine a
+// message without it being delivered
+//
+var ErrPeekUnsupported = kv.NewError("peeking is not supported by the queue platform")
+
+// PeekResource returns the resources requested by a queue message, for encrypted and signed
+// messages the clear text resource request of the envelope is used, otherwise the resources
+// of the clear text request.  The message is not decrypted and its signature is not checked.
+//
+func PeekResource(msg []byte) (rsc *server.Resource, err kv.Error) {
+	if isEnvelope, _ := defense.IsEnvelope(msg); isEnvelope {
+		envelope, err := defense.UnmarshalEnvelope(msg)
+		if err != nil {
+			return nil, err
+		}
+		return &envelope.Message.Resource, nil
+	}
+
+	r, err := request.UnmarshalRequest(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &r.Experiment.Resource, nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package task
+
+// This file contains the marking of errors returned by message handlers that declined to
+// process a message, as opposed to having failed to process it
+
+import (
+	"errors"
+
+	"github.com/jjeffery/kv" // MIT License
+)
+
+// refusedError wraps the reason a handler gave for refusing a message
+//
+type refusedError struct {
+	error
+}
+
+func (r refusedError) Unwrap() error {
+	return r.error
+}
+
+// Refused marks an error as the handler refusing a message, for example because the runner
+// lacks the resources to run it at this time or is stopping.  Queues return refused messages
+// without counting them against the retry budget of the message.
+//
+func Refused(err kv.Error) kv.Error {
+	return kv.Wrap(refusedError{error: err})
+}
+
+// IsRefused is used to test if an error returned by a handler, or any error it wraps, was
+// marked using Refused
+//
+func IsRefused(err error) (refused bool) {
+	if err == nil {
+		return false
+	}
+	return errors.As(err, &refusedError{})
+}
@@ -0,0 +1,24 @@
+// Copyright 2021 (c) Cognizant Digital Business, Evolutionary AI. All rights reserved. Issued under the Apache 2.0 License.
+
+package task
+
+// Unit tests for the marking of refused messages
+
+import (
+	"testing"
+
+	"github.com/jjeffery/kv" // MIT License
+)
+
+func TestRefused(t *testing.T) {
+	err := kv.NewError("insufficient resources")
+	if IsRefused(err) || IsRefused(nil) {
+		t.Fatal("unmarked error seen as refused")
+	}
+
+	// The mark must survive the error being wrapped and annotated by callers
+	refused := kv.Wrap(Refused(err), "allocation failed").With("status", "retry")
+	if !IsRefused(refused) {
+		t.Fatalf("refusal lost from %s", refused.Error())
+	}
+}
@@ -57,6 +57,11 @@ type TaskQueue interface {
 	// HasWork is a probe to see if there is a potential for work to be available
 	HasWork(ctx context.Context, subscription string) (hasWork bool, err kv.Error)
 
+	// Peek returns the resources requested by the message at the head of the queue without claiming
+	// the message, a nil resource is returned when the queue is empty or the request is unknown.
+	// ErrPeekUnsupported is returned by queue platforms that cannot peek without a delivery.
+	Peek(ctx context.Context, subscription string) (resource *server.Resource, err kv.Error)
+
 	// Responder is used to open a connection to an existing response queue if
 	// one was made available and also to provision a channel into which the
 	// runner can place report messages
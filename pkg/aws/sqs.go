@@ -320,6 +320,15 @@ func (sq *SQS) Work(ctx context.Context, qt *task.QueueTask) (msgProcessed bool,
 	return true, resource, err
 }
 
+// Peek is not supported by SQS, receiving a message to examine it increments the
+// ApproximateReceiveCount of the message used by redrive policies, and SQS does not guarantee
+// the order of messages so the message received might not be the next one processed.
+// ErrPeekUnsupported is returned so that messages are claimed without being examined first.
+//
+func (sq *SQS) Peek(ctx context.Context, subscription string) (resource *server.Resource, err kv.Error) {
+	return nil, task.ErrPeekUnsupported
+}
+
 // HasWork will look at the SQS queue to see if there is any pending work.  The function
 // is called in an attempt to see if there is any point in processing new work without a
 // lot of overhead.  In the case of SQS at the moment we always assume there is work.